@@ -0,0 +1,156 @@
+// Copyright 2017 Martin Baillie <martin.t.baillie@gmail.com>.
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file or at:
+// https://opensource.org/licenses/BSD-3-Clause
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+
+	stdopentracing "github.com/opentracing/opentracing-go"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/tracing/opentracing"
+	kithttp "github.com/go-kit/kit/transport/http"
+)
+
+// AdminEndpoints administer a remote instance of the service over HTTP.
+// Administrative calls need one of the instance's action tokens.
+type AdminEndpoints struct {
+	LogLevelEndpoint endpoint.Endpoint
+	DrainEndpoint    endpoint.Endpoint
+}
+
+// MakeAdminEndpoints returns the AdminEndpoints of the service instance at
+// the given base URL, e.g. http://localhost:8080/rms/v1.
+// Each endpoint is decorated with opentracing annotations, propagating the
+// trace to the instance.
+func MakeAdminEndpoints(instance string, client *http.Client, tracer stdopentracing.Tracer, logger log.Logger) (AdminEndpoints, error) {
+	base, err := baseURL(instance)
+	if err != nil {
+		return AdminEndpoints{}, err
+	}
+	logLevel, drain := *base, *base
+	logLevel.Path += "/logs/level"
+	drain.Path += "/drain"
+
+	options := []kithttp.ClientOption{
+		kithttp.ClientBefore(opentracing.ToHTTPRequest(tracer, logger)),
+	}
+	if client != nil {
+		options = append(options, kithttp.SetClient(client))
+	}
+
+	return AdminEndpoints{
+		LogLevelEndpoint: opentracing.TraceClient(tracer, "LogLevel")(kithttp.NewClient(
+			"PUT", &logLevel,
+			encodeHTTPAdminRequest,
+			decodeHTTPLogLevelResponse,
+			options...,
+		).Endpoint()),
+		DrainEndpoint: opentracing.TraceClient(tracer, "Drain")(kithttp.NewClient(
+			"PUT", &drain,
+			encodeHTTPAdminRequest,
+			decodeHTTPDrainResponse,
+			options...,
+		).Endpoint()),
+	}, nil
+}
+
+type logLevelRequest struct {
+	Level string
+}
+
+type logLevelResponse struct {
+	Level string
+}
+
+type drainRequest struct {
+	Draining bool
+}
+
+type drainResponse struct {
+	Draining bool
+}
+
+func encodeHTTPAdminRequest(ctx context.Context, r *http.Request, request interface{}) error {
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(request); err != nil {
+		return err
+	}
+	r.Header.Set("Content-Type", "application/json; charset=utf-8")
+	r.Body = ioutil.NopCloser(&buf)
+	return encodeHTTPGenericRequest(ctx, r, request)
+}
+
+func decodeHTTPLogLevelResponse(_ context.Context, r *http.Response) (interface{}, error) {
+	if r.StatusCode != http.StatusOK {
+		return nil, decodeHTTPError(r)
+	}
+	var resp logLevelResponse
+	err := json.NewDecoder(r.Body).Decode(&resp)
+	return resp, err
+}
+
+func decodeHTTPDrainResponse(_ context.Context, r *http.Response) (interface{}, error) {
+	if r.StatusCode != http.StatusOK {
+		return nil, decodeHTTPError(r)
+	}
+	var resp drainResponse
+	err := json.NewDecoder(r.Body).Decode(&resp)
+	return resp, err
+}
+
+// Admin administers a single instance of the service. Unlike the
+// rancher.ServerService returned by New, calls are neither load balanced nor
+// retried, since each instance is administered in its own right.
+type Admin struct {
+	endpoints AdminEndpoints
+}
+
+// NewAdmin returns an Admin of the service instance at the given base URL,
+// e.g. http://localhost:8080/rms/v1. Only the HTTPClient, Tracer and Logger
+// options apply.
+func NewAdmin(instance string, opts ...Option) (*Admin, error) {
+	o := options{
+		tracer: stdopentracing.GlobalTracer(),
+		logger: log.NewNopLogger(),
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	es, err := MakeAdminEndpoints(instance, o.client, o.tracer, o.logger)
+	if err != nil {
+		return nil, err
+	}
+	return &Admin{endpoints: es}, nil
+}
+
+// SetLogLevel switches the instance's log statements to the debug or info
+// level, until its configuration is next reloaded.
+func (a *Admin) SetLogLevel(ctx context.Context, level string) (string, error) {
+	response, err := a.endpoints.LogLevelEndpoint(ctx, logLevelRequest{Level: level})
+	if err != nil {
+		return "", err
+	}
+	return response.(logLevelResponse).Level, nil
+}
+
+// Drain reports the instance not ready, moving traffic to other instances,
+// or stops it draining.
+func (a *Admin) Drain(ctx context.Context, draining bool) (bool, error) {
+	response, err := a.endpoints.DrainEndpoint(ctx, drainRequest{Draining: draining})
+	if err != nil {
+		return false, err
+	}
+	return response.(drainResponse).Draining, nil
+}
@@ -0,0 +1,275 @@
+// Copyright 2017 Martin Baillie <martin.t.baillie@gmail.com>.
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file or at:
+// https://opensource.org/licenses/BSD-3-Clause
+
+// Package client is a Go client for the service's HTTP API.
+//
+// The client is a rancher.ServerService, so a remote instance of the service
+// can stand in for a local ServerService. Calls are load balanced round robin
+// across the given instances and retried on failure. Errors served by an
+// instance are mapped back to the Rancher package's business errors, e.g.
+// rancher.ErrContainerNotFound.
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	stdopentracing "github.com/opentracing/opentracing-go"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/sd"
+	"github.com/go-kit/kit/sd/lb"
+
+	"github.com/martinbaillie/rancher-management-service/rancher"
+)
+
+// Client errors
+var (
+	ErrNoInstances = errors.New("no service instances")
+)
+
+// Error is an error served by an instance of the service that does not map
+// to one of the Rancher package's business errors.
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s (%d)", e.Message, e.StatusCode)
+}
+
+// businessErrors are the Rancher package's errors served by the HTTP
+// transport, by message.
+var businessErrors = map[string]error{}
+
+func init() {
+	for _, err := range []error{
+		rancher.ErrContainerNotFound,
+		rancher.ErrHostNotFound,
+		rancher.ErrContainerRepoEmpty,
+		rancher.ErrHostRepoEmpty,
+		rancher.ErrContainerRepoStale,
+		rancher.ErrHostRepoStale,
+		rancher.ErrActionUnauthorized,
+	} {
+		businessErrors[err.Error()] = err
+	}
+}
+
+// decodeHTTPError maps an error response back to the Rancher package's
+// business errors, falling back to an *Error.
+func decodeHTTPError(r *http.Response) error {
+	b, _ := ioutil.ReadAll(r.Body)
+	var body struct{ Error string }
+	if err := json.Unmarshal(b, &body); err != nil || body.Error == "" {
+		return &Error{StatusCode: r.StatusCode, Message: http.StatusText(r.StatusCode)}
+	}
+	if err, ok := businessErrors[body.Error]; ok {
+		return err
+	}
+	return &Error{StatusCode: r.StatusCode, Message: body.Error}
+}
+
+// retryable reports whether the call may succeed against another instance.
+// An object that is not found, or a client error, will not. Another
+// instance's cache may well be fresher.
+func retryable(err error) bool {
+	switch err {
+	case rancher.ErrContainerNotFound, rancher.ErrHostNotFound:
+		return false
+	}
+	if e, ok := err.(*Error); ok {
+		return e.StatusCode >= http.StatusInternalServerError
+	}
+	return true
+}
+
+type options struct {
+	environment   string
+	client        *http.Client
+	tracer        stdopentracing.Tracer
+	logger        log.Logger
+	retryMax      int
+	retryTimeout  time.Duration
+	watchInterval time.Duration
+}
+
+// Option configures the client.
+type Option func(*options)
+
+// Environment calls the named Rancher environment of each instance, rather
+// than its default environment.
+func Environment(name string) Option {
+	return func(o *options) { o.environment = name }
+}
+
+// HTTPClient makes calls with the given client rather than
+// http.DefaultClient.
+func HTTPClient(client *http.Client) Option {
+	return func(o *options) { o.client = client }
+}
+
+// Tracer propagates traces with the given tracer rather than the global
+// tracer.
+func Tracer(tracer stdopentracing.Tracer) Option {
+	return func(o *options) { o.tracer = tracer }
+}
+
+// Logger logs with the given logger rather than discarding logs.
+func Logger(logger log.Logger) Option {
+	return func(o *options) { o.logger = logger }
+}
+
+// Retry attempts each call up to max times within the timeout. Defaults to
+// 3 attempts within 10 seconds.
+func Retry(max int, timeout time.Duration) Option {
+	return func(o *options) { o.retryMax, o.retryTimeout = max, timeout }
+}
+
+// WatchInterval polls for container changes at the given interval when
+// watching containers. Defaults to 30 seconds.
+func WatchInterval(d time.Duration) Option {
+	return func(o *options) { o.watchInterval = d }
+}
+
+// New returns a rancher.ServerService calling the service instances at the
+// given base URLs, e.g. http://localhost:8080/rms/v1.
+func New(instances []string, opts ...Option) (rancher.ServerService, error) {
+	if len(instances) == 0 {
+		return nil, ErrNoInstances
+	}
+	o := options{
+		tracer:        stdopentracing.GlobalTracer(),
+		logger:        log.NewNopLogger(),
+		retryMax:      3,
+		retryTimeout:  10 * time.Second,
+		watchInterval: 30 * time.Second,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	var containers, container sd.FixedSubscriber
+	for _, instance := range instances {
+		es, err := MakeEndpoints(instance, o.environment, o.client, o.tracer, o.logger)
+		if err != nil {
+			return nil, err
+		}
+		containers = append(containers, es.ContainersEndpoint)
+		container = append(container, es.ContainerEndpoint)
+	}
+
+	return &service{
+		endpoints: Endpoints{
+			ContainersEndpoint: balance(containers, o),
+			ContainerEndpoint:  balance(container, o),
+		},
+		watchInterval: o.watchInterval,
+	}, nil
+}
+
+// balance load balances the endpoints round robin, retrying failures that
+// may succeed against another instance.
+func balance(es sd.FixedSubscriber, o options) endpoint.Endpoint {
+	retry := lb.RetryWithCallback(o.retryTimeout, lb.NewRoundRobin(es),
+		func(n int, err error) (bool, error) {
+			return n < o.retryMax && retryable(err), nil
+		})
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		response, err := retry(ctx, request)
+		if e, ok := err.(lb.RetryError); ok {
+			err = e.Final
+		}
+		return response, err
+	}
+}
+
+type service struct {
+	endpoints     Endpoints
+	watchInterval time.Duration
+
+	// Guards the cache status of the most recent response
+	mtx   sync.RWMutex
+	cache rancher.CacheStatus
+}
+
+// Containers implements rancher.ServerService.
+func (s *service) Containers(ctx context.Context) ([]*rancher.Container, error) {
+	response, err := s.endpoints.ContainersEndpoint(ctx, containersRequest{})
+	if err != nil {
+		return nil, err
+	}
+	resp := response.(containersResponse)
+	s.setCacheStatus(resp.Cache)
+	return resp.Containers, nil
+}
+
+// Container implements rancher.ServerService.
+func (s *service) Container(ctx context.Context, name string) (*rancher.Container, error) {
+	response, err := s.endpoints.ContainerEndpoint(ctx, containerRequest{Name: name})
+	if err != nil {
+		return nil, err
+	}
+	resp := response.(containerResponse)
+	s.setCacheStatus(resp.Cache)
+	return resp.Container, nil
+}
+
+// CacheStatus implements rancher.ServerService.
+// It describes the cache of the instance that served the most recent call.
+func (s *service) CacheStatus(_ context.Context) rancher.CacheStatus {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	return s.cache
+}
+
+func (s *service) setCacheStatus(cs rancher.CacheStatus) {
+	s.mtx.Lock()
+	s.cache = cs
+	s.mtx.Unlock()
+}
+
+// WatchContainers implements rancher.ServerService.
+// The HTTP API cannot stream changes, so containers are polled every watch
+// interval instead. Failed polls are skipped.
+func (s *service) WatchContainers(ctx context.Context) <-chan rancher.ContainerEvent {
+	ch := make(chan rancher.ContainerEvent)
+	go func() {
+		defer close(ch)
+
+		var last []*rancher.Container
+		t := time.NewTicker(s.watchInterval)
+		defer t.Stop()
+		for {
+			if cs, err := s.Containers(ctx); err == nil {
+				for _, e := range rancher.DiffContainers(last, cs) {
+					select {
+					case ch <- e:
+					case <-ctx.Done():
+						return
+					}
+				}
+				last = cs
+			}
+
+			select {
+			case <-t.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch
+}
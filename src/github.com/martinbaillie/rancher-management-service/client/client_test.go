@@ -0,0 +1,330 @@
+// Copyright 2017 Martin Baillie <martin.t.baillie@gmail.com>.
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file or at:
+// https://opensource.org/licenses/BSD-3-Clause
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	stdopentracing "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/go-kit/kit/log"
+
+	"github.com/martinbaillie/rancher-management-service/health"
+	"github.com/martinbaillie/rancher-management-service/rancher"
+)
+
+type stubServerService struct {
+	mtx        sync.Mutex
+	containers []*rancher.Container
+	cache      rancher.CacheStatus
+	err        error
+	calls      int32
+}
+
+func (s *stubServerService) Container(_ context.Context, name string) (*rancher.Container, error) {
+	atomic.AddInt32(&s.calls, 1)
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.err != nil {
+		return nil, s.err
+	}
+	for _, c := range s.containers {
+		if c.Name == name {
+			return c, nil
+		}
+	}
+	return nil, rancher.ErrContainerNotFound
+}
+
+func (s *stubServerService) Containers(_ context.Context) ([]*rancher.Container, error) {
+	atomic.AddInt32(&s.calls, 1)
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.containers, s.err
+}
+
+func (s *stubServerService) CacheStatus(_ context.Context) rancher.CacheStatus {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.cache
+}
+
+func (s *stubServerService) WatchContainers(_ context.Context) <-chan rancher.ContainerEvent {
+	ch := make(chan rancher.ContainerEvent)
+	close(ch)
+	return ch
+}
+
+func (s *stubServerService) setContainers(cs []*rancher.Container) {
+	s.mtx.Lock()
+	s.containers = cs
+	s.mtx.Unlock()
+}
+
+// newInstance serves the stub through the Rancher package's HTTP transport,
+// as the service does, calling inspect with each request.
+func newInstance(s rancher.ServerService, inspect func(*http.Request)) *httptest.Server {
+	tracer := stdopentracing.GlobalTracer()
+	logger := log.NewNopLogger()
+	rhs := rancher.MakeHTTPHandlers(context.Background(), rancher.NewServerEndpoints(s, tracer), tracer, logger)
+
+	r := mux.NewRouter()
+	r.Methods("GET").Path("/rms/v1/containers").Handler(rhs.Containers)
+	r.Methods("GET").Path("/rms/v1/containers/{name}").Handler(rhs.Container)
+	r.Methods("GET").Path("/rms/v1/environments/dev/containers").Handler(rhs.Containers)
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if inspect != nil {
+			inspect(req)
+		}
+		r.ServeHTTP(w, req)
+	}))
+}
+
+var defaultContainers = []*rancher.Container{
+	{Name: "web", UUID: "c1", State: "running", PrivateIP: "10.0.0.1", ServiceIndex: 1, Host: rancher.Host{Name: "host1"}},
+	{Name: "db", UUID: "c2", State: "running", PrivateIP: "10.0.0.2", ServiceIndex: 1, Host: rancher.Host{Name: "host2"}},
+}
+
+func TestNoInstances(t *testing.T) {
+	_, err := New(nil)
+	assert.Equal(t, ErrNoInstances, err, "New() no instances")
+}
+
+func TestClient(t *testing.T) {
+	assert := assert.New(t)
+
+	s := &stubServerService{
+		containers: defaultContainers,
+		cache:      rancher.CacheStatus{Refreshed: time.Now().Add(-time.Minute), Failures: 1},
+	}
+	instance := newInstance(s, nil)
+	defer instance.Close()
+
+	c, err := New([]string{instance.URL + "/rms/v1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cs, err := c.Containers(context.Background())
+	assert.Equal(nil, err, "Containers() success")
+	assert.Equal(defaultContainers, cs, "Containers() success")
+
+	cache := c.CacheStatus(context.Background())
+	assert.InDelta(time.Minute.Seconds(), time.Since(cache.Refreshed).Seconds(), 2, "CacheStatus() age")
+	assert.Equal(1, cache.Failures, "CacheStatus() revalidation failed")
+	assert.Equal(false, cache.Restored, "CacheStatus() not restored")
+
+	res, err := c.Container(context.Background(), "db")
+	assert.Equal(nil, err, "Container() success")
+	assert.Equal(defaultContainers[1], res, "Container() success")
+
+	_, err = c.Container(context.Background(), "cache")
+	assert.Equal(rancher.ErrContainerNotFound, err, "Container() not found")
+
+	s.err = rancher.ErrContainerRepoStale
+	_, err = c.Containers(context.Background())
+	assert.Equal(rancher.ErrContainerRepoStale, err, "Containers() beyond max staleness")
+
+	s.err = errors.New("boom")
+	_, err = c.Containers(context.Background())
+	assert.Equal(&Error{StatusCode: http.StatusInternalServerError, Message: "boom"}, err, "Containers() internal error")
+}
+
+func TestClientEnvironment(t *testing.T) {
+	var path string
+	instance := newInstance(&stubServerService{containers: defaultContainers}, func(r *http.Request) {
+		path = r.URL.Path
+	})
+	defer instance.Close()
+
+	c, _ := New([]string{instance.URL + "/rms/v1/"}, Environment("dev"))
+	cs, err := c.Containers(context.Background())
+	assert.Equal(t, nil, err, "Containers() environment")
+	assert.Equal(t, defaultContainers, cs, "Containers() environment")
+	assert.Equal(t, "/rms/v1/environments/dev/containers", path, "Containers() environment")
+}
+
+func TestClientLoadBalancing(t *testing.T) {
+	assert := assert.New(t)
+
+	s1 := &stubServerService{containers: defaultContainers}
+	s2 := &stubServerService{containers: defaultContainers}
+	i1, i2 := newInstance(s1, nil), newInstance(s2, nil)
+	defer i1.Close()
+	defer i2.Close()
+
+	c, _ := New([]string{i1.URL + "/rms/v1", i2.URL + "/rms/v1"})
+	for i := 0; i < 4; i++ {
+		c.Containers(context.Background())
+	}
+	assert.Equal(int32(2), atomic.LoadInt32(&s1.calls), "Containers() round robin")
+	assert.Equal(int32(2), atomic.LoadInt32(&s2.calls), "Containers() round robin")
+
+	// Instances not finding the container are not retried
+	c.Container(context.Background(), "cache")
+	assert.Equal(int32(5), atomic.LoadInt32(&s1.calls)+atomic.LoadInt32(&s2.calls), "Container() not found")
+
+	// Instances with a stale cache are retried
+	s1.err = rancher.ErrContainerRepoStale
+	for i := 0; i < 2; i++ {
+		cs, err := c.Containers(context.Background())
+		assert.Equal(nil, err, "Containers() retried stale instance")
+		assert.Equal(defaultContainers, cs, "Containers() retried stale instance")
+	}
+}
+
+func TestClientRetry(t *testing.T) {
+	assert := assert.New(t)
+
+	s := &stubServerService{containers: defaultContainers}
+	up := newInstance(s, nil)
+	defer up.Close()
+	down := newInstance(s, nil)
+	down.Close()
+
+	c, _ := New([]string{down.URL + "/rms/v1", up.URL + "/rms/v1"})
+	for i := 0; i < 2; i++ {
+		cs, err := c.Containers(context.Background())
+		assert.Equal(nil, err, "Containers() retried instance down")
+		assert.Equal(defaultContainers, cs, "Containers() retried instance down")
+	}
+
+	c, _ = New([]string{down.URL + "/rms/v1"}, Retry(2, time.Second))
+	_, err := c.Containers(context.Background())
+	assert.NotEqual(nil, err, "Containers() all instances down")
+}
+
+func TestClientWatchContainers(t *testing.T) {
+	assert := assert.New(t)
+
+	s := &stubServerService{containers: defaultContainers[:1]}
+	instance := newInstance(s, nil)
+	defer instance.Close()
+
+	c, _ := New([]string{instance.URL + "/rms/v1"}, WatchInterval(10*time.Millisecond))
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := c.WatchContainers(ctx)
+
+	e := <-ch
+	assert.Equal(rancher.ContainerAdded, e.Type, "WatchContainers() initial")
+	assert.Equal("web", e.Container.Name, "WatchContainers() initial")
+
+	s.setContainers(defaultContainers[1:])
+	var types []rancher.ContainerEventType
+	for i := 0; i < 2; i++ {
+		types = append(types, (<-ch).Type)
+	}
+	assert.Equal([]rancher.ContainerEventType{rancher.ContainerAdded, rancher.ContainerRemoved}, types, "WatchContainers() changes")
+
+	cancel()
+	for range ch {
+	}
+}
+
+func TestClientTracing(t *testing.T) {
+	assert := assert.New(t)
+
+	var traced int32
+	instance := newInstance(&stubServerService{containers: defaultContainers}, func(r *http.Request) {
+		if r.Header.Get("Mockpfx-Ids-Traceid") != "" {
+			atomic.AddInt32(&traced, 1)
+		}
+	})
+	defer instance.Close()
+
+	tracer := mocktracer.New()
+	c, _ := New([]string{instance.URL + "/rms/v1"}, Tracer(tracer))
+	c.Containers(context.Background())
+
+	assert.Equal(int32(1), atomic.LoadInt32(&traced), "Containers() propagates trace")
+	spans := tracer.FinishedSpans()
+	if assert.Equal(1, len(spans), "Containers() traced") {
+		assert.Equal("Containers", spans[0].OperationName, "Containers() traced")
+	}
+}
+
+// newAdminInstance serves the administrative routes as the service does,
+// allowing the token.
+func newAdminInstance(token string) (*httptest.Server, *health.Health) {
+	h := health.New()
+	a := rancher.NewActionAuthorizer([]string{token})
+
+	level := "info"
+	r := mux.NewRouter()
+	r.Methods("PUT").Path("/rms/v1/drain").Handler(rancher.AuthorizedHandler(a, health.MakeHTTPHandlers(h).Drain))
+	r.Methods("PUT").Path("/rms/v1/logs/level").Handler(rancher.AuthorizedHandler(a, http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			var body struct{ Level string }
+			json.NewDecoder(req.Body).Decode(&body)
+			if body.Level != "debug" && body.Level != "info" {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(struct{ Level, Error string }{level, "Level must be debug or info"})
+				return
+			}
+			level = body.Level
+			json.NewEncoder(w).Encode(struct{ Level string }{level})
+		})))
+	return httptest.NewServer(r), h
+}
+
+type bearerTransport string
+
+func (t bearerTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	rc := new(http.Request)
+	*rc = *r
+	rc.Header = http.Header{"Authorization": {"Bearer " + string(t)}}
+	for k, v := range r.Header {
+		rc.Header[k] = v
+	}
+	return http.DefaultTransport.RoundTrip(rc)
+}
+
+func TestAdmin(t *testing.T) {
+	assert := assert.New(t)
+
+	instance, h := newAdminInstance("s3cr3t")
+	defer instance.Close()
+
+	a, err := NewAdmin(instance.URL+"/rms/v1", HTTPClient(&http.Client{Transport: bearerTransport("s3cr3t")}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	draining, err := a.Drain(context.Background(), true)
+	assert.Equal(nil, err, "Drain() success")
+	assert.Equal(true, draining, "Drain() success")
+	assert.Equal(health.ErrDraining, h.Ready(), "Drain() success")
+
+	draining, err = a.Drain(context.Background(), false)
+	assert.Equal(nil, err, "Drain() stopped")
+	assert.Equal(false, draining, "Drain() stopped")
+	assert.Equal(nil, h.Ready(), "Drain() stopped")
+
+	level, err := a.SetLogLevel(context.Background(), "debug")
+	assert.Equal(nil, err, "SetLogLevel() success")
+	assert.Equal("debug", level, "SetLogLevel() success")
+
+	_, err = a.SetLogLevel(context.Background(), "trace")
+	assert.Equal(&Error{StatusCode: http.StatusBadRequest, Message: "Level must be debug or info"}, err, "SetLogLevel() invalid level")
+
+	unauthorized, _ := NewAdmin(instance.URL + "/rms/v1")
+	_, err = unauthorized.Drain(context.Background(), true)
+	assert.Equal(rancher.ErrActionUnauthorized, err, "Drain() without token")
+	assert.Equal(nil, h.Ready(), "Drain() without token")
+}
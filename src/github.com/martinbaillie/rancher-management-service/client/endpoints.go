@@ -0,0 +1,191 @@
+// Copyright 2017 Martin Baillie <martin.t.baillie@gmail.com>.
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file or at:
+// https://opensource.org/licenses/BSD-3-Clause
+
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	stdopentracing "github.com/opentracing/opentracing-go"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/tracing/opentracing"
+	kithttp "github.com/go-kit/kit/transport/http"
+
+	"github.com/martinbaillie/rancher-management-service/rancher"
+)
+
+// Endpoints mirrors the Rancher package's ServerEndpoints, calling a remote
+// instance of the service over HTTP.
+type Endpoints struct {
+	ContainersEndpoint endpoint.Endpoint
+	ContainerEndpoint  endpoint.Endpoint
+}
+
+// MakeEndpoints returns the Endpoints of the service instance at the given
+// base URL, e.g. http://localhost:8080/rms/v1, serving the named environment
+// (or the instance's default environment should it be empty).
+// Each endpoint is decorated with opentracing annotations, propagating the
+// trace to the instance.
+func MakeEndpoints(instance, environment string, client *http.Client, tracer stdopentracing.Tracer, logger log.Logger) (Endpoints, error) {
+	base, err := baseURL(instance)
+	if err != nil {
+		return Endpoints{}, err
+	}
+	if environment != "" {
+		base.Path += "/environments/" + environment
+	}
+	base.Path += "/containers"
+
+	options := []kithttp.ClientOption{
+		kithttp.ClientBefore(opentracing.ToHTTPRequest(tracer, logger)),
+	}
+	if client != nil {
+		options = append(options, kithttp.SetClient(client))
+	}
+
+	return Endpoints{
+		ContainersEndpoint: opentracing.TraceClient(tracer, "Containers")(kithttp.NewClient(
+			"GET", base,
+			encodeHTTPGenericRequest,
+			decodeHTTPContainersResponse,
+			options...,
+		).Endpoint()),
+		ContainerEndpoint: opentracing.TraceClient(tracer, "Container")(kithttp.NewClient(
+			"GET", base,
+			encodeHTTPContainerRequest,
+			decodeHTTPContainerResponse,
+			options...,
+		).Endpoint()),
+	}, nil
+}
+
+// baseURL parses the base URL of a service instance, defaulting to HTTP.
+func baseURL(instance string) (*url.URL, error) {
+	if !strings.HasPrefix(instance, "http") {
+		instance = "http://" + instance
+	}
+	return url.Parse(strings.TrimSuffix(instance, "/"))
+}
+
+type containersRequest struct{}
+
+type containersResponse struct {
+	Containers []*rancher.Container
+	Cache      rancher.CacheStatus
+}
+
+type containerRequest struct {
+	Name string
+}
+
+type containerResponse struct {
+	Container *rancher.Container
+	Cache     rancher.CacheStatus
+}
+
+func encodeHTTPGenericRequest(_ context.Context, r *http.Request, _ interface{}) error {
+	r.Header.Set("Accept", "application/json")
+	return nil
+}
+
+func encodeHTTPContainerRequest(ctx context.Context, r *http.Request, request interface{}) error {
+	// NOTE: The path is escaped as the request is made
+	r.URL.Path += "/" + request.(containerRequest).Name
+	return encodeHTTPGenericRequest(ctx, r, request)
+}
+
+// httpContainer is the JSON representation of a rancher.Container served by
+// the HTTP transport.
+type httpContainer struct {
+	Name         string
+	UUID         string
+	State        string
+	PrivateIP    string
+	ServiceIndex int64
+	ServiceName  string
+	StackName    string
+	Labels       map[string]string
+	Ports        []string
+	HostName     string
+	Environment  string
+}
+
+func (c httpContainer) container() *rancher.Container {
+	return &rancher.Container{
+		Name:         c.Name,
+		UUID:         c.UUID,
+		State:        c.State,
+		PrivateIP:    c.PrivateIP,
+		ServiceIndex: c.ServiceIndex,
+		ServiceName:  c.ServiceName,
+		StackName:    c.StackName,
+		Labels:       c.Labels,
+		Ports:        c.Ports,
+		Host:         rancher.Host{Name: c.HostName},
+		Environment:  c.Environment,
+	}
+}
+
+func decodeHTTPContainersResponse(_ context.Context, r *http.Response) (interface{}, error) {
+	if r.StatusCode != http.StatusOK {
+		return nil, decodeHTTPError(r)
+	}
+	var body struct{ Containers []httpContainer }
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+
+	resp := containersResponse{
+		Containers: make([]*rancher.Container, len(body.Containers)),
+		Cache:      decodeHTTPCacheHeaders(r.Header),
+	}
+	for i, c := range body.Containers {
+		resp.Containers[i] = c.container()
+	}
+	return resp, nil
+}
+
+func decodeHTTPContainerResponse(_ context.Context, r *http.Response) (interface{}, error) {
+	if r.StatusCode != http.StatusOK {
+		return nil, decodeHTTPError(r)
+	}
+	var body struct{ Container httpContainer }
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	return containerResponse{
+		Container: body.Container.container(),
+		Cache:     decodeHTTPCacheHeaders(r.Header),
+	}, nil
+}
+
+// decodeHTTPCacheHeaders recovers the instance's CacheStatus, as far as the
+// cache headers describe it.
+// NOTE: A failed revalidation is reported as a single failure.
+func decodeHTTPCacheHeaders(h http.Header) rancher.CacheStatus {
+	var cs rancher.CacheStatus
+	if age, err := strconv.Atoi(h.Get("X-Cache-Age")); err == nil {
+		cs.Refreshed = time.Now().Add(-time.Duration(age) * time.Second)
+	}
+	for _, w := range h["Warning"] {
+		switch {
+		case strings.HasPrefix(w, "110 "):
+			cs.Restored = true
+		case strings.HasPrefix(w, "111 "):
+			cs.Failures = 1
+		}
+	}
+	return cs
+}
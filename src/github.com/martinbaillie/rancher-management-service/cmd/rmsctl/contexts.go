@@ -0,0 +1,121 @@
+// Copyright 2017 Martin Baillie <martin.t.baillie@gmail.com>.
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file or at:
+// https://opensource.org/licenses/BSD-3-Clause
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Context file errors
+var (
+	ErrNoContext       = errors.New("no context selected, set -context or current-context")
+	ErrNoInstances     = errors.New("no service instances, set -instances or a context")
+	ErrContextNotFound = errors.New("context not found")
+	ErrContextEmpty    = errors.New("context has no instances")
+)
+
+// contextFile lists the service instances rmsctl may talk to, in the manner
+// of a kubeconfig, e.g.
+//
+//	current-context: prod
+//	contexts:
+//	- name: prod
+//	  instances:
+//	  - http://rms-1.corp:8080/rms/v1
+//	  - http://rms-2.corp:8080/rms/v1
+//	  environment: prod
+//	  token: s3cr3t
+type contextFile struct {
+	CurrentContext string           `yaml:"current-context"`
+	Contexts       []serviceContext `yaml:"contexts"`
+}
+
+// serviceContext is a named set of service instances and the credentials to
+// call them with.
+type serviceContext struct {
+	Name string `yaml:"name"`
+	// the base URLs of the service instances
+	Instances []string `yaml:"instances"`
+	// the Rancher environment to call, empty for each instance's default
+	Environment string `yaml:"environment,omitempty"`
+	// sent as a bearer token with every call
+	Token string `yaml:"token,omitempty"`
+}
+
+// defaultContextFile is ~/.rmsctl/config.
+func defaultContextFile() string {
+	home := os.Getenv("HOME")
+	if home == "" {
+		return ""
+	}
+	return filepath.Join(home, ".rmsctl", "config")
+}
+
+// loadContextFile reads the context file at the given path. A missing file
+// is treated as empty.
+func loadContextFile(path string) (*contextFile, error) {
+	var cf contextFile
+	if path == "" {
+		return &cf, nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &cf, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := yaml.Unmarshal(b, &cf); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return &cf, nil
+}
+
+// context returns the named context, or the current context should the name
+// be empty.
+func (cf *contextFile) context(name string) (serviceContext, error) {
+	if name == "" {
+		name = cf.CurrentContext
+	}
+	if name == "" {
+		return serviceContext{}, ErrNoContext
+	}
+	for _, c := range cf.Contexts {
+		if c.Name == name {
+			if len(c.Instances) == 0 {
+				return serviceContext{}, fmt.Errorf("%s: %v", name, ErrContextEmpty)
+			}
+			return c, nil
+		}
+	}
+	return serviceContext{}, fmt.Errorf("%s: %v", name, ErrContextNotFound)
+}
+
+// bearerTransport sends the token with every request.
+type bearerTransport struct {
+	token string
+	next  http.RoundTripper
+}
+
+func (t bearerTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	// NOTE: RoundTrippers must not modify the given request
+	rc := new(http.Request)
+	*rc = *r
+	rc.Header = make(http.Header, len(r.Header)+1)
+	for k, v := range r.Header {
+		rc.Header[k] = v
+	}
+	rc.Header.Set("Authorization", "Bearer "+t.token)
+	return t.next.RoundTrip(rc)
+}
@@ -0,0 +1,284 @@
+// Copyright 2017 Martin Baillie <martin.t.baillie@gmail.com>.
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file or at:
+// https://opensource.org/licenses/BSD-3-Clause
+
+// Command rmsctl is a command-line client for the Rancher management
+// service's API.
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/namsral/flag"
+
+	"github.com/martinbaillie/rancher-management-service/client"
+	"github.com/martinbaillie/rancher-management-service/rancher"
+)
+
+// Command errors
+var (
+	ErrUnknownCommand = errors.New("unknown command")
+	ErrUsage          = errors.New("invalid usage")
+)
+
+const usage = `Usage: rmsctl [flags] <command> [args]
+
+Commands:
+  get containers            List the containers
+  get hosts                 List the hosts running containers
+  get stacks                List the stacks
+  describe container <name> Describe a container
+  watch                     Watch the containers for changes
+  logs level set <level>    Switch each instance's logs to the debug or info level
+  drain                     Drain each instance, reporting it not ready
+  undrain                   Stop draining each instance
+
+Flags:
+`
+
+// options are the parsed command-line flags.
+type options struct {
+	contextFile string
+	context     string
+	instances   string
+	environment string
+	token       string
+	output      string
+	selector    string
+	timeout     time.Duration
+	interval    time.Duration
+}
+
+func main() {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
+		<-c
+		cancel()
+	}()
+
+	if err := run(ctx, os.Args[1:], os.Stdout, os.Stderr); err != nil {
+		if err != flag.ErrHelp {
+			fmt.Fprintf(os.Stderr, "rmsctl: %v\n", err)
+		}
+		os.Exit(1)
+	}
+}
+
+// run parses the arguments and runs the command they describe.
+func run(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	var o options
+	// NOTE: All flags can also be set in the environment, prefixed with
+	// RMSCTL_ e.g. RMSCTL_CONTEXT.
+	fs := flag.NewFlagSetWithEnvPrefix("rmsctl", "RMSCTL", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprint(stderr, usage)
+		fs.PrintDefaults()
+	}
+	fs.StringVar(&o.contextFile, "context_file", defaultContextFile(), "File listing the contexts of service instances to call")
+	fs.StringVar(&o.context, "context", "", "Context to call (defaults to the context file's current-context)")
+	fs.StringVar(&o.instances, "instances", "", "Comma separated base URLs of service instances to call, overriding the context e.g. http://localhost:8080/rms/v1")
+	fs.StringVar(&o.environment, "environment", "", "Rancher environment to call, overriding the context")
+	fs.StringVar(&o.token, "token", "", "Bearer token to call the service instances with, overriding the context")
+	fs.StringVar(&o.output, "output", outputTable, "Output format, one of table, json or yaml")
+	fs.StringVar(&o.output, "o", outputTable, "Shorthand for -output")
+	fs.StringVar(&o.selector, "selector", "", "Select containers by field, e.g. stack=web,state!=running")
+	fs.StringVar(&o.selector, "l", "", "Shorthand for -selector")
+	fs.DurationVar(&o.timeout, "timeout", 10*time.Second, "Duration to wait for each call to the service")
+	fs.DurationVar(&o.interval, "interval", 5*time.Second, "Duration between polls for changes when watching")
+
+	// Flags may come before, between or after the command's arguments
+	var cmd []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return err
+		}
+		if fs.NArg() == 0 {
+			break
+		}
+		cmd = append(cmd, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+	if len(cmd) == 0 {
+		fs.Usage()
+		return ErrUsage
+	}
+
+	p, err := newPrinter(stdout, o.output)
+	if err != nil {
+		return err
+	}
+	sel, err := parseSelector(o.selector)
+	if err != nil {
+		return err
+	}
+	c, err := resolveContext(o)
+	if err != nil {
+		return err
+	}
+	svc, err := newService(o, c)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case len(cmd) == 2 && cmd[0] == "get":
+		cs, err := containers(ctx, svc, o.timeout, sel)
+		if err != nil {
+			return err
+		}
+		switch cmd[1] {
+		case "containers", "container":
+			return p.containers(cs)
+		case "hosts", "host":
+			return p.hosts(hosts(cs))
+		case "stacks", "stack":
+			return p.stacks(stacks(cs))
+		}
+	case len(cmd) == 3 && cmd[0] == "describe" && cmd[1] == "container":
+		ctx, cancel := context.WithTimeout(ctx, o.timeout)
+		defer cancel()
+		c, err := svc.Container(ctx, cmd[2])
+		if err != nil {
+			return err
+		}
+		return p.container(c)
+	case len(cmd) <= 2 && cmd[0] == "watch":
+		if len(cmd) == 2 && cmd[1] != "containers" {
+			break
+		}
+		first := true
+		for e := range svc.WatchContainers(ctx) {
+			if !sel.matches(e.Container) {
+				continue
+			}
+			if err := p.event(e, first); err != nil {
+				return err
+			}
+			first = false
+		}
+		return nil
+	case len(cmd) == 4 && cmd[0] == "logs" && cmd[1] == "level" && cmd[2] == "set":
+		var ls []logLevel
+		err := administer(ctx, o, c, func(ctx context.Context, instance string, a *client.Admin) error {
+			level, err := a.SetLogLevel(ctx, cmd[3])
+			if err == nil {
+				ls = append(ls, logLevel{Instance: instance, Level: level})
+			}
+			return err
+		})
+		if perr := p.logLevels(ls); err == nil {
+			err = perr
+		}
+		return err
+	case len(cmd) == 1 && (cmd[0] == "drain" || cmd[0] == "undrain"):
+		var ds []drain
+		err := administer(ctx, o, c, func(ctx context.Context, instance string, a *client.Admin) error {
+			draining, err := a.Drain(ctx, cmd[0] == "drain")
+			if err == nil {
+				ds = append(ds, drain{Instance: instance, Draining: draining})
+			}
+			return err
+		})
+		if perr := p.drains(ds); err == nil {
+			err = perr
+		}
+		return err
+	}
+	return fmt.Errorf("%q: %v", strings.Join(cmd, " "), ErrUnknownCommand)
+}
+
+// resolveContext returns the context of the service instances described by
+// the flags and context file.
+func resolveContext(o options) (serviceContext, error) {
+	cf, err := loadContextFile(o.contextFile)
+	if err != nil {
+		return serviceContext{}, err
+	}
+
+	var c serviceContext
+	if o.instances != "" {
+		// NOTE: A context is still used for its environment and token, if any
+		if c, err = cf.context(o.context); err != nil && o.context != "" {
+			return serviceContext{}, err
+		}
+		c.Instances = strings.Split(o.instances, ",")
+	} else if c, err = cf.context(o.context); err == ErrNoContext {
+		return serviceContext{}, ErrNoInstances
+	} else if err != nil {
+		return serviceContext{}, err
+	}
+	if o.environment != "" {
+		c.Environment = o.environment
+	}
+	if o.token != "" {
+		c.Token = o.token
+	}
+	return c, nil
+}
+
+// httpClient returns an HTTP client sending the context's token, if any.
+func httpClient(o options, c serviceContext) *http.Client {
+	hc := &http.Client{Timeout: o.timeout}
+	if c.Token != "" {
+		hc.Transport = bearerTransport{token: c.Token, next: http.DefaultTransport}
+	}
+	return hc
+}
+
+// newService returns a client of the context's service instances.
+func newService(o options, c serviceContext) (rancher.ServerService, error) {
+	return client.New(c.Instances,
+		client.Environment(c.Environment),
+		client.HTTPClient(httpClient(o, c)),
+		client.Retry(len(c.Instances), o.timeout),
+		client.WatchInterval(o.interval),
+	)
+}
+
+// administer calls f upon each of the context's service instances in turn,
+// rather than upon any one of them. Every instance is called, even should
+// one fail, returning the error of the first to fail.
+func administer(ctx context.Context, o options, c serviceContext, f func(context.Context, string, *client.Admin) error) error {
+	var first error
+	for _, instance := range c.Instances {
+		err := func() error {
+			a, err := client.NewAdmin(instance, client.HTTPClient(httpClient(o, c)))
+			if err != nil {
+				return err
+			}
+			ctx, cancel := context.WithTimeout(ctx, o.timeout)
+			defer cancel()
+			return f(ctx, instance, a)
+		}()
+		if err != nil && first == nil {
+			first = fmt.Errorf("%s: %v", instance, err)
+		}
+	}
+	return first
+}
+
+// containers returns the selected containers.
+func containers(ctx context.Context, svc rancher.ServerService, timeout time.Duration, sel selector) ([]*rancher.Container, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	cs, err := svc.Containers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return sel.filter(cs), nil
+}
@@ -0,0 +1,256 @@
+// Copyright 2017 Martin Baillie <martin.t.baillie@gmail.com>.
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file or at:
+// https://opensource.org/licenses/BSD-3-Clause
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gorilla/mux"
+	stdopentracing "github.com/opentracing/opentracing-go"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/go-kit/kit/log"
+
+	"github.com/martinbaillie/rancher-management-service/health"
+	"github.com/martinbaillie/rancher-management-service/rancher"
+)
+
+var defaultContainers = []*rancher.Container{
+	{Name: "web_gossman_1", State: "running", PrivateIP: "10.0.0.1", ServiceIndex: 1, ServiceName: "gossman", StackName: "web", Labels: map[string]string{"tier": "frontend"}, Host: rancher.Host{Name: "host-1"}},
+	{Name: "web_gossman_2", State: "stopped", PrivateIP: "10.0.0.2", ServiceIndex: 2, ServiceName: "gossman", StackName: "web", Host: rancher.Host{Name: "host-2"}},
+	{Name: "db_postgres_1", State: "running", PrivateIP: "10.0.0.3", ServiceIndex: 1, ServiceName: "postgres", StackName: "db", Host: rancher.Host{Name: "host-1"}},
+	{Name: "standalone", State: "running", PrivateIP: "10.0.0.4", Host: rancher.Host{Name: "host-2"}},
+}
+
+type stubServerService struct{}
+
+func (stubServerService) Container(_ context.Context, name string) (*rancher.Container, error) {
+	for _, c := range defaultContainers {
+		if c.Name == name {
+			return c, nil
+		}
+	}
+	return nil, rancher.ErrContainerNotFound
+}
+
+func (stubServerService) Containers(_ context.Context) ([]*rancher.Container, error) {
+	return defaultContainers, nil
+}
+
+func (stubServerService) CacheStatus(_ context.Context) rancher.CacheStatus {
+	return rancher.CacheStatus{}
+}
+
+func (stubServerService) WatchContainers(_ context.Context) <-chan rancher.ContainerEvent {
+	return nil
+}
+
+// newInstance serves the stub through the Rancher package's HTTP transport,
+// recording the Authorization header of the most recent request.
+func newInstance(auth *string) *httptest.Server {
+	tracer := stdopentracing.GlobalTracer()
+	rhs := rancher.MakeHTTPHandlers(context.Background(), rancher.NewServerEndpoints(stubServerService{}, tracer), tracer, log.NewNopLogger())
+
+	r := mux.NewRouter()
+	r.Methods("GET").Path("/rms/v1/containers").Handler(rhs.Containers)
+	r.Methods("GET").Path("/rms/v1/containers/{name}").Handler(rhs.Container)
+
+	a := rancher.NewActionAuthorizer([]string{"s3cr3t"})
+	r.Methods("PUT").Path("/rms/v1/drain").Handler(rancher.AuthorizedHandler(a, health.MakeHTTPHandlers(health.New()).Drain))
+	r.Methods("PUT").Path("/rms/v1/logs/level").Handler(rancher.AuthorizedHandler(a, http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			var body struct{ Level string }
+			json.NewDecoder(req.Body).Decode(&body)
+			json.NewEncoder(w).Encode(body)
+		})))
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		*auth = req.Header.Get("Authorization")
+		r.ServeHTTP(w, req)
+	}))
+}
+
+func TestParseSelector(t *testing.T) {
+	assert := assert.New(t)
+
+	sel, err := parseSelector("stack=web, state!=running")
+	assert.Equal(nil, err, "parseSelector() valid")
+	assert.Equal(selector{{"stack", "web", true}, {"state", "running", false}}, sel, "parseSelector() valid")
+	assert.Equal([]*rancher.Container{defaultContainers[1]}, sel.filter(defaultContainers), "filter()")
+
+	sel, err = parseSelector("host==host-1")
+	assert.Equal(nil, err, "parseSelector() double equals")
+	assert.Equal(selector{{"host", "host-1", true}}, sel, "parseSelector() double equals")
+
+	sel, err = parseSelector("label.tier=frontend")
+	assert.Equal(nil, err, "parseSelector() label")
+	assert.Equal([]*rancher.Container{defaultContainers[0]}, sel.filter(defaultContainers), "filter() label")
+	sel, _ = parseSelector("stack=web,label.tier!=frontend")
+	assert.Equal([]*rancher.Container{defaultContainers[1]}, sel.filter(defaultContainers), "filter() label not equal")
+
+	_, err = parseSelector("stack")
+	assert.NotEqual(nil, err, "parseSelector() invalid")
+	_, err = parseSelector("label.=frontend")
+	assert.NotEqual(nil, err, "parseSelector() label without key")
+	_, err = parseSelector("colour=blue")
+	assert.NotEqual(nil, err, "parseSelector() unknown field")
+}
+
+func TestSummaries(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal([]host{
+		{Name: "host-1", Containers: 2, Running: 2},
+		{Name: "host-2", Containers: 2, Running: 1},
+	}, hosts(defaultContainers), "hosts()")
+	assert.Equal([]stack{
+		{Name: "db", Services: []string{"postgres"}, Containers: 1, Running: 1},
+		{Name: "web", Services: []string{"gossman"}, Containers: 2, Running: 1},
+	}, stacks(defaultContainers), "stacks()")
+}
+
+func TestContextFile(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, _ := ioutil.TempDir("", "rmsctl")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config")
+	ioutil.WriteFile(path, []byte(`
+current-context: prod
+contexts:
+- name: prod
+  instances:
+  - http://rms-1:8080/rms/v1
+  environment: prod
+  token: s3cr3t
+- name: empty
+`), 0600)
+
+	cf, err := loadContextFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := cf.context("")
+	assert.Equal(nil, err, "context() current")
+	assert.Equal(serviceContext{
+		Name:        "prod",
+		Instances:   []string{"http://rms-1:8080/rms/v1"},
+		Environment: "prod",
+		Token:       "s3cr3t",
+	}, c, "context() current")
+
+	_, err = cf.context("dev")
+	assert.NotEqual(nil, err, "context() not found")
+	_, err = cf.context("empty")
+	assert.NotEqual(nil, err, "context() without instances")
+
+	cf, err = loadContextFile(filepath.Join(dir, "missing"))
+	assert.Equal(nil, err, "loadContextFile() missing")
+	_, err = cf.context("")
+	assert.Equal(ErrNoContext, err, "context() none")
+}
+
+func TestRun(t *testing.T) {
+	assert := assert.New(t)
+
+	var auth string
+	instance := newInstance(&auth)
+	defer instance.Close()
+
+	dir, _ := ioutil.TempDir("", "rmsctl")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config")
+	ioutil.WriteFile(path, []byte(`
+current-context: test
+contexts:
+- name: test
+  instances:
+  - `+instance.URL+`/rms/v1
+  token: s3cr3t
+`), 0600)
+
+	run := func(args ...string) (string, error) {
+		var stdout, stderr bytes.Buffer
+		err := run(context.Background(), append([]string{"-context_file", path}, args...), &stdout, &stderr)
+		return stdout.String(), err
+	}
+
+	out, err := run("get", "containers", "-l", "stack=web")
+	assert.Equal(nil, err, "get containers")
+	assert.Equal(`NAME           STACK  SERVICE  STATE    IP        HOST
+web_gossman_1  web    gossman  running  10.0.0.1  host-1
+web_gossman_2  web    gossman  stopped  10.0.0.2  host-2
+`, out, "get containers")
+	assert.Equal("Bearer s3cr3t", auth, "get containers sends token")
+
+	out, err = run("-o", "json", "get", "containers", "-l", "label.tier=frontend")
+	assert.Equal(nil, err, "get containers as JSON")
+	assert.JSONEq(`[{"Name":"web_gossman_1","UUID":"","State":"running","PrivateIP":"10.0.0.1","ServiceIndex":1,
+		"ServiceName":"gossman","StackName":"web","Labels":{"tier":"frontend"},"HostName":"host-1"}]`, out, "get containers as JSON")
+
+	out, err = run("-o", "yaml", "describe", "container", "standalone")
+	assert.Equal(nil, err, "describe container as YAML")
+	assert.Contains(out, "HostName: host-2\n", "describe container as YAML")
+
+	out, err = run("-o", "json", "get", "stacks")
+	assert.Equal(nil, err, "get stacks")
+	var ss []stack
+	assert.Equal(nil, json.Unmarshal([]byte(out), &ss), "get stacks")
+	assert.Equal(stacks(defaultContainers), ss, "get stacks")
+
+	out, err = run("get", "hosts", "-output", "yaml", "-selector", "state=running")
+	assert.Equal(nil, err, "get hosts")
+	assert.Equal(`---
+- Containers: 2
+  HostName: host-1
+  Running: 2
+- Containers: 1
+  HostName: host-2
+  Running: 1
+`, out, "get hosts")
+
+	out, err = run("describe", "container", "standalone")
+	assert.Equal(nil, err, "describe container")
+	assert.Contains(out, "Stack:          -\n", "describe container")
+	assert.Contains(out, "Host:           host-2\n", "describe container")
+
+	_, err = run("describe", "container", "missing")
+	assert.Equal(rancher.ErrContainerNotFound, err, "describe container not found")
+
+	out, err = run("logs", "level", "set", "debug")
+	assert.Equal(nil, err, "logs level set")
+	assert.Contains(out, "LEVEL\n"+instance.URL+"/rms/v1  debug\n", "logs level set")
+
+	out, err = run("-o", "json", "drain")
+	assert.Equal(nil, err, "drain")
+	var ds []drain
+	assert.Equal(nil, json.Unmarshal([]byte(out), &ds), "drain")
+	assert.Equal([]drain{{Instance: instance.URL + "/rms/v1", Draining: true}}, ds, "drain")
+
+	out, err = run("-instances", instance.URL+"/rms/v1,"+instance.URL+"/rms/v2", "undrain")
+	assert.Equal(instance.URL+"/rms/v2: Not Found (404)", fmt.Sprint(err), "undrain, one instance failing")
+	assert.Contains(out, instance.URL+"/rms/v1  false\n", "undrain, one instance failing")
+
+	_, err = run("-token", "wrong", "drain")
+	assert.Equal(instance.URL+"/rms/v1: "+rancher.ErrActionUnauthorized.Error(), fmt.Sprint(err), "drain without token")
+
+	_, err = run("get", "pods")
+	assert.NotEqual(nil, err, "unknown command")
+	_, err = run("-o", "xml", "get", "containers")
+	assert.NotEqual(nil, err, "unknown output")
+	_, err = run("-context", "missing", "get", "containers")
+	assert.NotEqual(nil, err, "unknown context")
+}
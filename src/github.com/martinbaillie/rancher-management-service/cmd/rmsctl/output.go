@@ -0,0 +1,387 @@
+// Copyright 2017 Martin Baillie <martin.t.baillie@gmail.com>.
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file or at:
+// https://opensource.org/licenses/BSD-3-Clause
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/martinbaillie/rancher-management-service/rancher"
+)
+
+// Output errors
+var (
+	ErrUnknownOutput   = errors.New("unknown output, one of table, json or yaml")
+	ErrInvalidSelector = errors.New("invalid selector, e.g. stack=web,state!=running,label.tier=frontend")
+	ErrUnknownField    = errors.New("unknown selector field, one of name, state, ip, stack, service, host, environment or label.<key>")
+)
+
+// Output formats
+const (
+	outputTable = "table"
+	outputJSON  = "json"
+	outputYAML  = "yaml"
+)
+
+// selector matches containers by their fields and labels, e.g.
+// stack=web,state!=running,label.tier=frontend.
+type selector []requirement
+
+type requirement struct {
+	field string
+	value string
+	equal bool
+}
+
+// containerFields are the container fields that may be selected on.
+var containerFields = map[string]func(*rancher.Container) string{
+	"name":        func(c *rancher.Container) string { return c.Name },
+	"state":       func(c *rancher.Container) string { return c.State },
+	"ip":          func(c *rancher.Container) string { return c.PrivateIP },
+	"stack":       func(c *rancher.Container) string { return c.StackName },
+	"service":     func(c *rancher.Container) string { return c.ServiceName },
+	"host":        func(c *rancher.Container) string { return c.Host.Name },
+	"environment": func(c *rancher.Container) string { return c.Environment },
+}
+
+// labelPrefix selects on a container label, e.g. label.tier=frontend. A
+// container without the label has an empty value.
+const labelPrefix = "label."
+
+// containerField returns the named container field, or label.
+func containerField(field string) (func(*rancher.Container) string, bool) {
+	if strings.HasPrefix(field, labelPrefix) && len(field) > len(labelPrefix) {
+		key := field[len(labelPrefix):]
+		return func(c *rancher.Container) string { return c.Labels[key] }, true
+	}
+	f, ok := containerFields[field]
+	return f, ok
+}
+
+func parseSelector(s string) (selector, error) {
+	var sel selector
+	if s == "" {
+		return sel, nil
+	}
+	for _, term := range strings.Split(s, ",") {
+		var r requirement
+		if i := strings.Index(term, "!="); i > 0 {
+			r = requirement{field: term[:i], value: term[i+2:]}
+		} else if i := strings.Index(term, "="); i > 0 {
+			r = requirement{field: term[:i], value: strings.TrimPrefix(term[i+1:], "="), equal: true}
+		} else {
+			return nil, fmt.Errorf("%q: %v", term, ErrInvalidSelector)
+		}
+		r.field = strings.TrimSpace(r.field)
+		r.value = strings.TrimSpace(r.value)
+		if _, ok := containerField(r.field); !ok {
+			return nil, fmt.Errorf("%q: %v", r.field, ErrUnknownField)
+		}
+		sel = append(sel, r)
+	}
+	return sel, nil
+}
+
+func (sel selector) matches(c *rancher.Container) bool {
+	for _, r := range sel {
+		f, _ := containerField(r.field)
+		if (f(c) == r.value) != r.equal {
+			return false
+		}
+	}
+	return true
+}
+
+func (sel selector) filter(cs []*rancher.Container) []*rancher.Container {
+	var res []*rancher.Container
+	for _, c := range cs {
+		if sel.matches(c) {
+			res = append(res, c)
+		}
+	}
+	return res
+}
+
+// host summarises the containers running on a Rancher host.
+type host struct {
+	Name       string `json:"HostName"`
+	Containers int    `json:"Containers"`
+	Running    int    `json:"Running"`
+}
+
+// stack summarises the containers of a Rancher stack.
+type stack struct {
+	Name       string   `json:"StackName"`
+	Services   []string `json:"Services"`
+	Containers int      `json:"Containers"`
+	Running    int      `json:"Running"`
+}
+
+func hosts(cs []*rancher.Container) []host {
+	hm := make(map[string]*host)
+	var names []string
+	for _, c := range cs {
+		h, ok := hm[c.Host.Name]
+		if !ok {
+			h = &host{Name: c.Host.Name}
+			hm[c.Host.Name] = h
+			names = append(names, c.Host.Name)
+		}
+		h.Containers++
+		if c.State == "running" {
+			h.Running++
+		}
+	}
+	sort.Strings(names)
+
+	hs := make([]host, len(names))
+	for i, name := range names {
+		hs[i] = *hm[name]
+	}
+	return hs
+}
+
+// stacks summarises the containers by stack, ignoring standalone containers.
+func stacks(cs []*rancher.Container) []stack {
+	sm := make(map[string]*stack)
+	services := make(map[string]map[string]bool)
+	var names []string
+	for _, c := range cs {
+		if c.StackName == "" {
+			continue
+		}
+		s, ok := sm[c.StackName]
+		if !ok {
+			s = &stack{Name: c.StackName}
+			sm[c.StackName] = s
+			services[c.StackName] = make(map[string]bool)
+			names = append(names, c.StackName)
+		}
+		if !services[c.StackName][c.ServiceName] {
+			services[c.StackName][c.ServiceName] = true
+			s.Services = append(s.Services, c.ServiceName)
+		}
+		s.Containers++
+		if c.State == "running" {
+			s.Running++
+		}
+	}
+	sort.Strings(names)
+
+	ss := make([]stack, len(names))
+	for i, name := range names {
+		ss[i] = *sm[name]
+		sort.Strings(ss[i].Services)
+	}
+	return ss
+}
+
+// printer writes objects in the requested output format. Tables are written
+// as rows under a header, JSON and YAML as the objects themselves.
+type printer struct {
+	w      io.Writer
+	output string
+}
+
+func newPrinter(w io.Writer, output string) (*printer, error) {
+	switch output {
+	case outputTable, outputJSON, outputYAML:
+		return &printer{w: w, output: output}, nil
+	}
+	return nil, fmt.Errorf("%q: %v", output, ErrUnknownOutput)
+}
+
+// print writes v, or the table rows should the output be a table.
+func (p *printer) print(v interface{}, header []string, rows [][]string) error {
+	switch p.output {
+	case outputJSON:
+		enc := json.NewEncoder(p.w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	case outputYAML:
+		return p.yaml(v)
+	}
+
+	tw := tabwriter.NewWriter(p.w, 0, 8, 2, ' ', 0)
+	if header != nil {
+		fmt.Fprintln(tw, strings.Join(header, "\t"))
+	}
+	for _, row := range rows {
+		fmt.Fprintln(tw, strings.Join(row, "\t"))
+	}
+	return tw.Flush()
+}
+
+// yaml writes v as a YAML document with the same field names as the API's
+// JSON, by way of the JSON.
+func (p *printer) yaml(v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	// NOTE: JSON is YAML
+	var doc interface{}
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		return err
+	}
+	if b, err = yaml.Marshal(doc); err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(p.w, "---\n%s", b)
+	return err
+}
+
+// apiContainer is the JSON and YAML representation of a container, as served
+// by the HTTP API.
+type apiContainer struct {
+	Name         string            `json:"Name"`
+	UUID         string            `json:"UUID"`
+	State        string            `json:"State"`
+	PrivateIP    string            `json:"PrivateIP"`
+	ServiceIndex int64             `json:"ServiceIndex"`
+	ServiceName  string            `json:"ServiceName,omitempty"`
+	StackName    string            `json:"StackName,omitempty"`
+	Labels       map[string]string `json:"Labels,omitempty"`
+	Ports        []string          `json:"Ports,omitempty"`
+	HostName     string            `json:"HostName"`
+	Environment  string            `json:"Environment,omitempty"`
+}
+
+func newAPIContainer(c *rancher.Container) apiContainer {
+	return apiContainer{
+		Name:         c.Name,
+		UUID:         c.UUID,
+		State:        c.State,
+		PrivateIP:    c.PrivateIP,
+		ServiceIndex: c.ServiceIndex,
+		ServiceName:  c.ServiceName,
+		StackName:    c.StackName,
+		Labels:       c.Labels,
+		Ports:        c.Ports,
+		HostName:     c.Host.Name,
+		Environment:  c.Environment,
+	}
+}
+
+var containerHeader = []string{"NAME", "STACK", "SERVICE", "STATE", "IP", "HOST"}
+
+func containerRow(c *rancher.Container) []string {
+	return []string{c.Name, dash(c.StackName), dash(c.ServiceName), c.State, c.PrivateIP, c.Host.Name}
+}
+
+func (p *printer) containers(cs []*rancher.Container) error {
+	rows := make([][]string, len(cs))
+	acs := make([]apiContainer, len(cs))
+	for i, c := range cs {
+		rows[i] = containerRow(c)
+		acs[i] = newAPIContainer(c)
+	}
+	return p.print(acs, containerHeader, rows)
+}
+
+func (p *printer) hosts(hs []host) error {
+	rows := make([][]string, len(hs))
+	for i, h := range hs {
+		rows[i] = []string{h.Name, fmt.Sprint(h.Containers), fmt.Sprint(h.Running)}
+	}
+	return p.print(hs, []string{"NAME", "CONTAINERS", "RUNNING"}, rows)
+}
+
+func (p *printer) stacks(ss []stack) error {
+	rows := make([][]string, len(ss))
+	for i, s := range ss {
+		rows[i] = []string{s.Name, strings.Join(s.Services, ","), fmt.Sprint(s.Containers), fmt.Sprint(s.Running)}
+	}
+	return p.print(ss, []string{"NAME", "SERVICES", "CONTAINERS", "RUNNING"}, rows)
+}
+
+// container describes a single container as a table of its fields.
+func (p *printer) container(c *rancher.Container) error {
+	rows := [][]string{
+		{"Name:", c.Name},
+		{"UUID:", dash(c.UUID)},
+		{"Stack:", dash(c.StackName)},
+		{"Service:", dash(c.ServiceName)},
+		{"Service Index:", fmt.Sprint(c.ServiceIndex)},
+		{"State:", c.State},
+		{"IP:", c.PrivateIP},
+		{"Host:", c.Host.Name},
+	}
+	if c.Environment != "" {
+		rows = append(rows, []string{"Environment:", c.Environment})
+	}
+	return p.print(newAPIContainer(c), nil, rows)
+}
+
+// logLevel is the level of an instance's log statements.
+type logLevel struct {
+	Instance string
+	Level    string
+}
+
+func (p *printer) logLevels(ls []logLevel) error {
+	rows := make([][]string, len(ls))
+	for i, l := range ls {
+		rows[i] = []string{l.Instance, l.Level}
+	}
+	if ls == nil {
+		ls = []logLevel{}
+	}
+	return p.print(ls, []string{"INSTANCE", "LEVEL"}, rows)
+}
+
+// drain is whether an instance is draining.
+type drain struct {
+	Instance string
+	Draining bool
+}
+
+func (p *printer) drains(ds []drain) error {
+	rows := make([][]string, len(ds))
+	for i, d := range ds {
+		rows[i] = []string{d.Instance, fmt.Sprint(d.Draining)}
+	}
+	if ds == nil {
+		ds = []drain{}
+	}
+	return p.print(ds, []string{"INSTANCE", "DRAINING"}, rows)
+}
+
+// watchEvent is the JSON and YAML representation of a watched change.
+type watchEvent struct {
+	Type      rancher.ContainerEventType `json:"Type"`
+	Container apiContainer               `json:"Container"`
+}
+
+// event writes a watched change, with the table header before the first.
+func (p *printer) event(e rancher.ContainerEvent, first bool) error {
+	if p.output == outputJSON {
+		// NOTE: one object per line, so that the output may be streamed
+		return json.NewEncoder(p.w).Encode(watchEvent{e.Type, newAPIContainer(e.Container)})
+	}
+	var header []string
+	if first {
+		header = append([]string{"EVENT"}, containerHeader...)
+	}
+	row := append([]string{strings.ToUpper(string(e.Type))}, containerRow(e.Container)...)
+	return p.print(watchEvent{e.Type, newAPIContainer(e.Container)}, header, [][]string{row})
+}
+
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
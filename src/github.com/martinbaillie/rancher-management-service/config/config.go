@@ -0,0 +1,908 @@
+// Copyright 2017 Martin Baillie <martin.t.baillie@gmail.com>.
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file or at:
+// https://opensource.org/licenses/BSD-3-Clause
+
+// Package config provides the project's declarative configuration file.
+//
+// The file is YAML, and each of its settings backs one of the command-line
+// flags. It is layered beneath the flags and their environment variables, so
+// that precedence is:
+// - flags, e.g. -probe_workers=4
+// - environment variables, e.g. PROBE_WORKERS=4
+// - the configuration file, e.g. probe: {workers: 4}
+// - the flag defaults.
+//
+// While running, the file may be reloaded beneath the flags as they were
+// given, changing only the settings that do not require a restart.
+package config
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/namsral/flag"
+	"gopkg.in/yaml.v2"
+
+	"github.com/martinbaillie/rancher-management-service/rancher"
+)
+
+// Config is the schema of the configuration file. Each setting is tagged with
+// the flag it backs.
+type Config struct {
+	Debug          bool           `yaml:"debug" flag:"debug"`
+	Listeners      Listeners      `yaml:"listeners"`
+	HTTP           HTTP           `yaml:"http"`
+	Thrift         Thrift         `yaml:"thrift"`
+	Zipkin         Zipkin         `yaml:"zipkin"`
+	Metadata       Metadata       `yaml:"metadata"`
+	Environments   Environments   `yaml:"environments" flag:"environments"`
+	Kafka          Kafka          `yaml:"kafka"`
+	AMQP           AMQP           `yaml:"amqp"`
+	PrometheusSD   PrometheusSD   `yaml:"prometheus_sd"`
+	Proxy          Proxy          `yaml:"proxy"`
+	Probe          Probe          `yaml:"probe"`
+	API            API            `yaml:"api"`
+	Actions        Actions        `yaml:"actions"`
+	ClientPolicies ClientPolicies `yaml:"client_policies" flag:"client_policies"`
+	RateLimit      RateLimit      `yaml:"rate_limit"`
+	Outbound       Outbound       `yaml:"outbound"`
+}
+
+// Listeners are the bind addresses of each transport.
+type Listeners struct {
+	HTTP    string `yaml:"http" flag:"http_addr"`
+	Metrics string `yaml:"metrics" flag:"metrics_addr"`
+	Debug   string `yaml:"debug" flag:"debug_addr"`
+	GRPC    string `yaml:"grpc" flag:"grpc_addr"`
+	Thrift  string `yaml:"thrift" flag:"thrift_addr"`
+}
+
+// HTTP configures the HTTP transport.
+type HTTP struct {
+	BasePath     string   `yaml:"base_path" flag:"http_basepath"`
+	DrainTimeout Duration `yaml:"drain_timeout" flag:"drain_timeout"`
+	CORSOrigins  List     `yaml:"cors_origins" flag:"cors_origins"`
+}
+
+// Thrift configures the Thrift transport.
+type Thrift struct {
+	Protocol  string `yaml:"protocol" flag:"thrift_protocol"`
+	Transport string `yaml:"transport" flag:"thrift_transport"`
+}
+
+// Zipkin configures tracing.
+type Zipkin struct {
+	Addr string `yaml:"addr" flag:"zipkin_addr"`
+}
+
+// Metadata configures the Rancher metadata cache of the default environment,
+// and the cache of every environment.
+type Metadata struct {
+	Addr           string   `yaml:"addr" flag:"metadata_addr"`
+	Interval       Duration `yaml:"interval" flag:"metadata_interval"`
+	MaxStaleness   Duration `yaml:"max_staleness" flag:"metadata_max_staleness"`
+	ReadyIntervals int      `yaml:"ready_intervals" flag:"ready_intervals"`
+	CacheDir       string   `yaml:"cache_dir" flag:"cache_dir"`
+}
+
+// Environment is a Rancher environment to manage. Settings that are not given
+// are taken from the metadata and api settings.
+type Environment struct {
+	Name             string   `yaml:"name"`
+	MetadataAddr     string   `yaml:"metadata_addr,omitempty"`
+	Proxy            string   `yaml:"proxy,omitempty"`
+	MetadataInterval Duration `yaml:"metadata_interval,omitempty"`
+	APIURL           string   `yaml:"api_url,omitempty"`
+	APIAccessKey     string   `yaml:"api_access_key,omitempty"`
+	APISecretKey     string   `yaml:"api_secret_key,omitempty"`
+	APISecretKeyFile string   `yaml:"api_secret_key_file,omitempty"`
+}
+
+// ClientPolicy is the resilience policy of a Rancher client endpoint, or of
+// every endpoint without one when the endpoint is default. Settings that are
+// not given are taken from the default policy, see rancher.ParsePolicies.
+type ClientPolicy struct {
+	Endpoint      string    `yaml:"endpoint"`
+	Timeout       *Duration `yaml:"timeout,omitempty"`
+	Retries       *int      `yaml:"retries,omitempty"`
+	Backoff       *Duration `yaml:"backoff,omitempty"`
+	MaxBackoff    *Duration `yaml:"max_backoff,omitempty"`
+	Breaker       string    `yaml:"breaker,omitempty"`
+	MaxConcurrent *int      `yaml:"max_concurrent,omitempty"`
+}
+
+// Kafka configures the publishing of Rancher environment change events.
+type Kafka struct {
+	Brokers List   `yaml:"brokers" flag:"kafka_brokers"`
+	Topic   string `yaml:"topic" flag:"kafka_topic"`
+	Buffer  int    `yaml:"buffer" flag:"kafka_buffer"`
+}
+
+// AMQP configures the consuming of management commands.
+type AMQP struct {
+	URL                string `yaml:"url" flag:"amqp_url"`
+	Queue              string `yaml:"queue" flag:"amqp_queue"`
+	DeadLetterExchange string `yaml:"dead_letter_exchange" flag:"amqp_dead_letter_exchange"`
+}
+
+// PrometheusSD configures the Prometheus service discovery of containers.
+type PrometheusSD struct {
+	Selector  string `yaml:"selector" flag:"prometheus_sd_selector"`
+	PortLabel string `yaml:"port_label" flag:"prometheus_sd_port_label"`
+	PathLabel string `yaml:"path_label" flag:"prometheus_sd_path_label"`
+}
+
+// Proxy configures the reverse proxy into containers.
+type Proxy struct {
+	Tokens     List   `yaml:"tokens" flag:"proxy_tokens"`
+	PortsLabel string `yaml:"ports_label" flag:"proxy_ports_label"`
+}
+
+// Probe configures the probing of containers.
+type Probe struct {
+	Interval Duration `yaml:"interval" flag:"probe_interval"`
+	Timeout  Duration `yaml:"timeout" flag:"probe_timeout"`
+	Workers  int      `yaml:"workers" flag:"probe_workers"`
+}
+
+// API configures the Rancher API of the default environment.
+type API struct {
+	URL           string `yaml:"url" flag:"api_url"`
+	AccessKey     string `yaml:"access_key" flag:"api_access_key"`
+	SecretKey     string `yaml:"secret_key" flag:"api_secret_key"`
+	SecretKeyFile string `yaml:"secret_key_file" flag:"api_secret_key_file"`
+}
+
+// Actions configures how actions upon containers and services are awaited.
+type Actions struct {
+	Timeout        Duration `yaml:"timeout" flag:"action_timeout"`
+	PollInterval   Duration `yaml:"poll_interval" flag:"action_poll_interval"`
+	ServiceTimeout Duration `yaml:"service_timeout" flag:"service_action_timeout"`
+	Tokens         List     `yaml:"tokens" flag:"action_tokens"`
+}
+
+// RateLimit configures the budgets of each client's read and mutating
+// requests, see rancher.RateLimit.
+type RateLimit struct {
+	Read               float64 `yaml:"read" flag:"rate_limit_read"`
+	ReadBurst          int     `yaml:"read_burst" flag:"rate_limit_read_burst"`
+	ReadConcurrent     int     `yaml:"read_concurrent" flag:"rate_limit_read_concurrent"`
+	Mutating           float64 `yaml:"mutating" flag:"rate_limit_mutating"`
+	MutatingBurst      int     `yaml:"mutating_burst" flag:"rate_limit_mutating_burst"`
+	MutatingConcurrent int     `yaml:"mutating_concurrent" flag:"rate_limit_mutating_concurrent"`
+}
+
+// Outbound configures the governor of calls into containers, see
+// rancher.GovernorConfig.
+type Outbound struct {
+	MaxConcurrent int      `yaml:"max_concurrent" flag:"outbound_max_concurrent"`
+	MaxPerHost    int      `yaml:"max_per_host" flag:"outbound_max_per_host"`
+	MaxPerService int      `yaml:"max_per_service" flag:"outbound_max_per_service"`
+	MaxWait       Duration `yaml:"max_wait" flag:"outbound_max_wait"`
+}
+
+// Duration is a time.Duration written as a string, e.g. 1m30s.
+type Duration time.Duration
+
+func (d Duration) String() string { return time.Duration(d).String() }
+
+// Set implements flag.Value.
+func (d *Duration) Set(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("invalid duration %q", s)
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// MarshalYAML implements yaml.Marshaler.
+func (d Duration) MarshalYAML() (interface{}, error) { return d.String(), nil }
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	return d.Set(s)
+}
+
+// List is a list of strings, given to its flag comma separated.
+type List []string
+
+func (l List) String() string { return strings.Join(l, ",") }
+
+// Set implements flag.Value.
+func (l *List) Set(s string) error {
+	*l = nil
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*l = append(*l, v)
+		}
+	}
+	return nil
+}
+
+// Environments are the Rancher environments to manage, given to their flag
+// as described by rancher.ParseEnvironments.
+type Environments []Environment
+
+func (es Environments) String() string {
+	specs := make([]string, len(es))
+	for i, e := range es {
+		specs[i] = e.spec()
+	}
+	return strings.Join(specs, ";")
+}
+
+// Set implements flag.Value.
+func (es *Environments) Set(s string) error {
+	*es = nil
+	for _, spec := range strings.Split(s, ";") {
+		if strings.TrimSpace(spec) == "" {
+			continue
+		}
+		var e Environment
+		for _, setting := range strings.Split(spec, ",") {
+			kv := strings.SplitN(setting, "=", 2)
+			if len(kv) != 2 {
+				return fmt.Errorf("environment setting %q is not of the form key=value", setting)
+			}
+			var err error
+			switch k, v := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1]); k {
+			case "name":
+				e.Name = v
+			case "metadata_addr":
+				e.MetadataAddr = v
+			case "proxy":
+				e.Proxy = v
+			case "metadata_interval":
+				err = e.MetadataInterval.Set(v)
+			case "api_url":
+				e.APIURL = v
+			case "api_access_key":
+				e.APIAccessKey = v
+			case "api_secret_key":
+				e.APISecretKey = v
+			case "api_secret_key_file":
+				e.APISecretKeyFile = v
+			default:
+				err = fmt.Errorf("unknown setting %q", k)
+			}
+			if err != nil {
+				return fmt.Errorf("environment %q: %v", spec, err)
+			}
+		}
+		*es = append(*es, e)
+	}
+	return nil
+}
+
+// spec returns the environment as given to the environments flag.
+func (e Environment) spec() string {
+	var settings []string
+	for _, kv := range e.settings() {
+		if kv[1] != "" {
+			settings = append(settings, kv[0]+"="+kv[1])
+		}
+	}
+	return strings.Join(settings, ",")
+}
+
+func (e Environment) settings() [][2]string {
+	var interval string
+	if e.MetadataInterval != 0 {
+		interval = e.MetadataInterval.String()
+	}
+	return [][2]string{
+		{"name", e.Name},
+		{"metadata_addr", e.MetadataAddr},
+		{"proxy", e.Proxy},
+		{"metadata_interval", interval},
+		{"api_url", e.APIURL},
+		{"api_access_key", e.APIAccessKey},
+		{"api_secret_key", e.APISecretKey},
+		{"api_secret_key_file", e.APISecretKeyFile},
+	}
+}
+
+// ClientPolicies are the resilience policies of the Rancher client endpoints,
+// given to their flag as described by rancher.ParsePolicies.
+type ClientPolicies []ClientPolicy
+
+func (ps ClientPolicies) String() string {
+	specs := make([]string, len(ps))
+	for i, p := range ps {
+		specs[i] = p.spec()
+	}
+	return strings.Join(specs, ";")
+}
+
+// Set implements flag.Value.
+func (ps *ClientPolicies) Set(s string) error {
+	*ps = nil
+	for _, spec := range strings.Split(s, ";") {
+		if strings.TrimSpace(spec) == "" {
+			continue
+		}
+		var p ClientPolicy
+		for _, setting := range strings.Split(spec, ",") {
+			kv := strings.SplitN(setting, "=", 2)
+			if len(kv) != 2 {
+				return fmt.Errorf("policy setting %q is not of the form key=value", setting)
+			}
+			var err error
+			switch k, v := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1]); k {
+			case "endpoint":
+				p.Endpoint = v
+			case "timeout":
+				p.Timeout, err = parseDuration(v)
+			case "retries":
+				p.Retries, err = parseInt(v)
+			case "backoff":
+				p.Backoff, err = parseDuration(v)
+			case "max_backoff":
+				p.MaxBackoff, err = parseDuration(v)
+			case "breaker":
+				p.Breaker = v
+			case "max_concurrent":
+				p.MaxConcurrent, err = parseInt(v)
+			default:
+				err = fmt.Errorf("unknown setting %q", k)
+			}
+			if err != nil {
+				return fmt.Errorf("policy %q: %v", spec, err)
+			}
+		}
+		*ps = append(*ps, p)
+	}
+	return nil
+}
+
+func parseDuration(s string) (*Duration, error) {
+	var d Duration
+	return &d, d.Set(s)
+}
+
+func parseInt(s string) (*int, error) {
+	i, err := strconv.Atoi(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid integer %q", s)
+	}
+	return &i, nil
+}
+
+// spec returns the policy as given to the client_policies flag.
+func (p ClientPolicy) spec() string {
+	var settings []string
+	for _, kv := range p.settings() {
+		if kv[1] != "" {
+			settings = append(settings, kv[0]+"="+kv[1])
+		}
+	}
+	return strings.Join(settings, ",")
+}
+
+func (p ClientPolicy) settings() [][2]string {
+	duration := func(d *Duration) string {
+		if d == nil {
+			return ""
+		}
+		return d.String()
+	}
+	integer := func(i *int) string {
+		if i == nil {
+			return ""
+		}
+		return strconv.Itoa(*i)
+	}
+	return [][2]string{
+		{"endpoint", p.Endpoint},
+		{"timeout", duration(p.Timeout)},
+		{"retries", integer(p.Retries)},
+		{"backoff", duration(p.Backoff)},
+		{"max_backoff", duration(p.MaxBackoff)},
+		{"breaker", p.Breaker},
+		{"max_concurrent", integer(p.MaxConcurrent)},
+	}
+}
+
+// setting is a setting of the file, by its path, and the flag it backs.
+type setting struct {
+	path  string
+	flag  string
+	value reflect.Value
+}
+
+func (s setting) String() string {
+	switch v := s.value.Addr().Interface().(type) {
+	case *string:
+		return *v
+	case *bool:
+		return strconv.FormatBool(*v)
+	case *int:
+		return strconv.Itoa(*v)
+	case *float64:
+		return strconv.FormatFloat(*v, 'g', -1, 64)
+	case flag.Value:
+		return v.String()
+	}
+	panic("unsupported setting type " + s.value.Type().String())
+}
+
+func (s setting) Set(value string) error {
+	switch v := s.value.Addr().Interface().(type) {
+	case *string:
+		*v = value
+	case *bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q", value)
+		}
+		*v = b
+	case *int:
+		i, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", value)
+		}
+		*v = i
+	case *float64:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("invalid number %q", value)
+		}
+		*v = f
+	case flag.Value:
+		return v.Set(value)
+	default:
+		panic("unsupported setting type " + s.value.Type().String())
+	}
+	return nil
+}
+
+// settings returns every setting of the configuration, in schema order.
+func (c *Config) settings() []setting {
+	return walk(reflect.ValueOf(c).Elem(), "", nil)
+}
+
+func walk(v reflect.Value, prefix string, ss []setting) []setting {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		path := strings.Split(f.Tag.Get("yaml"), ",")[0]
+		if prefix != "" {
+			path = prefix + "." + path
+		}
+		if name := f.Tag.Get("flag"); name != "" {
+			ss = append(ss, setting{path: path, flag: name, value: v.Field(i)})
+		} else if f.Type.Kind() == reflect.Struct {
+			ss = walk(v.Field(i), path, ss)
+		}
+	}
+	return ss
+}
+
+// Loader layers a configuration file beneath a flag set, remembering which
+// flags were given so that the file may be reloaded beneath them.
+type Loader struct {
+	fs    *flag.FlagSet
+	path  string
+	given map[string]bool
+}
+
+// NewLoader returns a Loader for the configuration file at path, if any, and
+// the flags already parsed into the flag set.
+func NewLoader(fs *flag.FlagSet, path string) *Loader {
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	return &Loader{fs: fs, path: path, given: given}
+}
+
+// Load layers the configuration file at path, if any, beneath the flags
+// already parsed into the flag set, and returns the effective configuration.
+// The flags that were not given, on the command-line or in the environment,
+// are set from the file, so the rest of the program need only read flags.
+//
+// Load fails on a file that cannot be read, has settings that are not in the
+// schema or values of the wrong type. The effective configuration is then
+// validated, see Validate.
+func Load(fs *flag.FlagSet, path string) (*Config, error) {
+	return NewLoader(fs, path).Load()
+}
+
+// Load is as the package's Load.
+func (l *Loader) Load() (*Config, error) { return l.load(true) }
+
+// Reload reads the file again and returns the effective configuration, as
+// Load does, but leaves the flag set untouched. Settings removed from the
+// file fall back to their flag defaults.
+func (l *Loader) Reload() (*Config, error) { return l.load(false) }
+
+func (l *Loader) load(setFlags bool) (*Config, error) {
+	// Start from the flags, given or defaulted
+	var c Config
+	for _, s := range c.settings() {
+		f := l.fs.Lookup(s.flag)
+		if f == nil {
+			return nil, fmt.Errorf("%s: flag -%s is not defined", s.path, s.flag)
+		}
+		value := f.DefValue
+		if l.given[s.flag] {
+			value = f.Value.String()
+		}
+		if err := s.Set(value); err != nil {
+			return nil, fmt.Errorf("-%s: %v", s.flag, err)
+		}
+	}
+	if l.path == "" {
+		return &c, c.Validate()
+	}
+
+	b, err := ioutil.ReadFile(l.path)
+	if err != nil {
+		return nil, err
+	}
+	file := c
+	if err := yaml.UnmarshalStrict(b, &file); err != nil {
+		return nil, fmt.Errorf("%s: %v", l.path, err)
+	}
+
+	// Flags and their environment variables take precedence over the file
+	fss := file.settings()
+	for i, s := range c.settings() {
+		if l.given[s.flag] {
+			continue
+		}
+		s.value.Set(fss[i].value)
+		if !setFlags {
+			continue
+		}
+		if err := l.fs.Set(s.flag, s.String()); err != nil {
+			return nil, fmt.Errorf("%s: %s: %v", l.path, s.path, err)
+		}
+	}
+	return &c, c.Validate()
+}
+
+// FieldError is an invalid setting, by its path in the file.
+type FieldError struct {
+	Field string
+	Err   error
+}
+
+func (e *FieldError) Error() string { return e.Field + ": " + e.Err.Error() }
+
+// Errors are every invalid setting of a configuration.
+type Errors []*FieldError
+
+func (es Errors) Error() string {
+	msgs := make([]string, len(es))
+	for i, e := range es {
+		msgs[i] = e.Error()
+	}
+	return "invalid configuration:\n\t" + strings.Join(msgs, "\n\t")
+}
+
+// Validate reports every invalid setting of the configuration as Errors,
+// sorted by path.
+func (c *Config) Validate() error {
+	var errs Errors
+	check := func(field string, err error) {
+		if err != nil {
+			errs = append(errs, &FieldError{Field: field, Err: err})
+		}
+	}
+	positive := func(field string, d Duration) {
+		if d <= 0 {
+			check(field, fmt.Errorf("must be positive, not %s", d))
+		}
+	}
+	notNegative := func(field string, d Duration) {
+		if d < 0 {
+			check(field, fmt.Errorf("must not be negative, not %s", d))
+		}
+	}
+	required := func(field, v string) {
+		if v == "" {
+			check(field, fmt.Errorf("is required"))
+		}
+	}
+
+	check("listeners.http", validAddr(c.Listeners.HTTP))
+	check("listeners.metrics", validAddr(c.Listeners.Metrics))
+	check("listeners.debug", validAddr(c.Listeners.Debug))
+	// The gRPC and Thrift transports are disabled without an address
+	if c.Listeners.GRPC != "" {
+		check("listeners.grpc", validAddr(c.Listeners.GRPC))
+	}
+	if c.Listeners.Thrift != "" {
+		check("listeners.thrift", validAddr(c.Listeners.Thrift))
+	}
+
+	if !strings.HasPrefix(c.HTTP.BasePath, "/") {
+		check("http.base_path", fmt.Errorf("must begin with /, not %q", c.HTTP.BasePath))
+	}
+	notNegative("http.drain_timeout", c.HTTP.DrainTimeout)
+	for i, o := range c.HTTP.CORSOrigins {
+		if o != "*" {
+			check(fmt.Sprintf("http.cors_origins[%d]", i), validURL(o, "http", "https"))
+		}
+	}
+
+	check("thrift.protocol", oneOf(c.Thrift.Protocol, "binary", "compact", "json"))
+	check("thrift.transport", oneOf(c.Thrift.Transport, "buffered", "framed"))
+
+	if c.Zipkin.Addr != "" {
+		check("zipkin.addr", validURL(c.Zipkin.Addr, "http", "https"))
+	}
+
+	required("metadata.addr", c.Metadata.Addr)
+	if c.Metadata.Addr != "" {
+		u, err := rancher.MetadataURLFromStr(c.Metadata.Addr)
+		if err == nil && u.Host == "" {
+			err = fmt.Errorf("no host in %q", c.Metadata.Addr)
+		}
+		check("metadata.addr", err)
+	}
+	positive("metadata.interval", c.Metadata.Interval)
+	notNegative("metadata.max_staleness", c.Metadata.MaxStaleness)
+	if c.Metadata.ReadyIntervals < 1 {
+		check("metadata.ready_intervals", fmt.Errorf("must be at least 1, not %d", c.Metadata.ReadyIntervals))
+	}
+
+	names := make(map[string]int)
+	for i, e := range c.Environments {
+		field := fmt.Sprintf("environments[%d]", i)
+		separated := false
+		for _, kv := range e.settings() {
+			if strings.ContainsAny(kv[1], ",;") {
+				check(field+"."+kv[0], fmt.Errorf("must not contain , or ;"))
+				separated = true
+			}
+		}
+		if _, err := rancher.ParseEnvironments(e.spec(), rancher.Environment{}); err != nil && !separated {
+			check(field, err)
+		}
+		if e.MetadataInterval < 0 {
+			check(field+".metadata_interval", fmt.Errorf("must not be negative, not %s", e.MetadataInterval))
+		}
+		if e.APIURL != "" {
+			check(field+".api_url", validURL(e.APIURL, "http", "https"))
+		}
+		if e.APISecretKey != "" && e.APISecretKeyFile != "" {
+			check(field+".api_secret_key_file", fmt.Errorf("must not be given with api_secret_key"))
+		}
+		if j, ok := names[e.Name]; ok {
+			check(field+".name", fmt.Errorf("duplicates environments[%d]", j))
+		}
+		names[e.Name] = i
+	}
+
+	if len(c.Kafka.Brokers) > 0 {
+		for i, b := range c.Kafka.Brokers {
+			check(fmt.Sprintf("kafka.brokers[%d]", i), validAddr(b))
+		}
+		required("kafka.topic", c.Kafka.Topic)
+		if c.Kafka.Buffer < 1 {
+			check("kafka.buffer", fmt.Errorf("must be at least 1, not %d", c.Kafka.Buffer))
+		}
+	}
+
+	if c.AMQP.URL != "" {
+		check("amqp.url", validURL(c.AMQP.URL, "amqp", "amqps"))
+		required("amqp.queue", c.AMQP.Queue)
+	}
+
+	required("prometheus_sd.selector", c.PrometheusSD.Selector)
+	required("prometheus_sd.port_label", c.PrometheusSD.PortLabel)
+
+	if len(c.Proxy.Tokens) > 0 {
+		required("proxy.ports_label", c.Proxy.PortsLabel)
+	}
+
+	notNegative("probe.interval", c.Probe.Interval)
+	if c.Probe.Interval > 0 {
+		positive("probe.timeout", c.Probe.Timeout)
+		if c.Probe.Workers < 1 {
+			check("probe.workers", fmt.Errorf("must be at least 1, not %d", c.Probe.Workers))
+		}
+	}
+
+	if c.API.URL != "" {
+		check("api.url", validURL(c.API.URL, "http", "https"))
+	}
+	if c.API.SecretKey != "" && c.API.SecretKeyFile != "" {
+		check("api", fmt.Errorf("secret_key and secret_key_file must not be given together"))
+	} else if (c.API.AccessKey == "") != (c.API.SecretKey == "" && c.API.SecretKeyFile == "") {
+		check("api", fmt.Errorf("access_key and secret_key or secret_key_file must be given together"))
+	}
+	if c.API.SecretKeyFile != "" {
+		_, err := rancher.ReadSecretFile(c.API.SecretKeyFile)
+		check("api.secret_key_file", err)
+	}
+
+	positive("actions.timeout", c.Actions.Timeout)
+	positive("actions.poll_interval", c.Actions.PollInterval)
+	positive("actions.service_timeout", c.Actions.ServiceTimeout)
+
+	separated := false
+	for i, p := range c.ClientPolicies {
+		for _, kv := range p.settings() {
+			if strings.ContainsAny(kv[1], ",;") {
+				check(fmt.Sprintf("client_policies[%d].%s", i, kv[0]), fmt.Errorf("must not contain , or ;"))
+				separated = true
+			}
+		}
+	}
+	// Policies build on the default policy, so are validated together
+	if _, err := rancher.ParsePolicies(c.ClientPolicies.String(), rancher.DefaultPolicy); err != nil && !separated {
+		check("client_policies", err)
+	}
+
+	for field, v := range map[string]float64{
+		"rate_limit.read":                c.RateLimit.Read,
+		"rate_limit.read_burst":          float64(c.RateLimit.ReadBurst),
+		"rate_limit.read_concurrent":     float64(c.RateLimit.ReadConcurrent),
+		"rate_limit.mutating":            c.RateLimit.Mutating,
+		"rate_limit.mutating_burst":      float64(c.RateLimit.MutatingBurst),
+		"rate_limit.mutating_concurrent": float64(c.RateLimit.MutatingConcurrent),
+	} {
+		if v < 0 {
+			check(field, fmt.Errorf("must not be negative, not %v", v))
+		}
+	}
+
+	for field, v := range map[string]int{
+		"outbound.max_concurrent":  c.Outbound.MaxConcurrent,
+		"outbound.max_per_host":    c.Outbound.MaxPerHost,
+		"outbound.max_per_service": c.Outbound.MaxPerService,
+	} {
+		if v < 0 {
+			check(field, fmt.Errorf("must not be negative, not %d", v))
+		}
+	}
+	notNegative("outbound.max_wait", c.Outbound.MaxWait)
+
+	if len(errs) == 0 {
+		return nil
+	}
+	sort.SliceStable(errs, func(i, j int) bool { return errs[i].Field < errs[j].Field })
+	return errs
+}
+
+func validAddr(addr string) error {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("invalid address %q, expected host:port", addr)
+	}
+	if p, err := strconv.ParseUint(port, 10, 16); err != nil || (p == 0 && port != "0") {
+		return fmt.Errorf("invalid port %q in address %q", port, addr)
+	}
+	return nil
+}
+
+func validURL(s string, schemes ...string) error {
+	u, err := url.Parse(s)
+	if err != nil {
+		return fmt.Errorf("invalid URL %q", s)
+	}
+	if err := oneOf(u.Scheme, schemes...); err != nil {
+		return fmt.Errorf("invalid URL %q: scheme %v", s, err)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("invalid URL %q: no host", s)
+	}
+	return nil
+}
+
+func oneOf(v string, valid ...string) error {
+	for _, s := range valid {
+		if v == s {
+			return nil
+		}
+	}
+	return fmt.Errorf("must be one of %s, not %q", strings.Join(valid, ", "), v)
+}
+
+// CheckArgs returns an error if the command-line arguments give a secret,
+// which every user of the host could read from the process list. Secrets are
+// given by environment variable, the configuration file or a secret file
+// instead, e.g. API_SECRET_KEY or -api_secret_key_file.
+func CheckArgs(args []string) error {
+	for i := 0; i < len(args); i++ {
+		if args[i] == "--" {
+			break
+		}
+		name := strings.TrimLeft(args[i], "-")
+		if name == args[i] {
+			continue
+		}
+		value, inline := "", false
+		if j := strings.Index(name, "="); j >= 0 {
+			name, value, inline = name[:j], name[j+1:], true
+		}
+		switch name {
+		case "api_secret_key":
+			return fmt.Errorf("-api_secret_key must not be given on the command line; " +
+				"set API_SECRET_KEY, api.secret_key in the configuration file or -api_secret_key_file instead")
+		case "action_tokens":
+			return fmt.Errorf("-action_tokens must not be given on the command line; " +
+				"set ACTION_TOKENS or actions.tokens in the configuration file instead")
+		case "environments":
+			if !inline && i+1 < len(args) {
+				i++
+				value = args[i]
+			}
+			for _, spec := range strings.Split(value, ";") {
+				for _, setting := range strings.Split(spec, ",") {
+					if k := strings.SplitN(setting, "=", 2)[0]; strings.TrimSpace(k) == "api_secret_key" {
+						return fmt.Errorf("-environments must not give api_secret_key on the command line; " +
+							"give api_secret_key_file instead, or set ENVIRONMENTS or environments in the configuration file")
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// redacted replaces secrets when printing.
+const redacted = "REDACTED"
+
+// Redacted returns a copy of the configuration with its secrets redacted.
+func (c Config) Redacted() Config {
+	if c.API.SecretKey != "" {
+		c.API.SecretKey = redacted
+	}
+	if len(c.Proxy.Tokens) > 0 {
+		tokens := make(List, len(c.Proxy.Tokens))
+		for i := range tokens {
+			tokens[i] = redacted
+		}
+		c.Proxy.Tokens = tokens
+	}
+	if len(c.Actions.Tokens) > 0 {
+		tokens := make(List, len(c.Actions.Tokens))
+		for i := range tokens {
+			tokens[i] = redacted
+		}
+		c.Actions.Tokens = tokens
+	}
+	if u, err := url.Parse(c.AMQP.URL); err == nil && u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), redacted)
+			c.AMQP.URL = u.String()
+		}
+	}
+	envs := make(Environments, len(c.Environments))
+	for i, e := range c.Environments {
+		if e.APISecretKey != "" {
+			e.APISecretKey = redacted
+		}
+		envs[i] = e
+	}
+	c.Environments = envs
+	return c
+}
+
+// Print writes the configuration as YAML, with its secrets redacted.
+func Print(w io.Writer, c *Config) error {
+	b, err := yaml.Marshal(c.Redacted())
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
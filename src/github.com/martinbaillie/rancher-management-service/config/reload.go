@@ -0,0 +1,202 @@
+// Copyright 2017 Martin Baillie <martin.t.baillie@gmail.com>.
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file or at:
+// https://opensource.org/licenses/BSD-3-Clause
+
+package config
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/martinbaillie/rancher-management-service/rancher"
+)
+
+// reloadable are the settings, by path, that may change without a restart.
+var reloadable = map[string]bool{
+	"actions.tokens":                 true,
+	"api.access_key":                 true,
+	"api.secret_key":                 true,
+	"api.secret_key_file":            true,
+	"client_policies":                true,
+	"debug":                          true,
+	"http.cors_origins":              true,
+	"metadata.interval":              true,
+	"proxy.tokens":                   true,
+	"rate_limit.mutating":            true,
+	"rate_limit.mutating_burst":      true,
+	"rate_limit.mutating_concurrent": true,
+	"rate_limit.read":                true,
+	"rate_limit.read_burst":          true,
+	"rate_limit.read_concurrent":     true,
+}
+
+// reloadableEnvironment matches the settings of an environment that may
+// change without a restart.
+var reloadableEnvironment = regexp.MustCompile(`^environments\[\d+\]\.(metadata_interval|api_access_key|api_secret_key|api_secret_key_file)$`)
+
+// Changes returns the paths of the settings that differ between the
+// configurations, in schema order. Environments are compared setting by
+// setting, unless one was added or removed.
+func (c *Config) Changes(next *Config) []string {
+	var changes []string
+	nss := next.settings()
+	for i, s := range c.settings() {
+		if s.path == "environments" {
+			changes = append(changes, c.Environments.changes(next.Environments)...)
+			continue
+		}
+		if s.String() != nss[i].String() {
+			changes = append(changes, s.path)
+		}
+	}
+	return changes
+}
+
+func (es Environments) changes(next Environments) []string {
+	if len(es) != len(next) {
+		return []string{"environments"}
+	}
+	var changes []string
+	for i := range es {
+		nkvs := next[i].settings()
+		for j, kv := range es[i].settings() {
+			if kv[1] != nkvs[j][1] {
+				changes = append(changes, fmt.Sprintf("environments[%d].%s", i, kv[0]))
+			}
+		}
+	}
+	return changes
+}
+
+// Reloadable returns the settings changed by the next configuration, failing
+// should any of them require a restart. Enabling or disabling the proxy or
+// the actions, by adding their first or removing their last token, requires a
+// restart. So does changing the policies of client endpoints in a way that
+// cannot apply while running, see rancher.Policies.RequireRestart.
+func (c *Config) Reloadable(next *Config) ([]string, error) {
+	changes := c.Changes(next)
+	var restart []string
+	for _, path := range changes {
+		if !reloadable[path] && !reloadableEnvironment.MatchString(path) {
+			restart = append(restart, path)
+		}
+	}
+	if (len(c.Proxy.Tokens) == 0) != (len(next.Proxy.Tokens) == 0) {
+		restart = append(restart, "proxy.tokens")
+	}
+	if (len(c.Actions.Tokens) == 0) != (len(next.Actions.Tokens) == 0) {
+		restart = append(restart, "actions.tokens")
+	}
+	if ps, err := c.Policies(); err == nil {
+		if nps, err := next.Policies(); err == nil {
+			for _, command := range ps.RequireRestart(nps) {
+				restart = append(restart, "client_policies."+command)
+			}
+		}
+	}
+	if len(restart) > 0 {
+		return nil, fmt.Errorf("changed settings require a restart: %s", strings.Join(restart, ", "))
+	}
+	return changes, nil
+}
+
+// MetadataIntervals returns the metadata interval of each environment, by
+// name, defaulting to the metadata interval as rancher.ParseEnvironments does.
+func (c *Config) MetadataIntervals() map[string]time.Duration {
+	intervals := make(map[string]time.Duration)
+	if len(c.Environments) == 0 {
+		intervals[rancher.DefaultEnvironment] = time.Duration(c.Metadata.Interval)
+	}
+	for _, e := range c.Environments {
+		d := e.MetadataInterval
+		if d == 0 {
+			d = c.Metadata.Interval
+		}
+		intervals[e.Name] = time.Duration(d)
+	}
+	return intervals
+}
+
+// APIKeys returns the Rancher API key pair of each environment, by name,
+// reading any secret key files as main does.
+func (c *Config) APIKeys() (map[string]rancher.APIKeyPair, error) {
+	defaults := rancher.Environment{
+		Name:         rancher.DefaultEnvironment,
+		APIAccessKey: c.API.AccessKey,
+		APISecretKey: c.API.SecretKey,
+	}
+	if c.API.SecretKeyFile != "" {
+		var err error
+		if defaults.APISecretKey, err = rancher.ReadSecretFile(c.API.SecretKeyFile); err != nil {
+			return nil, err
+		}
+	}
+	envs, err := rancher.ParseEnvironments(c.Environments.String(), defaults)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]rancher.APIKeyPair)
+	for _, e := range envs {
+		keys[e.Name] = rancher.APIKeyPair{AccessKey: e.APIAccessKey, SecretKey: e.APISecretKey}
+	}
+	return keys, nil
+}
+
+// Policies returns the resilience policies of the client endpoints.
+func (c *Config) Policies() (rancher.Policies, error) {
+	return rancher.ParsePolicies(c.ClientPolicies.String(), rancher.DefaultPolicy)
+}
+
+// RateLimits returns the limits of each client's read and mutating requests.
+func (c *Config) RateLimits() (read, mutating rancher.RateLimit) {
+	read = rancher.RateLimit{
+		Rate:          c.RateLimit.Read,
+		Burst:         c.RateLimit.ReadBurst,
+		MaxConcurrent: c.RateLimit.ReadConcurrent,
+	}
+	mutating = rancher.RateLimit{
+		Rate:          c.RateLimit.Mutating,
+		Burst:         c.RateLimit.MutatingBurst,
+		MaxConcurrent: c.RateLimit.MutatingConcurrent,
+	}
+	return read, mutating
+}
+
+// Watch calls changed whenever the contents of the file at path change,
+// checking every interval until the context is cancelled. A file that cannot
+// be read is not a change, e.g. while it is being replaced.
+func Watch(ctx context.Context, path string, interval time.Duration, changed func()) {
+	sum := func() []byte {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil
+		}
+		s := sha256.Sum256(b)
+		return s[:]
+	}
+
+	last := sum()
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return
+		}
+		if s := sum(); s != nil && !bytes.Equal(s, last) {
+			last = s
+			changed()
+		}
+	}
+}
@@ -0,0 +1,155 @@
+// Copyright 2017 Martin Baillie <martin.t.baillie@gmail.com>.
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file or at:
+// https://opensource.org/licenses/BSD-3-Clause
+
+// Package health provides the project's health model.
+//
+// It distinguishes between:
+// - liveness, i.e. the process is up and able to serve HTTP at all.
+// - readiness, i.e. the service should be sent traffic. This is governed by
+// a shutdown flag and by the Checkers registered with the model.
+// - a detailed report of the status of each dependency.
+package health
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+// Health errors
+var (
+	ErrShuttingDown = errors.New("service is shutting down")
+	ErrDraining     = errors.New("service is draining")
+)
+
+// Status is the health status of the service or one of its dependencies.
+type Status string
+
+// Health statuses
+//
+// A degraded dependency is failing, but the service still copes without it,
+// e.g. by serving cached data.
+const (
+	StatusUp       Status = "UP"
+	StatusDegraded Status = "DEGRADED"
+	StatusDown     Status = "DOWN"
+)
+
+// Dependency describes the health of a single dependency.
+//
+// swagger:model healthDependency
+type Dependency struct {
+	// the name of the dependency
+	// required: true
+	// min: 1
+	Name string `json:"Name"`
+	// the status of the dependency
+	// required: true
+	// min: 1
+	Status Status `json:"Status"`
+	// dependency specific details e.g. circuit state or cache age
+	Details map[string]interface{} `json:"Details,omitempty"`
+}
+
+// Report describes the health of the service and all of its dependencies.
+//
+// swagger:model healthReport
+type Report struct {
+	// the overall status of the service
+	// required: true
+	// min: 1
+	Status Status `json:"Status"`
+	// whether the service is ready to receive traffic
+	// required: true
+	Ready bool `json:"Ready"`
+	// the status of each dependency
+	Dependencies []Dependency `json:"Dependencies"`
+}
+
+// Checker is implemented by anything able to report on the health of the
+// dependencies it integrates with.
+type Checker interface {
+	// Ready returns a non-nil error should the dependency be in a state that
+	// means the service ought not to receive traffic.
+	Ready() error
+	// Dependencies returns the detailed status of each dependency.
+	Dependencies() []Dependency
+}
+
+// Health is the project's health model.
+type Health struct {
+	shuttingDown int32
+	draining     int32
+	checkers     []Checker
+}
+
+// New creates a new instance of Health using the given Checkers.
+func New(checkers ...Checker) *Health {
+	return &Health{
+		checkers: checkers,
+	}
+}
+
+// ShuttingDown flips the model to not-ready, regardless of the state of its
+// Checkers. It should be called before draining in-flight requests.
+func (h *Health) ShuttingDown() {
+	atomic.StoreInt32(&h.shuttingDown, 1)
+}
+
+// SetDraining flips the model to not-ready while draining, regardless of the
+// state of its Checkers, so that traffic moves to other instances without
+// this one shutting down.
+func (h *Health) SetDraining(draining bool) {
+	var on int32
+	if draining {
+		on = 1
+	}
+	atomic.StoreInt32(&h.draining, on)
+}
+
+// Draining reports whether the model is draining.
+func (h *Health) Draining() bool {
+	return atomic.LoadInt32(&h.draining) == 1
+}
+
+// Ready returns a non-nil error if the service should not receive traffic.
+func (h *Health) Ready() error {
+	if atomic.LoadInt32(&h.shuttingDown) == 1 {
+		return ErrShuttingDown
+	}
+	if h.Draining() {
+		return ErrDraining
+	}
+	for _, c := range h.checkers {
+		if err := c.Ready(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Report returns a detailed report on the health of every dependency.
+// The overall status is down should any one dependency be down, otherwise
+// degraded should any one dependency be degraded.
+func (h *Health) Report() Report {
+	r := Report{
+		Status:       StatusUp,
+		Ready:        h.Ready() == nil,
+		Dependencies: []Dependency{},
+	}
+	for _, c := range h.checkers {
+		for _, d := range c.Dependencies() {
+			switch {
+			case d.Status == StatusDown:
+				r.Status = StatusDown
+			case d.Status == StatusDegraded && r.Status == StatusUp:
+				r.Status = StatusDegraded
+			}
+			r.Dependencies = append(r.Dependencies, d)
+		}
+	}
+	return r
+}
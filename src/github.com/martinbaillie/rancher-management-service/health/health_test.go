@@ -0,0 +1,186 @@
+// Copyright 2017 Martin Baillie <martin.t.baillie@gmail.com>.
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file or at:
+// https://opensource.org/licenses/BSD-3-Clause
+package health
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var errNotReady = errors.New("not ready")
+
+type stubChecker struct {
+	ready        error
+	dependencies []Dependency
+}
+
+func (c stubChecker) Ready() error               { return c.ready }
+func (c stubChecker) Dependencies() []Dependency { return c.dependencies }
+
+type HandlerTestAssertion struct {
+	description    string
+	checker        stubChecker
+	shuttingDown   bool
+	draining       bool
+	handler        func(HTTPHandlers) http.Handler
+	expectedStatus int
+	expectedBody   Status
+}
+
+var (
+	up   = stubChecker{dependencies: []Dependency{{Name: "up", Status: StatusUp}}}
+	down = stubChecker{ready: errNotReady, dependencies: []Dependency{{Name: "down", Status: StatusDown}}}
+
+	degraded = stubChecker{dependencies: []Dependency{{Name: "degraded", Status: StatusDegraded}}}
+
+	liveness  = func(hhs HTTPHandlers) http.Handler { return hhs.Liveness }
+	readiness = func(hhs HTTPHandlers) http.Handler { return hhs.Readiness }
+	report    = func(hhs HTTPHandlers) http.Handler { return hhs.Report }
+)
+
+func TestHandlers(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, tc := range []HandlerTestAssertion{
+		{
+			description:    "Liveness success",
+			checker:        up,
+			handler:        liveness,
+			expectedStatus: http.StatusOK,
+			expectedBody:   StatusUp,
+		},
+		{
+			description:    "Liveness success, despite failing dependency",
+			checker:        down,
+			handler:        liveness,
+			expectedStatus: http.StatusOK,
+			expectedBody:   StatusUp,
+		},
+		{
+			description:    "Readiness success",
+			checker:        up,
+			handler:        readiness,
+			expectedStatus: http.StatusOK,
+			expectedBody:   StatusUp,
+		},
+		{
+			description:    "Readiness failure, dependency not ready",
+			checker:        down,
+			handler:        readiness,
+			expectedStatus: http.StatusServiceUnavailable,
+			expectedBody:   StatusDown,
+		},
+		{
+			description:    "Readiness failure, shutting down",
+			checker:        up,
+			shuttingDown:   true,
+			handler:        readiness,
+			expectedStatus: http.StatusServiceUnavailable,
+			expectedBody:   StatusDown,
+		},
+		{
+			description:    "Readiness failure, draining",
+			checker:        up,
+			draining:       true,
+			handler:        readiness,
+			expectedStatus: http.StatusServiceUnavailable,
+			expectedBody:   StatusDown,
+		},
+		{
+			description:    "Liveness success, despite draining",
+			checker:        up,
+			draining:       true,
+			handler:        liveness,
+			expectedStatus: http.StatusOK,
+			expectedBody:   StatusUp,
+		},
+		{
+			description:    "Report success",
+			checker:        up,
+			handler:        report,
+			expectedStatus: http.StatusOK,
+			expectedBody:   StatusUp,
+		},
+		{
+			description:    "Report success, dependency degraded",
+			checker:        degraded,
+			handler:        report,
+			expectedStatus: http.StatusOK,
+			expectedBody:   StatusDegraded,
+		},
+		{
+			description:    "Report failure, dependency down",
+			checker:        down,
+			handler:        report,
+			expectedStatus: http.StatusServiceUnavailable,
+			expectedBody:   StatusDown,
+		},
+	} {
+		h := New(tc.checker)
+		if tc.shuttingDown {
+			h.ShuttingDown()
+		}
+		h.SetDraining(tc.draining)
+
+		w := httptest.NewRecorder()
+		tc.handler(MakeHTTPHandlers(h)).ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+
+		var body struct{ Status Status }
+		json.NewDecoder(w.Body).Decode(&body)
+
+		assert.Equal(tc.expectedStatus, w.Code, tc.description)
+		assert.Equal(tc.expectedBody, body.Status, tc.description)
+	}
+}
+
+func TestReport(t *testing.T) {
+	assert := assert.New(t)
+
+	r := New(up, down).Report()
+	assert.Equal(StatusDown, r.Status, "Report() aggregates status")
+	assert.Equal(false, r.Ready, "Report() aggregates readiness")
+	assert.Equal(append(up.dependencies, down.dependencies...), r.Dependencies, "Report() aggregates dependencies")
+
+	assert.Equal(StatusDegraded, New(up, degraded).Report().Status, "Report() degraded")
+	assert.Equal(StatusDown, New(degraded, down).Report().Status, "Report() down outweighs degraded")
+}
+
+func TestDrain(t *testing.T) {
+	assert := assert.New(t)
+
+	h := New(up)
+	drain := MakeHTTPHandlers(h).Drain
+
+	for _, tc := range []struct {
+		description      string
+		body             string
+		expectedStatus   int
+		expectedDraining bool
+	}{
+		{"Drain", `{"Draining":true}`, http.StatusOK, true},
+		{"Drain, missing draining", `{}`, http.StatusBadRequest, true},
+		{"Drain, malformed", `{`, http.StatusBadRequest, true},
+		{"Stop draining", `{"Draining":false}`, http.StatusOK, false},
+	} {
+		w := httptest.NewRecorder()
+		drain.ServeHTTP(w, httptest.NewRequest("PUT", "/drain", strings.NewReader(tc.body)))
+
+		var body struct{ Draining bool }
+		json.NewDecoder(w.Body).Decode(&body)
+
+		assert.Equal(tc.expectedStatus, w.Code, tc.description)
+		assert.Equal(tc.expectedDraining, body.Draining, tc.description)
+		assert.Equal(tc.expectedDraining, h.Draining(), tc.description)
+		assert.Equal(tc.expectedDraining, h.Ready() == ErrDraining, tc.description)
+	}
+}
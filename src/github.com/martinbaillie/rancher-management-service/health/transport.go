@@ -0,0 +1,161 @@
+// Copyright 2017 Martin Baillie <martin.t.baillie@gmail.com>.
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file or at:
+// https://opensource.org/licenses/BSD-3-Clause
+
+package health
+
+// This file provides server-side bindings for the HTTP transport.
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// HTTPHandlers is a holder for the health package's HTTP handlers.
+type HTTPHandlers struct {
+	Liveness  http.Handler
+	Readiness http.Handler
+	Report    http.Handler
+	Drain     http.Handler
+}
+
+// probeResponse A liveness or readiness probe response model.
+//
+// swagger:response probeResponse
+type probeResponse struct {
+	// in: body
+	Status Status `json:"Status"`
+	// in: body
+	Error string `json:"Error,omitempty"`
+}
+
+// reportResponse A detailed health report response model.
+//
+// swagger:response reportResponse
+type reportResponse struct {
+	// in: body
+	Report Report
+}
+
+// drainRequest A drain parameter model.
+//
+// swagger:parameters drain
+type drainRequest struct {
+	// Whether the service should drain, or stop draining
+	//
+	// in: body
+	// required: true
+	Draining *bool `json:"Draining"`
+}
+
+// drainResponse A drain response model.
+//
+// swagger:response drainResponse
+type drainResponse struct {
+	// in: body
+	Draining bool `json:"Draining"`
+	// in: body
+	Error string `json:"Error,omitempty"`
+}
+
+// MakeHTTPHandlers creates a new instance of HTTPHandlers.
+func MakeHTTPHandlers(h *Health) HTTPHandlers {
+	return HTTPHandlers{
+		// Liveness swagger:route GET /healthz health liveness
+		//
+		// Report whether the service is alive
+		//
+		// Produces:
+		// - application/json
+		//
+		// Schemes: http, https
+		//
+		// Responses:
+		//	200: probeResponse
+		Liveness: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			encodeHTTPResponse(w, http.StatusOK, probeResponse{Status: StatusUp})
+		}),
+
+		// Readiness swagger:route GET /readyz health readiness
+		//
+		// Report whether the service is ready to receive traffic
+		//
+		// Produces:
+		// - application/json
+		//
+		// Schemes: http, https
+		//
+		// Responses:
+		//	200: probeResponse
+		//	503: probeResponse
+		Readiness: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if err := h.Ready(); err != nil {
+				encodeHTTPResponse(w, http.StatusServiceUnavailable, probeResponse{
+					Status: StatusDown,
+					Error:  err.Error(),
+				})
+				return
+			}
+			encodeHTTPResponse(w, http.StatusOK, probeResponse{Status: StatusUp})
+		}),
+
+		// Report swagger:route GET /health health report
+		//
+		// Get a detailed report on the health of every dependency
+		//
+		// Produces:
+		// - application/json
+		//
+		// Schemes: http, https
+		//
+		// Responses:
+		//	200: reportResponse
+		//	503: reportResponse
+		Report: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			report := h.Report()
+			status := http.StatusOK
+			if report.Status == StatusDown {
+				status = http.StatusServiceUnavailable
+			}
+			encodeHTTPResponse(w, status, report)
+		}),
+
+		// Drain swagger:route PUT /drain health drain
+		//
+		// Drain the service, reporting it not ready until it stops draining
+		//
+		// Consumes:
+		// - application/json
+		//
+		// Produces:
+		// - application/json
+		//
+		// Schemes: http, https
+		//
+		// Responses:
+		//	200: drainResponse
+		//	400: drainResponse
+		Drain: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var req drainRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Draining == nil {
+				encodeHTTPResponse(w, http.StatusBadRequest, drainResponse{
+					Draining: h.Draining(),
+					Error:    "Draining must be given",
+				})
+				return
+			}
+			h.SetDraining(*req.Draining)
+			encodeHTTPResponse(w, http.StatusOK, drainResponse{Draining: h.Draining()})
+		}),
+	}
+}
+
+func encodeHTTPResponse(w http.ResponseWriter, status int, response interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
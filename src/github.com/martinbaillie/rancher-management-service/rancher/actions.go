@@ -0,0 +1,219 @@
+// Copyright 2017 Martin Baillie <martin.t.baillie@gmail.com>.
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file or at:
+// https://opensource.org/licenses/BSD-3-Clause
+
+package rancher
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/tracing/opentracing"
+
+	stdopentracing "github.com/opentracing/opentracing-go"
+)
+
+// Container action errors
+var (
+	ErrContainerActionUnknown     = errors.New("unknown container action")
+	ErrContainerActionUnavailable = errors.New("container action unavailable in its current state")
+	ErrContainerActionTimeout     = errors.New("timed out waiting for container to transition")
+)
+
+// Container actions
+const (
+	ContainerRestart = "restart"
+	ContainerStop    = "stop"
+	ContainerStart   = "start"
+)
+
+// ContainerTransitionError is returned when Rancher fails to transition a
+// container after an action.
+type ContainerTransitionError struct {
+	State   string
+	Message string
+}
+
+func (e *ContainerTransitionError) Error() string {
+	return "container transition failed in state " + e.State + ": " + e.Message
+}
+
+// ContainerActionResult is the outcome of an action upon a container.
+//
+// swagger:model containerActionResult
+type ContainerActionResult struct {
+	// the name of the container in Rancher
+	// required: true
+	Name string `json:"Name"`
+	// the Rancher API ID of the container
+	// required: true
+	ID string `json:"ID"`
+	// the action taken
+	// required: true
+	Action string `json:"Action"`
+	// the Rancher state of the container once it stopped transitioning
+	// required: true
+	State string `json:"State"`
+}
+
+// ActionConfig describes how the completion of actions is awaited.
+type ActionConfig struct {
+	// the duration between checks on a transitioning container
+	PollInterval time.Duration
+	// the duration after which an action is no longer awaited
+	Timeout time.Duration
+	// the duration after which an action upon a service is no longer tracked
+	ServiceTimeout time.Duration
+}
+
+// ActionService acts upon the containers and services of an environment
+// through the Rancher API, as the metadata service is read-only.
+type ActionService interface {
+	ContainerAction(ctx context.Context, name, action string) (*ContainerActionResult, error)
+	ScaleService(ctx context.Context, stack, service string, scale int) (*ServiceProgress, error)
+	UpgradeService(ctx context.Context, stack, service string, u UpgradeStrategy) (*ServiceProgress, error)
+	ServiceAction(ctx context.Context, stack, service, id string) (*ServiceProgress, error)
+}
+
+// NewActionService creates a new instance of ActionService, resolving
+// containers by name from the Repository and acting upon them with the
+// ClientService. Actions upon services are tracked in the background until
+// the context is cancelled.
+func NewActionService(ctx context.Context, r Repository, c ClientService, cfg ActionConfig) ActionService {
+	return &actionService{
+		ctx:        ctx,
+		repository: r,
+		client:     c,
+		cfg:        cfg,
+		actions:    &serviceActions{progress: make(map[string]*ServiceProgress)},
+	}
+}
+
+type actionService struct {
+	ctx        context.Context
+	repository Repository
+	client     ClientService
+	cfg        ActionConfig
+	actions    *serviceActions
+}
+
+// ContainerAction implements ActionService.
+// It requests the action of the Rancher API and polls the container until it
+// has finished transitioning.
+func (s actionService) ContainerAction(ctx context.Context, name, action string) (*ContainerActionResult, error) {
+	switch action {
+	case ContainerRestart, ContainerStop, ContainerStart:
+	default:
+		return nil, ErrContainerActionUnknown
+	}
+
+	c, err := s.repository.ContainerByName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, s.cfg.Timeout)
+	defer cancel()
+
+	ac, err := s.client.APIContainer(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := ac.Actions[action]; !ok {
+		return nil, ErrContainerActionUnavailable
+	}
+
+	id := ac.ID
+	if ac, err = s.client.APIContainerAction(ctx, id, action); err != nil {
+		return nil, err
+	}
+
+	t := time.NewTicker(s.cfg.PollInterval)
+	defer t.Stop()
+	for ac.transitioning() {
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return nil, ErrContainerActionTimeout
+		}
+		if ac, err = s.client.APIContainerByID(ctx, id); err != nil {
+			if ctx.Err() != nil {
+				return nil, ErrContainerActionTimeout
+			}
+			return nil, err
+		}
+	}
+	if ac.Transitioning == "error" {
+		return nil, &ContainerTransitionError{State: ac.State, Message: ac.TransitioningMessage}
+	}
+
+	return &ContainerActionResult{
+		Name:   name,
+		ID:     id,
+		Action: action,
+		State:  ac.State,
+	}, nil
+}
+
+// ActionEndpoints holds the endpoints acting upon containers and services,
+// for transports other than HTTP. An endpoint that is nil is not served.
+type ActionEndpoints struct {
+	ContainerActionEndpoint endpoint.Endpoint
+	ServiceScaleEndpoint    endpoint.Endpoint
+	ServiceUpgradeEndpoint  endpoint.Endpoint
+}
+
+// NewContainerActionEndpoint creates an endpoint acting upon containers with
+// the ActionService, decorated with tracing.
+func NewContainerActionEndpoint(s ActionService, t stdopentracing.Tracer) endpoint.Endpoint {
+	return opentracing.TraceServer(t, "rancher-container-action-endpoint")(ContainerActionEndpoint(s))
+}
+
+// containerActionRequest A container action parameter model.
+//
+// Used for identifying the container and the action to take.
+//
+// swagger:parameters containerAction
+type containerActionRequest struct {
+	// The name of the container
+	//
+	// in: path
+	// required: true
+	Name string
+	// The action to take, one of restart, stop or start
+	//
+	// in: path
+	// required: true
+	Action string
+}
+
+// containerActionResponse A container action response model.
+//
+// Used for returning the outcome of an action upon a container.
+//
+// swagger:response containerActionResponse
+type containerActionResponse struct {
+	// in: body
+	Result *ContainerActionResult `json:"Result,omitempty"`
+	// in: body
+	Err error `json:"Error,omitempty"`
+}
+
+func (r containerActionResponse) error() error { return r.Err }
+
+// ContainerActionEndpoint acts upon a container with the ActionService.
+func ContainerActionEndpoint(s ActionService) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(containerActionRequest)
+		res, err := s.ContainerAction(ctx, req.Name, req.Action)
+		return containerActionResponse{
+			Result: res,
+			Err:    err,
+		}, nil
+	}
+}
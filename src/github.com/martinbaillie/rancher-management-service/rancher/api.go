@@ -0,0 +1,468 @@
+// Copyright 2017 Martin Baillie <martin.t.baillie@gmail.com>.
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file or at:
+// https://opensource.org/licenses/BSD-3-Clause
+
+package rancher
+
+// This file provides client-side bindings for the Rancher (Cattle v2-beta)
+// API, which unlike the metadata service can act upon containers and
+// services.
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+
+	"github.com/go-kit/kit/endpoint"
+
+	kithttp "github.com/go-kit/kit/transport/http"
+)
+
+// Rancher API errors
+var (
+	ErrAPINotConfigured     = errors.New("rancher API is not configured")
+	ErrAPIContainerNotFound = errors.New("container not found in rancher API")
+	ErrAPIServiceNotFound   = errors.New("service not found in rancher API")
+)
+
+// APIError is an error returned by the Rancher API.
+type APIError struct {
+	Status  int    `json:"status"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *APIError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("rancher API: %d %s", e.Status, e.Code)
+	}
+	return fmt.Sprintf("rancher API: %d %s: %s", e.Status, e.Code, e.Message)
+}
+
+// APIContainer is a Rancher API container resource, as far as this service
+// is concerned.
+type APIContainer struct {
+	// the Rancher API ID of the container, e.g. 1i123
+	ID string `json:"id"`
+	// the uuid of the container, as found in the metadata service
+	UUID string `json:"uuid"`
+	// the Docker ID of the container, as found in the metadata service
+	ExternalID string `json:"externalId"`
+	// the current Rancher state of the container
+	State string `json:"state"`
+	// one of yes, no or error while the container is changing state
+	Transitioning string `json:"transitioning"`
+	// why a transition failed
+	TransitioningMessage string `json:"transitioningMessage"`
+	// the actions currently available, by name
+	Actions map[string]string `json:"actions"`
+}
+
+// transitioning reports whether the container is still changing state.
+func (c *APIContainer) transitioning() bool {
+	return c.Transitioning == "yes"
+}
+
+// APIStack is a Rancher API stack resource, as far as this service is
+// concerned.
+type APIStack struct {
+	// the Rancher API ID of the stack, e.g. 1st12
+	ID string `json:"id"`
+	// the name of the stack
+	Name string `json:"name"`
+	// the current Rancher state of the stack
+	State string `json:"state"`
+}
+
+// APIService is a Rancher API service resource, as far as this service is
+// concerned.
+type APIService struct {
+	// the Rancher API ID of the service, e.g. 1s34
+	ID string `json:"id"`
+	// the name of the service
+	Name string `json:"name"`
+	// the Rancher API ID of the service's stack
+	StackID string `json:"stackId"`
+	// the current Rancher state of the service, e.g. active or upgraded
+	State string `json:"state"`
+	// one of yes, no or error while the service is changing state
+	Transitioning string `json:"transitioning"`
+	// why a transition failed
+	TransitioningMessage string `json:"transitioningMessage"`
+	// the number of containers the service is scaled to, unless global
+	Scale int `json:"scale"`
+	// the actions currently available, by name
+	Actions map[string]string `json:"actions"`
+	// the launch configs of the service and its sidekicks, passed back to
+	// Rancher untouched when upgrading
+	LaunchConfig           map[string]interface{}   `json:"launchConfig"`
+	SecondaryLaunchConfigs []map[string]interface{} `json:"secondaryLaunchConfigs"`
+}
+
+// transitioning reports whether the service is still changing state.
+func (s *APIService) transitioning() bool {
+	return s.Transitioning == "yes"
+}
+
+// Rancher API collections
+const (
+	apiContainers = "containers"
+	apiStacks     = "stacks"
+	apiServices   = "services"
+)
+
+type apiListRequest struct {
+	Filter url.Values
+}
+
+type apiGetRequest struct {
+	ID string
+}
+
+type apiActionRequest struct {
+	ID     string
+	Action string
+	// the action's input, if any
+	Input interface{}
+}
+
+type apiUpdateRequest struct {
+	ID    string
+	Input interface{}
+}
+
+type apiContainersResponse struct {
+	Containers []*APIContainer `json:"data"`
+	Err        error           `json:"-"`
+}
+
+type apiContainerResponse struct {
+	Container *APIContainer
+	Err       error
+}
+
+type apiStacksResponse struct {
+	Stacks []*APIStack `json:"data"`
+	Err    error       `json:"-"`
+}
+
+type apiServicesResponse struct {
+	Services []*APIService `json:"data"`
+	Err      error         `json:"-"`
+}
+
+type apiServiceResponse struct {
+	Service *APIService
+	Err     error
+}
+
+// apiServiceUpgrade is the input of a service's upgrade action.
+type apiServiceUpgrade struct {
+	InServiceStrategy apiInServiceStrategy `json:"inServiceStrategy"`
+}
+
+type apiInServiceStrategy struct {
+	BatchSize              int                      `json:"batchSize"`
+	IntervalMillis         int64                    `json:"intervalMillis"`
+	StartFirst             bool                     `json:"startFirst"`
+	LaunchConfig           map[string]interface{}   `json:"launchConfig,omitempty"`
+	SecondaryLaunchConfigs []map[string]interface{} `json:"secondaryLaunchConfigs,omitempty"`
+}
+
+// apiServiceScale is the input of a service update changing its scale.
+type apiServiceScale struct {
+	Scale int `json:"scale"`
+}
+
+// APIKeyPair is a Rancher API key pair.
+type APIKeyPair struct {
+	AccessKey string
+	SecretKey string
+}
+
+// APIKeys holds an environment's API key pair, so that it may be rotated
+// while running, see NewClientEndpoints.
+type APIKeys struct {
+	v atomic.Value
+}
+
+// newAPIKeys holds the key pair.
+func newAPIKeys(keys APIKeyPair) *APIKeys {
+	k := new(APIKeys)
+	k.v.Store(keys)
+	return k
+}
+
+// SetKeys authenticates the environment's API requests with the key pair from
+// the next request.
+func (k *APIKeys) SetKeys(keys APIKeyPair) {
+	k.v.Store(keys)
+}
+
+// apiBasicAuth authenticates requests with the environment's current API
+// key pair.
+func apiBasicAuth(keys *APIKeys) kithttp.RequestFunc {
+	return func(ctx context.Context, r *http.Request) context.Context {
+		k := keys.v.Load().(APIKeyPair)
+		r.SetBasicAuth(k.AccessKey, k.SecretKey)
+		return ctx
+	}
+}
+
+// APIContainersEndpoint implements ClientService.
+// This endpoint is used as part of a client interaction.
+func APIContainersEndpoint(ctx context.Context, apiURL *url.URL, options ...kithttp.ClientOption) endpoint.Endpoint {
+	return kithttp.NewClient(
+		"GET", apiURL,
+		encodeAPIListRequest(apiContainers),
+		decodeAPIContainersResponse,
+		options...,
+	).Endpoint()
+}
+
+// APIContainerEndpoint implements ClientService.
+// This endpoint is used as part of a client interaction.
+func APIContainerEndpoint(ctx context.Context, apiURL *url.URL, options ...kithttp.ClientOption) endpoint.Endpoint {
+	return kithttp.NewClient(
+		"GET", apiURL,
+		encodeAPIGetRequest(apiContainers),
+		decodeAPIContainerResponse,
+		options...,
+	).Endpoint()
+}
+
+// APIContainerActionEndpoint implements ClientService.
+// This endpoint is used as part of a client interaction.
+func APIContainerActionEndpoint(ctx context.Context, apiURL *url.URL, options ...kithttp.ClientOption) endpoint.Endpoint {
+	return kithttp.NewClient(
+		"POST", apiURL,
+		encodeAPIActionRequest(apiContainers),
+		decodeAPIContainerResponse,
+		options...,
+	).Endpoint()
+}
+
+// APIStacksEndpoint implements ClientService.
+// This endpoint is used as part of a client interaction.
+func APIStacksEndpoint(ctx context.Context, apiURL *url.URL, options ...kithttp.ClientOption) endpoint.Endpoint {
+	return kithttp.NewClient(
+		"GET", apiURL,
+		encodeAPIListRequest(apiStacks),
+		decodeAPIStacksResponse,
+		options...,
+	).Endpoint()
+}
+
+// APIServicesEndpoint implements ClientService.
+// This endpoint is used as part of a client interaction.
+func APIServicesEndpoint(ctx context.Context, apiURL *url.URL, options ...kithttp.ClientOption) endpoint.Endpoint {
+	return kithttp.NewClient(
+		"GET", apiURL,
+		encodeAPIListRequest(apiServices),
+		decodeAPIServicesResponse,
+		options...,
+	).Endpoint()
+}
+
+// APIServiceEndpoint implements ClientService.
+// This endpoint is used as part of a client interaction.
+func APIServiceEndpoint(ctx context.Context, apiURL *url.URL, options ...kithttp.ClientOption) endpoint.Endpoint {
+	return kithttp.NewClient(
+		"GET", apiURL,
+		encodeAPIGetRequest(apiServices),
+		decodeAPIServiceResponse,
+		options...,
+	).Endpoint()
+}
+
+// APIServiceUpdateEndpoint implements ClientService.
+// This endpoint is used as part of a client interaction.
+func APIServiceUpdateEndpoint(ctx context.Context, apiURL *url.URL, options ...kithttp.ClientOption) endpoint.Endpoint {
+	return kithttp.NewClient(
+		"PUT", apiURL,
+		encodeAPIUpdateRequest(apiServices),
+		decodeAPIServiceResponse,
+		options...,
+	).Endpoint()
+}
+
+// APIServiceActionEndpoint implements ClientService.
+// This endpoint is used as part of a client interaction.
+func APIServiceActionEndpoint(ctx context.Context, apiURL *url.URL, options ...kithttp.ClientOption) endpoint.Endpoint {
+	return kithttp.NewClient(
+		"POST", apiURL,
+		encodeAPIActionRequest(apiServices),
+		decodeAPIServiceResponse,
+		options...,
+	).Endpoint()
+}
+
+// encodeAPIListRequest lists the collection, filtered, e.g.
+// <API URL>/containers?uuid=<uuid>
+func encodeAPIListRequest(collection string) kithttp.EncodeRequestFunc {
+	return func(_ context.Context, r *http.Request, request interface{}) error {
+		req := request.(apiListRequest)
+		r.Header.Set("Accept", "application/json")
+		r.URL.Path = strings.TrimSuffix(r.URL.Path, "/") + "/" + collection
+		r.URL.RawQuery = req.Filter.Encode()
+		return nil
+	}
+}
+
+// encodeAPIGetRequest gets a resource of the collection by ID, e.g.
+// <API URL>/containers/<id>
+func encodeAPIGetRequest(collection string) kithttp.EncodeRequestFunc {
+	return func(_ context.Context, r *http.Request, request interface{}) error {
+		req := request.(apiGetRequest)
+		r.Header.Set("Accept", "application/json")
+		r.URL.Path = strings.TrimSuffix(r.URL.Path, "/") + "/" + collection + "/" + url.PathEscape(req.ID)
+		return nil
+	}
+}
+
+// encodeAPIActionRequest requests an action upon a resource of the
+// collection, e.g. POST <API URL>/containers/<id>?action=<action>
+func encodeAPIActionRequest(collection string) kithttp.EncodeRequestFunc {
+	return func(_ context.Context, r *http.Request, request interface{}) error {
+		req := request.(apiActionRequest)
+		r.Header.Set("Accept", "application/json")
+		r.URL.Path = strings.TrimSuffix(r.URL.Path, "/") + "/" + collection + "/" + url.PathEscape(req.ID)
+		r.URL.RawQuery = url.Values{"action": {req.Action}}.Encode()
+
+		// Actions without input have sensible defaults
+		input := req.Input
+		if input == nil {
+			input = struct{}{}
+		}
+		return encodeAPIBody(r, input)
+	}
+}
+
+// encodeAPIUpdateRequest updates a resource of the collection, e.g.
+// PUT <API URL>/services/<id>
+func encodeAPIUpdateRequest(collection string) kithttp.EncodeRequestFunc {
+	return func(_ context.Context, r *http.Request, request interface{}) error {
+		req := request.(apiUpdateRequest)
+		r.Header.Set("Accept", "application/json")
+		r.URL.Path = strings.TrimSuffix(r.URL.Path, "/") + "/" + collection + "/" + url.PathEscape(req.ID)
+		return encodeAPIBody(r, req.Input)
+	}
+}
+
+func encodeAPIBody(r *http.Request, input interface{}) error {
+	body, err := json.Marshal(input)
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Content-Type", "application/json")
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	return nil
+}
+
+// decodeAPIError decodes the Rancher API's error body. Client errors are
+// returned in the response, so as not to trip circuit breakers, while server
+// errors are returned outright.
+func decodeAPIError(resp *http.Response) (*APIError, error) {
+	e := &APIError{Status: resp.StatusCode}
+	json.NewDecoder(resp.Body).Decode(e)
+	e.Status = resp.StatusCode
+	if e.Code == "" {
+		e.Code = http.StatusText(resp.StatusCode)
+	}
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return nil, e
+	}
+	return e, nil
+}
+
+func decodeAPIContainersResponse(_ context.Context, resp *http.Response) (interface{}, error) {
+	if resp.StatusCode != http.StatusOK {
+		e, err := decodeAPIError(resp)
+		if err != nil {
+			return nil, err
+		}
+		return apiContainersResponse{Err: e}, nil
+	}
+	var response apiContainersResponse
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+func decodeAPIContainerResponse(_ context.Context, resp *http.Response) (interface{}, error) {
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		e, err := decodeAPIError(resp)
+		if err != nil {
+			return nil, err
+		}
+		if e.Status == http.StatusNotFound {
+			return apiContainerResponse{Err: ErrAPIContainerNotFound}, nil
+		}
+		return apiContainerResponse{Err: e}, nil
+	}
+	var response apiContainerResponse
+	if err := json.NewDecoder(resp.Body).Decode(&response.Container); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+func decodeAPIStacksResponse(_ context.Context, resp *http.Response) (interface{}, error) {
+	if resp.StatusCode != http.StatusOK {
+		e, err := decodeAPIError(resp)
+		if err != nil {
+			return nil, err
+		}
+		return apiStacksResponse{Err: e}, nil
+	}
+	var response apiStacksResponse
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+func decodeAPIServicesResponse(_ context.Context, resp *http.Response) (interface{}, error) {
+	if resp.StatusCode != http.StatusOK {
+		e, err := decodeAPIError(resp)
+		if err != nil {
+			return nil, err
+		}
+		return apiServicesResponse{Err: e}, nil
+	}
+	var response apiServicesResponse
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+func decodeAPIServiceResponse(_ context.Context, resp *http.Response) (interface{}, error) {
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		e, err := decodeAPIError(resp)
+		if err != nil {
+			return nil, err
+		}
+		if e.Status == http.StatusNotFound {
+			return apiServiceResponse{Err: ErrAPIServiceNotFound}, nil
+		}
+		return apiServiceResponse{Err: e}, nil
+	}
+	var response apiServiceResponse
+	if err := json.NewDecoder(resp.Body).Decode(&response.Service); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
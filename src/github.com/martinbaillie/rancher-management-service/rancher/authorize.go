@@ -0,0 +1,102 @@
+// Copyright 2017 Martin Baillie <martin.t.baillie@gmail.com>.
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file or at:
+// https://opensource.org/licenses/BSD-3-Clause
+
+package rancher
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/go-kit/kit/endpoint"
+)
+
+// ErrActionUnauthorized is returned when an action is requested without one
+// of the action tokens.
+var ErrActionUnauthorized = errors.New("action authorization required")
+
+const (
+	actionAuthorizationHeader = "Authorization"
+	actionAuthenticate        = `Bearer realm="rancher-management-service"`
+)
+
+// ActionAuthorizer allows actions upon containers and services only to
+// requests carrying one of its bearer tokens. It implements
+// ProxyTokensSetter, so that the tokens may change while running.
+type ActionAuthorizer struct {
+	mtx    sync.RWMutex
+	tokens []string
+}
+
+// NewActionAuthorizer returns an authorizer allowing the bearer tokens.
+func NewActionAuthorizer(tokens []string) *ActionAuthorizer {
+	return &ActionAuthorizer{tokens: tokens}
+}
+
+// SetTokens implements ProxyTokensSetter.
+func (a *ActionAuthorizer) SetTokens(tokens []string) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	a.tokens = tokens
+}
+
+// Authorized returns an endpoint middleware failing with
+// ErrActionUnauthorized unless the bearer token noted in the context by
+// PopulateBearerToken is one of the authorizer's.
+func Authorized(a *ActionAuthorizer) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			if !a.allows(bearerTokenFromContext(ctx)) {
+				return nil, ErrActionUnauthorized
+			}
+			return next(ctx, request)
+		}
+	}
+}
+
+// AuthorizedHandler returns a handler serving only the requests carrying one
+// of the authorizer's bearer tokens, for handlers that are not endpoints.
+func AuthorizedHandler(a *ActionAuthorizer, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := PopulateBearerToken(r.Context(), r)
+		if !a.allows(bearerTokenFromContext(ctx)) {
+			encodeHTTPError(ctx, ErrActionUnauthorized, w)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// allows reports whether the bearer token is one of the authorizer's.
+func (a *ActionAuthorizer) allows(token string) bool {
+	a.mtx.RLock()
+	tokens := a.tokens
+	a.mtx.RUnlock()
+
+	return tokenAllowed(token, tokens)
+}
+
+type bearerTokenKey struct{}
+
+// PopulateBearerToken is a RequestFunc noting the bearer token of the
+// request's Authorization header in the context, for the Authorized
+// middleware.
+func PopulateBearerToken(ctx context.Context, r *http.Request) context.Context {
+	auth := r.Header.Get(actionAuthorizationHeader)
+	if !strings.HasPrefix(auth, proxyAuthorizationBearer) {
+		return ctx
+	}
+	return context.WithValue(ctx, bearerTokenKey{}, strings.TrimPrefix(auth, proxyAuthorizationBearer))
+}
+
+func bearerTokenFromContext(ctx context.Context) string {
+	token, _ := ctx.Value(bearerTokenKey{}).(string)
+	return token
+}
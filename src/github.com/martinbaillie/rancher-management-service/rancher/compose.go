@@ -0,0 +1,293 @@
+// Copyright 2017 Martin Baillie <martin.t.baillie@gmail.com>.
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file or at:
+// https://opensource.org/licenses/BSD-3-Clause
+
+package rancher
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/tracing/opentracing"
+	"gopkg.in/yaml.v2"
+
+	stdopentracing "github.com/opentracing/opentracing-go"
+)
+
+// Export errors
+var (
+	ErrStackNotFound           = errors.New("stack not found")
+	ErrExportFormatUnsupported = errors.New("unsupported export format")
+)
+
+// Export formats
+const (
+	ExportCompose = "compose"
+)
+
+const (
+	composeVersion = "2"
+
+	rancherLaunchConfigLabel   = "io.rancher.service.launch.config"
+	rancherPrimaryLaunchConfig = "io.rancher.service.primary.launch.config"
+	rancherSidekicksLabel      = "io.rancher.sidekicks"
+	rancherGlobalLabel         = "io.rancher.scheduler.global"
+)
+
+// rancherRuntimeLabels are set by Rancher on each container it schedules, so
+// are not part of a service's definition.
+var rancherRuntimeLabels = map[string]bool{
+	"io.rancher.cni.network":               true,
+	"io.rancher.cni.wait":                  true,
+	"io.rancher.container.ip":              true,
+	"io.rancher.container.mac_address":     true,
+	"io.rancher.container.name":            true,
+	"io.rancher.container.network":         true,
+	"io.rancher.container.uuid":            true,
+	"io.rancher.project.name":              true,
+	"io.rancher.project_service.name":      true,
+	"io.rancher.service.deployment.unit":   true,
+	"io.rancher.service.hash":              true,
+	"io.rancher.service.requested.host.id": true,
+	"io.rancher.stack.name":                true,
+	"io.rancher.stack_service.name":        true,
+	rancherLaunchConfigLabel:               true,
+}
+
+// ComposeExport is a stack reconstructed as the pair of documents
+// rancher-compose up would create it from.
+type ComposeExport struct {
+	DockerCompose  []byte
+	RancherCompose []byte
+}
+
+type dockerComposeFile struct {
+	Version  string                          `yaml:"version"`
+	Services map[string]dockerComposeService `yaml:"services"`
+}
+
+type dockerComposeService struct {
+	Labels map[string]string `yaml:"labels,omitempty"`
+	Ports  []string          `yaml:"ports,omitempty"`
+}
+
+type rancherComposeFile struct {
+	Version  string                           `yaml:"version"`
+	Services map[string]rancherComposeService `yaml:"services"`
+}
+
+type rancherComposeService struct {
+	Scale int `yaml:"scale,omitempty"`
+}
+
+// composeService gathers the containers observed for one of a stack's
+// services, or sidekicks.
+type composeService struct {
+	containers []*Container
+	sidekicks  []string
+}
+
+// NewComposeExport reconstructs the docker-compose.yml and
+// rancher-compose.yml of the named stack from its observed containers.
+//
+// Each service's labels are those shared by all of its containers, less the
+// labels Rancher sets at runtime, and its ports are those published by any of
+// its containers. Services are scaled to the number of containers observed,
+// unless scheduled globally. Sidekicks are recognised by their launch config
+// label.
+//
+// NOTE: The metadata service does not record images, commands or the like,
+// so these are left for the reader to fill in.
+func NewComposeExport(stack string, cs []*Container) (*ComposeExport, error) {
+	services := make(map[string]*composeService)
+	for _, c := range cs {
+		if c.StackName != stack || c.ServiceName == "" {
+			continue
+		}
+		name := c.ServiceName
+		if lc := c.Labels[rancherLaunchConfigLabel]; lc != "" && lc != rancherPrimaryLaunchConfig {
+			name = lc
+			if services[c.ServiceName] == nil {
+				services[c.ServiceName] = &composeService{}
+			}
+			if p := services[c.ServiceName]; !containsString(p.sidekicks, lc) {
+				p.sidekicks = append(p.sidekicks, lc)
+			}
+		}
+		if services[name] == nil {
+			services[name] = &composeService{}
+		}
+		services[name].containers = append(services[name].containers, c)
+	}
+	if len(services) == 0 {
+		return nil, ErrStackNotFound
+	}
+
+	dc := dockerComposeFile{Version: composeVersion, Services: make(map[string]dockerComposeService)}
+	rc := rancherComposeFile{Version: composeVersion, Services: make(map[string]rancherComposeService)}
+	for name, s := range services {
+		labels := composeLabels(s.containers)
+		if len(s.sidekicks) > 0 {
+			sort.Strings(s.sidekicks)
+			if labels == nil {
+				labels = make(map[string]string)
+			}
+			labels[rancherSidekicksLabel] = strings.Join(s.sidekicks, ",")
+		}
+		dc.Services[name] = dockerComposeService{
+			Labels: labels,
+			Ports:  composePorts(s.containers),
+		}
+
+		var r rancherComposeService
+		if labels[rancherGlobalLabel] != "true" {
+			r.Scale = len(s.containers)
+		}
+		rc.Services[name] = r
+	}
+
+	var (
+		e   ComposeExport
+		err error
+	)
+	if e.DockerCompose, err = yaml.Marshal(dc); err != nil {
+		return nil, err
+	}
+	if e.RancherCompose, err = yaml.Marshal(rc); err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+// composeLabels returns the labels shared by all of the containers, less
+// those set by Rancher at runtime.
+func composeLabels(cs []*Container) map[string]string {
+	var labels map[string]string
+	if len(cs) == 0 {
+		return labels
+	}
+	for k, v := range cs[0].Labels {
+		if rancherRuntimeLabels[k] {
+			continue
+		}
+		shared := true
+		for _, c := range cs[1:] {
+			if cv, ok := c.Labels[k]; !ok || cv != v {
+				shared = false
+				break
+			}
+		}
+		if shared {
+			if labels == nil {
+				labels = make(map[string]string)
+			}
+			labels[k] = v
+		}
+	}
+	return labels
+}
+
+// composePorts returns the ports published by any of the containers, in the
+// compose format, e.g. 0.0.0.0:8080:80/tcp becomes 8080:80/tcp.
+func composePorts(cs []*Container) []string {
+	var ports []string
+	for _, c := range cs {
+		for _, p := range c.Ports {
+			p = strings.TrimPrefix(p, "0.0.0.0:")
+			if !containsString(ports, p) {
+				ports = append(ports, p)
+			}
+		}
+	}
+	sort.Strings(ports)
+	return ports
+}
+
+func containsString(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// NewStackExportEndpoint creates an endpoint serving a stack reconstructed
+// from the ServerService's containers, decorated with tracing.
+func NewStackExportEndpoint(s ServerService, t stdopentracing.Tracer) endpoint.Endpoint {
+	return opentracing.TraceServer(t, "rancher-stack-export-endpoint")(StackExportEndpoint(s))
+}
+
+// stackExportRequest A stack export parameter model.
+//
+// Used for identifying the stack and the format to export it in.
+//
+// swagger:parameters stackExport
+type stackExportRequest struct {
+	// The name of the stack
+	//
+	// in: path
+	// required: true
+	Name string
+	// The format to export the stack in, currently only compose
+	//
+	// in: query
+	Format string
+}
+
+// stackExportResponse A stack export response model.
+//
+// Used for returning the files a stack was reconstructed as, by file name.
+//
+// swagger:response stackExportResponse
+type stackExportResponse struct {
+	// in: body
+	Name string `json:"Name,omitempty"`
+	// in: body
+	Format string `json:"Format,omitempty"`
+	// in: body
+	Files map[string]string `json:"Files,omitempty"`
+	// in: body
+	Err error `json:"Error,omitempty"`
+
+	cache CacheStatus
+}
+
+func (r stackExportResponse) error() error             { return r.Err }
+func (r stackExportResponse) cacheStatus() CacheStatus { return r.cache }
+
+// StackExportEndpoint serves a stack reconstructed from the ServerService's
+// containers.
+func StackExportEndpoint(s ServerService) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(stackExportRequest)
+		resp := stackExportResponse{Name: req.Name, Format: req.Format}
+		if req.Format != ExportCompose {
+			resp.Err = ErrExportFormatUnsupported
+			return resp, nil
+		}
+
+		cs, err := s.Containers(ctx)
+		if err != nil {
+			resp.Err = err
+			return resp, nil
+		}
+		e, err := NewComposeExport(req.Name, cs)
+		if err != nil {
+			resp.Err = err
+			return resp, nil
+		}
+		resp.Files = map[string]string{
+			"docker-compose.yml":  string(e.DockerCompose),
+			"rancher-compose.yml": string(e.RancherCompose),
+		}
+		resp.cache = s.CacheStatus(ctx)
+		return resp, nil
+	}
+}
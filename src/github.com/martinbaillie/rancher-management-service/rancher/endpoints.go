@@ -8,10 +8,11 @@
 package rancher
 
 import (
+	"net/http"
 	"net/url"
 
-	"github.com/go-kit/kit/circuitbreaker"
 	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/tracing/opentracing"
 	kithttp "github.com/go-kit/kit/transport/http"
 
@@ -25,6 +26,22 @@ type errorer interface {
 	error() error
 }
 
+// Cache status type used for asserting the freshness of responses
+type cacheStatuser interface {
+	cacheStatus() CacheStatus
+}
+
+// Status type used for responses that are not simply 200 OK
+type statuser interface {
+	status() int
+}
+
+// Location type used for responses pointing to another resource, relative to
+// the request
+type locationer interface {
+	location() string
+}
+
 // ServerEndpoints holds the Rancher package's externally facing endpoints
 type ServerEndpoints struct {
 	ContainerEndpoint  endpoint.Endpoint
@@ -44,7 +61,7 @@ func NewServerEndpoints(s ServerService, t stdopentracing.Tracer) ServerEndpoint
 //
 // Used for identifying the name of the container.
 //
-// swagger:parameters container
+// swagger:parameters container containerHealth
 type containerRequest struct {
 	// The name of the container
 	//
@@ -63,9 +80,12 @@ type containerResponse struct {
 	Container *Container `json:"Container,omitempty"`
 	// in: body
 	Err error `json:"Error,omitempty"`
+
+	cache CacheStatus
 }
 
-func (r containerResponse) error() error { return r.Err }
+func (r containerResponse) error() error             { return r.Err }
+func (r containerResponse) cacheStatus() CacheStatus { return r.cache }
 
 // ContainerEndpoint implements ServerService.
 // This endpoint is used as part of a server interaction.
@@ -76,6 +96,7 @@ func ContainerEndpoint(s ServerService) endpoint.Endpoint {
 		return containerResponse{
 			Container: c,
 			Err:       err,
+			cache:     s.CacheStatus(ctx),
 		}, nil
 	}
 }
@@ -97,9 +118,12 @@ type containersResponse struct {
 	Containers []*Container `json:"Containers,omitempty"`
 	// in: body
 	Err error `json:"Error,omitempty"`
+
+	cache CacheStatus
 }
 
-func (r containersResponse) error() error { return r.Err }
+func (r containersResponse) error() error             { return r.Err }
+func (r containersResponse) cacheStatus() CacheStatus { return r.cache }
 
 // ContainersEndpoint implements ServerService.
 // This endpoint is used as part of a server interaction.
@@ -111,35 +135,96 @@ func ContainersEndpoint(s ServerService) endpoint.Endpoint {
 		return containersResponse{
 			Containers: cs,
 			Err:        err,
+			cache:      s.CacheStatus(ctx),
 		}, nil
 	}
 }
 
+// Tracing and circuit breaking command names for the client endpoints
+const (
+	metadataContainersCommand = "rancher-metadata-service-containers-endpoint"
+	metadataHostsCommand      = "rancher-metadata-service-hosts-endpoint"
+	apiContainersCommand      = "rancher-api-containers-endpoint"
+	apiContainerCommand       = "rancher-api-container-endpoint"
+	apiContainerActionCommand = "rancher-api-container-action-endpoint"
+	apiStacksCommand          = "rancher-api-stacks-endpoint"
+	apiServicesCommand        = "rancher-api-services-endpoint"
+	apiServiceCommand         = "rancher-api-service-endpoint"
+	apiServiceUpdateCommand   = "rancher-api-service-update-endpoint"
+	apiServiceActionCommand   = "rancher-api-service-action-endpoint"
+)
+
 // ClientEndpoints holds the Rancher package's internally used endpoints
+//
+// NOTE: The Rancher API endpoints are nil unless the environment has an API.
 type ClientEndpoints struct {
 	MetadataContainersEndpoint endpoint.Endpoint
 	MetadataHostsEndpoint      endpoint.Endpoint
-}
+	APIContainersEndpoint      endpoint.Endpoint
+	APIContainerEndpoint       endpoint.Endpoint
+	APIContainerActionEndpoint endpoint.Endpoint
+	APIStacksEndpoint          endpoint.Endpoint
+	APIServicesEndpoint        endpoint.Endpoint
+	APIServiceEndpoint         endpoint.Endpoint
+	APIServiceUpdateEndpoint   endpoint.Endpoint
+	APIServiceActionEndpoint   endpoint.Endpoint
 
-// NewClientEndpoints creates an instance of ClientEndpoints.
-// Each endpoint is decorated with tracing and circuit breaking.
-func NewClientEndpoints(ctx context.Context, metadataServiceURL *url.URL, t stdopentracing.Tracer) ClientEndpoints {
-	var mce endpoint.Endpoint
-	mce = MetadataContainersEndpoint(ctx, metadataServiceURL)
-	mce = opentracing.TraceServer(t, "rancher-metadata-service-containers-endpoint")(mce)
-	mce = circuitbreaker.Hystrix("rancher-metadata-service-containers-endpoint")(mce)
+	// Circuits guards the endpoints, and APIKeys authenticates those of the
+	// API, so that their policies and keys may change while running.
+	Circuits Circuits
+	APIKeys  *APIKeys
+}
 
-	var mhe endpoint.Endpoint
-	mhe = MetadataHostsEndpoint(ctx, metadataServiceURL)
-	mhe = opentracing.TraceServer(t, "rancher-metadata-service-hosts-endpoint")(mhe)
-	mhe = circuitbreaker.Hystrix("rancher-metadata-service-hosts-endpoint")(mhe)
+// NewClientEndpoints creates an instance of ClientEndpoints for the given
+// Rancher environment.
+// Each endpoint is decorated with a client span, a child of any span in the
+// calling context, and guarded as its policy describes, see Policy. The span
+// is propagated to Rancher in the B3 headers. The Circuits and APIKeys
+// returned are the endpoints' own, for the caller to change while running.
+func NewClientEndpoints(ctx context.Context, env Environment, ps Policies, t stdopentracing.Tracer, logger log.Logger) ClientEndpoints {
+	// NOTE: Go kit's ClientBefore replaces rather than appends, so the request
+	// funcs are given together
+	befores := []kithttp.RequestFunc{ForwardRequestID, opentracing.ToHTTPRequest(t, logger)}
+	// NOTE: Attempts are timed out by their policy, which may change, rather
+	// than by the client
+	hc := env.httpClient()
+	if hc == nil {
+		hc = &http.Client{}
+	}
+	var ces ClientEndpoints
+	client := func(command string, u *url.URL, f clientEndpointFactory) endpoint.Endpoint {
+		c := newCircuit(env, command, ps.policy(command))
+		ces.Circuits = append(ces.Circuits, c)
+		e := f(ctx, u, kithttp.ClientBefore(befores...), kithttp.SetClient(hc))
+		e = opentracing.TraceClient(t, env.command(command))(e)
+		return resilient(c)(e)
+	}
 
-	return ClientEndpoints{
-		MetadataContainersEndpoint: mce,
-		MetadataHostsEndpoint:      mhe,
+	ces.MetadataContainersEndpoint = client(metadataContainersCommand, env.MetadataURL, MetadataContainersEndpoint)
+	ces.MetadataHostsEndpoint = client(metadataHostsCommand, env.MetadataURL, MetadataHostsEndpoint)
+	if env.APIURL == nil {
+		return ces
 	}
+
+	ces.APIKeys = newAPIKeys(APIKeyPair{AccessKey: env.APIAccessKey, SecretKey: env.APISecretKey})
+	befores = append(befores, apiBasicAuth(ces.APIKeys))
+
+	ces.APIContainersEndpoint = client(apiContainersCommand, env.APIURL, APIContainersEndpoint)
+	ces.APIContainerEndpoint = client(apiContainerCommand, env.APIURL, APIContainerEndpoint)
+	ces.APIContainerActionEndpoint = client(apiContainerActionCommand, env.APIURL, APIContainerActionEndpoint)
+	ces.APIStacksEndpoint = client(apiStacksCommand, env.APIURL, APIStacksEndpoint)
+	ces.APIServicesEndpoint = client(apiServicesCommand, env.APIURL, APIServicesEndpoint)
+	ces.APIServiceEndpoint = client(apiServiceCommand, env.APIURL, APIServiceEndpoint)
+	ces.APIServiceUpdateEndpoint = client(apiServiceUpdateCommand, env.APIURL, APIServiceUpdateEndpoint)
+	ces.APIServiceActionEndpoint = client(apiServiceActionCommand, env.APIURL, APIServiceActionEndpoint)
+
+	return ces
 }
 
+// clientEndpointFactory creates a client endpoint for the URL, e.g.
+// MetadataContainersEndpoint.
+type clientEndpointFactory func(ctx context.Context, u *url.URL, options ...kithttp.ClientOption) endpoint.Endpoint
+
 type metadataGenericRequest struct {
 	Subpath string
 }
@@ -154,20 +239,22 @@ type metadataHostsResponse struct {
 
 // MetadataContainersEndpoint implements ClientService.
 // This endpoint is used as part of a client interaction.
-func MetadataContainersEndpoint(ctx context.Context, metadataServiceURL *url.URL) endpoint.Endpoint {
+func MetadataContainersEndpoint(ctx context.Context, metadataServiceURL *url.URL, options ...kithttp.ClientOption) endpoint.Endpoint {
 	return kithttp.NewClient(
 		"GET", metadataServiceURL,
 		encodeMetadataGenericRequest,
 		decodeMetadataContainersResponse,
+		options...,
 	).Endpoint()
 }
 
 // MetadataHostsEndpoint implements ClientService.
 // This endpoint is used as part of a client interaction.
-func MetadataHostsEndpoint(ctx context.Context, metadataServiceURL *url.URL) endpoint.Endpoint {
+func MetadataHostsEndpoint(ctx context.Context, metadataServiceURL *url.URL, options ...kithttp.ClientOption) endpoint.Endpoint {
 	return kithttp.NewClient(
 		"GET", metadataServiceURL,
 		encodeMetadataGenericRequest,
 		decodeMetadataHostsResponse,
+		options...,
 	).Endpoint()
 }
@@ -0,0 +1,308 @@
+// Copyright 2017 Martin Baillie <martin.t.baillie@gmail.com>.
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file or at:
+// https://opensource.org/licenses/BSD-3-Clause
+
+package rancher
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultEnvironment is the name given to the single Rancher environment
+// managed when no others are configured.
+const DefaultEnvironment = "default"
+
+// Environment describes a Rancher environment managed by this service and
+// how to reach its metadata service.
+type Environment struct {
+	// the unique name of the environment e.g. dev, test, prod
+	Name string
+	// the environment's Rancher metadata service
+	MetadataURL *url.URL
+	// an optional HTTP proxy bridging the environment's overlay network
+	ProxyURL *url.URL
+	// the duration between Rancher metadata cache calls
+	MetadataInterval time.Duration
+	// the environment's Rancher API project, e.g.
+	// http://rancher:8080/v2-beta/projects/1a5, if containers may be acted upon
+	APIURL *url.URL
+	// the Rancher API key pair authenticating against the API
+	APIAccessKey string
+	APISecretKey string
+}
+
+// command returns the tracing and circuit breaking command name used for
+// this environment's client endpoints.
+//
+// NOTE: The default environment keeps the unqualified command names so
+// existing dashboards and alerts continue to work.
+func (e Environment) command(name string) string {
+	if e.Name == "" || e.Name == DefaultEnvironment {
+		return name
+	}
+	return name + "-" + e.Name
+}
+
+// httpClient returns the HTTP client used to reach the environment's metadata
+// service, or nil if the default client (which obeys the proxy vars) will do.
+func (e Environment) httpClient() *http.Client {
+	if e.ProxyURL == nil {
+		return nil
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy: http.ProxyURL(e.ProxyURL),
+		},
+	}
+}
+
+var environmentNameRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// ParseEnvironments parses a semicolon separated list of environments, each
+// a comma separated list of key=value settings, e.g.:
+//
+//	name=dev,metadata_addr=rancher-metadata.dev/latest,proxy=http://squid.dev:3128;name=prod,metadata_interval=1m,api_url=http://rancher:8080/v2-beta/projects/1a5,api_access_key=...,api_secret_key_file=/run/secrets/rancher-prod
+//
+// Only the name is required. Settings that are not given are taken from the
+// provided defaults. An empty spec results in the defaults alone. The API
+// secret key may be given inline as api_secret_key, or read from a file by
+// api_secret_key_file, see ReadSecretFile.
+func ParseEnvironments(spec string, defaults Environment) ([]Environment, error) {
+	if strings.TrimSpace(spec) == "" {
+		return []Environment{defaults}, nil
+	}
+
+	var (
+		envs  []Environment
+		names = make(map[string]bool)
+	)
+	for _, envSpec := range strings.Split(spec, ";") {
+		if strings.TrimSpace(envSpec) == "" {
+			continue
+		}
+
+		env := defaults
+		env.Name = ""
+		for _, setting := range strings.Split(envSpec, ",") {
+			kv := strings.SplitN(setting, "=", 2)
+			if len(kv) != 2 {
+				return nil, fmt.Errorf("environment setting %q is not of the form key=value", setting)
+			}
+
+			var err error
+			switch k, v := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1]); k {
+			case "name":
+				env.Name = v
+			case "metadata_addr":
+				env.MetadataURL, err = MetadataURLFromStr(v)
+			case "proxy":
+				env.ProxyURL, err = url.Parse(v)
+			case "metadata_interval":
+				env.MetadataInterval, err = time.ParseDuration(v)
+			case "api_url":
+				env.APIURL, err = url.Parse(v)
+			case "api_access_key":
+				env.APIAccessKey = v
+			case "api_secret_key":
+				env.APISecretKey = v
+			case "api_secret_key_file":
+				env.APISecretKey, err = ReadSecretFile(v)
+			default:
+				err = fmt.Errorf("unknown setting %q", k)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("environment %q: %v", envSpec, err)
+			}
+		}
+
+		switch {
+		case !environmentNameRegexp.MatchString(env.Name):
+			return nil, fmt.Errorf("environment %q: invalid name %q", envSpec, env.Name)
+		case env.Name == "containers":
+			// Reserved for queries spanning every environment
+			return nil, fmt.Errorf("environment %q: name %q is reserved", envSpec, env.Name)
+		case names[env.Name]:
+			return nil, fmt.Errorf("environment %q: duplicate name %q", envSpec, env.Name)
+		}
+		names[env.Name] = true
+		envs = append(envs, env)
+	}
+	return envs, nil
+}
+
+// ReadSecretFile reads a secret, e.g. an API secret key, from the file at
+// path, ignoring surrounding whitespace such as a trailing newline.
+func ReadSecretFile(path string) (string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	secret := strings.TrimSpace(string(b))
+	if secret == "" {
+		return "", fmt.Errorf("secret file %q is empty", path)
+	}
+	return secret, nil
+}
+
+// MetadataURLFromStr parses a Rancher metadata service address, defaulting
+// the scheme to http.
+func MetadataURLFromStr(metadataServiceStr string) (*url.URL, error) {
+	if !strings.Contains(metadataServiceStr, "://") {
+		// Rancher.metadata is usually http
+		metadataServiceStr = "http://" + metadataServiceStr
+	}
+	return url.Parse(metadataServiceStr)
+}
+
+// NewAggregateServerService creates a ServerService spanning several
+// environments. Containers are stamped with the name of their environment.
+//
+// A container name present in more than one environment is ambiguous, and
+// must instead be queried within its environment.
+func NewAggregateServerService(names []string, services map[string]ServerService) ServerService {
+	return &aggregateServerService{
+		names:    names,
+		services: services,
+	}
+}
+
+type aggregateServerService struct {
+	names    []string
+	services map[string]ServerService
+}
+
+// Container implements ServerService.
+// It returns the container found in exactly one environment, failing with
+// ErrContainerAmbiguous should it be found in several.
+func (s aggregateServerService) Container(ctx context.Context, name string) (*Container, error) {
+	var (
+		found    *Container
+		firstErr error
+	)
+	for _, env := range s.names {
+		c, err := s.services[env].Container(ctx, name)
+		if err == nil {
+			if found != nil {
+				return nil, ErrContainerAmbiguous
+			}
+			found = stampContainer(c, env)
+			continue
+		}
+		if err != ErrContainerNotFound && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if found != nil {
+		return found, nil
+	}
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return nil, ErrContainerNotFound
+}
+
+// Containers implements ServerService.
+// It returns the containers of every environment able to serve them, failing
+// only if none are. CacheStatus names the environments left out.
+func (s aggregateServerService) Containers(ctx context.Context) ([]*Container, error) {
+	var (
+		all      []*Container
+		firstErr error
+	)
+	for _, env := range s.names {
+		cs, err := s.services[env].Containers(ctx)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		for _, c := range cs {
+			all = append(all, stampContainer(c, env))
+		}
+	}
+	if len(all) == 0 && firstErr != nil {
+		return nil, firstErr
+	}
+	return all, nil
+}
+
+// CacheStatus implements ServerService.
+// It reports the stalest view across the environments whose containers can
+// be served, naming those whose cannot, as Containers leaves them out. Errors
+// are prefixed with their environment.
+func (s aggregateServerService) CacheStatus(ctx context.Context) (cs CacheStatus) {
+	var served bool
+	for _, env := range s.names {
+		ecs := s.services[env].CacheStatus(ctx)
+		cs.Failures += ecs.Failures
+		cs.Restored = cs.Restored || ecs.Restored
+		cs.Containers += ecs.Containers
+		cs.Hosts += ecs.Hosts
+
+		// NOTE: Containers are not served from a stale or empty cache
+		if ecs.Stale || ecs.Containers == 0 {
+			cs.Unavailable = append(cs.Unavailable, env)
+		} else if !served || ecs.Refreshed.Before(cs.Refreshed) {
+			cs.Refreshed, served = ecs.Refreshed, true
+		}
+		if cs.LastError != nil {
+			continue
+		}
+		switch {
+		case ecs.LastError != nil:
+			cs.LastError = fmt.Errorf("%s: %v", env, ecs.LastError)
+		case ecs.Stale:
+			cs.LastError = fmt.Errorf("%s: %v", env, ErrContainerRepoStale)
+		case ecs.Containers == 0:
+			cs.LastError = fmt.Errorf("%s: %v", env, ErrContainerRepoEmpty)
+		}
+	}
+	return
+}
+
+// WatchContainers implements ServerService.
+// It merges the changes to the containers of every environment. The merged
+// channel is closed once every environment's channel is.
+func (s aggregateServerService) WatchContainers(ctx context.Context) <-chan ContainerEvent {
+	var (
+		wg     sync.WaitGroup
+		merged = make(chan ContainerEvent)
+	)
+	for _, env := range s.names {
+		wg.Add(1)
+		go func(env string, ch <-chan ContainerEvent) {
+			defer wg.Done()
+			for e := range ch {
+				e.Container = stampContainer(e.Container, env)
+				select {
+				case merged <- e:
+				case <-ctx.Done():
+				}
+			}
+		}(env, s.services[env].WatchContainers(ctx))
+	}
+	go func() {
+		wg.Wait()
+		close(merged)
+	}()
+	return merged
+}
+
+// stampContainer returns a copy of the container labelled with its environment.
+func stampContainer(c *Container, env string) *Container {
+	stamped := *c
+	stamped.Environment = env
+	return &stamped
+}
@@ -0,0 +1,184 @@
+// Copyright 2017 Martin Baillie <martin.t.baillie@gmail.com>.
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file or at:
+// https://opensource.org/licenses/BSD-3-Clause
+
+package rancher
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"time"
+)
+
+// EventSchemaVersion is the version of the Event JSON schema. It is bumped on
+// any change to the schema that is not purely additive.
+const EventSchemaVersion = 1
+
+// EventType describes how the Rancher environment changed.
+type EventType string
+
+// Event types
+const (
+	EventContainerAdded        EventType = "container.added"
+	EventContainerRemoved      EventType = "container.removed"
+	EventContainerStateChanged EventType = "container.state_changed"
+	EventHostAdded             EventType = "host.added"
+	EventHostRemoved           EventType = "host.removed"
+)
+
+// Event is a change to the Rancher environment, found by diffing successive
+// snapshots of a Repository.
+//
+// NOTE: This is published to other teams so the JSON representation is a
+// contract, see EventSchemaVersion.
+type Event struct {
+	// the version of this schema
+	SchemaVersion int `json:"SchemaVersion"`
+	// uniquely identifies the event, redeliveries of an event share the ID
+	ID string `json:"ID"`
+	// how the environment changed
+	Type EventType `json:"Type"`
+	// the Rancher environment that changed
+	Environment string `json:"Environment"`
+	// when the change was observed
+	Time time.Time `json:"Time"`
+	// the container that changed, for container events
+	Container *EventContainer `json:"Container,omitempty"`
+	// the container's state before the change, for state changes
+	PreviousState string `json:"PreviousState,omitempty"`
+	// the host that changed, for host events
+	Host *EventHost `json:"Host,omitempty"`
+}
+
+// EventContainer is the representation of a Container in an Event.
+type EventContainer struct {
+	UUID         string `json:"UUID"`
+	Name         string `json:"Name"`
+	State        string `json:"State"`
+	PrivateIP    string `json:"PrivateIP"`
+	ServiceIndex int64  `json:"ServiceIndex"`
+	HostUUID     string `json:"HostUUID"`
+	HostName     string `json:"HostName"`
+}
+
+// EventHost is the representation of a Host in an Event.
+type EventHost struct {
+	UUID string `json:"UUID"`
+	Name string `json:"Name"`
+}
+
+// Key returns the UUID of the container or host that changed, under which
+// events for the same object are kept in order.
+func (e Event) Key() string {
+	if e.Container != nil {
+		return e.Container.UUID
+	}
+	if e.Host != nil {
+		return e.Host.UUID
+	}
+	return ""
+}
+
+// diffSnapshots returns the events that turn the old snapshot into the new.
+// Containers and hosts are matched by UUID. A nil old snapshot is treated as
+// empty.
+func diffSnapshots(env string, old, new *Snapshot) []Event {
+	if old == nil {
+		old = &Snapshot{}
+	}
+
+	var es []Event
+	event := func(t EventType, previousState string, c *Container, h *Host) {
+		e := Event{
+			SchemaVersion: EventSchemaVersion,
+			Type:          t,
+			Environment:   env,
+			Time:          new.Refreshed,
+			PreviousState: previousState,
+		}
+		if c != nil {
+			e.Container = &EventContainer{
+				UUID:         containerKey(c),
+				Name:         c.Name,
+				State:        c.State,
+				PrivateIP:    c.PrivateIP,
+				ServiceIndex: c.ServiceIndex,
+				HostUUID:     c.Host.UUID,
+				HostName:     c.Host.Name,
+			}
+		}
+		if h != nil {
+			e.Host = &EventHost{UUID: h.UUID, Name: h.Name}
+		}
+		e.ID = eventID(e)
+		es = append(es, e)
+	}
+
+	ohm := make(map[string]*Host, len(old.Hosts))
+	for _, h := range old.Hosts {
+		ohm[h.UUID] = h
+	}
+	nhm := make(map[string]bool, len(new.Hosts))
+	for _, h := range new.Hosts {
+		nhm[h.UUID] = true
+		if _, ok := ohm[h.UUID]; !ok {
+			event(EventHostAdded, "", nil, h)
+		}
+	}
+
+	ocm := make(map[string]*Container, len(old.Containers))
+	for _, c := range old.Containers {
+		ocm[containerKey(c)] = c
+	}
+	ncm := make(map[string]bool, len(new.Containers))
+	for _, c := range new.Containers {
+		ncm[containerKey(c)] = true
+		if o, ok := ocm[containerKey(c)]; !ok {
+			event(EventContainerAdded, "", c, nil)
+		} else if o.State != c.State {
+			event(EventContainerStateChanged, o.State, c, nil)
+		}
+	}
+	for _, c := range old.Containers {
+		if !ncm[containerKey(c)] {
+			event(EventContainerRemoved, "", c, nil)
+		}
+	}
+
+	for _, h := range old.Hosts {
+		if !nhm[h.UUID] {
+			event(EventHostRemoved, "", nil, h)
+		}
+	}
+	return es
+}
+
+// containerKey returns the container's UUID, falling back to its name for
+// containers restored from snapshots that predate UUIDs.
+func containerKey(c *Container) string {
+	if c.UUID != "" {
+		return c.UUID
+	}
+	return c.Name
+}
+
+// eventID derives the event's ID from the change it describes, so that the
+// same change observed at the same time always has the same ID.
+func eventID(e Event) string {
+	h := sha256.New()
+	for _, s := range []string{
+		e.Environment,
+		string(e.Type),
+		e.Key(),
+		e.PreviousState,
+		strconv.FormatInt(e.Time.UnixNano(), 10),
+	} {
+		h.Write([]byte(s))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil)[:16])
+}
@@ -0,0 +1,264 @@
+// Copyright 2017 Martin Baillie <martin.t.baillie@gmail.com>.
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file or at:
+// https://opensource.org/licenses/BSD-3-Clause
+
+package rancher
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/metrics"
+)
+
+// Governor errors
+var (
+	ErrGovernorTimeout = errors.New("timed out waiting to call container")
+)
+
+// GovernorConfig describes how many calls into containers may be in flight.
+// A cap of 0 does not limit the calls.
+type GovernorConfig struct {
+	// the calls that may be in flight across every container
+	MaxConcurrent int
+	// the calls that may be in flight to the containers of a single host, told
+	// apart by its UUID
+	MaxPerHost int
+	// the calls that may be in flight to the containers of a single service
+	MaxPerService int
+	// the longest a call may wait for its turn, should its context allow
+	// longer (0 waits as long as the context allows)
+	MaxWait time.Duration
+}
+
+// Governor schedules the calls made into containers, e.g. to their
+// PrivateIP, keeping them within the global, per-host and per-service caps.
+// Calls waiting for a turn are queued by job, and the jobs take turns so
+// that a job with many calls does not starve a job with few.
+//
+// A single Governor is expected to be shared by every client that calls
+// into containers.
+type Governor struct {
+	cfg    GovernorConfig
+	queued metrics.Gauge
+	waited metrics.Histogram
+
+	// Guards the calls in flight and the jobs waiting, in turn order
+	mtx      sync.Mutex
+	inFlight int
+	hosts    map[string]int
+	services map[string]int
+	jobs     []*governorJob
+	next     int
+}
+
+type governorJob struct {
+	name  string
+	calls []*governorCall
+}
+
+type governorCall struct {
+	host    string
+	service string
+	ready   chan struct{}
+	granted bool
+}
+
+// NewGovernor returns a Governor keeping calls within the caps, reporting the
+// calls queued and how long they waited by job.
+func NewGovernor(cfg GovernorConfig, queued metrics.Gauge, waited metrics.Histogram) *Governor {
+	return &Governor{
+		cfg:      cfg,
+		queued:   queued,
+		waited:   waited,
+		hosts:    make(map[string]int),
+		services: make(map[string]int),
+	}
+}
+
+// Acquire waits for the job's turn to call into the container of the named
+// environment, returning a func to release the turn once the call is done.
+//
+// The wait is bounded by the context, so a caller's deadline covers both its
+// time queued and its call, and by the configured maximum wait. Acquire is
+// safe to call on a nil Governor, which never waits.
+func (g *Governor) Acquire(ctx context.Context, job, env string, c *Container) (func(), error) {
+	if g == nil {
+		return func() {}, nil
+	}
+
+	call := &governorCall{ready: make(chan struct{})}
+	if c.Host.UUID != "" {
+		call.host = env + "/" + c.Host.UUID
+	}
+	if c.ServiceName != "" {
+		call.service = env + "/" + c.StackName + "/" + c.ServiceName
+	}
+
+	begin := time.Now()
+	g.mtx.Lock()
+	g.enqueue(job, call)
+	g.dispatch()
+	g.mtx.Unlock()
+
+	var timeout <-chan time.Time
+	if g.cfg.MaxWait > 0 {
+		t := time.NewTimer(g.cfg.MaxWait)
+		defer t.Stop()
+		timeout = t.C
+	}
+	var err error
+	select {
+	case <-call.ready:
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-timeout:
+		err = ErrGovernorTimeout
+	}
+	g.waited.With("job", job).Observe(time.Since(begin).Seconds())
+
+	if err != nil {
+		g.mtx.Lock()
+		granted := call.granted
+		if !granted {
+			g.dequeue(job, call)
+		}
+		g.mtx.Unlock()
+
+		// NOTE: The turn may have been granted while giving up on it
+		if !granted {
+			return nil, err
+		}
+		if ctx.Err() != nil {
+			g.release(call)
+			return nil, err
+		}
+	}
+	return func() { g.release(call) }, nil
+}
+
+// enqueue adds the call to its job's queue, the job taking its turn after
+// every job already waiting. It must be called locked.
+func (g *Governor) enqueue(name string, call *governorCall) {
+	var job *governorJob
+	for _, j := range g.jobs {
+		if j.name == name {
+			job = j
+			break
+		}
+	}
+	if job == nil {
+		job = &governorJob{name: name}
+		g.jobs = append(g.jobs, job)
+	}
+	job.calls = append(job.calls, call)
+	g.queued.With("job", name).Set(float64(len(job.calls)))
+}
+
+// dequeue removes the call from its job's queue. It must be called locked.
+func (g *Governor) dequeue(name string, call *governorCall) {
+	for i, j := range g.jobs {
+		if j.name != name {
+			continue
+		}
+		for k, c := range j.calls {
+			if c == call {
+				g.remove(i, k)
+				return
+			}
+		}
+	}
+}
+
+// remove removes the call from the job's queue, and the job from the turn
+// order once it has no calls waiting. It must be called locked.
+func (g *Governor) remove(i, k int) {
+	job := g.jobs[i]
+	job.calls = append(job.calls[:k], job.calls[k+1:]...)
+	g.queued.With("job", job.name).Set(float64(len(job.calls)))
+	if len(job.calls) > 0 {
+		return
+	}
+	g.jobs = append(g.jobs[:i], g.jobs[i+1:]...)
+	if i < g.next {
+		g.next--
+	}
+	if g.next >= len(g.jobs) {
+		g.next = 0
+	}
+}
+
+// dispatch grants turns to the waiting calls the caps allow, taking the jobs
+// in turn and each job's calls in order. A call held back by its host or
+// service does not hold back the calls queued behind it. It must be called
+// locked.
+func (g *Governor) dispatch() {
+	for len(g.jobs) > 0 {
+		if g.cfg.MaxConcurrent > 0 && g.inFlight >= g.cfg.MaxConcurrent {
+			return
+		}
+		granted := false
+		for n := 0; n < len(g.jobs) && !granted; n++ {
+			i := (g.next + n) % len(g.jobs)
+			for k, call := range g.jobs[i].calls {
+				if !g.allows(call) {
+					continue
+				}
+				g.grant(call)
+				g.next = i + 1
+				g.remove(i, k)
+				granted = true
+				break
+			}
+		}
+		if !granted {
+			return
+		}
+	}
+}
+
+// allows reports whether the call's host and service have room for it.
+func (g *Governor) allows(call *governorCall) bool {
+	if call.host != "" && g.cfg.MaxPerHost > 0 && g.hosts[call.host] >= g.cfg.MaxPerHost {
+		return false
+	}
+	if call.service != "" && g.cfg.MaxPerService > 0 && g.services[call.service] >= g.cfg.MaxPerService {
+		return false
+	}
+	return true
+}
+
+func (g *Governor) grant(call *governorCall) {
+	g.inFlight++
+	if call.host != "" {
+		g.hosts[call.host]++
+	}
+	if call.service != "" {
+		g.services[call.service]++
+	}
+	call.granted = true
+	close(call.ready)
+}
+
+func (g *Governor) release(call *governorCall) {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+
+	g.inFlight--
+	if call.host != "" {
+		if g.hosts[call.host]--; g.hosts[call.host] == 0 {
+			delete(g.hosts, call.host)
+		}
+	}
+	if call.service != "" {
+		if g.services[call.service]--; g.services[call.service] == 0 {
+			delete(g.services, call.service)
+		}
+	}
+	g.dispatch()
+}
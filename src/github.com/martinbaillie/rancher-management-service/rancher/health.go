@@ -0,0 +1,134 @@
+// Copyright 2017 Martin Baillie <martin.t.baillie@gmail.com>.
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file or at:
+// https://opensource.org/licenses/BSD-3-Clause
+
+package rancher
+
+import (
+	"sync"
+	"time"
+
+	"github.com/martinbaillie/rancher-management-service/health"
+)
+
+// NewHealthChecker returns a health.Checker reporting on the Rancher
+// package's dependencies for the given environment: the metadata service (by
+// way of the Repository's cache) and the circuit breakers guarding the
+// metadata client endpoints, among the given Circuits.
+//
+// The checker is not ready until the cache has been populated at least once,
+// nor once the cache has aged beyond maxIntervals cache intervals. A cache
+// restored from a snapshot does not count as populated until it is refreshed,
+// though the metadata service is only reported degraded meanwhile, as it is
+// while its last refresh has failed but the last good snapshot is still
+// served. It is reported down once the snapshot is not served. It
+// implements CacheIntervalSetter, so that it may follow the Repository's
+// interval.
+func NewHealthChecker(env Environment, r Repository, cs Circuits, maxIntervals int) health.Checker {
+	return &healthChecker{
+		name:         env.command("rancher-metadata-service"),
+		repository:   r,
+		circuits:     cs,
+		maxIntervals: maxIntervals,
+		maxAge:       env.MetadataInterval * time.Duration(maxIntervals),
+		commands: []string{
+			env.command(metadataContainersCommand),
+			env.command(metadataHostsCommand),
+		},
+	}
+}
+
+type healthChecker struct {
+	name         string
+	repository   Repository
+	circuits     Circuits
+	maxIntervals int
+	commands     []string
+
+	// Guards the age beyond which the cache is stale
+	mtx    sync.RWMutex
+	maxAge time.Duration
+}
+
+// SetCacheInterval implements CacheIntervalSetter.
+func (hc *healthChecker) SetCacheInterval(d time.Duration) {
+	hc.mtx.Lock()
+	defer hc.mtx.Unlock()
+
+	hc.maxAge = d * time.Duration(hc.maxIntervals)
+}
+
+// Ready implements health.Checker.
+func (hc *healthChecker) Ready() error {
+	cs := hc.repository.CacheStatus()
+	if cs.Refreshed.IsZero() {
+		return ErrCacheNotPopulated
+	}
+	// NOTE: The snapshot's refresh time is that of the previous instance
+	if cs.Restored {
+		return ErrCacheRestored
+	}
+	hc.mtx.RLock()
+	maxAge := hc.maxAge
+	hc.mtx.RUnlock()
+	if time.Since(cs.Refreshed) > maxAge {
+		return ErrCacheStale
+	}
+	return nil
+}
+
+// Dependencies implements health.Checker.
+func (hc *healthChecker) Dependencies() []health.Dependency {
+	cs := hc.repository.CacheStatus()
+	metadata := health.Dependency{
+		Name:   hc.name,
+		Status: health.StatusUp,
+		Details: map[string]interface{}{
+			"Containers": cs.Containers,
+			"Hosts":      cs.Hosts,
+			"Failures":   cs.Failures,
+			"Restored":   cs.Restored,
+		},
+	}
+	if err := hc.Ready(); err == ErrCacheRestored {
+		metadata.Status = health.StatusDegraded
+		metadata.Details["Error"] = err.Error()
+	} else if err != nil {
+		metadata.Status = health.StatusDown
+		metadata.Details["Error"] = err.Error()
+	} else if cs.Stale {
+		metadata.Status = health.StatusDown
+		metadata.Details["Error"] = ErrContainerRepoStale.Error()
+	} else if cs.LastError != nil {
+		// Still serving the last good snapshot, until it is stale
+		metadata.Status = health.StatusDegraded
+		metadata.Details["Error"] = cs.LastError.Error()
+	}
+	if !cs.Refreshed.IsZero() {
+		metadata.Details["CacheAge"] = time.Since(cs.Refreshed).String()
+	}
+
+	ds := []health.Dependency{metadata}
+	for _, name := range hc.commands {
+		circuit := health.Dependency{
+			Name:    name,
+			Status:  health.StatusUp,
+			Details: map[string]interface{}{"Circuit": CircuitClosed},
+		}
+		if state, err := hc.circuits.state(name); err != nil {
+			circuit.Status = health.StatusDown
+			circuit.Details["Error"] = err.Error()
+		} else if state != CircuitClosed {
+			// A half-open circuit is still up, as it lets test calls through
+			circuit.Details["Circuit"] = state
+			if state == CircuitOpen {
+				circuit.Status = health.StatusDown
+			}
+		}
+		ds = append(ds, circuit)
+	}
+	return ds
+}
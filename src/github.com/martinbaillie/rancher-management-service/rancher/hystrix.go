@@ -0,0 +1,412 @@
+// Copyright 2017 Martin Baillie <martin.t.baillie@gmail.com>.
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file or at:
+// https://opensource.org/licenses/BSD-3-Clause
+
+package rancher
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/afex/hystrix-go/hystrix"
+	metricCollector "github.com/afex/hystrix-go/hystrix/metric_collector"
+	"github.com/afex/hystrix-go/hystrix/rolling"
+
+	"github.com/go-kit/kit/circuitbreaker"
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/metrics"
+)
+
+// hystrixStreamInterval is how often the metrics of every Hystrix command are
+// sent down each Hystrix stream.
+var hystrixStreamInterval = time.Second
+
+func init() {
+	// Every Hystrix circuit keeps the rolling statistics streamed for it from
+	// the moment it is created
+	metricCollector.Registry.Register(func(command string) metricCollector.MetricCollector {
+		c := newHystrixStreamCollector()
+		hystrixStreamCollectors.Lock()
+		hystrixStreamCollectors.m[command] = c
+		hystrixStreamCollectors.Unlock()
+		return c
+	})
+}
+
+// hystrixBreaker returns a middleware guarding an endpoint with the named
+// Hystrix command. The command's circuit is created up front, rather than on
+// its first call, so that it is on the Hystrix stream from the start.
+//
+// NOTE: The command must be configured before its circuit is created, as
+// Hystrix sizes a circuit's concurrency when creating it.
+func hystrixBreaker(command string) endpoint.Middleware {
+	hystrix.GetCircuit(command)
+	return circuitbreaker.Hystrix(command)
+}
+
+// HystrixStreamHandler serves the metrics of every Hystrix command as a
+// Hystrix dashboard (or Turbine) event stream, once a second.
+//
+// NOTE: Hystrix's own stream handler is not used as it drops events once a
+// handful of commands are in use, leaving commands missing from the stream.
+type HystrixStreamHandler struct {
+	done chan struct{}
+	once sync.Once
+}
+
+// NewHystrixStreamHandler returns a HystrixStreamHandler.
+func NewHystrixStreamHandler() *HystrixStreamHandler {
+	return &HystrixStreamHandler{done: make(chan struct{})}
+}
+
+// Stop ends every stream being served, e.g. so that the server serving them
+// may shut down.
+func (h *HystrixStreamHandler) Stop() {
+	h.once.Do(func() { close(h.done) })
+}
+
+// ServeHTTP implements http.Handler.
+func (h *HystrixStreamHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	f.Flush()
+
+	t := time.NewTicker(hystrixStreamInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-r.Context().Done():
+			return
+		case <-h.done:
+			return
+		}
+		for _, event := range hystrixStreamEvents(time.Now()) {
+			if _, err := w.Write(event); err != nil {
+				return
+			}
+		}
+		f.Flush()
+	}
+}
+
+// hystrixStreamEvents returns the command and thread pool event of every
+// Hystrix command, sorted by command name.
+func hystrixStreamEvents(now time.Time) [][]byte {
+	hystrixStreamCollectors.Lock()
+	collectors := make(map[string]*hystrixStreamCollector, len(hystrixStreamCollectors.m))
+	commands := make([]string, 0, len(hystrixStreamCollectors.m))
+	for command, c := range hystrixStreamCollectors.m {
+		collectors[command] = c
+		commands = append(commands, command)
+	}
+	hystrixStreamCollectors.Unlock()
+	sort.Strings(commands)
+
+	settings := hystrix.GetCircuitSettings()
+	var events [][]byte
+	for _, command := range commands {
+		s, ok := settings[command]
+		if !ok {
+			s = &hystrix.Settings{
+				Timeout:                time.Duration(hystrix.DefaultTimeout) * time.Millisecond,
+				MaxConcurrentRequests:  hystrix.DefaultMaxConcurrent,
+				RequestVolumeThreshold: uint64(hystrix.DefaultVolumeThreshold),
+				SleepWindow:            time.Duration(hystrix.DefaultSleepWindow) * time.Millisecond,
+				ErrorPercentThreshold:  hystrix.DefaultErrorPercentThreshold,
+			}
+		}
+		var open bool
+		if cb, _, err := hystrix.GetCircuit(command); err == nil {
+			open = cb.IsOpen()
+		}
+
+		for _, event := range collectors[command].events(command, s, open, now) {
+			b, err := json.Marshal(event)
+			if err != nil {
+				continue
+			}
+			events = append(events, append(append([]byte("data: "), b...), '\n', '\n'))
+		}
+	}
+	return events
+}
+
+// hystrixStreamCollectors holds the hystrixStreamCollector of every Hystrix
+// command, by command name.
+var hystrixStreamCollectors = struct {
+	sync.Mutex
+	m map[string]*hystrixStreamCollector
+}{m: make(map[string]*hystrixStreamCollector)}
+
+// hystrixStreamCollector is a Hystrix metric collector keeping the rolling
+// statistics of a Hystrix command sent down the Hystrix stream.
+type hystrixStreamCollector struct {
+	mtx                                   sync.RWMutex
+	attempts, errors, successes, failures *rolling.Number
+	rejects, shortCircuits, timeouts      *rolling.Number
+	fallbackSuccesses, fallbackFailures   *rolling.Number
+	totalDuration, runDuration            *rolling.Timing
+}
+
+func newHystrixStreamCollector() *hystrixStreamCollector {
+	c := &hystrixStreamCollector{}
+	c.Reset()
+	return c
+}
+
+// increment increments the number, which is read under lock as Reset may be
+// replacing it.
+func (c *hystrixStreamCollector) increment(n **rolling.Number) {
+	c.mtx.RLock()
+	(*n).Increment(1)
+	c.mtx.RUnlock()
+}
+
+func (c *hystrixStreamCollector) IncrementAttempts()          { c.increment(&c.attempts) }
+func (c *hystrixStreamCollector) IncrementErrors()            { c.increment(&c.errors) }
+func (c *hystrixStreamCollector) IncrementSuccesses()         { c.increment(&c.successes) }
+func (c *hystrixStreamCollector) IncrementFailures()          { c.increment(&c.failures) }
+func (c *hystrixStreamCollector) IncrementRejects()           { c.increment(&c.rejects) }
+func (c *hystrixStreamCollector) IncrementShortCircuits()     { c.increment(&c.shortCircuits) }
+func (c *hystrixStreamCollector) IncrementTimeouts()          { c.increment(&c.timeouts) }
+func (c *hystrixStreamCollector) IncrementFallbackSuccesses() { c.increment(&c.fallbackSuccesses) }
+func (c *hystrixStreamCollector) IncrementFallbackFailures()  { c.increment(&c.fallbackFailures) }
+
+func (c *hystrixStreamCollector) UpdateTotalDuration(d time.Duration) {
+	c.mtx.RLock()
+	c.totalDuration.Add(d)
+	c.mtx.RUnlock()
+}
+
+func (c *hystrixStreamCollector) UpdateRunDuration(d time.Duration) {
+	c.mtx.RLock()
+	c.runDuration.Add(d)
+	c.mtx.RUnlock()
+}
+
+// Reset is called by Hystrix as a command's circuit closes.
+func (c *hystrixStreamCollector) Reset() {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.attempts, c.errors, c.successes, c.failures = rolling.NewNumber(), rolling.NewNumber(), rolling.NewNumber(), rolling.NewNumber()
+	c.rejects, c.shortCircuits, c.timeouts = rolling.NewNumber(), rolling.NewNumber(), rolling.NewNumber()
+	c.fallbackSuccesses, c.fallbackFailures = rolling.NewNumber(), rolling.NewNumber()
+	c.totalDuration, c.runDuration = rolling.NewTiming(), rolling.NewTiming()
+}
+
+// events returns the command and thread pool events of the command, in the
+// Hystrix stream format.
+//
+// NOTE: The number of executions in flight is not known outside of Hystrix,
+// so is always reported as zero.
+func (c *hystrixStreamCollector) events(command string, s *hystrix.Settings, open bool, now time.Time) []interface{} {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+
+	requests, errs := uint32(c.attempts.Sum(now)), uint32(c.errors.Sum(now))
+	var errPct uint32
+	if requests > 0 {
+		errPct = uint32(float64(errs) / float64(requests) * 100)
+	}
+	window := uint32(10 * time.Second / time.Millisecond)
+
+	return []interface{}{
+		hystrixCommandEvent{
+			Type:           "HystrixCommand",
+			Name:           command,
+			Group:          command,
+			CurrentTime:    now.UnixNano() / int64(time.Millisecond),
+			ReportingHosts: 1,
+
+			RequestCount:       requests,
+			ErrorCount:         errs,
+			ErrorPercentage:    errPct,
+			CircuitBreakerOpen: open,
+
+			RollingCountSuccess:            uint32(c.successes.Sum(now)),
+			RollingCountFailure:            uint32(c.failures.Sum(now)),
+			RollingCountThreadPoolRejected: uint32(c.rejects.Sum(now)),
+			RollingCountShortCircuited:     uint32(c.shortCircuits.Sum(now)),
+			RollingCountTimeout:            uint32(c.timeouts.Sum(now)),
+			RollingCountFallbackSuccess:    uint32(c.fallbackSuccesses.Sum(now)),
+			RollingCountFallbackFailure:    uint32(c.fallbackFailures.Sum(now)),
+
+			LatencyExecuteMean: c.runDuration.Mean(),
+			LatencyExecute:     newHystrixLatency(c.runDuration),
+			LatencyTotalMean:   c.totalDuration.Mean(),
+			LatencyTotal:       newHystrixLatency(c.totalDuration),
+
+			CircuitBreakerRequestVolumeThreshold: uint32(s.RequestVolumeThreshold),
+			CircuitBreakerSleepWindow:            uint32(s.SleepWindow / time.Millisecond),
+			CircuitBreakerErrorThresholdPercent:  uint32(s.ErrorPercentThreshold),
+			CircuitBreakerEnabled:                true,
+			ExecutionIsolationStrategy:           "THREAD",
+			ExecutionIsolationThreadTimeout:      uint32(s.Timeout / time.Millisecond),
+			RollingStatsWindow:                   window,
+		},
+		hystrixThreadPoolEvent{
+			Type:           "HystrixThreadPool",
+			Name:           command,
+			ReportingHosts: 1,
+
+			CurrentCorePoolSize:    uint32(s.MaxConcurrentRequests),
+			CurrentLargestPoolSize: uint32(s.MaxConcurrentRequests),
+			CurrentMaximumPoolSize: uint32(s.MaxConcurrentRequests),
+			CurrentPoolSize:        uint32(s.MaxConcurrentRequests),
+
+			RollingCountThreadsExecuted: requests,
+			RollingStatsWindow:          window,
+		},
+	}
+}
+
+// hystrixCommandEvent is the Hystrix stream event of a command.
+type hystrixCommandEvent struct {
+	Type           string `json:"type"`
+	Name           string `json:"name"`
+	Group          string `json:"group"`
+	CurrentTime    int64  `json:"currentTime"`
+	ReportingHosts uint32 `json:"reportingHosts"`
+
+	RequestCount       uint32 `json:"requestCount"`
+	ErrorCount         uint32 `json:"errorCount"`
+	ErrorPercentage    uint32 `json:"errorPercentage"`
+	CircuitBreakerOpen bool   `json:"isCircuitBreakerOpen"`
+
+	RollingCountCollapsedRequests  uint32 `json:"rollingCountCollapsedRequests"`
+	RollingCountExceptionsThrown   uint32 `json:"rollingCountExceptionsThrown"`
+	RollingCountFailure            uint32 `json:"rollingCountFailure"`
+	RollingCountFallbackFailure    uint32 `json:"rollingCountFallbackFailure"`
+	RollingCountFallbackRejection  uint32 `json:"rollingCountFallbackRejection"`
+	RollingCountFallbackSuccess    uint32 `json:"rollingCountFallbackSuccess"`
+	RollingCountResponsesFromCache uint32 `json:"rollingCountResponsesFromCache"`
+	RollingCountSemaphoreRejected  uint32 `json:"rollingCountSemaphoreRejected"`
+	RollingCountShortCircuited     uint32 `json:"rollingCountShortCircuited"`
+	RollingCountSuccess            uint32 `json:"rollingCountSuccess"`
+	RollingCountThreadPoolRejected uint32 `json:"rollingCountThreadPoolRejected"`
+	RollingCountTimeout            uint32 `json:"rollingCountTimeout"`
+
+	CurrentConcurrentExecutionCount uint32 `json:"currentConcurrentExecutionCount"`
+
+	LatencyExecuteMean uint32         `json:"latencyExecute_mean"`
+	LatencyExecute     hystrixLatency `json:"latencyExecute"`
+	LatencyTotalMean   uint32         `json:"latencyTotal_mean"`
+	LatencyTotal       hystrixLatency `json:"latencyTotal"`
+
+	CircuitBreakerRequestVolumeThreshold uint32 `json:"propertyValue_circuitBreakerRequestVolumeThreshold"`
+	CircuitBreakerSleepWindow            uint32 `json:"propertyValue_circuitBreakerSleepWindowInMilliseconds"`
+	CircuitBreakerErrorThresholdPercent  uint32 `json:"propertyValue_circuitBreakerErrorThresholdPercentage"`
+	CircuitBreakerForceOpen              bool   `json:"propertyValue_circuitBreakerForceOpen"`
+	CircuitBreakerForceClosed            bool   `json:"propertyValue_circuitBreakerForceClosed"`
+	CircuitBreakerEnabled                bool   `json:"propertyValue_circuitBreakerEnabled"`
+	ExecutionIsolationStrategy           string `json:"propertyValue_executionIsolationStrategy"`
+	ExecutionIsolationThreadTimeout      uint32 `json:"propertyValue_executionIsolationThreadTimeoutInMilliseconds"`
+	RollingStatsWindow                   uint32 `json:"propertyValue_metricsRollingStatisticalWindowInMilliseconds"`
+	RequestCacheEnabled                  bool   `json:"propertyValue_requestCacheEnabled"`
+	RequestLogEnabled                    bool   `json:"propertyValue_requestLogEnabled"`
+}
+
+// hystrixThreadPoolEvent is the Hystrix stream event of a command's thread
+// pool, i.e. its concurrency limit.
+type hystrixThreadPoolEvent struct {
+	Type           string `json:"type"`
+	Name           string `json:"name"`
+	ReportingHosts uint32 `json:"reportingHosts"`
+
+	CurrentActiveCount        uint32 `json:"currentActiveCount"`
+	CurrentCompletedTaskCount uint32 `json:"currentCompletedTaskCount"`
+	CurrentCorePoolSize       uint32 `json:"currentCorePoolSize"`
+	CurrentLargestPoolSize    uint32 `json:"currentLargestPoolSize"`
+	CurrentMaximumPoolSize    uint32 `json:"currentMaximumPoolSize"`
+	CurrentPoolSize           uint32 `json:"currentPoolSize"`
+	CurrentQueueSize          uint32 `json:"currentQueueSize"`
+	CurrentTaskCount          uint32 `json:"currentTaskCount"`
+
+	RollingMaxActiveThreads     uint32 `json:"rollingMaxActiveThreads"`
+	RollingCountThreadsExecuted uint32 `json:"rollingCountThreadsExecuted"`
+
+	RollingStatsWindow          uint32 `json:"propertyValue_metricsRollingStatisticalWindowInMilliseconds"`
+	QueueSizeRejectionThreshold uint32 `json:"propertyValue_queueSizeRejectionThreshold"`
+}
+
+// hystrixLatency are the percentiles of a command's latency in milliseconds.
+type hystrixLatency struct {
+	P0   uint32 `json:"0"`
+	P25  uint32 `json:"25"`
+	P50  uint32 `json:"50"`
+	P75  uint32 `json:"75"`
+	P90  uint32 `json:"90"`
+	P95  uint32 `json:"95"`
+	P99  uint32 `json:"99"`
+	P995 uint32 `json:"99.5"`
+	P100 uint32 `json:"100"`
+}
+
+func newHystrixLatency(t *rolling.Timing) hystrixLatency {
+	return hystrixLatency{
+		P0:   t.Percentile(0),
+		P25:  t.Percentile(25),
+		P50:  t.Percentile(50),
+		P75:  t.Percentile(75),
+		P90:  t.Percentile(90),
+		P95:  t.Percentile(95),
+		P99:  t.Percentile(99),
+		P995: t.Percentile(99.5),
+		P100: t.Percentile(100),
+	}
+}
+
+// NewHystrixMetricCollector returns a Hystrix metric collector initializer,
+// for metricCollector.Registry, bridging the events of every Hystrix command
+// into the given metrics. Events are counted by command and event, e.g.
+// short_circuits, and the duration of each run is observed by command.
+func NewHystrixMetricCollector(events metrics.Counter, durations metrics.Histogram) func(string) metricCollector.MetricCollector {
+	return func(command string) metricCollector.MetricCollector {
+		return &hystrixMetricCollector{command: command, events: events, durations: durations}
+	}
+}
+
+type hystrixMetricCollector struct {
+	command   string
+	events    metrics.Counter
+	durations metrics.Histogram
+}
+
+func (c *hystrixMetricCollector) increment(event string) {
+	c.events.With("command", c.command, "event", event).Add(1)
+}
+
+func (c *hystrixMetricCollector) IncrementAttempts()          { c.increment("attempts") }
+func (c *hystrixMetricCollector) IncrementErrors()            { c.increment("errors") }
+func (c *hystrixMetricCollector) IncrementSuccesses()         { c.increment("successes") }
+func (c *hystrixMetricCollector) IncrementFailures()          { c.increment("failures") }
+func (c *hystrixMetricCollector) IncrementRejects()           { c.increment("rejects") }
+func (c *hystrixMetricCollector) IncrementShortCircuits()     { c.increment("short_circuits") }
+func (c *hystrixMetricCollector) IncrementTimeouts()          { c.increment("timeouts") }
+func (c *hystrixMetricCollector) IncrementFallbackSuccesses() { c.increment("fallback_successes") }
+func (c *hystrixMetricCollector) IncrementFallbackFailures()  { c.increment("fallback_failures") }
+
+// UpdateTotalDuration is not bridged, as it differs from the run duration
+// only by the time spent waiting on the command's concurrency limit.
+func (c *hystrixMetricCollector) UpdateTotalDuration(time.Duration) {}
+
+func (c *hystrixMetricCollector) UpdateRunDuration(d time.Duration) {
+	c.durations.With("command", c.command).Observe(d.Seconds())
+}
+
+// Reset is a no-op, as the bridged metrics are cumulative.
+func (c *hystrixMetricCollector) Reset() {}
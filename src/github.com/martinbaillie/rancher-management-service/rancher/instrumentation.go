@@ -48,6 +48,21 @@ func (s *serverServiceInstrumenter) Container(ctx context.Context, name string)
 	return s.service.Container(ctx, name)
 }
 
+// CacheStatus passes straight through to the wrapped ServerService.
+// NOTE: Not instrumented as it accompanies every other ServerService call.
+func (s *serverServiceInstrumenter) CacheStatus(ctx context.Context) CacheStatus {
+	return s.service.CacheStatus(ctx)
+}
+
+// WatchContainers decorates the wrapped ServerService method with useful Prometheus instrumentation.
+func (s *serverServiceInstrumenter) WatchContainers(ctx context.Context) <-chan ContainerEvent {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "WatchContainers").Add(1)
+		s.requestLatency.With("method", "WatchContainers").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+	return s.service.WatchContainers(ctx)
+}
+
 // NewClientServiceInstrumenter returns an instance of an instrumenting ClientService.
 func NewClientServiceInstrumenter(rc metrics.Counter, rl metrics.Histogram, cs metrics.Gauge, hs metrics.Gauge, s ClientService) ClientService {
 	return &clientServiceInstrumenter{
@@ -68,21 +83,84 @@ type clientServiceInstrumenter struct {
 }
 
 // MetadataContainers decorates the wrapped ClientService method with useful Prometheus instrumentation.
-func (s *clientServiceInstrumenter) MetadataContainers() (cs []*Container, err error) {
+func (s *clientServiceInstrumenter) MetadataContainers(ctx context.Context) (cs []*Container, err error) {
 	defer func(begin time.Time) {
 		s.requestCount.With("method", "MetadataContainers").Add(1)
 		s.requestLatency.With("method", "MetadataContainers").Observe(time.Since(begin).Seconds())
 		s.containers.With("method", "MetadataContainers").Set(float64(len(cs)))
 	}(time.Now())
-	return s.service.MetadataContainers()
+	return s.service.MetadataContainers(ctx)
 }
 
 // MetadataHosts decorates the wrapped ClientService method with useful Prometheus instrumentation.
-func (s *clientServiceInstrumenter) MetadataHosts() (hs []*Host, err error) {
+func (s *clientServiceInstrumenter) MetadataHosts(ctx context.Context) (hs []*Host, err error) {
 	defer func(begin time.Time) {
 		s.requestCount.With("method", "MetadataHosts").Add(1)
 		s.requestLatency.With("method", "MetadataHosts").Observe(time.Since(begin).Seconds())
 		s.hosts.With("method", "MetadataHosts").Set(float64(len(hs)))
 	}(time.Now())
-	return s.service.MetadataHosts()
+	return s.service.MetadataHosts(ctx)
+}
+
+// APIContainer decorates the wrapped ClientService method with useful Prometheus instrumentation.
+func (s *clientServiceInstrumenter) APIContainer(ctx context.Context, c *Container) (*APIContainer, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "APIContainer").Add(1)
+		s.requestLatency.With("method", "APIContainer").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+	return s.service.APIContainer(ctx, c)
+}
+
+// APIContainerByID decorates the wrapped ClientService method with useful Prometheus instrumentation.
+func (s *clientServiceInstrumenter) APIContainerByID(ctx context.Context, id string) (*APIContainer, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "APIContainerByID").Add(1)
+		s.requestLatency.With("method", "APIContainerByID").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+	return s.service.APIContainerByID(ctx, id)
+}
+
+// APIContainerAction decorates the wrapped ClientService method with useful Prometheus instrumentation.
+func (s *clientServiceInstrumenter) APIContainerAction(ctx context.Context, id, action string) (*APIContainer, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "APIContainerAction").Add(1)
+		s.requestLatency.With("method", "APIContainerAction").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+	return s.service.APIContainerAction(ctx, id, action)
+}
+
+// APIService decorates the wrapped ClientService method with useful Prometheus instrumentation.
+func (s *clientServiceInstrumenter) APIService(ctx context.Context, stack, service string) (*APIService, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "APIService").Add(1)
+		s.requestLatency.With("method", "APIService").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+	return s.service.APIService(ctx, stack, service)
+}
+
+// APIServiceByID decorates the wrapped ClientService method with useful Prometheus instrumentation.
+func (s *clientServiceInstrumenter) APIServiceByID(ctx context.Context, id string) (*APIService, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "APIServiceByID").Add(1)
+		s.requestLatency.With("method", "APIServiceByID").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+	return s.service.APIServiceByID(ctx, id)
+}
+
+// APIServiceScale decorates the wrapped ClientService method with useful Prometheus instrumentation.
+func (s *clientServiceInstrumenter) APIServiceScale(ctx context.Context, id string, scale int) (*APIService, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "APIServiceScale").Add(1)
+		s.requestLatency.With("method", "APIServiceScale").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+	return s.service.APIServiceScale(ctx, id, scale)
+}
+
+// APIServiceAction decorates the wrapped ClientService method with useful Prometheus instrumentation.
+func (s *clientServiceInstrumenter) APIServiceAction(ctx context.Context, id, action string, input interface{}) (*APIService, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "APIServiceAction").Add(1)
+		s.requestLatency.With("method", "APIServiceAction").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+	return s.service.APIServiceAction(ctx, id, action, input)
 }
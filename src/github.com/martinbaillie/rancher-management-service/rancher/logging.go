@@ -54,7 +54,7 @@ func Log(logger log.Logger, begin time.Time, err error, additionalKVs ...interfa
 // Containers decorates the wrapped ServerService method with useful structured logging.
 func (s *serverServiceLogger) Containers(ctx context.Context) (cs []*Container, err error) {
 	defer func(begin time.Time) {
-		Log(s.logger, begin, err, "container_count", len(cs))
+		Log(withCorrelation(s.logger, ctx), begin, err, "container_count", len(cs))
 	}(time.Now())
 	return s.service.Containers(ctx)
 }
@@ -62,11 +62,25 @@ func (s *serverServiceLogger) Containers(ctx context.Context) (cs []*Container,
 // Container decorates the wrapped ServerService method with useful structured logging.
 func (s *serverServiceLogger) Container(ctx context.Context, name string) (c *Container, err error) {
 	defer func(begin time.Time) {
-		Log(s.logger, begin, err, "container_name", name)
+		Log(withCorrelation(s.logger, ctx), begin, err, "container_name", name)
 	}(time.Now())
 	return s.service.Container(ctx, name)
 }
 
+// CacheStatus passes straight through to the wrapped ServerService.
+// NOTE: Not logged as it accompanies every other ServerService call.
+func (s *serverServiceLogger) CacheStatus(ctx context.Context) CacheStatus {
+	return s.service.CacheStatus(ctx)
+}
+
+// WatchContainers decorates the wrapped ServerService method with useful structured logging.
+func (s *serverServiceLogger) WatchContainers(ctx context.Context) <-chan ContainerEvent {
+	defer func(begin time.Time) {
+		Log(withCorrelation(s.logger, ctx), begin, nil)
+	}(time.Now())
+	return s.service.WatchContainers(ctx)
+}
+
 // NewClientServiceLogger returns a new instance of a ClientService logging wrapper.
 func NewClientServiceLogger(l log.Logger, s ClientService) ClientService {
 	return &clientServiceLogger{
@@ -81,17 +95,107 @@ type clientServiceLogger struct {
 }
 
 // MetadataContainers decorates the wrapped ClientService method with useful structured logging.
-func (s *clientServiceLogger) MetadataContainers() (cs []*Container, err error) {
+func (s *clientServiceLogger) MetadataContainers(ctx context.Context) (cs []*Container, err error) {
 	defer func(begin time.Time) {
-		Log(s.logger, begin, err, "container_count", len(cs))
+		Log(withCorrelation(s.logger, ctx), begin, err, "container_count", len(cs))
 	}(time.Now())
-	return s.service.MetadataContainers()
+	return s.service.MetadataContainers(ctx)
 }
 
 // MetadataHosts decorates the wrapped ClientService method with useful structured logging.
-func (s *clientServiceLogger) MetadataHosts() (hs []*Host, err error) {
+func (s *clientServiceLogger) MetadataHosts(ctx context.Context) (hs []*Host, err error) {
+	defer func(begin time.Time) {
+		Log(withCorrelation(s.logger, ctx), begin, err, "host_count", len(hs))
+	}(time.Now())
+	return s.service.MetadataHosts(ctx)
+}
+
+// APIContainer decorates the wrapped ClientService method with useful structured logging.
+func (s *clientServiceLogger) APIContainer(ctx context.Context, c *Container) (ac *APIContainer, err error) {
+	defer func(begin time.Time) {
+		Log(withCorrelation(s.logger, ctx), begin, err, "container_name", c.Name)
+	}(time.Now())
+	return s.service.APIContainer(ctx, c)
+}
+
+// APIContainerByID decorates the wrapped ClientService method with useful structured logging.
+func (s *clientServiceLogger) APIContainerByID(ctx context.Context, id string) (ac *APIContainer, err error) {
+	defer func(begin time.Time) {
+		Log(withCorrelation(s.logger, ctx), begin, err, "container_id", id)
+	}(time.Now())
+	return s.service.APIContainerByID(ctx, id)
+}
+
+// APIContainerAction decorates the wrapped ClientService method with useful structured logging.
+func (s *clientServiceLogger) APIContainerAction(ctx context.Context, id, action string) (ac *APIContainer, err error) {
+	defer func(begin time.Time) {
+		Log(withCorrelation(s.logger, ctx), begin, err, "container_id", id, "action", action)
+	}(time.Now())
+	return s.service.APIContainerAction(ctx, id, action)
+}
+
+// APIService decorates the wrapped ClientService method with useful structured logging.
+func (s *clientServiceLogger) APIService(ctx context.Context, stack, service string) (as *APIService, err error) {
+	defer func(begin time.Time) {
+		Log(withCorrelation(s.logger, ctx), begin, err, "stack_name", stack, "service_name", service)
+	}(time.Now())
+	return s.service.APIService(ctx, stack, service)
+}
+
+// APIServiceByID decorates the wrapped ClientService method with useful structured logging.
+func (s *clientServiceLogger) APIServiceByID(ctx context.Context, id string) (as *APIService, err error) {
+	defer func(begin time.Time) {
+		Log(withCorrelation(s.logger, ctx), begin, err, "service_id", id)
+	}(time.Now())
+	return s.service.APIServiceByID(ctx, id)
+}
+
+// APIServiceScale decorates the wrapped ClientService method with useful structured logging.
+func (s *clientServiceLogger) APIServiceScale(ctx context.Context, id string, scale int) (as *APIService, err error) {
+	defer func(begin time.Time) {
+		Log(withCorrelation(s.logger, ctx), begin, err, "service_id", id, "scale", scale)
+	}(time.Now())
+	return s.service.APIServiceScale(ctx, id, scale)
+}
+
+// APIServiceAction decorates the wrapped ClientService method with useful structured logging.
+func (s *clientServiceLogger) APIServiceAction(ctx context.Context, id, action string, input interface{}) (as *APIService, err error) {
+	defer func(begin time.Time) {
+		Log(withCorrelation(s.logger, ctx), begin, err, "service_id", id, "action", action)
+	}(time.Now())
+	return s.service.APIServiceAction(ctx, id, action, input)
+}
+
+// NewSnapshotStoreLogger returns a new instance of a SnapshotStore logging wrapper.
+func NewSnapshotStoreLogger(l log.Logger, s SnapshotStore) SnapshotStore {
+	return &snapshotStoreLogger{
+		logger: l,
+		store:  s,
+	}
+}
+
+type snapshotStoreLogger struct {
+	logger log.Logger
+	store  SnapshotStore
+}
+
+// Load decorates the wrapped SnapshotStore method with useful structured logging.
+func (s *snapshotStoreLogger) Load() (snap *Snapshot, err error) {
+	defer func(begin time.Time) {
+		if snap == nil {
+			Log(s.logger, begin, err, "restored", false)
+			return
+		}
+		Log(s.logger, begin, err, "restored", true, "refreshed", snap.Refreshed,
+			"container_count", len(snap.Containers), "host_count", len(snap.Hosts))
+	}(time.Now())
+	return s.store.Load()
+}
+
+// Save decorates the wrapped SnapshotStore method with useful structured logging.
+func (s *snapshotStoreLogger) Save(snap *Snapshot) (err error) {
 	defer func(begin time.Time) {
-		Log(s.logger, begin, err, "host_count", len(hs))
+		Log(s.logger, begin, err, "container_count", len(snap.Containers), "host_count", len(snap.Hosts))
 	}(time.Now())
-	return s.service.MetadataHosts()
+	return s.store.Save(snap)
 }
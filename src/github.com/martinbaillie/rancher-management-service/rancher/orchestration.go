@@ -0,0 +1,636 @@
+// Copyright 2017 Martin Baillie <martin.t.baillie@gmail.com>.
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file or at:
+// https://opensource.org/licenses/BSD-3-Clause
+
+package rancher
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/tracing/opentracing"
+
+	stdopentracing "github.com/opentracing/opentracing-go"
+)
+
+// Service action errors
+var (
+	ErrServiceActionUnknown     = errors.New("unknown service action")
+	ErrServiceActionUnavailable = errors.New("service action unavailable in its current state")
+	ErrServiceScaleInvalid      = errors.New("service scale must be given and not negative")
+	ErrServiceScaleGlobal       = errors.New("globally scheduled services cannot be scaled")
+	ErrServiceActionNotFound    = errors.New("service action not found")
+	ErrServiceActionTimeout     = errors.New("timed out waiting for service to transition")
+)
+
+// Service actions
+const (
+	ServiceScale         = "scale"
+	ServiceUpgrade       = "upgrade"
+	ServiceFinishUpgrade = "finishupgrade"
+	ServiceRollback      = "rollback"
+)
+
+// Rancher's in-service upgrade defaults
+const (
+	defUpgradeBatchSize      = 1
+	defUpgradeIntervalMillis = 2000
+)
+
+// ServiceTransitionError is returned when Rancher fails to transition a
+// service after an action.
+type ServiceTransitionError struct {
+	State   string
+	Message string
+}
+
+func (e *ServiceTransitionError) Error() string {
+	return "service transition failed in state " + e.State + ": " + e.Message
+}
+
+// UpgradeStrategy describes an in-service upgrade, or the step that follows
+// one.
+//
+// swagger:model upgradeStrategy
+type UpgradeStrategy struct {
+	// the action, one of upgrade (the default), finishupgrade or rollback
+	Action string `json:"Action,omitempty"`
+	// the number of containers upgraded at once, defaulting to 1
+	BatchSize int `json:"BatchSize,omitempty"`
+	// the milliseconds between batches, defaulting to 2000
+	IntervalMillis int64 `json:"IntervalMillis,omitempty"`
+	// whether new containers start before the old are stopped
+	StartFirst bool `json:"StartFirst,omitempty"`
+	// the image to upgrade to, defaulting to the service's current image
+	Image string `json:"Image,omitempty"`
+}
+
+// ServiceContainer is a container of a service, as last observed in the
+// repository.
+//
+// swagger:model serviceContainer
+type ServiceContainer struct {
+	// the name of the container in Rancher
+	// required: true
+	Name string `json:"Name"`
+	// the state of the container in Rancher
+	// required: true
+	State string `json:"State"`
+	// whether the container was created after the action began
+	New bool `json:"New,omitempty"`
+}
+
+// ServiceProgress is the progress of an action upon a service, as observed
+// in the repository.
+//
+// swagger:model serviceProgress
+type ServiceProgress struct {
+	// the ID of the action, by which its progress is served
+	// required: true
+	ActionID string `json:"ActionID"`
+	// the name of the stack
+	// required: true
+	Stack string `json:"Stack"`
+	// the name of the service
+	// required: true
+	Service string `json:"Service"`
+	// the Rancher API ID of the service
+	// required: true
+	ID string `json:"ID"`
+	// the action taken, one of scale, upgrade, finishupgrade or rollback
+	// required: true
+	Action string `json:"Action"`
+	// the Rancher state of the service when last checked
+	// required: true
+	State string `json:"State"`
+	// the number of running containers the action is complete with
+	// required: true
+	Desired int `json:"Desired"`
+	// the number of the service's containers running
+	// required: true
+	Running int `json:"Running"`
+	// the number of containers created after the action began and running
+	// required: true
+	NewRunning int `json:"NewRunning"`
+	// the service's containers
+	Containers []ServiceContainer `json:"Containers,omitempty"`
+	// when the action began
+	// required: true
+	Started time.Time `json:"Started"`
+	// when the action completed, failed or timed out
+	Finished *time.Time `json:"Finished,omitempty"`
+	// whether the action completed before the service action timeout
+	// required: true
+	Complete bool `json:"Complete"`
+	// why the action failed or timed out, if it did
+	Error string `json:"Error,omitempty"`
+}
+
+// observe summarises the service's containers, by name, noting those not
+// present before the action began.
+func (p *ServiceProgress) observe(cs map[string]*Container, before map[string]bool) {
+	p.Running, p.NewRunning, p.Containers = 0, 0, nil
+	for name, c := range cs {
+		sc := ServiceContainer{Name: name, State: c.State, New: !before[name]}
+		if c.State == "running" {
+			p.Running++
+			if sc.New {
+				p.NewRunning++
+			}
+		}
+		p.Containers = append(p.Containers, sc)
+	}
+	sort.Slice(p.Containers, func(i, j int) bool { return p.Containers[i].Name < p.Containers[j].Name })
+}
+
+// done reports whether the service's containers reflect the completed action.
+func (p *ServiceProgress) done() bool {
+	switch p.Action {
+	case ServiceScale:
+		return p.Running == p.Desired && len(p.Containers) == p.Desired
+	case ServiceUpgrade:
+		return p.NewRunning >= p.Desired
+	case ServiceFinishUpgrade:
+		return p.Running >= p.Desired && len(p.Containers) == p.Running
+	default:
+		return p.Running >= p.Desired
+	}
+}
+
+// ScaleService implements ActionService.
+// It scales the service through the Rancher API and, in the background,
+// watches the Repository until exactly the desired number of its containers
+// are running.
+func (s actionService) ScaleService(ctx context.Context, stack, service string, scale int) (*ServiceProgress, error) {
+	if scale < 0 {
+		return nil, ErrServiceScaleInvalid
+	}
+
+	svc, err := s.client.APIService(ctx, stack, service)
+	if err != nil {
+		return nil, err
+	}
+	if serviceGlobal(svc) {
+		return nil, ErrServiceScaleGlobal
+	}
+
+	t, err := s.watch(ctx, stack, service)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &ServiceProgress{Stack: stack, Service: service, ID: svc.ID, Action: ServiceScale, Desired: scale, Started: time.Now()}
+	if svc, err = s.client.APIServiceScale(ctx, svc.ID, scale); err != nil {
+		t.cancel()
+		return nil, err
+	}
+	return s.start(t, p, svc), nil
+}
+
+// UpgradeService implements ActionService.
+// It upgrades, finishes upgrading or rolls back the service through the
+// Rancher API and, in the background, watches the Repository until the
+// containers it replaces are running.
+//
+// An upgrade is complete once as many new containers are running as the
+// service is scaled to, or as were running for a global service. Finishing
+// an upgrade is complete once only running containers remain, and a rollback
+// once as many containers as desired run again.
+func (s actionService) UpgradeService(ctx context.Context, stack, service string, u UpgradeStrategy) (*ServiceProgress, error) {
+	if u.Action == "" {
+		u.Action = ServiceUpgrade
+	}
+	switch u.Action {
+	case ServiceUpgrade, ServiceFinishUpgrade, ServiceRollback:
+	default:
+		return nil, ErrServiceActionUnknown
+	}
+
+	svc, err := s.client.APIService(ctx, stack, service)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := svc.Actions[u.Action]; !ok {
+		return nil, ErrServiceActionUnavailable
+	}
+
+	t, err := s.watch(ctx, stack, service)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &ServiceProgress{Stack: stack, Service: service, ID: svc.ID, Action: u.Action, Desired: svc.Scale, Started: time.Now()}
+	if serviceGlobal(svc) || svc.Scale == 0 {
+		p.observe(t.cs, t.before)
+		p.Desired = p.Running
+	}
+
+	var input interface{}
+	if u.Action == ServiceUpgrade {
+		input = upgradeInput(svc, u)
+	}
+	if svc, err = s.client.APIServiceAction(ctx, svc.ID, u.Action, input); err != nil {
+		t.cancel()
+		return nil, err
+	}
+	return s.start(t, p, svc), nil
+}
+
+// ServiceAction implements ActionService.
+// It returns the progress of an action upon the service, while it is
+// tracked and for a service action timeout after.
+func (s actionService) ServiceAction(_ context.Context, stack, service, id string) (*ServiceProgress, error) {
+	p, ok := s.actions.get(id)
+	if !ok || p.Stack != stack || p.Service != service {
+		return nil, ErrServiceActionNotFound
+	}
+	return p, nil
+}
+
+// upgradeInput builds the Rancher in-service upgrade of the service, passing
+// back its launch configs with the image replaced, if one is given.
+func upgradeInput(svc *APIService, u UpgradeStrategy) apiServiceUpgrade {
+	strategy := apiInServiceStrategy{
+		BatchSize:              u.BatchSize,
+		IntervalMillis:         u.IntervalMillis,
+		StartFirst:             u.StartFirst,
+		LaunchConfig:           svc.LaunchConfig,
+		SecondaryLaunchConfigs: svc.SecondaryLaunchConfigs,
+	}
+	if strategy.BatchSize < 1 {
+		strategy.BatchSize = defUpgradeBatchSize
+	}
+	if strategy.IntervalMillis < 1 {
+		strategy.IntervalMillis = defUpgradeIntervalMillis
+	}
+	if u.Image != "" {
+		lc := make(map[string]interface{}, len(svc.LaunchConfig)+1)
+		for k, v := range svc.LaunchConfig {
+			lc[k] = v
+		}
+		lc["imageUuid"] = "docker:" + u.Image
+		strategy.LaunchConfig = lc
+	}
+	return apiServiceUpgrade{InServiceStrategy: strategy}
+}
+
+// serviceGlobal reports whether the service is scheduled on every host.
+func serviceGlobal(svc *APIService) bool {
+	labels, _ := svc.LaunchConfig["labels"].(map[string]interface{})
+	return labels[rancherGlobalLabel] == "true"
+}
+
+// serviceContainers returns the service's containers in the Repository, by
+// name, along with the set of their names.
+func (s actionService) serviceContainers(stack, service string) (map[string]*Container, map[string]bool, error) {
+	all, err := s.repository.Containers()
+	if err != nil {
+		return nil, nil, err
+	}
+	cs := make(map[string]*Container)
+	names := make(map[string]bool)
+	for _, c := range all {
+		if c.StackName == stack && c.ServiceName == service {
+			cs[c.Name] = c
+			names[c.Name] = true
+		}
+	}
+	return cs, names, nil
+}
+
+// serviceActions holds the progress of the actions upon services, by ID.
+type serviceActions struct {
+	mtx      sync.RWMutex
+	progress map[string]*ServiceProgress
+}
+
+// put notes a copy of the progress.
+func (a *serviceActions) put(p *ServiceProgress) {
+	cp := *p
+	a.mtx.Lock()
+	a.progress[p.ActionID] = &cp
+	a.mtx.Unlock()
+}
+
+// get returns a copy of the action's progress, if it is known.
+func (a *serviceActions) get(id string) (*ServiceProgress, bool) {
+	a.mtx.RLock()
+	defer a.mtx.RUnlock()
+
+	p, ok := a.progress[id]
+	if !ok {
+		return nil, false
+	}
+	cp := *p
+	return &cp, true
+}
+
+// forget drops the action's progress after the duration.
+func (a *serviceActions) forget(id string, after time.Duration) {
+	time.AfterFunc(after, func() {
+		a.mtx.Lock()
+		delete(a.progress, id)
+		a.mtx.Unlock()
+	})
+}
+
+// serviceTracking is what is known of a service's containers from just
+// before an action is taken upon it.
+type serviceTracking struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	events <-chan ContainerEvent
+	cs     map[string]*Container
+	before map[string]bool
+}
+
+// watch subscribes to the Repository's changes and only then snapshots the
+// service's containers, ahead of an action upon the service, so that no
+// change to them is missed.
+//
+// Tracking outlives the request, for up to the service action timeout, but
+// carries its request ID and a span following from its own.
+func (s actionService) watch(ctx context.Context, stack, service string) (*serviceTracking, error) {
+	tctx, cancel := context.WithTimeout(ContextWithRequestID(s.ctx, RequestIDFromContext(ctx)), s.cfg.ServiceTimeout)
+	t := &serviceTracking{ctx: tctx, cancel: cancel}
+	if parent := stdopentracing.SpanFromContext(ctx); parent != nil {
+		span := parent.Tracer().StartSpan("rancher-service-action-tracking", stdopentracing.FollowsFrom(parent.Context()))
+		t.ctx = stdopentracing.ContextWithSpan(tctx, span)
+		t.cancel = func() {
+			cancel()
+			span.Finish()
+		}
+	}
+
+	t.events = s.repository.WatchContainers(t.ctx)
+	var err error
+	if t.cs, t.before, err = s.serviceContainers(stack, service); err != nil {
+		t.cancel()
+		return nil, err
+	}
+	return t, nil
+}
+
+// start tracks the action in the background, returning its progress so far.
+// The progress is served by ServiceAction until a service action timeout
+// after tracking stops.
+func (s actionService) start(t *serviceTracking, p *ServiceProgress, svc *APIService) *ServiceProgress {
+	p.ActionID = NewRequestID()
+	p.State = svc.State
+	p.observe(t.cs, t.before)
+	s.actions.put(p)
+	started := *p
+
+	go func() {
+		defer t.cancel()
+		if err := s.track(t, p, svc); err != nil {
+			finished := time.Now()
+			p.Finished = &finished
+			p.Error = err.Error()
+		}
+		s.actions.put(p)
+		s.actions.forget(p.ActionID, s.cfg.ServiceTimeout)
+	}()
+	return &started
+}
+
+// track watches the Repository for changes to the service's containers,
+// polling the Rancher API for the service's state, until the action is done
+// or the context expires. An action is done once Rancher has finished
+// transitioning the service and its containers reflect the action.
+//
+// NOTE: Progress is only as fresh as the Repository's cache, so an action
+// may time out after Rancher has finished it.
+func (s actionService) track(t *serviceTracking, p *ServiceProgress, svc *APIService) error {
+	ctx, events, cs := t.ctx, t.events, t.cs
+
+	poll := time.NewTicker(s.cfg.PollInterval)
+	defer poll.Stop()
+	for {
+		if svc.Transitioning == "error" {
+			return &ServiceTransitionError{State: svc.State, Message: svc.TransitioningMessage}
+		}
+		p.State = svc.State
+		p.observe(cs, t.before)
+		if !svc.transitioning() && p.done() {
+			finished := time.Now()
+			p.Finished = &finished
+			p.Complete = true
+			return nil
+		}
+		s.actions.put(p)
+
+		select {
+		case e, ok := <-events:
+			if !ok {
+				if ctx.Err() != nil {
+					return serviceTrackingErr(ctx)
+				}
+				// Fell behind, so watch again before starting again from the
+				// cache
+				events = s.repository.WatchContainers(ctx)
+				var err error
+				if cs, _, err = s.serviceContainers(p.Stack, p.Service); err != nil {
+					return err
+				}
+				continue
+			}
+			if e.Container.StackName != p.Stack || e.Container.ServiceName != p.Service {
+				continue
+			}
+			if e.Type == ContainerRemoved {
+				delete(cs, e.Container.Name)
+			} else {
+				cs[e.Container.Name] = e.Container
+			}
+		case <-poll.C:
+			latest, err := s.client.APIServiceByID(ctx, p.ID)
+			if err != nil {
+				if ctx.Err() != nil {
+					return serviceTrackingErr(ctx)
+				}
+				return err
+			}
+			svc = latest
+		case <-ctx.Done():
+			return serviceTrackingErr(ctx)
+		}
+	}
+}
+
+// serviceTrackingErr is why tracking stopped with the context.
+func serviceTrackingErr(ctx context.Context) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		return ErrServiceActionTimeout
+	}
+	return ctx.Err()
+}
+
+// NewServiceScaleEndpoint creates an endpoint scaling services with the
+// ActionService, decorated with tracing.
+func NewServiceScaleEndpoint(s ActionService, t stdopentracing.Tracer) endpoint.Endpoint {
+	return opentracing.TraceServer(t, "rancher-service-scale-endpoint")(ServiceScaleEndpoint(s))
+}
+
+// NewServiceUpgradeEndpoint creates an endpoint upgrading services with the
+// ActionService, decorated with tracing.
+func NewServiceUpgradeEndpoint(s ActionService, t stdopentracing.Tracer) endpoint.Endpoint {
+	return opentracing.TraceServer(t, "rancher-service-upgrade-endpoint")(ServiceUpgradeEndpoint(s))
+}
+
+// NewServiceActionEndpoint creates an endpoint serving the progress of
+// actions upon services with the ActionService, decorated with tracing.
+func NewServiceActionEndpoint(s ActionService, t stdopentracing.Tracer) endpoint.Endpoint {
+	return opentracing.TraceServer(t, "rancher-service-action-endpoint")(ServiceActionEndpoint(s))
+}
+
+// serviceScaleRequest A service scale parameter model.
+//
+// Used for identifying the service and the scale to change it to.
+//
+// swagger:parameters serviceScale
+type serviceScaleRequest struct {
+	// The name of the stack
+	//
+	// in: path
+	// required: true
+	Stack string `json:"-"`
+	// The name of the service
+	//
+	// in: path
+	// required: true
+	Service string `json:"-"`
+	// The number of containers to scale the service to
+	//
+	// in: body
+	// required: true
+	Scale *int `json:"Scale"`
+}
+
+// serviceUpgradeRequest A service upgrade parameter model.
+//
+// Used for identifying the service and how to upgrade it.
+//
+// swagger:parameters serviceUpgrade
+type serviceUpgradeRequest struct {
+	// The name of the stack
+	//
+	// in: path
+	// required: true
+	Stack string
+	// The name of the service
+	//
+	// in: path
+	// required: true
+	Service string
+	// The upgrade, defaulting to an upgrade in batches of 1 every 2 seconds
+	//
+	// in: body
+	Strategy UpgradeStrategy
+}
+
+// serviceActionRequest A service action parameter model.
+//
+// Used for identifying an action upon a service.
+//
+// swagger:parameters serviceAction
+type serviceActionRequest struct {
+	// The name of the stack
+	//
+	// in: path
+	// required: true
+	Stack string
+	// The name of the service
+	//
+	// in: path
+	// required: true
+	Service string
+	// The ID of the action
+	//
+	// in: path
+	// required: true
+	ID string
+}
+
+// serviceProgressResponse A service progress response model.
+//
+// Used for returning the progress of an action upon a service.
+//
+// swagger:response serviceProgressResponse
+type serviceProgressResponse struct {
+	// in: body
+	Progress *ServiceProgress `json:"Progress,omitempty"`
+	// in: body
+	Err error `json:"Error,omitempty"`
+
+	accepted bool
+}
+
+func (r serviceProgressResponse) error() error { return r.Err }
+
+// status is 202 Accepted once an action is taken, as it is tracked in the
+// background.
+func (r serviceProgressResponse) status() int {
+	if r.accepted {
+		return http.StatusAccepted
+	}
+	return http.StatusOK
+}
+
+// location is the action's progress, relative to where it was taken.
+func (r serviceProgressResponse) location() string {
+	if !r.accepted || r.Progress == nil {
+		return ""
+	}
+	return "actions/" + r.Progress.ActionID
+}
+
+// ServiceScaleEndpoint scales a service with the ActionService.
+func ServiceScaleEndpoint(s ActionService) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(serviceScaleRequest)
+		if req.Scale == nil {
+			return serviceProgressResponse{Err: ErrServiceScaleInvalid}, nil
+		}
+		p, err := s.ScaleService(ctx, req.Stack, req.Service, *req.Scale)
+		return serviceProgressResponse{
+			Progress: p,
+			Err:      err,
+			accepted: err == nil,
+		}, nil
+	}
+}
+
+// ServiceUpgradeEndpoint upgrades a service with the ActionService.
+func ServiceUpgradeEndpoint(s ActionService) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(serviceUpgradeRequest)
+		p, err := s.UpgradeService(ctx, req.Stack, req.Service, req.Strategy)
+		return serviceProgressResponse{
+			Progress: p,
+			Err:      err,
+			accepted: err == nil,
+		}, nil
+	}
+}
+
+// ServiceActionEndpoint serves the progress of an action upon a service with
+// the ActionService.
+func ServiceActionEndpoint(s ActionService) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(serviceActionRequest)
+		p, err := s.ServiceAction(ctx, req.Stack, req.Service, req.ID)
+		return serviceProgressResponse{
+			Progress: p,
+			Err:      err,
+		}, nil
+	}
+}
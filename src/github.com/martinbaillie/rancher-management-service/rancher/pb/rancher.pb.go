@@ -0,0 +1,463 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// source: rancher.proto
+
+/*
+Package pb is a generated protocol buffer package.
+
+It is generated from these files:
+
+	rancher.proto
+
+It has these top-level messages:
+
+	Host
+	Container
+	ContainersRequest
+	ContainersReply
+	ContainerRequest
+	ContainerReply
+	WatchContainersRequest
+	ContainerEvent
+*/
+package pb
+
+import proto "github.com/golang/protobuf/proto"
+import fmt "fmt"
+import math "math"
+
+import (
+	context "golang.org/x/net/context"
+	grpc "google.golang.org/grpc"
+)
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ = proto.Marshal
+var _ = fmt.Errorf
+var _ = math.Inf
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the proto package it is being compiled against.
+// A compilation error at this line likely means your copy of the
+// proto package needs to be updated.
+const _ = proto.ProtoPackageIsVersion2 // please upgrade the proto package
+
+type ContainerEvent_Type int32
+
+const (
+	ContainerEvent_ADDED   ContainerEvent_Type = 0
+	ContainerEvent_UPDATED ContainerEvent_Type = 1
+	ContainerEvent_REMOVED ContainerEvent_Type = 2
+)
+
+var ContainerEvent_Type_name = map[int32]string{
+	0: "ADDED",
+	1: "UPDATED",
+	2: "REMOVED",
+}
+var ContainerEvent_Type_value = map[string]int32{
+	"ADDED":   0,
+	"UPDATED": 1,
+	"REMOVED": 2,
+}
+
+func (x ContainerEvent_Type) String() string {
+	return proto.EnumName(ContainerEvent_Type_name, int32(x))
+}
+func (ContainerEvent_Type) EnumDescriptor() ([]byte, []int) { return fileDescriptor0, []int{7, 0} }
+
+// A Rancher host.
+type Host struct {
+	Uuid string `protobuf:"bytes,1,opt,name=uuid" json:"uuid,omitempty"`
+	Name string `protobuf:"bytes,2,opt,name=name" json:"name,omitempty"`
+}
+
+func (m *Host) Reset()                    { *m = Host{} }
+func (m *Host) String() string            { return proto.CompactTextString(m) }
+func (*Host) ProtoMessage()               {}
+func (*Host) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{0} }
+
+func (m *Host) GetUuid() string {
+	if m != nil {
+		return m.Uuid
+	}
+	return ""
+}
+
+func (m *Host) GetName() string {
+	if m != nil {
+		return m.Name
+	}
+	return ""
+}
+
+// A Rancher container.
+type Container struct {
+	Name         string `protobuf:"bytes,1,opt,name=name" json:"name,omitempty"`
+	State        string `protobuf:"bytes,2,opt,name=state" json:"state,omitempty"`
+	PrivateIp    string `protobuf:"bytes,3,opt,name=private_ip,json=privateIp" json:"private_ip,omitempty"`
+	ServiceIndex int64  `protobuf:"varint,4,opt,name=service_index,json=serviceIndex" json:"service_index,omitempty"`
+	Host         *Host  `protobuf:"bytes,5,opt,name=host" json:"host,omitempty"`
+	Environment  string `protobuf:"bytes,6,opt,name=environment" json:"environment,omitempty"`
+}
+
+func (m *Container) Reset()                    { *m = Container{} }
+func (m *Container) String() string            { return proto.CompactTextString(m) }
+func (*Container) ProtoMessage()               {}
+func (*Container) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{1} }
+
+func (m *Container) GetName() string {
+	if m != nil {
+		return m.Name
+	}
+	return ""
+}
+
+func (m *Container) GetState() string {
+	if m != nil {
+		return m.State
+	}
+	return ""
+}
+
+func (m *Container) GetPrivateIp() string {
+	if m != nil {
+		return m.PrivateIp
+	}
+	return ""
+}
+
+func (m *Container) GetServiceIndex() int64 {
+	if m != nil {
+		return m.ServiceIndex
+	}
+	return 0
+}
+
+func (m *Container) GetHost() *Host {
+	if m != nil {
+		return m.Host
+	}
+	return nil
+}
+
+func (m *Container) GetEnvironment() string {
+	if m != nil {
+		return m.Environment
+	}
+	return ""
+}
+
+// The Containers request message.
+type ContainersRequest struct {
+}
+
+func (m *ContainersRequest) Reset()                    { *m = ContainersRequest{} }
+func (m *ContainersRequest) String() string            { return proto.CompactTextString(m) }
+func (*ContainersRequest) ProtoMessage()               {}
+func (*ContainersRequest) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{2} }
+
+// The Containers response message.
+type ContainersReply struct {
+	Containers []*Container `protobuf:"bytes,1,rep,name=containers" json:"containers,omitempty"`
+}
+
+func (m *ContainersReply) Reset()                    { *m = ContainersReply{} }
+func (m *ContainersReply) String() string            { return proto.CompactTextString(m) }
+func (*ContainersReply) ProtoMessage()               {}
+func (*ContainersReply) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{3} }
+
+func (m *ContainersReply) GetContainers() []*Container {
+	if m != nil {
+		return m.Containers
+	}
+	return nil
+}
+
+// The Container request message.
+type ContainerRequest struct {
+	Name string `protobuf:"bytes,1,opt,name=name" json:"name,omitempty"`
+}
+
+func (m *ContainerRequest) Reset()                    { *m = ContainerRequest{} }
+func (m *ContainerRequest) String() string            { return proto.CompactTextString(m) }
+func (*ContainerRequest) ProtoMessage()               {}
+func (*ContainerRequest) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{4} }
+
+func (m *ContainerRequest) GetName() string {
+	if m != nil {
+		return m.Name
+	}
+	return ""
+}
+
+// The Container response message.
+type ContainerReply struct {
+	Container *Container `protobuf:"bytes,1,opt,name=container" json:"container,omitempty"`
+}
+
+func (m *ContainerReply) Reset()                    { *m = ContainerReply{} }
+func (m *ContainerReply) String() string            { return proto.CompactTextString(m) }
+func (*ContainerReply) ProtoMessage()               {}
+func (*ContainerReply) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{5} }
+
+func (m *ContainerReply) GetContainer() *Container {
+	if m != nil {
+		return m.Container
+	}
+	return nil
+}
+
+// The WatchContainers request message.
+type WatchContainersRequest struct {
+}
+
+func (m *WatchContainersRequest) Reset()                    { *m = WatchContainersRequest{} }
+func (m *WatchContainersRequest) String() string            { return proto.CompactTextString(m) }
+func (*WatchContainersRequest) ProtoMessage()               {}
+func (*WatchContainersRequest) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{6} }
+
+// A change to a Rancher container.
+type ContainerEvent struct {
+	Type      ContainerEvent_Type `protobuf:"varint,1,opt,name=type,enum=pb.ContainerEvent_Type" json:"type,omitempty"`
+	Container *Container          `protobuf:"bytes,2,opt,name=container" json:"container,omitempty"`
+}
+
+func (m *ContainerEvent) Reset()                    { *m = ContainerEvent{} }
+func (m *ContainerEvent) String() string            { return proto.CompactTextString(m) }
+func (*ContainerEvent) ProtoMessage()               {}
+func (*ContainerEvent) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{7} }
+
+func (m *ContainerEvent) GetType() ContainerEvent_Type {
+	if m != nil {
+		return m.Type
+	}
+	return ContainerEvent_ADDED
+}
+
+func (m *ContainerEvent) GetContainer() *Container {
+	if m != nil {
+		return m.Container
+	}
+	return nil
+}
+
+func init() {
+	proto.RegisterType((*Host)(nil), "pb.Host")
+	proto.RegisterType((*Container)(nil), "pb.Container")
+	proto.RegisterType((*ContainersRequest)(nil), "pb.ContainersRequest")
+	proto.RegisterType((*ContainersReply)(nil), "pb.ContainersReply")
+	proto.RegisterType((*ContainerRequest)(nil), "pb.ContainerRequest")
+	proto.RegisterType((*ContainerReply)(nil), "pb.ContainerReply")
+	proto.RegisterType((*WatchContainersRequest)(nil), "pb.WatchContainersRequest")
+	proto.RegisterType((*ContainerEvent)(nil), "pb.ContainerEvent")
+	proto.RegisterEnum("pb.ContainerEvent_Type", ContainerEvent_Type_name, ContainerEvent_Type_value)
+}
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ context.Context
+var _ grpc.ClientConn
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+const _ = grpc.SupportPackageIsVersion4
+
+// Client API for Rancher service
+
+type RancherClient interface {
+	// Get summaries of all Rancher containers in the environment.
+	Containers(ctx context.Context, in *ContainersRequest, opts ...grpc.CallOption) (*ContainersReply, error)
+	// Get a summary for a single Rancher container in the environment.
+	Container(ctx context.Context, in *ContainerRequest, opts ...grpc.CallOption) (*ContainerReply, error)
+	// Watch the Rancher containers in the environment for changes. The current
+	// containers are first sent as added, followed by changes as they are
+	// observed by the metadata cache.
+	WatchContainers(ctx context.Context, in *WatchContainersRequest, opts ...grpc.CallOption) (Rancher_WatchContainersClient, error)
+}
+
+type rancherClient struct {
+	cc *grpc.ClientConn
+}
+
+func NewRancherClient(cc *grpc.ClientConn) RancherClient {
+	return &rancherClient{cc}
+}
+
+func (c *rancherClient) Containers(ctx context.Context, in *ContainersRequest, opts ...grpc.CallOption) (*ContainersReply, error) {
+	out := new(ContainersReply)
+	err := grpc.Invoke(ctx, "/pb.Rancher/Containers", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *rancherClient) Container(ctx context.Context, in *ContainerRequest, opts ...grpc.CallOption) (*ContainerReply, error) {
+	out := new(ContainerReply)
+	err := grpc.Invoke(ctx, "/pb.Rancher/Container", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *rancherClient) WatchContainers(ctx context.Context, in *WatchContainersRequest, opts ...grpc.CallOption) (Rancher_WatchContainersClient, error) {
+	stream, err := grpc.NewClientStream(ctx, &_Rancher_serviceDesc.Streams[0], c.cc, "/pb.Rancher/WatchContainers", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &rancherWatchContainersClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Rancher_WatchContainersClient interface {
+	Recv() (*ContainerEvent, error)
+	grpc.ClientStream
+}
+
+type rancherWatchContainersClient struct {
+	grpc.ClientStream
+}
+
+func (x *rancherWatchContainersClient) Recv() (*ContainerEvent, error) {
+	m := new(ContainerEvent)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Server API for Rancher service
+
+type RancherServer interface {
+	// Get summaries of all Rancher containers in the environment.
+	Containers(context.Context, *ContainersRequest) (*ContainersReply, error)
+	// Get a summary for a single Rancher container in the environment.
+	Container(context.Context, *ContainerRequest) (*ContainerReply, error)
+	// Watch the Rancher containers in the environment for changes. The current
+	// containers are first sent as added, followed by changes as they are
+	// observed by the metadata cache.
+	WatchContainers(*WatchContainersRequest, Rancher_WatchContainersServer) error
+}
+
+func RegisterRancherServer(s *grpc.Server, srv RancherServer) {
+	s.RegisterService(&_Rancher_serviceDesc, srv)
+}
+
+func _Rancher_Containers_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ContainersRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RancherServer).Containers(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/pb.Rancher/Containers",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RancherServer).Containers(ctx, req.(*ContainersRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Rancher_Container_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ContainerRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RancherServer).Container(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/pb.Rancher/Container",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RancherServer).Container(ctx, req.(*ContainerRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Rancher_WatchContainers_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchContainersRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(RancherServer).WatchContainers(m, &rancherWatchContainersServer{stream})
+}
+
+type Rancher_WatchContainersServer interface {
+	Send(*ContainerEvent) error
+	grpc.ServerStream
+}
+
+type rancherWatchContainersServer struct {
+	grpc.ServerStream
+}
+
+func (x *rancherWatchContainersServer) Send(m *ContainerEvent) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+var _Rancher_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "pb.Rancher",
+	HandlerType: (*RancherServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Containers",
+			Handler:    _Rancher_Containers_Handler,
+		},
+		{
+			MethodName: "Container",
+			Handler:    _Rancher_Container_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "WatchContainers",
+			Handler:       _Rancher_WatchContainers_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "rancher.proto",
+}
+
+func init() { proto.RegisterFile("rancher.proto", fileDescriptor0) }
+
+var fileDescriptor0 = []byte{
+	// 421 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x84, 0x93, 0xdf, 0x8a, 0xd3, 0x40,
+	0x14, 0xc6, 0x3b, 0x6d, 0xba, 0x6b, 0x4e, 0xed, 0x6e, 0x3d, 0xbb, 0xea, 0x50, 0x14, 0xc2, 0x08,
+	0x52, 0x28, 0x06, 0x89, 0x17, 0x82, 0x20, 0xb8, 0x98, 0x80, 0x7b, 0x21, 0xca, 0xb0, 0xea, 0xe5,
+	0x92, 0x66, 0x07, 0x1a, 0xd8, 0x9d, 0x8c, 0xc9, 0x34, 0x98, 0x27, 0xf1, 0x59, 0x7c, 0x00, 0xdf,
+	0x4b, 0x66, 0xd2, 0xcd, 0x9f, 0xb6, 0xe0, 0x5d, 0xe6, 0x77, 0xbe, 0x73, 0xbe, 0x6f, 0x0e, 0x13,
+	0x98, 0xe6, 0xb1, 0x4c, 0xd6, 0x22, 0xf7, 0x55, 0x9e, 0xe9, 0x0c, 0x87, 0x6a, 0xc5, 0x7c, 0x70,
+	0x3e, 0x65, 0x85, 0x46, 0x04, 0x67, 0xb3, 0x49, 0x6f, 0x28, 0xf1, 0xc8, 0xc2, 0xe5, 0xf6, 0xdb,
+	0x30, 0x19, 0xdf, 0x09, 0x3a, 0xac, 0x99, 0xf9, 0x66, 0x7f, 0x08, 0xb8, 0x1f, 0x33, 0xa9, 0xe3,
+	0x54, 0x8a, 0xbc, 0x51, 0x90, 0x56, 0x81, 0xe7, 0x30, 0x2e, 0x74, 0xac, 0xef, 0xdb, 0xea, 0x03,
+	0x3e, 0x07, 0x50, 0x79, 0x5a, 0xc6, 0x5a, 0x5c, 0xa7, 0x8a, 0x8e, 0x6c, 0xc9, 0xdd, 0x92, 0x4b,
+	0x85, 0x2f, 0x60, 0x5a, 0x88, 0xbc, 0x4c, 0x13, 0x71, 0x9d, 0xca, 0x1b, 0xf1, 0x8b, 0x3a, 0x1e,
+	0x59, 0x8c, 0xf8, 0xc3, 0x2d, 0xbc, 0x34, 0x0c, 0x9f, 0x81, 0xb3, 0xce, 0x0a, 0x4d, 0xc7, 0x1e,
+	0x59, 0x4c, 0x82, 0x07, 0xbe, 0x5a, 0xf9, 0x26, 0x3b, 0xb7, 0x14, 0x3d, 0x98, 0x08, 0x59, 0xa6,
+	0x79, 0x26, 0xef, 0x84, 0xd4, 0xf4, 0xc8, 0x5a, 0x74, 0x11, 0x3b, 0x83, 0x47, 0x4d, 0xf4, 0x82,
+	0x8b, 0x9f, 0x1b, 0x51, 0x68, 0xf6, 0x01, 0x4e, 0xbb, 0x50, 0xdd, 0x56, 0xf8, 0x0a, 0x20, 0x69,
+	0x10, 0x25, 0xde, 0x68, 0x31, 0x09, 0xa6, 0xc6, 0xad, 0x11, 0xf2, 0x8e, 0x80, 0xbd, 0x84, 0x59,
+	0x5b, 0xa8, 0xa7, 0x1e, 0x5a, 0x0c, 0x7b, 0x0f, 0x27, 0x1d, 0x9d, 0x31, 0x5a, 0x82, 0xdb, 0xcc,
+	0xb1, 0xd2, 0x3d, 0x9f, 0xb6, 0xce, 0x28, 0x3c, 0xf9, 0x11, 0xeb, 0x64, 0xbd, 0x7f, 0x85, 0xdf,
+	0xa4, 0x33, 0x39, 0x2a, 0x85, 0xd4, 0xb8, 0x04, 0x47, 0x57, 0xaa, 0xf6, 0x3f, 0x09, 0x9e, 0xf6,
+	0x86, 0x5a, 0x85, 0x7f, 0x55, 0x29, 0xc1, 0xad, 0xa8, 0x1f, 0x63, 0xf8, 0x9f, 0x18, 0x4b, 0x70,
+	0x4c, 0x2b, 0xba, 0x30, 0xbe, 0x08, 0xc3, 0x28, 0x9c, 0x0d, 0x70, 0x02, 0xc7, 0xdf, 0xbe, 0x86,
+	0x17, 0x57, 0x51, 0x38, 0x23, 0xe6, 0xc0, 0xa3, 0xcf, 0x5f, 0xbe, 0x47, 0xe1, 0x6c, 0x18, 0xfc,
+	0x25, 0x70, 0xcc, 0xeb, 0x37, 0x87, 0xef, 0x00, 0xda, 0xe8, 0xf8, 0xb8, 0x67, 0x70, 0x7f, 0x95,
+	0xf9, 0xd9, 0x2e, 0x56, 0xb7, 0x15, 0x1b, 0xe0, 0xdb, 0xee, 0xa3, 0x3b, 0xef, 0x67, 0xdb, 0x76,
+	0xe2, 0x0e, 0xad, 0x1b, 0x23, 0x38, 0xdd, 0x59, 0x1a, 0xce, 0x8d, 0xf0, 0xf0, 0x26, 0xe7, 0xb8,
+	0xbf, 0x28, 0x36, 0x78, 0x4d, 0x56, 0x47, 0xf6, 0x87, 0x79, 0xf3, 0x6f, 0x00, 0x01, 0xe7, 0x82,
+	0x2d, 0x41, 0x03, 0x00, 0x00,
+}
@@ -0,0 +1,453 @@
+// Copyright 2017 Martin Baillie <martin.t.baillie@gmail.com>.
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file or at:
+// https://opensource.org/licenses/BSD-3-Clause
+
+package rancher
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/log"
+	level "github.com/go-kit/kit/log/experimental_level"
+	"github.com/go-kit/kit/metrics"
+	"github.com/go-kit/kit/tracing/opentracing"
+
+	stdopentracing "github.com/opentracing/opentracing-go"
+)
+
+// Probe errors
+var (
+	ErrContainerNotProbed = errors.New("container has no probe")
+)
+
+// Container labels defining a probe, e.g. rms.probe.port=8080 and
+// rms.probe.path=/health. A probe with a path is an HTTP probe, otherwise a
+// TCP probe, unless the type label says otherwise.
+const (
+	ProbeTypeLabel = "rms.probe.type"
+	ProbePortLabel = "rms.probe.port"
+	ProbePathLabel = "rms.probe.path"
+)
+
+// Probe types
+const (
+	ProbeHTTP = "http"
+	ProbeTCP  = "tcp"
+)
+
+// ProbeStatus is the outcome of probing a container.
+type ProbeStatus string
+
+// Probe statuses
+const (
+	ProbeUp      ProbeStatus = "up"
+	ProbeDown    ProbeStatus = "down"
+	ProbeUnknown ProbeStatus = "unknown"
+)
+
+// ProbeResult is the outcome of the most recent probe of a container.
+//
+// swagger:model probeResult
+type ProbeResult struct {
+	// the outcome of the probe, one of up, down or unknown (not yet probed)
+	// required: true
+	Status ProbeStatus `json:"Status"`
+	// the type of probe, one of http or tcp
+	// required: true
+	Type string `json:"Type"`
+	// the address or URL probed
+	// required: true
+	Target string `json:"Target"`
+	// when the probe completed
+	Checked *time.Time `json:"Checked,omitempty"`
+	// how long the probe took in seconds
+	Duration float64 `json:"Duration,omitempty"`
+	// the HTTP status code, for HTTP probes
+	StatusCode int `json:"StatusCode,omitempty"`
+	// why the container is down, or was not probed
+	Error string `json:"Error,omitempty"`
+}
+
+// ProbeConfig describes how often and how widely containers are probed.
+type ProbeConfig struct {
+	// the duration between rounds of probes
+	Interval time.Duration
+	// the duration after which a probe fails
+	Timeout time.Duration
+	// the number of probes that may run at once
+	Workers int
+	// the optional governor scheduling the probes alongside other calls
+	// into containers
+	Governor *Governor
+}
+
+// Prober runs the probes defined by container labels against each running
+// container in a Repository, keeping the results alongside the cache.
+type Prober interface {
+	ContainerHealth(name string) (*ProbeResult, error)
+}
+
+// probe is a probe defined by a container's labels.
+type probe struct {
+	name      string
+	stack     string
+	svc       string
+	typ       string
+	target    string
+	container *Container
+}
+
+// containerProbe returns the probe defined by the container's labels, if any.
+func containerProbe(c *Container) (probe, bool) {
+	port, err := strconv.ParseUint(c.Labels[ProbePortLabel], 10, 16)
+	if err != nil || port == 0 || c.PrivateIP == "" {
+		return probe{}, false
+	}
+	addr := net.JoinHostPort(c.PrivateIP, strconv.FormatUint(port, 10))
+
+	p := probe{name: c.Name, stack: c.StackName, svc: c.ServiceName, typ: ProbeTCP, target: addr, container: c}
+	path, hasPath := c.Labels[ProbePathLabel]
+	switch c.Labels[ProbeTypeLabel] {
+	case ProbeHTTP:
+		p.typ = ProbeHTTP
+	case ProbeTCP:
+		hasPath = false
+	case "":
+		if hasPath {
+			p.typ = ProbeHTTP
+		}
+	default:
+		return probe{}, false
+	}
+	if p.typ == ProbeHTTP {
+		if !strings.HasPrefix(path, "/") {
+			path = "/" + path
+		}
+		p.target = "http://" + addr + path
+	}
+	return p, true
+}
+
+// NewProber creates a Prober probing the Repository's running containers
+// every interval, on a pool of workers. The number of containers up and down
+// is reported per service to the given gauges.
+//
+// Probing runs until the given context is cancelled.
+func NewProber(ctx context.Context, env Environment, r Repository, cfg ProbeConfig, up, down metrics.Gauge, logger log.Logger) Prober {
+	client := env.httpClient()
+	if client == nil {
+		client = &http.Client{}
+	}
+	client.Timeout = cfg.Timeout
+	// Never follow redirects, a redirect is up
+	client.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+
+	p := &prober{
+		env:        env,
+		repository: r,
+		cfg:        cfg,
+		client:     client,
+		results:    make(map[string]*ProbeResult),
+		services:   make(map[[2]string]bool),
+		up:         up,
+		down:       down,
+		logger:     logger,
+	}
+	go p.probeEvery(ctx)
+	return p
+}
+
+type prober struct {
+	env        Environment
+	repository Repository
+	cfg        ProbeConfig
+	client     *http.Client
+
+	// Guards the results of the most recent round of probes, by container
+	// name, and the services seen in it
+	mtx      sync.RWMutex
+	results  map[string]*ProbeResult
+	services map[[2]string]bool
+
+	up   metrics.Gauge
+	down metrics.Gauge
+
+	logger log.Logger
+}
+
+// ContainerHealth implements Prober.
+func (p *prober) ContainerHealth(name string) (*ProbeResult, error) {
+	c, err := p.repository.ContainerByName(name)
+	if err != nil {
+		return nil, err
+	}
+	pr, ok := containerProbe(c)
+	if !ok {
+		return nil, ErrContainerNotProbed
+	}
+
+	p.mtx.RLock()
+	res, ok := p.results[name]
+	p.mtx.RUnlock()
+	if !ok || res.Target != pr.target || c.State != "running" {
+		// Not yet probed, or changed since
+		return &ProbeResult{Status: ProbeUnknown, Type: pr.typ, Target: pr.target}, nil
+	}
+	rc := *res
+	return &rc, nil
+}
+
+func (p *prober) probeEvery(ctx context.Context) {
+	t := time.NewTicker(p.cfg.Interval)
+	defer t.Stop()
+	for {
+		p.probeAll(ctx)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// probeAll probes every running container with a probe, replacing the
+// results of the previous round.
+func (p *prober) probeAll(ctx context.Context) {
+	cs, err := p.repository.Containers()
+	if err != nil {
+		level.Error(p.logger).Log("err", err)
+		return
+	}
+
+	var probes []probe
+	for _, c := range cs {
+		if pr, ok := containerProbe(c); ok && c.State == "running" {
+			probes = append(probes, pr)
+		}
+	}
+
+	workers := p.cfg.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	results := make([]*ProbeResult, len(probes))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				results[i] = p.probe(ctx, probes[i])
+			}
+		}()
+	}
+	for i := range probes {
+		select {
+		case jobs <- i:
+		case <-ctx.Done():
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	if ctx.Err() != nil {
+		return
+	}
+
+	// Count each service's containers up and down, zeroing the services that
+	// have gone
+	rm := make(map[string]*ProbeResult, len(probes))
+	counts := make(map[[2]string][2]int)
+	for i, pr := range probes {
+		rm[pr.name] = results[i]
+		svc := [2]string{pr.stack, pr.svc}
+		n := counts[svc]
+		switch results[i].Status {
+		case ProbeUp:
+			n[0]++
+		case ProbeDown:
+			n[1]++
+		}
+		counts[svc] = n
+	}
+
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	for svc := range p.services {
+		if _, ok := counts[svc]; !ok {
+			p.gauges(svc, [2]int{})
+		}
+	}
+	p.services = make(map[[2]string]bool, len(counts))
+	for svc, n := range counts {
+		p.services[svc] = true
+		p.gauges(svc, n)
+	}
+	p.results = rm
+}
+
+func (p *prober) gauges(svc [2]string, n [2]int) {
+	labels := []string{"environment", p.env.Name, "stack", svc[0], "service", svc[1]}
+	p.up.With(labels...).Set(float64(n[0]))
+	p.down.With(labels...).Set(float64(n[1]))
+}
+
+// probe runs a single probe, in its turn with the governor, never taking
+// longer than the timeout. A probe that never gets its turn is unknown.
+func (p *prober) probe(ctx context.Context, pr probe) *ProbeResult {
+	res := &ProbeResult{Type: pr.typ, Target: pr.target}
+	release, err := p.cfg.Governor.Acquire(ctx, "probe-"+p.env.Name, p.env.Name, pr.container)
+	if err != nil {
+		res.Status = ProbeUnknown
+		res.Error = err.Error()
+		level.Debug(p.logger).Log("msg", "probe not run", "container", pr.name, "target", pr.target, "err", err)
+		return res
+	}
+	defer release()
+
+	begin := time.Now()
+	err = p.check(ctx, pr, res)
+	checked := time.Now()
+	res.Checked = &checked
+	res.Duration = checked.Sub(begin).Seconds()
+	if err != nil {
+		res.Status = ProbeDown
+		res.Error = err.Error()
+		level.Debug(p.logger).Log("msg", "probe failed", "container", pr.name, "target", pr.target, "err", err)
+		return res
+	}
+	res.Status = ProbeUp
+	return res
+}
+
+func (p *prober) check(ctx context.Context, pr probe, res *ProbeResult) error {
+	ctx, cancel := context.WithTimeout(ctx, p.cfg.Timeout)
+	defer cancel()
+
+	if pr.typ == ProbeTCP {
+		conn, err := dialProbe(ctx, p.env.ProxyURL, pr.target)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	req, err := http.NewRequest("GET", pr.target, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := p.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 4096))
+	resp.Body.Close()
+
+	res.StatusCode = resp.StatusCode
+	if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+		return fmt.Errorf("unhealthy status: %s", resp.Status)
+	}
+	return nil
+}
+
+// dialProbe connects to the address, tunnelling through the HTTP proxy with
+// CONNECT when there is one, as HTTP probes are proxied.
+func dialProbe(ctx context.Context, proxy *url.URL, addr string) (net.Conn, error) {
+	var d net.Dialer
+	if proxy == nil {
+		return d.DialContext(ctx, "tcp", addr)
+	}
+
+	proxyAddr := proxy.Host
+	if proxy.Port() == "" {
+		proxyAddr = net.JoinHostPort(proxy.Hostname(), "80")
+	}
+	conn, err := d.DialContext(ctx, "tcp", proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if u := proxy.User; u != nil {
+		secret, _ := u.Password()
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(u.Username()+":"+secret)))
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy refused tunnel: %s", resp.Status)
+	}
+	return conn, nil
+}
+
+// NewContainerHealthEndpoint creates an endpoint serving the Prober's most
+// recent result for a container, decorated with tracing.
+func NewContainerHealthEndpoint(p Prober, t stdopentracing.Tracer) endpoint.Endpoint {
+	return opentracing.TraceServer(t, "rancher-container-health-endpoint")(ContainerHealthEndpoint(p))
+}
+
+// containerHealthResponse A container health response model.
+//
+// Used for returning the most recent probe of a single container.
+//
+// swagger:response containerHealthResponse
+type containerHealthResponse struct {
+	// in: body
+	Name string `json:"Name,omitempty"`
+	// in: body
+	Probe *ProbeResult `json:"Probe,omitempty"`
+	// in: body
+	Err error `json:"Error,omitempty"`
+}
+
+func (r containerHealthResponse) error() error { return r.Err }
+
+// ContainerHealthEndpoint serves the Prober's most recent result for a
+// container.
+func ContainerHealthEndpoint(p Prober) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		containerReq := request.(containerRequest)
+		res, err := p.ContainerHealth(containerReq.Name)
+		return containerHealthResponse{
+			Name:  containerReq.Name,
+			Probe: res,
+			Err:   err,
+		}, nil
+	}
+}
@@ -0,0 +1,168 @@
+// Copyright 2017 Martin Baillie <martin.t.baillie@gmail.com>.
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file or at:
+// https://opensource.org/licenses/BSD-3-Clause
+
+package rancher
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/tracing/opentracing"
+
+	stdopentracing "github.com/opentracing/opentracing-go"
+)
+
+// Prometheus service discovery meta labels
+const (
+	prometheusMetaPrefix       = "__meta_rancher_"
+	prometheusMetaLabelPrefix  = prometheusMetaPrefix + "container_label_"
+	prometheusMetricsPathLabel = "__metrics_path__"
+)
+
+// PrometheusSDConfig describes how containers are discovered as Prometheus
+// scrape targets from their labels.
+type PrometheusSDConfig struct {
+	// selects the containers to scrape, either a label key that must be
+	// present or a key=value pair that must match, e.g.
+	// prometheus.io/scrape=true
+	SelectorLabel string
+	// the label holding the port to scrape, e.g. prometheus.io/port
+	PortLabel string
+	// the label holding the metrics path to scrape, e.g. prometheus.io/path,
+	// defaulting to Prometheus' own default of /metrics
+	PathLabel string
+}
+
+// selects reports whether the container should be scraped.
+func (cfg PrometheusSDConfig) selects(c *Container) bool {
+	key, value := cfg.SelectorLabel, ""
+	hasValue := false
+	if i := strings.Index(key, "="); i >= 0 {
+		key, value, hasValue = key[:i], key[i+1:], true
+	}
+	v, ok := c.Labels[key]
+	return ok && (!hasValue || v == value)
+}
+
+// PrometheusTargetGroup is a group of scrape targets sharing labels, in the
+// Prometheus http_sd format.
+type PrometheusTargetGroup struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels"`
+}
+
+// PrometheusTargets returns a target group for each running container
+// selected by the config, labelled with its Rancher metadata.
+// Containers without a valid port label are skipped.
+func PrometheusTargets(cs []*Container, cfg PrometheusSDConfig) []PrometheusTargetGroup {
+	tgs := []PrometheusTargetGroup{}
+	for _, c := range cs {
+		if c.State != "running" || c.PrivateIP == "" || !cfg.selects(c) {
+			continue
+		}
+		port, err := strconv.ParseUint(c.Labels[cfg.PortLabel], 10, 16)
+		if err != nil || port == 0 {
+			continue
+		}
+
+		labels := map[string]string{
+			prometheusMetaPrefix + "container_name": c.Name,
+			prometheusMetaPrefix + "container_uuid": c.UUID,
+			prometheusMetaPrefix + "stack":          c.StackName,
+			prometheusMetaPrefix + "service":        c.ServiceName,
+			prometheusMetaPrefix + "service_index":  strconv.FormatInt(c.ServiceIndex, 10),
+			prometheusMetaPrefix + "host":           c.Host.Name,
+		}
+		if c.Environment != "" {
+			labels[prometheusMetaPrefix+"environment"] = c.Environment
+		}
+		for k, v := range c.Labels {
+			labels[prometheusMetaLabelPrefix+prometheusLabelName(k)] = v
+		}
+		if path := c.Labels[cfg.PathLabel]; path != "" {
+			labels[prometheusMetricsPathLabel] = path
+		}
+
+		tgs = append(tgs, PrometheusTargetGroup{
+			Targets: []string{net.JoinHostPort(c.PrivateIP, strconv.FormatUint(port, 10))},
+			Labels:  labels,
+		})
+	}
+
+	// Keep the targets in a stable order between refreshes
+	sort.Slice(tgs, func(i, j int) bool { return tgs[i].Targets[0] < tgs[j].Targets[0] })
+	return tgs
+}
+
+var prometheusInvalidLabelChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+// prometheusLabelName sanitises a container label key into a valid
+// Prometheus label name, e.g. io.rancher.stack.name becomes
+// io_rancher_stack_name.
+func prometheusLabelName(k string) string {
+	return prometheusInvalidLabelChars.ReplaceAllString(k, "_")
+}
+
+// NewPrometheusTargetsEndpoint creates an endpoint serving the Prometheus
+// scrape targets discovered from the ServerService's containers, decorated
+// with tracing.
+func NewPrometheusTargetsEndpoint(s ServerService, cfg PrometheusSDConfig, t stdopentracing.Tracer) endpoint.Endpoint {
+	return opentracing.TraceServer(t, "rancher-prometheus-targets-endpoint")(PrometheusTargetsEndpoint(s, cfg))
+}
+
+// prometheusTargetsRequest A Prometheus targets parameter model.
+//
+// Unused.
+//
+// swagger:parameters prometheusTargets
+type prometheusTargetsRequest struct{}
+
+// prometheusTargetsResponse A Prometheus targets response model.
+//
+// Used for returning scrape targets in the Prometheus http_sd format.
+//
+// swagger:response prometheusTargetsResponse
+type prometheusTargetsResponse struct {
+	// in: body
+	TargetGroups []PrometheusTargetGroup
+	// in: body
+	Err error `json:"Error,omitempty"`
+
+	cache CacheStatus
+}
+
+func (r prometheusTargetsResponse) error() error             { return r.Err }
+func (r prometheusTargetsResponse) cacheStatus() CacheStatus { return r.cache }
+
+// MarshalJSON encodes the target groups as a bare array, as Prometheus
+// expects.
+func (r prometheusTargetsResponse) MarshalJSON() ([]byte, error) {
+	return json.Marshal(r.TargetGroups)
+}
+
+// PrometheusTargetsEndpoint serves the Prometheus scrape targets discovered
+// from the ServerService's containers.
+func PrometheusTargetsEndpoint(s ServerService, cfg PrometheusSDConfig) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		cs, err := s.Containers(ctx)
+		var tgs []PrometheusTargetGroup
+		if err == nil {
+			tgs = PrometheusTargets(cs, cfg)
+		}
+		return prometheusTargetsResponse{
+			TargetGroups: tgs,
+			Err:          err,
+			cache:        s.CacheStatus(ctx),
+		}, nil
+	}
+}
@@ -0,0 +1,371 @@
+// Copyright 2017 Martin Baillie <martin.t.baillie@gmail.com>.
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file or at:
+// https://opensource.org/licenses/BSD-3-Clause
+
+package rancher
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	stdopentracing "github.com/opentracing/opentracing-go"
+
+	"github.com/go-kit/kit/log"
+	level "github.com/go-kit/kit/log/experimental_level"
+	"github.com/go-kit/kit/metrics"
+	"github.com/go-kit/kit/tracing/opentracing"
+)
+
+// Proxy errors
+var (
+	ErrProxyUnauthorized     = errors.New("proxy authorization required")
+	ErrProxyInvalidPort      = errors.New("invalid port")
+	ErrProxyPortNotAllowed   = errors.New("port not allowed for container")
+	ErrProxyContainerDown    = errors.New("container not running")
+	ErrProxyUpstreamFailed   = errors.New("container did not respond")
+	errProxyMissingRouteVars = errors.New("failed to extract container name and port from URL")
+)
+
+const (
+	proxyAuthorizationHeader = "Proxy-Authorization"
+	proxyAuthorizationBearer = "Bearer "
+	proxyAuthenticate        = `Bearer realm="rancher-management-service"`
+)
+
+// ProxyConfig describes who may use the reverse proxy and to which ports.
+type ProxyConfig struct {
+	// the bearer tokens, sent in the Proxy-Authorization header, allowed to
+	// use the proxy
+	Tokens []string
+	// the container label listing the comma separated ports that may be
+	// proxied to, e.g. io.rms.proxy.ports=8080,9990
+	PortsLabel string
+	// the optional limiters applied to each token's safe (GET, HEAD and
+	// OPTIONS) and mutating requests respectively
+	ReadLimiter, MutatingLimiter *RateLimiter
+	// the optional governor scheduling each token's requests alongside other
+	// calls into containers
+	Governor *Governor
+}
+
+// proxyToken returns the bearer token the request carries, if any.
+func proxyToken(r *http.Request) string {
+	auth := r.Header.Get(proxyAuthorizationHeader)
+	if !strings.HasPrefix(auth, proxyAuthorizationBearer) {
+		return ""
+	}
+	return strings.TrimPrefix(auth, proxyAuthorizationBearer)
+}
+
+// authorized reports whether the request carries one of the tokens.
+func (cfg ProxyConfig) authorized(r *http.Request) bool {
+	return tokenAllowed(proxyToken(r), cfg.Tokens)
+}
+
+// tokenAllowed reports whether the bearer token is one of the tokens.
+func tokenAllowed(bearer string, tokens []string) bool {
+	token := []byte(bearer)
+	if len(token) == 0 {
+		return false
+	}
+	ok := false
+	for _, t := range tokens {
+		// NOTE: Every token is compared, in constant time, to avoid leaking
+		// which tokens are close to valid
+		if subtle.ConstantTimeCompare(token, []byte(t)) == 1 {
+			ok = true
+		}
+	}
+	return ok
+}
+
+// ProxyTokensSetter is implemented by the reverse proxy, so that the tokens
+// allowed to use it may change while running.
+type ProxyTokensSetter interface {
+	SetTokens([]string)
+}
+
+// allows reports whether the container's label allows proxying to the port.
+func (cfg ProxyConfig) allows(c *Container, port string) bool {
+	for _, p := range strings.Split(c.Labels[cfg.PortsLabel], ",") {
+		if strings.TrimSpace(p) == port {
+			return true
+		}
+	}
+	return false
+}
+
+// NewProxyHandler returns a reverse proxy into the containers of the
+// environment, bridging its private overlay network. It is expected to be
+// routed as .../{name}/proxy/{port}/{path...}, proxying the path to the given
+// port of the named container's PrivateIP.
+//
+// Requests must carry one of the configured tokens as a bearer token in the
+// Proxy-Authorization header, and the port must be allowed by the container's
+// ports label. WebSocket upgrades are proxied, and Location headers are
+// rewritten to point back through the proxy.
+//
+// Each request is traced, with the trace propagated to the container, and
+// counted by status code. The handler implements ProxyTokensSetter.
+func NewProxyHandler(env Environment, r Repository, cfg ProxyConfig, requestCount metrics.Counter, requestLatency metrics.Histogram, tracer stdopentracing.Tracer, logger log.Logger) http.Handler {
+	transport := http.DefaultTransport
+	if c := env.httpClient(); c != nil {
+		transport = c.Transport
+	}
+	return &proxyHandler{
+		env:            env,
+		repository:     r,
+		cfg:            cfg,
+		transport:      transport,
+		requestCount:   requestCount,
+		requestLatency: requestLatency,
+		tracer:         tracer,
+		logger:         logger,
+	}
+}
+
+type proxyHandler struct {
+	env        Environment
+	repository Repository
+	transport  http.RoundTripper
+
+	// Guards the configuration, whose tokens may be replaced
+	mtx sync.RWMutex
+	cfg ProxyConfig
+
+	requestCount   metrics.Counter
+	requestLatency metrics.Histogram
+
+	tracer stdopentracing.Tracer
+	logger log.Logger
+}
+
+func (h *proxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	sw := &proxyStatusWriter{ResponseWriter: w, status: http.StatusOK}
+	defer func(begin time.Time) {
+		h.requestCount.With("environment", h.env.Name, "code", strconv.Itoa(sw.status)).Add(1)
+		h.requestLatency.With("environment", h.env.Name).Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	ctx := opentracing.FromHTTPRequest(h.tracer, "Proxy", h.logger)(r.Context(), r)
+	ctx = PopulateRequestID(ctx, r)
+	span := stdopentracing.SpanFromContext(ctx)
+	defer span.Finish()
+	r = r.WithContext(ctx)
+
+	c, target, prefix, err := h.resolve(r)
+	if err != nil {
+		span.SetTag("error", true)
+		encodeProxyError(ctx, err, sw)
+		return
+	}
+	release, err := h.limit(r)
+	if err != nil {
+		span.SetTag("error", true)
+		encodeProxyError(ctx, err, sw)
+		return
+	}
+	defer release()
+	done, err := h.govern(r, c)
+	if err != nil {
+		span.SetTag("error", true)
+		encodeProxyError(ctx, err, sw)
+		return
+	}
+	defer done()
+	span.SetTag("peer.address", target.Host)
+
+	proxy := &httputil.ReverseProxy{
+		Director: func(out *http.Request) {
+			out.URL.Scheme = target.Scheme
+			out.URL.Host = target.Host
+			out.URL.Path = "/" + strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, prefix), "/")
+			out.URL.RawPath = ""
+			out.Host = target.Host
+			out.Header.Del(proxyAuthorizationHeader)
+			// NOTE: Responses are compressed on the way out by the HTTP
+			// middlewares, so have the transport decompress them on the way in
+			out.Header.Del("Accept-Encoding")
+			out.Header.Set("X-Forwarded-Prefix", prefix)
+			out.Header.Set(RequestIDHeader, RequestIDFromContext(out.Context()))
+			opentracing.ToHTTPRequest(h.tracer, h.logger)(out.Context(), out)
+		},
+		Transport: h.transport,
+		ModifyResponse: func(resp *http.Response) error {
+			rewriteProxyLocation(resp, target, prefix)
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			span.SetTag("error", true)
+			level.Error(h.logger).Log("err", err, "upstream", target.Host)
+			encodeProxyError(r.Context(), ErrProxyUpstreamFailed, w)
+		},
+	}
+	proxy.ServeHTTP(sw, r)
+}
+
+// SetTokens implements ProxyTokensSetter.
+func (h *proxyHandler) SetTokens(tokens []string) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	h.cfg.Tokens = tokens
+}
+
+// resolve authorizes the request and returns the container it targets and
+// the container's URL, along with the path prefix it was routed under.
+func (h *proxyHandler) resolve(r *http.Request) (*Container, *url.URL, string, error) {
+	h.mtx.RLock()
+	cfg := h.cfg
+	h.mtx.RUnlock()
+
+	if !cfg.authorized(r) {
+		return nil, nil, "", ErrProxyUnauthorized
+	}
+
+	vars := mux.Vars(r)
+	name, port := vars["name"], vars["port"]
+	if name == "" || port == "" {
+		return nil, nil, "", errProxyMissingRouteVars
+	}
+	if p, err := strconv.ParseUint(port, 10, 16); err != nil || p == 0 {
+		return nil, nil, "", ErrProxyInvalidPort
+	}
+
+	c, err := h.repository.ContainerByName(name)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	if !cfg.allows(c, port) {
+		return nil, nil, "", ErrProxyPortNotAllowed
+	}
+	if c.State != "running" || c.PrivateIP == "" {
+		return nil, nil, "", ErrProxyContainerDown
+	}
+
+	marker := "/" + name + "/proxy/" + port
+	i := strings.Index(r.URL.Path, marker)
+	if i < 0 {
+		return nil, nil, "", errProxyMissingRouteVars
+	}
+	prefix := r.URL.Path[:i+len(marker)]
+
+	return c, &url.URL{Scheme: "http", Host: net.JoinHostPort(c.PrivateIP, port)}, prefix, nil
+}
+
+// limit takes the authorized request from the budget of its token, chosen by
+// method, returning a func to release it once proxied.
+func (h *proxyHandler) limit(r *http.Request) (func(), error) {
+	h.mtx.RLock()
+	cfg := h.cfg
+	h.mtx.RUnlock()
+
+	l := cfg.MutatingLimiter
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		l = cfg.ReadLimiter
+	}
+	return l.acquire(tokenIdentity(proxyToken(r)))
+}
+
+// govern waits for the authorized request's turn, scheduled by its token, to
+// be proxied to the container, returning a func to release it once proxied.
+func (h *proxyHandler) govern(r *http.Request, c *Container) (func(), error) {
+	h.mtx.RLock()
+	cfg := h.cfg
+	h.mtx.RUnlock()
+
+	return cfg.Governor.Acquire(r.Context(), "proxy-"+tokenIdentity(proxyToken(r)), h.env.Name, c)
+}
+
+// rewriteProxyLocation points redirects to the container, whether absolute or
+// relative to its root, back through the proxy.
+func rewriteProxyLocation(resp *http.Response, target *url.URL, prefix string) {
+	loc := resp.Header.Get("Location")
+	if loc == "" {
+		return
+	}
+	u, err := url.Parse(loc)
+	if err != nil {
+		return
+	}
+	if u.Host != "" && u.Host != target.Host {
+		// Redirects elsewhere are left alone
+		return
+	}
+	if u.Host == "" && !strings.HasPrefix(u.Path, "/") {
+		// Relative redirects already resolve through the proxy
+		return
+	}
+	u.Scheme, u.Host, u.User = "", "", nil
+	u.Path = prefix + u.Path
+	u.RawPath = ""
+	resp.Header.Set("Location", u.String())
+}
+
+// encodeProxyError writes the proxy's own errors, deferring to the HTTP
+// transport's encoding of the Rancher package's business errors.
+func encodeProxyError(ctx context.Context, err error, w http.ResponseWriter) {
+	var status int
+	switch err {
+	case ErrProxyUnauthorized:
+		w.Header().Set("Proxy-Authenticate", proxyAuthenticate)
+		status = http.StatusProxyAuthRequired
+	case ErrProxyInvalidPort, errProxyMissingRouteVars:
+		status = http.StatusBadRequest
+	case ErrProxyPortNotAllowed:
+		status = http.StatusForbidden
+	case ErrProxyContainerDown, ErrGovernorTimeout:
+		status = http.StatusServiceUnavailable
+	case ErrProxyUpstreamFailed:
+		status = http.StatusBadGateway
+	default:
+		encodeHTTPError(ctx, err, w)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(httpErrorBody{Error: err.Error(), RequestID: RequestIDFromContext(ctx)})
+}
+
+// proxyStatusWriter records the status code written, for metrics.
+// NOTE: It must remain a Hijacker and Flusher for upgrades and streaming.
+type proxyStatusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *proxyStatusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *proxyStatusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *proxyStatusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	w.status = http.StatusSwitchingProtocols
+	return h.Hijack()
+}
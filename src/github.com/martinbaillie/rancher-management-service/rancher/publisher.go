@@ -0,0 +1,202 @@
+// Copyright 2017 Martin Baillie <martin.t.baillie@gmail.com>.
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file or at:
+// https://opensource.org/licenses/BSD-3-Clause
+
+package rancher
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/log"
+	level "github.com/go-kit/kit/log/experimental_level"
+	"github.com/go-kit/kit/metrics"
+)
+
+const kafkaPublishCommand = "kafka-publish-endpoint"
+
+// eventRetryInterval is how long delivery backs off after failing to publish
+// an event.
+var eventRetryInterval = 5 * time.Second
+
+// NewEventPublishEndpoint returns an endpoint publishing Events to the given
+// Kafka topic, decorated with circuit breaking.
+func NewEventPublishEndpoint(env Environment, p sarama.SyncProducer, topic string) endpoint.Endpoint {
+	var e endpoint.Endpoint
+	e = KafkaPublishEndpoint(p, topic)
+	e = hystrixBreaker(env.command(kafkaPublishCommand))(e)
+	return e
+}
+
+// KafkaPublishEndpoint returns an endpoint publishing an Event as JSON to the
+// given Kafka topic. Events are keyed by the UUID of the container or host
+// that changed, keeping the events for each in order on a single partition.
+func KafkaPublishEndpoint(p sarama.SyncProducer, topic string) endpoint.Endpoint {
+	return func(_ context.Context, request interface{}) (interface{}, error) {
+		e := request.(Event)
+		b, err := json.Marshal(e)
+		if err != nil {
+			return nil, err
+		}
+		_, _, err = p.SendMessage(&sarama.ProducerMessage{
+			Topic:     topic,
+			Key:       sarama.StringEncoder(e.Key()),
+			Value:     sarama.ByteEncoder(b),
+			Timestamp: e.Time,
+		})
+		return nil, err
+	}
+}
+
+// NewEventPublisher publishes the changes between the Repository's successive
+// snapshots as Events through the given endpoint, see
+// NewEventPublishEndpoint.
+//
+// Events are buffered, up to the given size, while waiting to be published.
+// Should the buffer fill, e.g. while the circuit is open, the oldest events
+// are dropped. An event that fails to publish is retried with the same ID,
+// allowing consumers to discard any duplicates.
+//
+// Changes are published from the snapshot the Repository was restored from,
+// so that a restart publishes only what changed while the service was down.
+//
+// NOTE: Without a SnapshotStore to restore from, every container and host is
+// published as added when the service starts.
+//
+// Publishing runs until the given context is cancelled.
+func NewEventPublisher(ctx context.Context, env Environment, r Repository, publish endpoint.Endpoint, size int, published, failed, dropped metrics.Counter, buffered metrics.Gauge, logger log.Logger) {
+	p := &eventPublisher{
+		env:       env,
+		publish:   publish,
+		size:      size,
+		ready:     make(chan struct{}, 1),
+		published: published,
+		failed:    failed,
+		dropped:   dropped,
+		buffered:  buffered,
+		logger:    logger,
+	}
+	go p.watch(ctx, r)
+	go p.deliver(ctx)
+}
+
+type eventPublisher struct {
+	env     Environment
+	publish endpoint.Endpoint
+
+	// Guards the buffer of events yet to be published
+	mtx    sync.Mutex
+	buffer []Event
+	size   int
+	ready  chan struct{}
+
+	published metrics.Counter
+	failed    metrics.Counter
+	dropped   metrics.Counter
+	buffered  metrics.Gauge
+
+	logger log.Logger
+}
+
+// watch buffers the events between each of the repository's snapshots,
+// starting from the one it was restored from, and watching again should it
+// fall behind.
+func (p *eventPublisher) watch(ctx context.Context, r Repository) {
+	last := r.RestoredSnapshot()
+	for ctx.Err() == nil {
+		for s := range r.WatchSnapshots(ctx) {
+			p.push(diffSnapshots(p.env.Name, last, s)...)
+			last = s
+		}
+	}
+}
+
+// deliver publishes the buffered events in order until the context is
+// cancelled.
+func (p *eventPublisher) deliver(ctx context.Context) {
+	for {
+		e, ok := p.pop()
+		if !ok {
+			select {
+			case <-p.ready:
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		if _, err := p.publish(ctx, e); err != nil {
+			p.failed.Add(1)
+			level.Error(p.logger).Log("err", err, "event", e.ID, "type", e.Type)
+
+			// Keep the event at the head of the buffer and back off
+			p.requeue(e)
+			select {
+			case <-time.After(eventRetryInterval):
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+		p.published.With("type", string(e.Type)).Add(1)
+	}
+}
+
+// push appends events to the buffer, dropping the oldest events should it
+// overflow.
+func (p *eventPublisher) push(es ...Event) {
+	if len(es) == 0 {
+		return
+	}
+	p.mtx.Lock()
+	p.buffer = append(p.buffer, es...)
+	p.trim()
+	p.mtx.Unlock()
+
+	select {
+	case p.ready <- struct{}{}:
+	default:
+	}
+}
+
+// requeue returns an event that failed to publish to the head of the buffer.
+func (p *eventPublisher) requeue(e Event) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	p.buffer = append([]Event{e}, p.buffer...)
+	p.trim()
+}
+
+// pop removes the event at the head of the buffer, if any.
+func (p *eventPublisher) pop() (Event, bool) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	if len(p.buffer) == 0 {
+		return Event{}, false
+	}
+	e := p.buffer[0]
+	p.buffer = p.buffer[1:]
+	p.buffered.Set(float64(len(p.buffer)))
+	return e, true
+}
+
+// trim drops the oldest events beyond the buffer's size.
+// NOTE: Expects the caller to hold the lock.
+func (p *eventPublisher) trim() {
+	if over := len(p.buffer) - p.size; over > 0 {
+		p.dropped.Add(float64(over))
+		level.Error(p.logger).Log("err", "event buffer full", "dropped", over)
+		p.buffer = p.buffer[over:]
+	}
+	p.buffered.Set(float64(len(p.buffer)))
+}
@@ -8,11 +8,15 @@
 package rancher
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"strconv"
 	"sync"
 	"time"
+
+	stdopentracing "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
 )
 
 // Business errors
@@ -22,9 +26,16 @@ var (
 	// swagger:response ErrContainerNotFound
 	ErrContainerNotFound  = errors.New("container not found")
 	ErrContainerRepoEmpty = errors.New("container repository is empty")
+	ErrContainerRepoStale = errors.New("container repository is stale")
+	ErrContainerAmbiguous = errors.New("container name is in more than one environment")
 
 	ErrHostNotFound  = errors.New("host not found")
 	ErrHostRepoEmpty = errors.New("host repository is empty")
+	ErrHostRepoStale = errors.New("host repository is stale")
+
+	ErrCacheNotPopulated = errors.New("metadata cache has not been populated")
+	ErrCacheStale        = errors.New("metadata cache is stale")
+	ErrCacheRestored     = errors.New("metadata cache is restored and has not been refreshed")
 
 	ErrNotImplemented = errors.New("not implemented")
 )
@@ -34,13 +45,45 @@ var (
 type Repository interface {
 	ContainerByName(name string) (*Container, error)
 	Containers() ([]*Container, error)
-	refreshContainers()
 
 	HostByUUID(uuid string) (*Host, error)
 	Hosts() ([]*Host, error)
-	refreshHosts()
 
-	cachePopulateEvery(time.Duration)
+	CacheStatus() CacheStatus
+	CacheIntervalSetter
+	cachePopulateEvery(context.Context, time.Duration)
+
+	WatchContainers(context.Context) <-chan ContainerEvent
+	WatchSnapshots(context.Context) <-chan *Snapshot
+	RestoredSnapshot() *Snapshot
+}
+
+// CacheIntervalSetter is implemented by the parts of an environment that
+// depend on its metadata interval, so that it may change while running.
+type CacheIntervalSetter interface {
+	SetCacheInterval(time.Duration)
+}
+
+// CacheStatus describes the state of a Repository's cache.
+type CacheStatus struct {
+	// when the cache was last fully and successfully populated
+	Refreshed time.Time
+	// the number of cache populations that have failed since Refreshed
+	Failures int
+	// the error from the most recent failed cache population, if any
+	LastError error
+	// whether the cache was restored from a snapshot and is yet to be refreshed
+	Restored bool
+	// the number of cached containers
+	Containers int
+	// the number of cached hosts
+	Hosts int
+	// whether the cache has aged beyond the repository's max staleness, and
+	// is no longer served
+	Stale bool
+	// the environments whose containers could not be served, when spanning
+	// several
+	Unavailable []string
 }
 
 // Container is a Rancher container representation.
@@ -51,6 +94,12 @@ type Container struct {
 	// required: true
 	// min: 1
 	Name string `json:"Name"`
+	// the internal rancher uuid for this container
+	// required: true
+	// min: 1
+	UUID string `json:"UUID"`
+	// the Docker ID of this container
+	ExternalID string `json:"-"`
 	// the current Rancher state for this container
 	// required: true
 	// min: 1
@@ -64,10 +113,23 @@ type Container struct {
 	// required: true
 	// min: 1
 	ServiceIndex int64 `json:"ServiceIndex"`
+	// the Rancher service this container belongs to
+	// NOTE: empty for standalone containers
+	ServiceName string `json:"ServiceName,omitempty"`
+	// the Rancher stack this container's service belongs to
+	// NOTE: empty for standalone containers
+	StackName string `json:"StackName,omitempty"`
+	// the Docker and Rancher labels of this container
+	Labels map[string]string `json:"Labels,omitempty"`
+	// the ports this container publishes on its host, e.g. 0.0.0.0:8080:80/tcp
+	Ports []string `json:"Ports,omitempty"`
 	// the Rancher host this container is running on
 	// required: true
 	// min: 1
 	Host
+	// the Rancher environment this container is running in
+	// NOTE: only set when querying across environments
+	Environment string `json:"Environment,omitempty"`
 }
 
 // UnmarshalJSON unmarshals the Rancher container struct
@@ -84,6 +146,12 @@ func (c *Container) UnmarshalJSON(b []byte) (err error) {
 	}
 
 	c.Name = data["name"].(string)
+	if uuid := data["uuid"]; uuid != nil {
+		c.UUID = uuid.(string)
+	}
+	if externalID := data["external_id"]; externalID != nil {
+		c.ExternalID = externalID.(string)
+	}
 	c.State = data["state"].(string)
 	c.PrivateIP = data["primary_ip"].(string)
 
@@ -91,6 +159,30 @@ func (c *Container) UnmarshalJSON(b []byte) (err error) {
 		c.ServiceIndex, _ = strconv.ParseInt(serviceIndex.(string), 10, 64)
 	}
 
+	if serviceName := data["service_name"]; serviceName != nil {
+		c.ServiceName = serviceName.(string)
+	}
+	if stackName := data["stack_name"]; stackName != nil {
+		c.StackName = stackName.(string)
+	}
+
+	if labels, ok := data["labels"].(map[string]interface{}); ok && len(labels) > 0 {
+		c.Labels = make(map[string]string, len(labels))
+		for k, v := range labels {
+			if v, ok := v.(string); ok {
+				c.Labels[k] = v
+			}
+		}
+	}
+
+	if ports, ok := data["ports"].([]interface{}); ok && len(ports) > 0 {
+		for _, p := range ports {
+			if p, ok := p.(string); ok {
+				c.Ports = append(c.Ports, p)
+			}
+		}
+	}
+
 	if hostUUID := data["host_uuid"]; hostUUID != nil {
 		c.Host.UUID = hostUUID.(string)
 	}
@@ -135,34 +227,89 @@ func (h *Host) UnmarshalJSON(b []byte) (err error) {
 // Its purpose is to periodically call into Rancher's metadata service and
 // populate data structures needed by this project such as the current list of
 // Docker containers or Rancher hosts in the environment.
-func NewMetadataCachingRepository(sc ClientService, cacheInterval time.Duration) (mcr Repository) {
-	mcr = &metadataCachingRepository{
+//
+// Should the metadata service become unavailable, the last good snapshot
+// continues to be served until it is older than maxStaleness, at which point
+// reads fail. A maxStaleness of zero serves the last good snapshot forever.
+//
+// Given a SnapshotStore, each successful population is persisted and the
+// repository is warmed from the last good snapshot at creation, ahead of the
+// first call to the metadata service. A nil SnapshotStore disables this.
+//
+// Each population is traced as a root span, the parent of its calls to the
+// metadata service.
+//
+// The cache loop runs until the given context is cancelled.
+func NewMetadataCachingRepository(ctx context.Context, sc ClientService, cacheInterval, maxStaleness time.Duration, ss SnapshotStore, t stdopentracing.Tracer) Repository {
+	mcr := &metadataCachingRepository{
 		containers:   []*Container{},
 		containerMap: make(map[string]*Container),
 
 		hosts:   []*Host{},
 		hostMap: make(map[string]*Host),
 
-		client: sc,
+		maxStaleness: maxStaleness,
+
+		watchers:         make(map[chan ContainerEvent]chan struct{}),
+		snapshotWatchers: make(map[chan *Snapshot]chan struct{}),
+
+		client:    sc,
+		snapshots: ss,
+		tracer:    t,
 	}
-	mcr.cachePopulateEvery(cacheInterval)
-	return
+	if ss != nil {
+		mcr.restore()
+	}
+	mcr.cachePopulateEvery(ctx, cacheInterval)
+	return mcr
 }
 
 type metadataCachingRepository struct {
+	// Guards the caches and their population status
+	mtx          sync.RWMutex
 	containers   []*Container
 	containerMap map[string]*Container
-
-	hosts   []*Host
-	hostMap map[string]*Host
+	hosts        []*Host
+	hostMap      map[string]*Host
+	refreshed    time.Time
+	failures     int
+	lastErr      error
+	restored     bool
+	maxStaleness time.Duration
+
+	// Guards the schedule of the cache loop
+	loopMtx   sync.Mutex
+	interval  time.Duration
+	populated time.Time
+	timer     *time.Timer
+
+	// Guards the watchers of container changes and snapshots, along with a
+	// channel for each that is closed once it is no longer watched
+	watchMtx         sync.Mutex
+	watchers         map[chan ContainerEvent]chan struct{}
+	watched          []*Container
+	snapshotWatchers map[chan *Snapshot]chan struct{}
+	watchedSnapshot  *Snapshot
+	restoredSnapshot *Snapshot
 
 	// For making external calls to Rancher's metadata service
 	client ClientService
+
+	// For persisting and restoring the last good snapshot
+	snapshots SnapshotStore
+
+	// For tracing each population
+	tracer stdopentracing.Tracer
 }
 
 // ContainerByName returns the Container in the repository identified by the given name.
 func (mcr *metadataCachingRepository) ContainerByName(name string) (*Container, error) {
-	if len(mcr.containerMap) == 0 {
+	mcr.mtx.RLock()
+	defer mcr.mtx.RUnlock()
+
+	if mcr.staleLocked() {
+		return nil, ErrContainerRepoStale
+	} else if len(mcr.containerMap) == 0 {
 		return nil, ErrContainerRepoEmpty
 	} else if c, ok := mcr.containerMap[name]; !ok {
 		return nil, ErrContainerNotFound
@@ -173,36 +320,42 @@ func (mcr *metadataCachingRepository) ContainerByName(name string) (*Container,
 
 // Containers returns all Containers found in the repository.
 func (mcr *metadataCachingRepository) Containers() (cs []*Container, err error) {
-	if cs = mcr.containers; len(cs) == 0 {
+	mcr.mtx.RLock()
+	defer mcr.mtx.RUnlock()
+
+	if mcr.staleLocked() {
+		err = ErrContainerRepoStale
+	} else if cs = mcr.containers; len(cs) == 0 {
 		err = ErrContainerRepoEmpty
 	}
 	return
 }
 
-// refreshContainers atomically replenishes the repository Containers cache.
-func (mcr *metadataCachingRepository) refreshContainers() {
-	cs, err := mcr.client.MetadataContainers()
-	if err != nil {
-		return
-	}
+// cacheContainers replaces the repository Containers cache, first naming
+// each container's host from the Hosts cache.
+//
+// NOTE: Expects the caller to hold the lock. Cached containers are shared
+// with readers, so are never changed once cached.
+func (mcr *metadataCachingRepository) cacheContainers(cs []*Container) {
 	cm := make(map[string]*Container)
 	for _, c := range cs {
+		if h, ok := mcr.hostMap[c.Host.UUID]; ok {
+			c.Host.Name = h.Name
+		}
 		cm[c.Name] = c
 	}
-
-	// Synchronize this pair of updates
-	ch := make(chan int)
-	go func() {
-		mcr.containerMap = cm
-		mcr.containers = cs
-		ch <- 0
-	}()
-	<-ch
+	mcr.containerMap = cm
+	mcr.containers = cs
 }
 
 // HostByUUID returns the Host in the repository identified by the given UUID
 func (mcr *metadataCachingRepository) HostByUUID(uuid string) (*Host, error) {
-	if len(mcr.hostMap) == 0 {
+	mcr.mtx.RLock()
+	defer mcr.mtx.RUnlock()
+
+	if mcr.staleLocked() {
+		return nil, ErrHostRepoStale
+	} else if len(mcr.hostMap) == 0 {
 		return nil, ErrHostRepoEmpty
 	} else if h, ok := mcr.hostMap[uuid]; !ok {
 		return nil, ErrHostNotFound
@@ -213,53 +366,189 @@ func (mcr *metadataCachingRepository) HostByUUID(uuid string) (*Host, error) {
 
 // Hosts returns all Hosts found in the repository
 func (mcr *metadataCachingRepository) Hosts() (hs []*Host, err error) {
-	if hs = mcr.hosts; len(hs) == 0 {
+	mcr.mtx.RLock()
+	defer mcr.mtx.RUnlock()
+
+	if mcr.staleLocked() {
+		err = ErrHostRepoStale
+	} else if hs = mcr.hosts; len(hs) == 0 {
 		err = ErrHostRepoEmpty
 	}
 	return
 }
 
-// refreshHosts atomically replenishes the repository Hosts cache
-func (mcr *metadataCachingRepository) refreshHosts() {
-	hs, err := mcr.client.MetadataHosts()
-	if err != nil {
-		return
-	}
-
+// cacheHosts replaces the repository Hosts cache.
+// NOTE: Expects the caller to hold the lock.
+func (mcr *metadataCachingRepository) cacheHosts(hs []*Host) {
 	hm := make(map[string]*Host)
 	for _, h := range hs {
 		hm[h.UUID] = h
 	}
+	mcr.hostMap = hm
+	mcr.hosts = hs
+}
 
-	// Synchronize this pair of updates
-	ch := make(chan int)
-	go func() {
-		mcr.hostMap = hm
-		mcr.hosts = hs
-		ch <- 0
-	}()
-	<-ch
+// CacheStatus returns the current state of the repository's caches.
+func (mcr *metadataCachingRepository) CacheStatus() CacheStatus {
+	mcr.mtx.RLock()
+	defer mcr.mtx.RUnlock()
+
+	return CacheStatus{
+		Refreshed:  mcr.refreshed,
+		Failures:   mcr.failures,
+		LastError:  mcr.lastErr,
+		Restored:   mcr.restored,
+		Containers: len(mcr.containers),
+		Hosts:      len(mcr.hosts),
+		Stale:      mcr.staleLocked(),
+	}
+}
+
+// staleLocked reports whether the last good snapshot has aged beyond the
+// repository's max staleness.
+// NOTE: Expects the caller to hold the lock.
+func (mcr *metadataCachingRepository) staleLocked() bool {
+	return mcr.maxStaleness > 0 && !mcr.refreshed.IsZero() &&
+		time.Since(mcr.refreshed) > mcr.maxStaleness
+}
+
+// SetCacheInterval changes the duration between cache populations. The next
+// population is rescheduled to the new interval after the last, so that
+// shortening it takes effect straight away.
+func (mcr *metadataCachingRepository) SetCacheInterval(d time.Duration) {
+	mcr.loopMtx.Lock()
+	defer mcr.loopMtx.Unlock()
+
+	mcr.interval = d
+	// NOTE: A timer that cannot be stopped has fired, and the population it
+	// runs schedules the next with the new interval
+	if mcr.timer != nil && mcr.timer.Stop() {
+		mcr.timer.Reset(time.Until(mcr.populated.Add(d)))
+	}
 }
 
 // cachePopulateEvery concurrently refreshes the caches every d Duration
-func (mcr *metadataCachingRepository) cachePopulateEvery(d time.Duration) {
-	// Refresh caches concurrently
-	var wg sync.WaitGroup
+// until the context is cancelled.
+func (mcr *metadataCachingRepository) cachePopulateEvery(ctx context.Context, d time.Duration) {
+	mcr.loopMtx.Lock()
+	mcr.interval = d
+	mcr.loopMtx.Unlock()
+
+	mcr.cachePopulate(ctx)
+}
+
+// metadataRefreshOperation is the name of the span tracing each population.
+const metadataRefreshOperation = "rancher-metadata-cache-refresh"
+
+// cachePopulate concurrently fetches the hosts and containers, installing
+// whichever were fetched together with the population status, then schedules
+// the next population after the cache interval.
+func (mcr *metadataCachingRepository) cachePopulate(ctx context.Context) {
+	// The context may have been cancelled while we were waiting
+	if ctx.Err() != nil {
+		return
+	}
+
+	// Trace the refresh as a root span, with its own request ID, so that
+	// its calls to the metadata service are tied together
+	span := mcr.tracer.StartSpan(metadataRefreshOperation)
+	rctx := stdopentracing.ContextWithSpan(ContextWithRequestID(ctx, NewRequestID()), span)
+	span.SetTag("request.id", RequestIDFromContext(rctx))
+
+	// Fetch concurrently
+	var (
+		wg         sync.WaitGroup
+		hs         []*Host
+		cs         []*Container
+		herr, cerr error
+	)
 	wg.Add(2)
-	run := func(f func()) { defer wg.Done(); f() }
-	go run(mcr.refreshHosts)
-	go run(mcr.refreshContainers)
+	go func() { defer wg.Done(); hs, herr = mcr.client.MetadataHosts(rctx) }()
+	go func() { defer wg.Done(); cs, cerr = mcr.client.MetadataContainers(rctx) }()
 	wg.Wait()
 
-	// Set the full host name on each container after refreshing
-	cs, _ := mcr.Containers()
-	for _, c := range cs {
-		h, err := mcr.HostByUUID(c.Host.UUID)
-		if err == nil {
-			c.Host.Name = h.Name
+	// Only a full population counts towards the cache's freshness, otherwise
+	// we keep serving the last good snapshot and record the failure
+	refreshed := herr == nil && cerr == nil
+	mcr.mtx.Lock()
+	if herr == nil {
+		mcr.cacheHosts(hs)
+	}
+	if cerr == nil {
+		mcr.cacheContainers(cs)
+	}
+	if refreshed {
+		mcr.refreshed = time.Now()
+		mcr.failures = 0
+		mcr.lastErr = nil
+		mcr.restored = false
+	} else {
+		mcr.failures++
+		if mcr.lastErr = cerr; mcr.lastErr == nil {
+			mcr.lastErr = herr
+		}
+	}
+	mcr.mtx.Unlock()
+
+	if !refreshed {
+		ext.Error.Set(span, true)
+	}
+	span.Finish()
+
+	// Let watchers know how the containers changed
+	if cerr == nil {
+		mcr.publishContainers(cs)
+	}
+
+	// Persist the new last good snapshot and let watchers know of it
+	if refreshed {
+		s := mcr.snapshot()
+		if mcr.snapshots != nil {
+			mcr.snapshots.Save(s)
 		}
+		mcr.publishSnapshot(s)
+	}
+
+	// Continue the cache loop, which stops at the first population after the
+	// context is cancelled
+	mcr.loopMtx.Lock()
+	mcr.populated = time.Now()
+	mcr.timer = time.AfterFunc(mcr.interval, func() { mcr.cachePopulate(ctx) })
+	mcr.loopMtx.Unlock()
+}
+
+// snapshot returns a Snapshot of the repository's caches.
+func (mcr *metadataCachingRepository) snapshot() *Snapshot {
+	mcr.mtx.RLock()
+	defer mcr.mtx.RUnlock()
+
+	return &Snapshot{
+		Refreshed:  mcr.refreshed,
+		Containers: mcr.containers,
+		Hosts:      mcr.hosts,
+	}
+}
+
+// restore warms the caches from the last good snapshot, if there is one.
+// The restored caches are marked as such until they are next refreshed.
+func (mcr *metadataCachingRepository) restore() {
+	s, err := mcr.snapshots.Load()
+	if err != nil || s == nil {
+		return
 	}
 
-	// Begin cache loop
-	time.AfterFunc(d, func() { mcr.cachePopulateEvery(d) })
+	mcr.mtx.Lock()
+	mcr.cacheHosts(s.Hosts)
+	mcr.cacheContainers(s.Containers)
+	mcr.refreshed = s.Refreshed
+	mcr.restored = true
+	mcr.mtx.Unlock()
+
+	mcr.publishContainers(s.Containers)
+
+	mcr.publishSnapshot(mcr.snapshot())
+
+	mcr.watchMtx.Lock()
+	mcr.restoredSnapshot = mcr.watchedSnapshot
+	mcr.watchMtx.Unlock()
 }
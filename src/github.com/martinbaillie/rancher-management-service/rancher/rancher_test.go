@@ -7,18 +7,56 @@
 package rancher
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/Shopify/sarama"
+	"github.com/Shopify/sarama/mocks"
+	"github.com/afex/hystrix-go/hystrix"
+	apache "github.com/apache/thrift/lib/go/thrift"
+	"github.com/gorilla/mux"
 	stdopentracing "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+	zipkin "github.com/openzipkin/zipkin-go-opentracing"
+	"github.com/streadway/amqp"
 
 	"context"
 
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"gopkg.in/jarcoal/httpmock.v1"
 
 	"github.com/stretchr/testify/assert"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/metrics"
+	"github.com/go-kit/kit/metrics/discard"
+
+	kitamqp "github.com/go-kit/kit/transport/amqp"
+
+	"github.com/martinbaillie/rancher-management-service/health"
+	"github.com/martinbaillie/rancher-management-service/rancher/pb"
+	"github.com/martinbaillie/rancher-management-service/rancher/thrift"
 )
 
 const (
@@ -57,11 +95,10 @@ func init() {
 	// Mock the remote calls to the rancher-metadata service
 	httpmock.Activate()
 
-	containersResponse, _ := ioutil.ReadFile("testdata/rancher_containers.json")
-	hostsResponse, _ := ioutil.ReadFile("testdata/rancher_hosts.json")
-
-	defaultContainerResponder = httpmock.NewStringResponder(200, string(containersResponse))
-	defaultHostResponder = httpmock.NewStringResponder(200, string(hostsResponse))
+	// NOTE: Each call decodes a fresh copy of the fixtures, so that no test
+	// sees containers or hosts another has populated
+	defaultContainerResponder = newFixtureResponder("testdata/rancher_containers.json")
+	defaultHostResponder = newFixtureResponder("testdata/rancher_hosts.json")
 
 	httpmock.RegisterResponder("GET", containersURLStr, defaultContainerResponder)
 	httpmock.RegisterResponder("GET", hostsURLStr, defaultHostResponder)
@@ -70,16 +107,35 @@ func init() {
 	ctx := context.Background()
 	tracer := stdopentracing.GlobalTracer()
 	metadataURL, _ := url.Parse(metadataURLStr)
-	rcses := NewClientEndpoints(ctx, metadataURL, tracer)
+	rcses := NewClientEndpoints(ctx, Environment{MetadataURL: metadataURL}, nil, tracer, log.NewNopLogger())
 	rcs = NewClientService(ctx, rcses)
 
 	// Default slices for when nothing has gone wrong
 	defaultContainers = []*Container{
 		&Container{
 			Name:         "web_gossman_2",
+			UUID:         "1627680a-94f9-4422-86e4-cb3cad353af7",
+			ExternalID:   "ee2af4caf0ec6247693701444199e67991b5e6c10d41ea332819654c290e043e",
 			State:        "running",
 			PrivateIP:    "10.42.250.129",
 			ServiceIndex: 2,
+			ServiceName:  "gossman",
+			StackName:    "web",
+			Labels: map[string]string{
+				"io.rancher.container.ip":                  "10.42.250.129/16",
+				"io.rancher.container.name":                "web_gossman_2",
+				"io.rancher.container.uuid":                "1627680a-94f9-4422-86e4-cb3cad353af7",
+				"io.rancher.project.name":                  "web",
+				"io.rancher.project_service.name":          "web/gossman",
+				"io.rancher.scheduler.affinity:host_label": "entry_host=true",
+				"io.rancher.scheduler.global":              "true",
+				"io.rancher.service.deployment.unit":       "109ac34e-82ef-4e32-b058-db0aff1eb980",
+				"io.rancher.service.hash":                  "d0363285c1ab7ce600012134d6d34448801e4f90",
+				"io.rancher.service.launch.config":         "io.rancher.service.primary.launch.config",
+				"io.rancher.service.requested.host.id":     "97",
+				"io.rancher.stack.name":                    "web",
+				"io.rancher.stack_service.name":            "web/gossman",
+			},
 			Host: Host{
 				UUID: "e966be1e-6543-4310-9a4a-5016f86b0eb1",
 				Name: "host-4.corp",
@@ -87,9 +143,37 @@ func init() {
 		},
 		&Container{
 			Name:         "web_service-web_1",
+			UUID:         "541334e5-88d0-433d-9892-cbbd5fa876d8",
+			ExternalID:   "37aa84595107b22bd90a0079a97b283622717b2d3a7dd56ea0ab68e0dc122806",
 			State:        "running",
 			PrivateIP:    "10.42.118.210",
 			ServiceIndex: 1,
+			ServiceName:  "service-web",
+			StackName:    "web",
+			Labels: map[string]string{
+				"Architecture":                    "x86_64",
+				"Authoritative_Registry":          "registry.access.redhat.com",
+				"BZComponent":                     "rhel-server-docker",
+				"Build_Host":                      "rcm-img05.build.eng.bos.redhat.com",
+				"Name":                            "redhat/rhel7",
+				"Release":                         "24",
+				"Vendor":                          "Red Hat, Inc.",
+				"Version":                         "7.1",
+				"io.rancher.container.ip":         "10.42.118.210/16",
+				"io.rancher.container.name":       "web_service-web_1",
+				"io.rancher.container.network":    "true",
+				"io.rancher.container.pull_image": "always",
+				"io.rancher.container.uuid":       "541334e5-88d0-433d-9892-cbbd5fa876d8",
+				"io.rancher.project.name":         "web",
+				"io.rancher.project_service.name": "web/service-web",
+				"io.rancher.scheduler.affinity:container_label_soft_ne": "io.rancher.stack_service.name=${stack_name}/${service_name}",
+				"io.rancher.scheduler.affinity:host_label_ne":           "log_host=true",
+				"io.rancher.service.deployment.unit":                    "0b3afb10-83c2-4cdd-9b9c-25d5050bc385",
+				"io.rancher.service.hash":                               "43236b1173906783aa2d94243207fcee6cdb6b89",
+				"io.rancher.service.launch.config":                      "io.rancher.service.primary.launch.config",
+				"io.rancher.stack.name":                                 "web",
+				"io.rancher.stack_service.name":                         "web/service-web",
+			},
 			Host: Host{
 				UUID: "bfa1363f-8f2a-44de-afb6-a1bb7db1d614",
 				Name: "host-2.corp",
@@ -97,9 +181,37 @@ func init() {
 		},
 		&Container{
 			Name:         "web_web-self-service_1",
+			UUID:         "1c4932ac-dff9-4e96-ade0-159c29de342a",
+			ExternalID:   "649354074c166f389a89204bf2ce771f93881746c93960389b546bdfa5b6c02b",
 			State:        "running",
 			PrivateIP:    "10.42.97.176",
 			ServiceIndex: 1,
+			ServiceName:  "web-self-service",
+			StackName:    "web",
+			Labels: map[string]string{
+				"Architecture":                    "x86_64",
+				"Authoritative_Registry":          "registry.access.redhat.com",
+				"BZComponent":                     "rhel-server-docker",
+				"Build_Host":                      "rcm-img05.build.eng.bos.redhat.com",
+				"Name":                            "redhat/rhel7",
+				"Release":                         "24",
+				"Vendor":                          "Red Hat, Inc.",
+				"Version":                         "7.1",
+				"io.rancher.container.ip":         "10.42.97.176/16",
+				"io.rancher.container.name":       "web_web-self-service_1",
+				"io.rancher.container.network":    "true",
+				"io.rancher.container.pull_image": "always",
+				"io.rancher.container.uuid":       "1c4932ac-dff9-4e96-ade0-159c29de342a",
+				"io.rancher.project.name":         "web",
+				"io.rancher.project_service.name": "web/web-self-service",
+				"io.rancher.scheduler.affinity:container_label_soft_ne": "io.rancher.stack_service.name=${stack_name}/${service_name}",
+				"io.rancher.scheduler.affinity:host_label_ne":           "log_host=true",
+				"io.rancher.service.deployment.unit":                    "f26af534-d681-4e9a-aab8-860216e47316",
+				"io.rancher.service.hash":                               "43236b1173906783aa2d94243207fcee6cdb6b89",
+				"io.rancher.service.launch.config":                      "io.rancher.service.primary.launch.config",
+				"io.rancher.stack.name":                                 "web",
+				"io.rancher.stack_service.name":                         "web/web-self-service",
+			},
 			Host: Host{
 				UUID: "e966be1e-6543-4310-9a4a-5016f86b0eb1",
 				Name: "host-4.corp",
@@ -107,9 +219,37 @@ func init() {
 		},
 		&Container{
 			Name:         "web_web-self-service_2",
+			UUID:         "20652706-de39-4dfe-ad26-c36fe75e77b5",
+			ExternalID:   "b55dbdca6205424dc3d46733765eb657af63664302d92052d6b5e9eafa81386c",
 			State:        "running",
 			PrivateIP:    "10.42.171.148",
 			ServiceIndex: 2,
+			ServiceName:  "web-self-service",
+			StackName:    "web",
+			Labels: map[string]string{
+				"Architecture":                    "x86_64",
+				"Authoritative_Registry":          "registry.access.redhat.com",
+				"BZComponent":                     "rhel-server-docker",
+				"Build_Host":                      "rcm-img05.build.eng.bos.redhat.com",
+				"Name":                            "redhat/rhel7",
+				"Release":                         "24",
+				"Vendor":                          "Red Hat, Inc.",
+				"Version":                         "7.1",
+				"io.rancher.container.ip":         "10.42.171.148/16",
+				"io.rancher.container.name":       "web_web-self-service_2",
+				"io.rancher.container.network":    "true",
+				"io.rancher.container.pull_image": "always",
+				"io.rancher.container.uuid":       "20652706-de39-4dfe-ad26-c36fe75e77b5",
+				"io.rancher.project.name":         "web",
+				"io.rancher.project_service.name": "web/web-self-service",
+				"io.rancher.scheduler.affinity:container_label_soft_ne": "io.rancher.stack_service.name=${stack_name}/${service_name}",
+				"io.rancher.scheduler.affinity:host_label_ne":           "log_host=true",
+				"io.rancher.service.deployment.unit":                    "bc5826a8-eea8-4805-95fb-682f103679a7",
+				"io.rancher.service.hash":                               "43236b1173906783aa2d94243207fcee6cdb6b89",
+				"io.rancher.service.launch.config":                      "io.rancher.service.primary.launch.config",
+				"io.rancher.stack.name":                                 "web",
+				"io.rancher.stack_service.name":                         "web/web-self-service",
+			},
 			Host: Host{
 				UUID: "e966be1e-6543-4310-9a4a-5016f86b0eb1",
 				Name: "host-4.corp",
@@ -117,9 +257,38 @@ func init() {
 		},
 		&Container{
 			Name:         "web_web-deployment_1",
+			UUID:         "d4c75bea-9cb6-479d-af3f-29eec96dc14a",
+			ExternalID:   "6a1ea6ae50da343c995c3b08eb880d3195c531c553da8c287365f1eb1f6a9832",
 			State:        "stopped",
 			PrivateIP:    "10.42.156.227",
 			ServiceIndex: 1,
+			ServiceName:  "web-deployment",
+			StackName:    "web",
+			Labels: map[string]string{
+				"Architecture":                    "x86_64",
+				"Authoritative_Registry":          "registry.access.redhat.com",
+				"BZComponent":                     "rhel-server-docker",
+				"Build_Host":                      "rcm-img05.build.eng.bos.redhat.com",
+				"Name":                            "redhat/rhel7",
+				"Release":                         "24",
+				"Vendor":                          "Red Hat, Inc.",
+				"Version":                         "7.1",
+				"io.rancher.container.ip":         "10.42.156.227/16",
+				"io.rancher.container.name":       "web_web-deployment_1",
+				"io.rancher.container.pull_image": "always",
+				"io.rancher.container.start_once": "true",
+				"io.rancher.container.uuid":       "d4c75bea-9cb6-479d-af3f-29eec96dc14a",
+				"io.rancher.project.name":         "web",
+				"io.rancher.project_service.name": "web/web-deployment",
+				"io.rancher.scheduler.affinity:host_label_ne": "log_host=true",
+				"io.rancher.scheduler.global":                 "true",
+				"io.rancher.service.deployment.unit":          "858e8a05-b4f9-40a7-8755-9471c39de4fd",
+				"io.rancher.service.hash":                     "ff7db7b2429ae321ae1e980f5a50306ae2107fcb",
+				"io.rancher.service.launch.config":            "io.rancher.service.primary.launch.config",
+				"io.rancher.service.requested.host.id":        "95",
+				"io.rancher.stack.name":                       "web",
+				"io.rancher.stack_service.name":               "web/web-deployment",
+			},
 			Host: Host{
 				UUID: "259466fc-2c68-4701-8fe5-0ca5be5d354f",
 				Name: "host-1.corp",
@@ -127,9 +296,38 @@ func init() {
 		},
 		&Container{
 			Name:         "web_web-deployment_2",
+			UUID:         "2cdcd948-69e8-43f4-8523-9b6130dd1a08",
+			ExternalID:   "3b5e17c4398809799c9bbe31582e2475fc862b70271f13732285c8bf8d23bf6b",
 			State:        "stopped",
 			PrivateIP:    "10.42.203.121",
 			ServiceIndex: 2,
+			ServiceName:  "web-deployment",
+			StackName:    "web",
+			Labels: map[string]string{
+				"Architecture":                    "x86_64",
+				"Authoritative_Registry":          "registry.access.redhat.com",
+				"BZComponent":                     "rhel-server-docker",
+				"Build_Host":                      "rcm-img05.build.eng.bos.redhat.com",
+				"Name":                            "redhat/rhel7",
+				"Release":                         "24",
+				"Vendor":                          "Red Hat, Inc.",
+				"Version":                         "7.1",
+				"io.rancher.container.ip":         "10.42.203.121/16",
+				"io.rancher.container.name":       "web_web-deployment_2",
+				"io.rancher.container.pull_image": "always",
+				"io.rancher.container.start_once": "true",
+				"io.rancher.container.uuid":       "2cdcd948-69e8-43f4-8523-9b6130dd1a08",
+				"io.rancher.project.name":         "web",
+				"io.rancher.project_service.name": "web/web-deployment",
+				"io.rancher.scheduler.affinity:host_label_ne": "log_host=true",
+				"io.rancher.scheduler.global":                 "true",
+				"io.rancher.service.deployment.unit":          "2cc5efab-65c9-4f4f-85ac-88db302a70af",
+				"io.rancher.service.hash":                     "ff7db7b2429ae321ae1e980f5a50306ae2107fcb",
+				"io.rancher.service.launch.config":            "io.rancher.service.primary.launch.config",
+				"io.rancher.service.requested.host.id":        "97",
+				"io.rancher.stack.name":                       "web",
+				"io.rancher.stack_service.name":               "web/web-deployment",
+			},
 			Host: Host{
 				UUID: "e966be1e-6543-4310-9a4a-5016f86b0eb1",
 				Name: "host-4.corp",
@@ -160,6 +358,15 @@ func init() {
 	}
 }
 
+// newFixtureResponder returns a Responder serving a fresh copy of the given
+// testdata fixture on every call.
+func newFixtureResponder(fixture string) httpmock.Responder {
+	body, _ := ioutil.ReadFile(fixture)
+	return func(*http.Request) (*http.Response, error) {
+		return httpmock.NewBytesResponse(200, body), nil
+	}
+}
+
 func ContainersTestRunner(t *testing.T, ts *[]ContainersMethodTestAssertion) {
 	assert := assert.New(t)
 	httpmock.Activate()
@@ -169,8 +376,8 @@ func ContainersTestRunner(t *testing.T, ts *[]ContainersMethodTestAssertion) {
 		httpmock.RegisterResponder("GET", containersURLStr, tc.containersResponder)
 		httpmock.RegisterResponder("GET", hostsURLStr, tc.hostsResponder)
 
-		repository := NewMetadataCachingRepository(rcs, cacheInterval)
-		repository.refreshContainers()
+		// The repository is populated on creation
+		repository := NewMetadataCachingRepository(context.Background(), rcs, cacheInterval, 0, nil, stdopentracing.GlobalTracer())
 		res, err := repository.Containers()
 
 		assert.Equal(tc.expectedContainers, res, tc.description)
@@ -189,8 +396,8 @@ func HostsTestRunner(t *testing.T, ts *[]HostsMethodTestAssertion) {
 		httpmock.RegisterResponder("GET", containersURLStr, tc.containersResponder)
 		httpmock.RegisterResponder("GET", hostsURLStr, tc.hostsResponder)
 
-		repository := NewMetadataCachingRepository(rcs, cacheInterval)
-		repository.refreshHosts()
+		// The repository is populated on creation
+		repository := NewMetadataCachingRepository(context.Background(), rcs, cacheInterval, 0, nil, stdopentracing.GlobalTracer())
 		res, err := repository.Hosts()
 
 		assert.Equal(tc.expectedHosts, res, tc.description)
@@ -267,9 +474,9 @@ func TestContainerByName(t *testing.T) {
 	defer httpmock.Deactivate()
 
 	httpmock.RegisterResponder("GET", containersURLStr, defaultContainerResponder)
+	httpmock.RegisterResponder("GET", hostsURLStr, httpmock.NewStringResponder(404, ""))
 
-	repository := NewMetadataCachingRepository(rcs, cacheInterval)
-	repository.refreshContainers()
+	repository := NewMetadataCachingRepository(context.Background(), rcs, cacheInterval, 0, nil, stdopentracing.GlobalTracer())
 	res, err := repository.ContainerByName("web_gossman_2")
 	assert.Equal(defaultContainersNoHostNames[0], res, "ContainerByName() success")
 	assert.Equal(nil, err, "ContainerByName() success")
@@ -286,8 +493,7 @@ func TestHostByUUID(t *testing.T) {
 
 	httpmock.RegisterResponder("GET", hostsURLStr, defaultHostResponder)
 
-	repository := NewMetadataCachingRepository(rcs, cacheInterval)
-	repository.refreshHosts()
+	repository := NewMetadataCachingRepository(context.Background(), rcs, cacheInterval, 0, nil, stdopentracing.GlobalTracer())
 	res, err := repository.HostByUUID("bfa1363f-8f2a-44de-afb6-a1bb7db1d614")
 	assert.Equal(defaultHosts[1], res, "HostByUUID() success")
 	assert.Equal(nil, err, "HostByUUID() success")
@@ -296,3 +502,2805 @@ func TestHostByUUID(t *testing.T) {
 	assert.Equal((*Host)(nil), res, "HostByUUID() failure")
 	assert.Equal(ErrHostNotFound, err, "HostByUUID() failure")
 }
+
+func TestCachePopulateEveryStopsOnCancel(t *testing.T) {
+	assert := assert.New(t)
+	httpmock.Activate()
+	defer httpmock.Deactivate()
+	hystrix.Flush()
+
+	// The second population, the first of the loop, cancels the loop
+	ctx, cancel := context.WithCancel(context.Background())
+	var calls int32
+	looped := make(chan struct{})
+	containers := newFixtureResponder("testdata/rancher_containers.json")
+	httpmock.RegisterResponder("GET", containersURLStr, func(r *http.Request) (*http.Response, error) {
+		if atomic.AddInt32(&calls, 1) == 2 {
+			cancel()
+			close(looped)
+		}
+		return containers(r)
+	})
+	httpmock.RegisterResponder("GET", hostsURLStr, defaultHostResponder)
+
+	interval := 10 * time.Millisecond
+	mcr := NewMetadataCachingRepository(ctx, rcs, interval, 0, nil, stdopentracing.GlobalTracer()).(*metadataCachingRepository)
+	populated := func() time.Time {
+		mcr.loopMtx.Lock()
+		defer mcr.loopMtx.Unlock()
+		return mcr.populated
+	}
+	first := populated()
+	select {
+	case <-looped:
+	case <-time.After(5 * time.Second):
+		assert.Fail("cachePopulateEvery() loops until cancelled")
+		return
+	}
+
+	// Let the cancelling population finish before its calls are unmocked
+	for populated() == first {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(5 * interval)
+	assert.Equal(int32(2), atomic.LoadInt32(&calls), "cachePopulateEvery() stops once cancelled")
+}
+
+func TestCacheReadsDuringPopulation(t *testing.T) {
+	assert := assert.New(t)
+	httpmock.Activate()
+	defer httpmock.Deactivate()
+	hystrix.Flush()
+
+	httpmock.RegisterResponder("GET", containersURLStr, newFixtureResponder("testdata/rancher_containers.json"))
+	httpmock.RegisterResponder("GET", hostsURLStr, defaultHostResponder)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	mcr := NewMetadataCachingRepository(ctx, rcs, time.Millisecond, 0, nil, stdopentracing.GlobalTracer()).(*metadataCachingRepository)
+	populated := func() time.Time {
+		mcr.loopMtx.Lock()
+		defer mcr.loopMtx.Unlock()
+		return mcr.populated
+	}
+
+	// Read the caches as the transports do while they are repopulated
+	for n, last := 0, populated(); n < 3; {
+		cs := mcr.CacheStatus()
+		assert.Equal(len(defaultContainers), cs.Containers, "CacheStatus() during population")
+		_, err := mcr.ContainerByName(defaultContainers[0].Name)
+		assert.NoError(err, "ContainerByName() during population")
+		_, err = mcr.Containers()
+		assert.NoError(err, "Containers() during population")
+		_, err = mcr.HostByUUID(defaultHosts[0].UUID)
+		assert.NoError(err, "HostByUUID() during population")
+		_, err = mcr.Hosts()
+		assert.NoError(err, "Hosts() during population")
+		if p := populated(); p != last {
+			n, last = n+1, p
+		}
+	}
+
+	// Let the loop stop before its calls are unmocked
+	cancel()
+	for last := populated(); ; {
+		time.Sleep(10 * time.Millisecond)
+		p := populated()
+		if p == last {
+			break
+		}
+		last = p
+	}
+}
+
+func TestCachedContainersUnchanged(t *testing.T) {
+	assert := assert.New(t)
+	httpmock.Activate()
+	defer httpmock.Deactivate()
+	hystrix.Flush()
+
+	httpmock.RegisterResponder("GET", containersURLStr, newFixtureResponder("testdata/rancher_containers.json"))
+	httpmock.RegisterResponder("GET", hostsURLStr, defaultHostResponder)
+	repository := NewMetadataCachingRepository(context.Background(), rcs, cacheInterval, 0, nil, stdopentracing.GlobalTracer())
+	cached, _ := repository.Containers()
+	before := make([]Container, len(cached))
+	for i, c := range cached {
+		before[i] = *c
+	}
+
+	// Renamed hosts name the new containers, not those already handed out
+	b, _ := ioutil.ReadFile("testdata/rancher_hosts.json")
+	httpmock.RegisterResponder("GET", hostsURLStr, httpmock.NewStringResponder(200, strings.Replace(string(b), ".corp", ".renamed", -1)))
+	repository.cachePopulateEvery(context.Background(), cacheInterval)
+	for i, c := range cached {
+		assert.Equal(before[i], *c, "cachePopulate() cached containers unchanged")
+	}
+	cs, err := repository.Containers()
+	if assert.NoError(err, "Containers() repopulated") {
+		assert.Equal(strings.Replace(defaultContainers[0].Host.Name, ".corp", ".renamed", 1), cs[0].Host.Name, "Containers() renamed host")
+	}
+}
+
+func TestHealthChecker(t *testing.T) {
+	assert := assert.New(t)
+	httpmock.Activate()
+	defer httpmock.Deactivate()
+
+	// NOTE: The environment's own client endpoints keep its circuits apart
+	// from those other tests may have opened
+	metadataURL, _ := url.Parse("http://rancher-metadata.health/latest")
+	env := Environment{Name: "health", MetadataURL: metadataURL, MetadataInterval: cacheInterval}
+	ces := NewClientEndpoints(context.Background(), env, nil, stdopentracing.GlobalTracer(), log.NewNopLogger())
+	client := NewClientService(context.Background(), ces)
+	httpmock.RegisterResponder("GET", metadataURL.String()+"/containers", httpmock.NewStringResponder(500, ""))
+	httpmock.RegisterResponder("GET", metadataURL.String()+"/hosts", defaultHostResponder)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	repository := NewMetadataCachingRepository(ctx, client, cacheInterval, 0, nil, stdopentracing.GlobalTracer())
+	checker := NewHealthChecker(env, repository, ces.Circuits, 1)
+	assert.Equal(ErrCacheNotPopulated, checker.Ready(), "Ready() cache not populated")
+	assert.Equal(health.StatusDown, checker.Dependencies()[0].Status, "Dependencies() cache not populated")
+
+	httpmock.RegisterResponder("GET", metadataURL.String()+"/containers", defaultContainerResponder)
+	repository.cachePopulateEvery(ctx, cacheInterval)
+	assert.Equal(nil, checker.Ready(), "Ready() cache populated")
+
+	ds := checker.Dependencies()
+	assert.Equal(3, len(ds), "Dependencies() metadata service and circuits")
+	assert.Equal(health.StatusUp, ds[0].Status, "Dependencies() cache populated")
+	assert.Equal(len(defaultContainers), ds[0].Details["Containers"], "Dependencies() container count")
+	assert.Equal(len(defaultHosts), ds[0].Details["Hosts"], "Dependencies() host count")
+	assert.Equal(env.command(metadataContainersCommand), ds[1].Name, "Dependencies() circuit name")
+	assert.Equal("closed", ds[1].Details["Circuit"], "Dependencies() circuit state")
+
+	checker = NewHealthChecker(Environment{Name: "health"}, repository, ces.Circuits, 1)
+	assert.Equal(ErrCacheStale, checker.Ready(), "Ready() cache stale")
+}
+
+// populationClientService stands in for the metadata service, noting each
+// population of the cache without a shared HTTP transport.
+type populationClientService struct {
+	ClientService
+	populations chan struct{}
+}
+
+func (s populationClientService) MetadataContainers(context.Context) ([]*Container, error) {
+	select {
+	case s.populations <- struct{}{}:
+	default:
+	}
+	return []*Container{}, nil
+}
+
+func (s populationClientService) MetadataHosts(context.Context) ([]*Host, error) {
+	return []*Host{}, nil
+}
+
+func TestSetCacheInterval(t *testing.T) {
+	assert := assert.New(t)
+
+	populations := make(chan struct{}, 100)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	repository := NewMetadataCachingRepository(ctx, populationClientService{populations: populations}, time.Hour, 0, nil, stdopentracing.GlobalTracer())
+	assert.Len(populations, 1, "cachePopulateEvery() awaits the interval")
+	<-populations
+
+	// NOTE: Checked while no population is in flight
+	checker := NewHealthChecker(Environment{MetadataInterval: time.Nanosecond}, repository, nil, 1)
+	assert.Equal(ErrCacheStale, checker.Ready(), "Ready() cache stale")
+	checker.(CacheIntervalSetter).SetCacheInterval(time.Hour)
+	assert.Equal(nil, checker.Ready(), "Ready() follows the cache interval")
+
+	repository.SetCacheInterval(time.Millisecond)
+	for i := 0; i < 2; i++ {
+		select {
+		case <-populations:
+		case <-time.After(5 * time.Second):
+			t.Fatal("SetCacheInterval() did not reschedule the next population")
+		}
+	}
+	repository.SetCacheInterval(time.Hour)
+}
+
+func TestLastGoodSnapshot(t *testing.T) {
+	assert := assert.New(t)
+	httpmock.Activate()
+	defer httpmock.Deactivate()
+	hystrix.Flush()
+
+	httpmock.RegisterResponder("GET", containersURLStr, newFixtureResponder("testdata/rancher_containers.json"))
+	httpmock.RegisterResponder("GET", hostsURLStr, newFixtureResponder("testdata/rancher_hosts.json"))
+
+	repository := NewMetadataCachingRepository(context.Background(), rcs, cacheInterval, 20*time.Millisecond, nil, stdopentracing.GlobalTracer())
+	cs := repository.CacheStatus()
+	assert.Equal(0, cs.Failures, "CacheStatus() success")
+	assert.Equal(nil, cs.LastError, "CacheStatus() success")
+
+	httpmock.RegisterResponder("GET", containersURLStr, httpmock.NewStringResponder(500, ""))
+	repository.cachePopulateEvery(context.Background(), cacheInterval)
+	repository.cachePopulateEvery(context.Background(), cacheInterval)
+	cs = repository.CacheStatus()
+	assert.Equal(2, cs.Failures, "CacheStatus() consecutive failures")
+	assert.NotNil(cs.LastError, "CacheStatus() last error")
+
+	res, err := repository.Containers()
+	assert.Equal(defaultContainers, res, "Containers() serves last good snapshot")
+	assert.Equal(nil, err, "Containers() serves last good snapshot")
+	checker := NewHealthChecker(Environment{MetadataInterval: cacheInterval}, repository, nil, 1)
+	assert.Equal(health.StatusDegraded, checker.Dependencies()[0].Status, "Dependencies() serving last good snapshot")
+
+	time.Sleep(25 * time.Millisecond)
+	res, err = repository.Containers()
+	assert.Equal(([]*Container)(nil), res, "Containers() beyond max staleness")
+	assert.Equal(ErrContainerRepoStale, err, "Containers() beyond max staleness")
+	_, err = repository.HostByUUID(defaultHosts[0].UUID)
+	assert.Equal(ErrHostRepoStale, err, "HostByUUID() beyond max staleness")
+	assert.Equal(true, repository.CacheStatus().Stale, "CacheStatus() beyond max staleness")
+	assert.Equal(health.StatusDown, checker.Dependencies()[0].Status, "Dependencies() beyond max staleness")
+}
+
+func TestEncodeHTTPCacheHeaders(t *testing.T) {
+	assert := assert.New(t)
+
+	w := httptest.NewRecorder()
+	EncodeHTTPGenericResponse(context.Background(), w, containersResponse{
+		Containers: defaultContainers,
+		cache:      CacheStatus{Refreshed: time.Now().Add(-time.Minute)},
+	})
+	assert.Equal(http.StatusOK, w.Code, "EncodeHTTPGenericResponse() fresh")
+	assert.Equal("60", w.Header().Get("X-Cache-Age"), "EncodeHTTPGenericResponse() fresh")
+	assert.Equal("", w.Header().Get("Warning"), "EncodeHTTPGenericResponse() fresh")
+
+	w = httptest.NewRecorder()
+	EncodeHTTPGenericResponse(context.Background(), w, containersResponse{
+		Containers: defaultContainers,
+		cache:      CacheStatus{Refreshed: time.Now().Add(-time.Minute), Failures: 1},
+	})
+	assert.Equal(http.StatusOK, w.Code, "EncodeHTTPGenericResponse() refresh failed")
+	assert.Equal(`111 - "Revalidation Failed"`, w.Header().Get("Warning"), "EncodeHTTPGenericResponse() refresh failed")
+
+	w = httptest.NewRecorder()
+	EncodeHTTPGenericResponse(context.Background(), w, containersResponse{
+		Err:   ErrContainerRepoStale,
+		cache: CacheStatus{Refreshed: time.Now().Add(-time.Hour), Failures: 12},
+	})
+	assert.Equal(http.StatusFailedDependency, w.Code, "EncodeHTTPGenericResponse() beyond max staleness")
+	assert.Equal("3600", w.Header().Get("X-Cache-Age"), "EncodeHTTPGenericResponse() beyond max staleness")
+}
+
+func TestFileSnapshotStore(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, _ := ioutil.TempDir("", "rancher-snapshot")
+	defer os.RemoveAll(dir)
+
+	ss := NewFileSnapshotStore(dir)
+	res, err := ss.Load()
+	assert.Equal((*Snapshot)(nil), res, "Load() no snapshot")
+	assert.Equal(nil, err, "Load() no snapshot")
+
+	snap := &Snapshot{
+		Refreshed:  time.Now().Add(-time.Minute).Round(0).UTC(),
+		Containers: defaultContainersNoHostNames,
+		Hosts:      defaultHosts,
+	}
+	assert.Equal(nil, ss.Save(snap), "Save() success")
+	res, err = ss.Load()
+	assert.Equal(snap, res, "Load() success")
+	assert.Equal(nil, err, "Load() success")
+
+	path := filepath.Join(dir, snapshotFileName)
+	b, _ := ioutil.ReadFile(path)
+	ioutil.WriteFile(path, bytes.Replace(b, []byte("web_gossman_2"), []byte("web_gossman_3"), 1), 0644)
+	_, err = ss.Load()
+	assert.Equal(ErrSnapshotChecksum, err, "Load() corrupted")
+
+	version := fmt.Sprintf(`"version":%d`, snapshotVersion)
+	ioutil.WriteFile(path, bytes.Replace(b, []byte(version), []byte(`"version":1`), 1), 0644)
+	_, err = ss.Load()
+	assert.Equal(ErrSnapshotVersion, err, "Load() older version")
+}
+
+func TestWarmRestart(t *testing.T) {
+	assert := assert.New(t)
+	httpmock.Activate()
+	defer httpmock.Deactivate()
+	hystrix.Flush()
+
+	dir, _ := ioutil.TempDir("", "rancher-snapshot")
+	defer os.RemoveAll(dir)
+	ss := NewFileSnapshotStore(dir)
+
+	httpmock.RegisterResponder("GET", containersURLStr, newFixtureResponder("testdata/rancher_containers.json"))
+	httpmock.RegisterResponder("GET", hostsURLStr, newFixtureResponder("testdata/rancher_hosts.json"))
+	NewMetadataCachingRepository(context.Background(), rcs, cacheInterval, 0, ss, stdopentracing.GlobalTracer())
+
+	httpmock.RegisterResponder("GET", containersURLStr, httpmock.NewStringResponder(500, ""))
+	repository := NewMetadataCachingRepository(context.Background(), rcs, cacheInterval, 0, ss, stdopentracing.GlobalTracer())
+	res, err := repository.Containers()
+	assert.Equal(defaultContainers, res, "Containers() restored from snapshot")
+	assert.Equal(nil, err, "Containers() restored from snapshot")
+	assert.Equal(true, repository.CacheStatus().Restored, "CacheStatus() restored from snapshot")
+	checker := NewHealthChecker(Environment{Name: "warm", MetadataInterval: cacheInterval}, repository, nil, 3)
+	assert.Equal(ErrCacheRestored, checker.Ready(), "Ready() restored from snapshot")
+	assert.Equal(health.StatusDegraded, checker.Dependencies()[0].Status, "Dependencies() restored from snapshot")
+	if restored := repository.RestoredSnapshot(); assert.NotNil(restored, "RestoredSnapshot() restored from snapshot") {
+		assert.Equal(defaultContainers, restored.Containers, "RestoredSnapshot() restored from snapshot")
+	}
+
+	httpmock.RegisterResponder("GET", containersURLStr, newFixtureResponder("testdata/rancher_containers.json"))
+	repository.cachePopulateEvery(context.Background(), cacheInterval)
+	assert.Equal(false, repository.CacheStatus().Restored, "CacheStatus() refreshed since restore")
+	assert.Equal(nil, checker.Ready(), "Ready() refreshed since restore")
+}
+
+func TestParseEnvironments(t *testing.T) {
+	assert := assert.New(t)
+
+	metadataURL, _ := url.Parse(metadataURLStr)
+	defaults := Environment{
+		Name:             DefaultEnvironment,
+		MetadataURL:      metadataURL,
+		MetadataInterval: cacheInterval,
+	}
+
+	envs, err := ParseEnvironments("", defaults)
+	assert.Equal([]Environment{defaults}, envs, "ParseEnvironments() empty spec")
+	assert.Equal(nil, err, "ParseEnvironments() empty spec")
+
+	u, err := MetadataURLFromStr("127.0.0.1:8080/latest")
+	assert.Equal("http://127.0.0.1:8080/latest", u.String(), "MetadataURLFromStr() host and port")
+	assert.Equal(nil, err, "MetadataURLFromStr() host and port")
+
+	envs, err = ParseEnvironments("name=dev,metadata_addr=rancher-metadata.dev/latest,proxy=http://squid:3128;name=prod,metadata_interval=1m,api_url=http://rancher:8080/v2-beta/projects/1a5,api_access_key=access,api_secret_key=s3cr3t", defaults)
+	assert.Equal(nil, err, "ParseEnvironments() success")
+	if assert.Len(envs, 2, "ParseEnvironments() success") {
+		assert.Equal("dev", envs[0].Name, "ParseEnvironments() name")
+		assert.Equal("http://rancher-metadata.dev/latest", envs[0].MetadataURL.String(), "ParseEnvironments() metadata_addr")
+		assert.Equal("http://squid:3128", envs[0].ProxyURL.String(), "ParseEnvironments() proxy")
+		assert.Equal(cacheInterval, envs[0].MetadataInterval, "ParseEnvironments() default metadata_interval")
+		assert.Equal("prod", envs[1].Name, "ParseEnvironments() name")
+		assert.Equal(metadataURL, envs[1].MetadataURL, "ParseEnvironments() default metadata_addr")
+		assert.Equal(time.Minute, envs[1].MetadataInterval, "ParseEnvironments() metadata_interval")
+		assert.Nil(envs[0].APIURL, "ParseEnvironments() default api_url")
+		assert.Equal("http://rancher:8080/v2-beta/projects/1a5", envs[1].APIURL.String(), "ParseEnvironments() api_url")
+		assert.Equal("access", envs[1].APIAccessKey, "ParseEnvironments() api_access_key")
+		assert.Equal("s3cr3t", envs[1].APISecretKey, "ParseEnvironments() api_secret_key")
+	}
+
+	secretFile, err := ioutil.TempFile("", "rms-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(secretFile.Name())
+	secretFile.WriteString("s3cr3t\n")
+	secretFile.Close()
+	envs, err = ParseEnvironments("name=prod,api_secret_key_file="+secretFile.Name(), defaults)
+	if assert.Nil(err, "ParseEnvironments() api_secret_key_file") {
+		assert.Equal("s3cr3t", envs[0].APISecretKey, "ParseEnvironments() api_secret_key_file")
+	}
+
+	for _, spec := range []string{
+		"name=dev,api_secret_key_file=/nonexistent",
+		"metadata_interval=1m",
+		"name=Dev",
+		"name=containers",
+		"name=dev;name=dev",
+		"name=dev,metadata_interval=soon",
+		"name=dev,colour=blue",
+		"name",
+	} {
+		_, err := ParseEnvironments(spec, defaults)
+		assert.NotNil(err, "ParseEnvironments() failure: "+spec)
+	}
+}
+
+type stubServerService struct {
+	containers []*Container
+	err        error
+	cs         CacheStatus
+	events     []ContainerEvent
+}
+
+func (s stubServerService) Container(_ context.Context, name string) (*Container, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	for _, c := range s.containers {
+		if c.Name == name {
+			return c, nil
+		}
+	}
+	return nil, ErrContainerNotFound
+}
+
+func (s stubServerService) Containers(_ context.Context) ([]*Container, error) {
+	return s.containers, s.err
+}
+
+func (s stubServerService) CacheStatus(_ context.Context) CacheStatus {
+	return s.cs
+}
+
+func (s stubServerService) WatchContainers(_ context.Context) <-chan ContainerEvent {
+	ch := make(chan ContainerEvent, len(s.events))
+	for _, e := range s.events {
+		ch <- e
+	}
+	close(ch)
+	return ch
+}
+
+func TestAggregateServerService(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	now := time.Now()
+
+	dev := stubServerService{
+		containers: []*Container{{Name: "web"}, {Name: "db"}},
+		cs:         CacheStatus{Refreshed: now, Containers: 2},
+	}
+	prod := stubServerService{
+		containers: []*Container{{Name: "web"}},
+		cs:         CacheStatus{Refreshed: now.Add(-time.Minute), Failures: 1, Containers: 1},
+	}
+	broken := stubServerService{err: ErrContainerRepoStale, cs: CacheStatus{Stale: true}}
+
+	s := NewAggregateServerService([]string{"dev", "prod"}, map[string]ServerService{"dev": dev, "prod": prod})
+
+	res, err := s.Containers(ctx)
+	assert.Equal([]*Container{
+		{Name: "web", Environment: "dev"},
+		{Name: "db", Environment: "dev"},
+		{Name: "web", Environment: "prod"},
+	}, res, "Containers() spans environments")
+	assert.Equal(nil, err, "Containers() spans environments")
+	assert.Equal("", dev.containers[0].Environment, "Containers() leaves environment caches untouched")
+
+	c, err := s.Container(ctx, "db")
+	assert.Equal(&Container{Name: "db", Environment: "dev"}, c, "Container() one environment")
+	assert.Equal(nil, err, "Container() one environment")
+
+	_, err = s.Container(ctx, "web")
+	assert.Equal(ErrContainerAmbiguous, err, "Container() several environments")
+
+	_, err = s.Container(ctx, "cache")
+	assert.Equal(ErrContainerNotFound, err, "Container() not found")
+
+	assert.Equal(CacheStatus{Refreshed: now.Add(-time.Minute), Failures: 1, Containers: 3}, s.CacheStatus(ctx), "CacheStatus() stalest view")
+
+	s = NewAggregateServerService([]string{"broken", "prod"}, map[string]ServerService{"broken": broken, "prod": prod})
+	res, err = s.Containers(ctx)
+	assert.Equal([]*Container{{Name: "web", Environment: "prod"}}, res, "Containers() partial failure")
+	assert.Equal(nil, err, "Containers() partial failure")
+	cs := s.CacheStatus(ctx)
+	assert.Equal(CacheStatus{
+		Refreshed:   now.Add(-time.Minute),
+		Failures:    1,
+		LastError:   errors.New("broken: container repository is stale"),
+		Containers:  1,
+		Unavailable: []string{"broken"},
+	}, cs, "CacheStatus() partial failure")
+	w := httptest.NewRecorder()
+	encodeHTTPCacheHeaders(cs, w)
+	assert.Equal([]string{`111 - "Revalidation Failed"`, `199 - "Environments Unavailable: broken"`}, w.Header()["Warning"], "Warning partial failure")
+
+	_, err = s.Container(ctx, "db")
+	assert.Equal(ErrContainerRepoStale, err, "Container() failure")
+
+	s = NewAggregateServerService([]string{"broken"}, map[string]ServerService{"broken": broken})
+	_, err = s.Containers(ctx)
+	assert.Equal(ErrContainerRepoStale, err, "Containers() total failure")
+}
+
+func TestDiffContainers(t *testing.T) {
+	assert := assert.New(t)
+
+	old := []*Container{
+		{Name: "web", State: "running"},
+		{Name: "db", State: "running"},
+	}
+	new := []*Container{
+		{Name: "web", State: "stopped"},
+		{Name: "cache", State: "running"},
+	}
+	assert.Equal([]ContainerEvent{
+		{Type: ContainerUpdated, Container: &Container{Name: "web", State: "stopped"}},
+		{Type: ContainerAdded, Container: &Container{Name: "cache", State: "running"}},
+		{Type: ContainerRemoved, Container: &Container{Name: "db", State: "running"}},
+	}, DiffContainers(old, new), "DiffContainers() changes")
+	assert.Len(DiffContainers(new, new), 0, "DiffContainers() no changes")
+}
+
+func TestWatchContainers(t *testing.T) {
+	assert := assert.New(t)
+	httpmock.Activate()
+	defer httpmock.Deactivate()
+	hystrix.Flush()
+
+	httpmock.RegisterResponder("GET", containersURLStr, newFixtureResponder("testdata/rancher_containers.json"))
+	httpmock.RegisterResponder("GET", hostsURLStr, newFixtureResponder("testdata/rancher_hosts.json"))
+	repository := NewMetadataCachingRepository(context.Background(), rcs, cacheInterval, 0, nil, stdopentracing.GlobalTracer())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := repository.WatchContainers(ctx)
+	for range defaultContainers {
+		e := <-ch
+		assert.Equal(ContainerAdded, e.Type, "WatchContainers() current containers")
+	}
+
+	// Containers gone from the metadata service are removed
+	httpmock.RegisterResponder("GET", containersURLStr, httpmock.NewStringResponder(200, "[]"))
+	repository.cachePopulateEvery(context.Background(), cacheInterval)
+	for range defaultContainers {
+		e := <-ch
+		assert.Equal(ContainerRemoved, e.Type, "WatchContainers() removed containers")
+	}
+
+	cancel()
+	_, open := <-ch
+	assert.Equal(false, open, "WatchContainers() closed on cancel")
+}
+
+func TestWatchSnapshots(t *testing.T) {
+	assert := assert.New(t)
+	httpmock.Activate()
+	defer httpmock.Deactivate()
+	hystrix.Flush()
+
+	httpmock.RegisterResponder("GET", containersURLStr, newFixtureResponder("testdata/rancher_containers.json"))
+	httpmock.RegisterResponder("GET", hostsURLStr, newFixtureResponder("testdata/rancher_hosts.json"))
+	repository := NewMetadataCachingRepository(context.Background(), rcs, cacheInterval, 0, nil, stdopentracing.GlobalTracer())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := repository.WatchSnapshots(ctx)
+	s := <-ch
+	assert.Equal(defaultContainers, s.Containers, "WatchSnapshots() current snapshot")
+	assert.Equal(defaultHosts, s.Hosts, "WatchSnapshots() current snapshot")
+	assert.Nil(repository.RestoredSnapshot(), "RestoredSnapshot() none to restore")
+
+	// Only fully populated caches make a snapshot
+	httpmock.RegisterResponder("GET", hostsURLStr, httpmock.NewStringResponder(500, ""))
+	repository.cachePopulateEvery(context.Background(), cacheInterval)
+	httpmock.RegisterResponder("GET", hostsURLStr, newFixtureResponder("testdata/rancher_hosts.json"))
+	httpmock.RegisterResponder("GET", containersURLStr, httpmock.NewStringResponder(200, "[]"))
+	repository.cachePopulateEvery(context.Background(), cacheInterval)
+	s = <-ch
+	assert.Empty(s.Containers, "WatchSnapshots() next snapshot")
+
+	cancel()
+	_, open := <-ch
+	assert.Equal(false, open, "WatchSnapshots() closed on cancel")
+
+	// Watchers falling too far behind are no longer watched
+	mcr := repository.(*metadataCachingRepository)
+	ch = mcr.WatchSnapshots(context.Background())
+	for i := 0; i <= watchBuffer; i++ {
+		mcr.publishSnapshot(mcr.snapshot())
+	}
+	for range ch {
+	}
+	mcr.watchMtx.Lock()
+	assert.Empty(mcr.snapshotWatchers, "WatchSnapshots() slow watcher dropped")
+	mcr.watchMtx.Unlock()
+}
+
+func TestGRPCServer(t *testing.T) {
+	assert := assert.New(t)
+
+	s := stubServerService{
+		containers: []*Container{{Name: "web", Host: Host{UUID: "1", Name: "host1"}}},
+		events: []ContainerEvent{
+			{Type: ContainerAdded, Container: &Container{Name: "web"}},
+			{Type: ContainerRemoved, Container: &Container{Name: "web"}},
+		},
+	}
+	tracer := stdopentracing.GlobalTracer()
+	logger := log.NewNopLogger()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	pb.RegisterRancherServer(server, MakeGRPCServer(NewServerEndpoints(s, tracer), s, tracer, logger))
+	go server.Serve(ln)
+	defer server.Stop()
+
+	conn, err := grpc.Dial(ln.Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := pb.NewRancherClient(conn)
+
+	cs, err := client.Containers(context.Background(), &pb.ContainersRequest{})
+	assert.Equal(nil, err, "Containers() success")
+	assert.Equal([]*pb.Container{{Name: "web", Host: &pb.Host{Uuid: "1", Name: "host1"}}}, cs.GetContainers(), "Containers() success")
+
+	c, err := client.Container(context.Background(), &pb.ContainerRequest{Name: "web"})
+	assert.Equal(nil, err, "Container() success")
+	assert.Equal("web", c.GetContainer().GetName(), "Container() success")
+
+	_, err = client.Container(context.Background(), &pb.ContainerRequest{Name: "db"})
+	assert.Equal(codes.NotFound, grpc.Code(err), "Container() not found")
+
+	stream, err := client.WatchContainers(context.Background(), &pb.WatchContainersRequest{})
+	if assert.Equal(nil, err, "WatchContainers() success") {
+		var types []pb.ContainerEvent_Type
+		for {
+			e, err := stream.Recv()
+			if err != nil {
+				break
+			}
+			types = append(types, e.GetType())
+		}
+		assert.Equal([]pb.ContainerEvent_Type{pb.ContainerEvent_ADDED, pb.ContainerEvent_REMOVED}, types, "WatchContainers() events")
+	}
+}
+
+func TestEncodeGRPCError(t *testing.T) {
+	assert := assert.New(t)
+
+	for err, code := range map[error]codes.Code{
+		ErrContainerNotFound:  codes.NotFound,
+		ErrHostNotFound:       codes.NotFound,
+		ErrContainerRepoEmpty: codes.FailedPrecondition,
+		ErrContainerRepoStale: codes.FailedPrecondition,
+		ErrHostRepoStale:      codes.FailedPrecondition,
+		ErrNotImplemented:     codes.Internal,
+	} {
+		assert.Equal(code, grpc.Code(encodeGRPCError(err)), err.Error())
+	}
+}
+
+func TestThriftServer(t *testing.T) {
+	assert := assert.New(t)
+
+	s := stubServerService{
+		containers: []*Container{{Name: "web", ServiceIndex: 1, Host: Host{UUID: "1", Name: "host1"}}},
+	}
+	es := NewServerEndpoints(s, stdopentracing.GlobalTracer())
+
+	for _, protocol := range []string{"binary", "compact", "json"} {
+		for _, transport := range []string{"buffered", "framed"} {
+			msg := protocol + "/" + transport
+			pf, err := thrift.NewProtocolFactory(protocol)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tf, err := thrift.NewTransportFactory(transport)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			socket, err := apache.NewTServerSocket("127.0.0.1:0")
+			if err == nil {
+				err = socket.Listen()
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			server := apache.NewTSimpleServer4(
+				thrift.NewRancherServiceProcessor(MakeThriftHandler(context.Background(), es, stdopentracing.GlobalTracer())),
+				socket, tf, pf)
+			go server.Serve()
+
+			sock, err := apache.NewTSocket(socket.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			trans := tf.GetTransport(sock)
+			if err := trans.Open(); err != nil {
+				t.Fatal(err)
+			}
+			client := thrift.NewRancherServiceClientFactory(trans, pf)
+
+			cs, err := client.Containers()
+			assert.Equal(nil, err, "Containers() success: "+msg)
+			assert.Equal([]*thrift.Container{{
+				Name:         "web",
+				ServiceIndex: 1,
+				Host:         &thrift.Host{Uuid: "1", Name: "host1"},
+			}}, cs, "Containers() success: "+msg)
+
+			c, err := client.Container("web")
+			assert.Equal(nil, err, "Container() success: "+msg)
+			assert.Equal("web", c.Name, "Container() success: "+msg)
+
+			_, err = client.Container("db")
+			assert.IsType(&thrift.NotFound{}, err, "Container() not found: "+msg)
+
+			// The connection survives declared exceptions.
+			_, err = client.Container("web")
+			assert.Equal(nil, err, "Container() after exception: "+msg)
+
+			trans.Close()
+		}
+	}
+}
+
+func TestThriftCallContext(t *testing.T) {
+	assert := assert.New(t)
+
+	tracer := mocktracer.New()
+	var ids []string
+	es := ServerEndpoints{
+		ContainerEndpoint: func(ctx context.Context, _ interface{}) (interface{}, error) {
+			ids = append(ids, RequestIDFromContext(ctx))
+			assert.NotNil(stdopentracing.SpanFromContext(ctx), "Container() span")
+			return containerResponse{Container: &Container{Name: "web"}}, nil
+		},
+	}
+	h := MakeThriftHandler(context.Background(), es, tracer)
+	h.Container("web")
+	h.Container("web")
+
+	// Each call is traced by its own span, tagged with its own request ID
+	spans := tracer.FinishedSpans()
+	if assert.Len(spans, 2, "Container() spans") && assert.Len(ids, 2, "Container() request IDs") {
+		assert.Equal("Container", spans[0].OperationName, "Container() span")
+		assert.Equal(ids[0], spans[0].Tag("request.id"), "Container() span request ID")
+		assert.NotEqual("", ids[0], "Container() request ID")
+		assert.NotEqual(ids[0], ids[1], "Container() request ID per call")
+	}
+}
+
+func TestEncodeThriftError(t *testing.T) {
+	assert := assert.New(t)
+
+	for err, expected := range map[error]error{
+		ErrContainerNotFound:  &thrift.NotFound{Message: ErrContainerNotFound.Error()},
+		ErrHostNotFound:       &thrift.NotFound{Message: ErrHostNotFound.Error()},
+		ErrContainerRepoEmpty: &thrift.FailedDependency{Message: ErrContainerRepoEmpty.Error()},
+		ErrContainerRepoStale: &thrift.FailedDependency{Message: ErrContainerRepoStale.Error()},
+		ErrHostRepoStale:      &thrift.FailedDependency{Message: ErrHostRepoStale.Error()},
+		ErrNotImplemented:     ErrNotImplemented,
+	} {
+		assert.Equal(expected, encodeThriftError(err), err.Error())
+	}
+}
+
+func TestDiffSnapshots(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Now()
+	host1, host2 := &Host{UUID: "h1", Name: "host1"}, &Host{UUID: "h2", Name: "host2"}
+	old := &Snapshot{
+		Containers: []*Container{
+			{Name: "web_1", UUID: "c1", State: "running", Host: *host1},
+			{Name: "web_2", UUID: "c2", State: "running", Host: *host1},
+			{Name: "db_1", UUID: "c3", State: "running", Host: *host1},
+		},
+		Hosts: []*Host{host1},
+	}
+	new := &Snapshot{
+		Refreshed: now,
+		Containers: []*Container{
+			{Name: "web_1", UUID: "c1", State: "running", PrivateIP: "10.42.0.1", Host: *host1},
+			{Name: "web_2", UUID: "c2", State: "stopped", Host: *host1},
+			{Name: "web_3", UUID: "c4", State: "running", Host: *host2},
+		},
+		Hosts: []*Host{host2},
+	}
+
+	es := diffSnapshots("dev", old, new)
+	var summary []string
+	for _, e := range es {
+		summary = append(summary, string(e.Type)+" "+e.Key()+" "+e.PreviousState)
+		assert.Equal(EventSchemaVersion, e.SchemaVersion, "diffSnapshots() schema version")
+		assert.Equal("dev", e.Environment, "diffSnapshots() environment")
+		assert.Equal(now, e.Time, "diffSnapshots() time")
+	}
+	assert.Equal([]string{
+		"host.added h2 ",
+		"container.state_changed c2 running",
+		"container.added c4 ",
+		"container.removed c3 ",
+		"host.removed h1 ",
+	}, summary, "diffSnapshots() events")
+	assert.Equal("host2", es[2].Container.HostName, "diffSnapshots() container host")
+
+	// Redelivered changes share an ID, while later changes do not
+	assert.Equal(es, diffSnapshots("dev", old, new), "diffSnapshots() idempotent")
+	new.Refreshed = now.Add(time.Minute)
+	assert.NotEqual(es[0].ID, diffSnapshots("dev", old, new)[0].ID, "diffSnapshots() unique")
+
+	// Everything is added from nothing
+	assert.Len(diffSnapshots("dev", nil, old), 4, "diffSnapshots() from nothing")
+}
+
+// stubMetric is a metrics.Counter and metrics.Gauge ignoring labels.
+type stubMetric struct {
+	mtx   sync.Mutex
+	value float64
+}
+
+func (m *stubMetric) With(...string) metrics.Counter { return m }
+func (m *stubMetric) Add(delta float64)              { m.mtx.Lock(); m.value += delta; m.mtx.Unlock() }
+func (m *stubMetric) Set(value float64)              { m.mtx.Lock(); m.value = value; m.mtx.Unlock() }
+func (m *stubMetric) Value() float64                 { m.mtx.Lock(); defer m.mtx.Unlock(); return m.value }
+
+type stubGauge struct{ *stubMetric }
+
+func (g stubGauge) With(...string) metrics.Gauge { return g }
+
+type stubSnapshotRepository struct {
+	Repository
+	snapshots chan *Snapshot
+	restored  *Snapshot
+}
+
+func (r stubSnapshotRepository) WatchSnapshots(_ context.Context) <-chan *Snapshot {
+	return r.snapshots
+}
+
+func (r stubSnapshotRepository) RestoredSnapshot() *Snapshot {
+	return r.restored
+}
+
+func TestEventPublisher(t *testing.T) {
+	assert := assert.New(t)
+	hystrix.Flush()
+	defer func(d time.Duration) { eventRetryInterval = d }(eventRetryInterval)
+	eventRetryInterval = time.Millisecond
+
+	received := make(chan Event, 8)
+	receive := func(val []byte) error {
+		var e Event
+		err := json.Unmarshal(val, &e)
+		received <- e
+		return err
+	}
+	producer := mocks.NewSyncProducer(t, nil)
+	producer.ExpectSendMessageWithCheckerFunctionAndFail(receive, sarama.ErrNotLeaderForPartition)
+	producer.ExpectSendMessageWithCheckerFunctionAndSucceed(receive)
+	producer.ExpectSendMessageWithCheckerFunctionAndSucceed(receive)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r := stubSnapshotRepository{snapshots: make(chan *Snapshot, 1)}
+	failed := &stubMetric{}
+	NewEventPublisher(ctx, Environment{Name: "dev"}, r,
+		NewEventPublishEndpoint(Environment{Name: "dev"}, producer, "rancher-events"),
+		8, discard.NewCounter(), failed, discard.NewCounter(), discard.NewGauge(),
+		log.NewNopLogger())
+
+	r.snapshots <- &Snapshot{
+		Refreshed:  time.Now(),
+		Containers: []*Container{{Name: "web_1", UUID: "c1", State: "running"}},
+		Hosts:      []*Host{{UUID: "h1", Name: "host1"}},
+	}
+
+	var es []Event
+	for len(es) < 3 {
+		select {
+		case e := <-received:
+			es = append(es, e)
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for events")
+		}
+	}
+	assert.Equal(EventHostAdded, es[0].Type, "EventPublisher() first attempt")
+	assert.Equal(es[0], es[1], "EventPublisher() retried with same ID")
+	assert.Equal(EventContainerAdded, es[2].Type, "EventPublisher() in order")
+	assert.Equal("c1", es[2].Container.UUID, "EventPublisher() container")
+	assert.Equal(float64(1), failed.Value(), "EventPublisher() failures")
+	assert.Nil(producer.Close(), "EventPublisher() expectations met")
+}
+
+func TestEventPublisherRestored(t *testing.T) {
+	assert := assert.New(t)
+	hystrix.Flush()
+
+	received := make(chan Event, 8)
+	producer := mocks.NewSyncProducer(t, nil)
+	producer.ExpectSendMessageWithCheckerFunctionAndSucceed(func(val []byte) error {
+		var e Event
+		err := json.Unmarshal(val, &e)
+		received <- e
+		return err
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	hosts := []*Host{{UUID: "h1", Name: "host1"}}
+	r := stubSnapshotRepository{
+		snapshots: make(chan *Snapshot, 1),
+		restored: &Snapshot{
+			Refreshed:  time.Now().Add(-time.Hour),
+			Containers: []*Container{{Name: "web_1", UUID: "c1", State: "running"}},
+			Hosts:      hosts,
+		},
+	}
+	NewEventPublisher(ctx, Environment{Name: "dev"}, r,
+		NewEventPublishEndpoint(Environment{Name: "dev"}, producer, "rancher-events"),
+		8, discard.NewCounter(), discard.NewCounter(), discard.NewCounter(), discard.NewGauge(),
+		log.NewNopLogger())
+
+	// Only what changed since the restored snapshot is published
+	r.snapshots <- &Snapshot{
+		Refreshed:  time.Now(),
+		Containers: []*Container{{Name: "web_1", UUID: "c1", State: "stopped"}},
+		Hosts:      hosts,
+	}
+	select {
+	case e := <-received:
+		assert.Equal(EventContainerStateChanged, e.Type, "EventPublisher() changed since restore")
+		assert.Equal("c1", e.Container.UUID, "EventPublisher() changed since restore")
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for events")
+	}
+	select {
+	case e := <-received:
+		t.Fatalf("unexpected event %s", e.Type)
+	case <-time.After(20 * time.Millisecond):
+	}
+	assert.Nil(producer.Close(), "EventPublisher() expectations met")
+}
+
+func TestEventPublisherBuffer(t *testing.T) {
+	assert := assert.New(t)
+
+	dropped, buffered := &stubMetric{}, stubGauge{&stubMetric{}}
+	p := &eventPublisher{
+		size:     2,
+		ready:    make(chan struct{}, 1),
+		dropped:  dropped,
+		buffered: buffered,
+		logger:   log.NewNopLogger(),
+	}
+	p.push(Event{ID: "1"}, Event{ID: "2"}, Event{ID: "3"})
+	assert.Equal(float64(1), dropped.Value(), "push() drops oldest")
+	assert.Equal(float64(2), buffered.Value(), "push() buffered")
+
+	e, ok := p.pop()
+	assert.True(ok, "pop() success")
+	assert.Equal("2", e.ID, "pop() oldest remaining")
+
+	p.push(Event{ID: "4"})
+	p.requeue(e)
+	assert.Equal(float64(2), dropped.Value(), "requeue() drops oldest")
+	assert.Equal([]Event{{ID: "3"}, {ID: "4"}}, p.buffer, "requeue() buffer")
+}
+
+type fakeAMQPChannel struct {
+	keys       []string
+	published  []amqp.Publishing
+	deliveries chan amqp.Delivery
+}
+
+func (ch *fakeAMQPChannel) Publish(_, key string, _, _ bool, msg amqp.Publishing) error {
+	ch.keys = append(ch.keys, key)
+	ch.published = append(ch.published, msg)
+	return nil
+}
+
+func (ch *fakeAMQPChannel) Consume(_, _ string, _, _, _, _ bool, _ amqp.Table) (<-chan amqp.Delivery, error) {
+	return ch.deliveries, nil
+}
+
+type fakeAMQPAcknowledger struct {
+	acked, nacked, requeued bool
+}
+
+func (a *fakeAMQPAcknowledger) Ack(_ uint64, _ bool) error { a.acked = true; return nil }
+func (a *fakeAMQPAcknowledger) Nack(_ uint64, _, requeue bool) error {
+	a.nacked, a.requeued = true, requeue
+	return nil
+}
+func (a *fakeAMQPAcknowledger) Reject(_ uint64, requeue bool) error { return a.Nack(0, false, requeue) }
+
+// stubActionService acts upon the containers and services by name, taking
+// every action at once.
+type stubActionService struct{}
+
+func (stubActionService) ContainerAction(_ context.Context, name, action string) (*ContainerActionResult, error) {
+	if name != "web" {
+		return nil, ErrContainerNotFound
+	}
+	return &ContainerActionResult{Name: name, ID: "1i1", Action: action, State: "running"}, nil
+}
+
+func (stubActionService) ScaleService(_ context.Context, stack, service string, scale int) (*ServiceProgress, error) {
+	return &ServiceProgress{ActionID: "a1", Stack: stack, Service: service, ID: "1s1", Action: ServiceScale, Desired: scale}, nil
+}
+
+func (stubActionService) UpgradeService(_ context.Context, stack, service string, u UpgradeStrategy) (*ServiceProgress, error) {
+	return &ServiceProgress{ActionID: "a2", Stack: stack, Service: service, ID: "1s1", Action: u.Action}, nil
+}
+
+func (stubActionService) ServiceAction(context.Context, string, string, string) (*ServiceProgress, error) {
+	return nil, ErrServiceActionNotFound
+}
+
+func TestAMQPHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	s := stubServerService{
+		containers: []*Container{{Name: "web", Host: Host{UUID: "1", Name: "host1"}}},
+	}
+	ch := &fakeAMQPChannel{}
+	authorized := Authorized(NewActionAuthorizer([]string{"t1"}))
+	aes := ActionEndpoints{
+		ContainerActionEndpoint: authorized(ContainerActionEndpoint(stubActionService{})),
+		ServiceScaleEndpoint:    authorized(ServiceScaleEndpoint(stubActionService{})),
+		ServiceUpgradeEndpoint:  authorized(ServiceUpgradeEndpoint(stubActionService{})),
+	}
+	handler := MakeAMQPHandler(NewServerEndpoints(s, stdopentracing.GlobalTracer()), aes, ch, log.NewNopLogger())
+
+	for _, test := range []struct {
+		command, body string
+		reply         string
+		failed        bool
+		unauthorized  bool
+	}{
+		{AMQPContainersCommand, "", `{"Containers":[{"Name":"web","UUID":"","State":"","PrivateIP":"","ServiceIndex":0,"HostName":"host1"}]}`, false, false},
+		{AMQPContainerCommand, `{"Name":"web"}`, `{"Container":{"Name":"web","UUID":"","State":"","PrivateIP":"","ServiceIndex":0,"HostName":"host1"}}`, false, false},
+		{AMQPContainerCommand, `{"Name":"db"}`, `{"Error":"container not found"}`, true, false},
+		{AMQPContainerCommand, `{}`, `{"Error":"container name is required"}`, true, false},
+		{"drain", `{"Name":"web"}`, `{"Error":"unknown command"}`, true, false},
+		{AMQPRestartCommand, `{"Name":"web"}`, `{"Result":{"Name":"web","ID":"1i1","Action":"restart","State":"running"}}`, false, false},
+		{AMQPStopCommand, `{"Name":"db"}`, `{"Error":"container not found"}`, true, false},
+		{AMQPStartCommand, `{}`, `{"Error":"container name is required"}`, true, false},
+		{AMQPRestartCommand, `{"Name":"web"}`, `{"Error":"action authorization required"}`, true, true},
+		{AMQPScaleCommand, `{"Stack":"web","Service":"gossman","Scale":3}`,
+			`{"Progress":{"ActionID":"a1","Stack":"web","Service":"gossman","ID":"1s1","Action":"scale","State":"","Desired":3,"Running":0,"NewRunning":0,"Started":"0001-01-01T00:00:00Z","Complete":false}}`, false, false},
+		{AMQPScaleCommand, `{"Stack":"web","Service":"gossman"}`, `{"Error":"service scale must be given and not negative"}`, true, false},
+		{AMQPScaleCommand, `{"Scale":3}`, `{"Error":"stack and service names are required"}`, true, false},
+		{AMQPUpgradeCommand, `{"Stack":"web","Service":"gossman","Action":"rollback"}`,
+			`{"Progress":{"ActionID":"a2","Stack":"web","Service":"gossman","ID":"1s1","Action":"rollback","State":"","Desired":0,"Running":0,"NewRunning":0,"Started":"0001-01-01T00:00:00Z","Complete":false}}`, false, false},
+		{AMQPUpgradeCommand, `{"Stack":"web","Service":"gossman"}`, `{"Error":"action authorization required"}`, true, true},
+	} {
+		msg := test.command + " " + test.body
+		ack := &fakeAMQPAcknowledger{}
+		headers := amqp.Table{amqpAuthorizationHeader: "Bearer t1"}
+		if test.unauthorized {
+			headers = amqp.Table{amqpAuthorizationHeader: "Bearer t2"}
+		}
+		handler(&amqp.Delivery{
+			Acknowledger:  ack,
+			Headers:       headers,
+			Type:          test.command,
+			ReplyTo:       "replies",
+			CorrelationId: msg,
+			Body:          []byte(test.body),
+		})
+
+		if assert.NotEmpty(ch.published, "AMQP reply: "+msg) {
+			reply := ch.published[len(ch.published)-1]
+			assert.Equal("replies", ch.keys[len(ch.keys)-1], "AMQP reply to: "+msg)
+			assert.Equal(msg, reply.CorrelationId, "AMQP reply correlation ID: "+msg)
+			assert.Equal("application/json", reply.ContentType, "AMQP reply content type: "+msg)
+			assert.JSONEq(test.reply, string(reply.Body), "AMQP reply body: "+msg)
+		}
+		assert.Equal(!test.failed, ack.acked, "AMQP acked: "+msg)
+		assert.Equal(test.failed, ack.nacked, "AMQP dead-lettered: "+msg)
+		assert.False(ack.requeued, "AMQP not requeued: "+msg)
+	}
+}
+
+func TestConsumeAMQPCommands(t *testing.T) {
+	assert := assert.New(t)
+
+	ch := &fakeAMQPChannel{deliveries: make(chan amqp.Delivery, 1)}
+	var served []string
+	handler := func(deliv *amqp.Delivery) { served = append(served, deliv.Type) }
+
+	ch.deliveries <- amqp.Delivery{Type: AMQPContainersCommand}
+	close(ch.deliveries)
+	err := ConsumeAMQPCommands(context.Background(), ch, "commands", "test", handler)
+	assert.Equal(amqp.ErrClosed, err, "ConsumeAMQPCommands() closed channel")
+	assert.Equal([]string{AMQPContainersCommand}, served, "ConsumeAMQPCommands() served")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	ch.deliveries = make(chan amqp.Delivery)
+	err = ConsumeAMQPCommands(ctx, ch, "commands", "test", handler)
+	assert.Equal(context.Canceled, err, "ConsumeAMQPCommands() cancelled")
+}
+
+func TestServeAMQPCommands(t *testing.T) {
+	assert := assert.New(t)
+
+	p := Policy{Backoff: time.Millisecond, MaxBackoff: time.Millisecond}
+	errDial := errors.New("connection refused")
+	var served []string
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	makeHandler := func(kitamqp.Channel) func(*amqp.Delivery) {
+		return func(deliv *amqp.Delivery) {
+			served = append(served, deliv.Type)
+			if len(served) == 2 {
+				cancel()
+			}
+		}
+	}
+
+	// The first connection failing is unrecoverable
+	dial := func() (kitamqp.Channel, <-chan *amqp.Error, func() error, error) {
+		return nil, nil, nil, errDial
+	}
+	err := ServeAMQPCommands(ctx, dial, p, "commands", "test", makeHandler, log.NewNopLogger())
+	assert.Equal(errDial, err, "ServeAMQPCommands() first dial")
+
+	// A dropped connection is redialed, through failures, until cancelled
+	var dials, closes int
+	dial = func() (kitamqp.Channel, <-chan *amqp.Error, func() error, error) {
+		dials++
+		if dials == 2 {
+			return nil, nil, nil, errDial
+		}
+		ch := &fakeAMQPChannel{deliveries: make(chan amqp.Delivery, 1)}
+		ch.deliveries <- amqp.Delivery{Type: fmt.Sprintf("command%d", dials)}
+		closed := make(chan *amqp.Error, 1)
+		if dials == 1 {
+			close(ch.deliveries)
+			closed <- amqp.ErrClosed
+		}
+		return ch, closed, func() error { closes++; return nil }, nil
+	}
+	err = ServeAMQPCommands(ctx, dial, p, "commands", "test", makeHandler, log.NewNopLogger())
+	assert.NoError(err, "ServeAMQPCommands() cancelled")
+	assert.Equal(3, dials, "ServeAMQPCommands() dials")
+	assert.Equal(2, closes, "ServeAMQPCommands() closes")
+	assert.Equal([]string{"command1", "command3"}, served, "ServeAMQPCommands() served")
+}
+
+func TestPrometheusTargets(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg := PrometheusSDConfig{
+		SelectorLabel: "prometheus.io/scrape=true",
+		PortLabel:     "prometheus.io/port",
+		PathLabel:     "prometheus.io/path",
+	}
+	scraped := func(name, state, ip string, labels map[string]string) *Container {
+		return &Container{
+			Name:         name,
+			UUID:         name + "-uuid",
+			State:        state,
+			PrivateIP:    ip,
+			ServiceIndex: 1,
+			ServiceName:  "gossman",
+			StackName:    "web",
+			Labels:       labels,
+			Host:         Host{Name: "host-1"},
+			Environment:  "dev",
+		}
+	}
+	cs := []*Container{
+		scraped("web_gossman_2", "running", "10.42.0.2", map[string]string{
+			"prometheus.io/scrape": "true",
+			"prometheus.io/port":   "9404",
+			"prometheus.io/path":   "/jmx",
+		}),
+		scraped("web_gossman_1", "running", "10.42.0.1", map[string]string{
+			"prometheus.io/scrape": "true",
+			"prometheus.io/port":   "9404",
+		}),
+		scraped("unselected", "running", "10.42.0.3", map[string]string{
+			"prometheus.io/scrape": "false",
+			"prometheus.io/port":   "9404",
+		}),
+		scraped("stopped", "stopped", "10.42.0.4", map[string]string{
+			"prometheus.io/scrape": "true",
+			"prometheus.io/port":   "9404",
+		}),
+		scraped("no-port", "running", "10.42.0.5", map[string]string{
+			"prometheus.io/scrape": "true",
+			"prometheus.io/port":   "jmx",
+		}),
+	}
+
+	tgs := PrometheusTargets(cs, cfg)
+	if assert.Equal(2, len(tgs), "PrometheusTargets() selected") {
+		assert.Equal(PrometheusTargetGroup{
+			Targets: []string{"10.42.0.1:9404"},
+			Labels: map[string]string{
+				"__meta_rancher_container_name":                       "web_gossman_1",
+				"__meta_rancher_container_uuid":                       "web_gossman_1-uuid",
+				"__meta_rancher_stack":                                "web",
+				"__meta_rancher_service":                              "gossman",
+				"__meta_rancher_service_index":                        "1",
+				"__meta_rancher_host":                                 "host-1",
+				"__meta_rancher_environment":                          "dev",
+				"__meta_rancher_container_label_prometheus_io_scrape": "true",
+				"__meta_rancher_container_label_prometheus_io_port":   "9404",
+			},
+		}, tgs[0], "PrometheusTargets() default path")
+		assert.Equal([]string{"10.42.0.2:9404"}, tgs[1].Targets, "PrometheusTargets() path label")
+		assert.Equal("/jmx", tgs[1].Labels["__metrics_path__"], "PrometheusTargets() path label")
+	}
+
+	cfg.SelectorLabel = "prometheus.io/port"
+	assert.Equal(3, len(PrometheusTargets(cs, cfg)), "PrometheusTargets() selected by presence")
+	assert.Equal([]PrometheusTargetGroup{}, PrometheusTargets(nil, cfg), "PrometheusTargets() none")
+}
+
+func TestPrometheusHTTPHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg := PrometheusSDConfig{SelectorLabel: "scrape", PortLabel: "port"}
+	serve := func(s ServerService) *httptest.ResponseRecorder {
+		h := MakePrometheusHTTPHandler(context.Background(),
+			NewPrometheusTargetsEndpoint(s, cfg, stdopentracing.GlobalTracer()),
+			stdopentracing.GlobalTracer(), log.NewNopLogger())
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/prometheus/targets", nil))
+		return w
+	}
+
+	w := serve(stubServerService{
+		containers: []*Container{{
+			Name:      "web",
+			State:     "running",
+			PrivateIP: "10.42.0.1",
+			Labels:    map[string]string{"scrape": "", "port": "8080"},
+		}},
+		cs: CacheStatus{Refreshed: time.Now()},
+	})
+	assert.Equal(http.StatusOK, w.Code, "PrometheusTargets success")
+	assert.Equal("0", w.Header().Get("X-Cache-Age"), "PrometheusTargets success")
+	var tgs []PrometheusTargetGroup
+	assert.Equal(nil, json.Unmarshal(w.Body.Bytes(), &tgs), "PrometheusTargets bare array")
+	if assert.Equal(1, len(tgs), "PrometheusTargets success") {
+		assert.Equal([]string{"10.42.0.1:8080"}, tgs[0].Targets, "PrometheusTargets success")
+	}
+
+	w = serve(stubServerService{})
+	assert.Equal("[]\n", w.Body.String(), "PrometheusTargets none")
+
+	w = serve(stubServerService{err: ErrContainerRepoStale})
+	assert.Equal(http.StatusFailedDependency, w.Code, "PrometheusTargets beyond max staleness")
+}
+
+type stubCounter struct {
+	mtx    *sync.Mutex
+	counts map[string]float64
+	labels string
+}
+
+func newStubCounter() stubCounter {
+	return stubCounter{mtx: &sync.Mutex{}, counts: make(map[string]float64)}
+}
+
+func (c stubCounter) With(lvs ...string) metrics.Counter {
+	c.labels += strings.Join(lvs, ",")
+	return c
+}
+
+func (c stubCounter) Add(delta float64) {
+	c.mtx.Lock()
+	c.counts[c.labels] += delta
+	c.mtx.Unlock()
+}
+
+func (c stubCounter) count(labels string) float64 {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.counts[labels]
+}
+
+type stubHistogram struct{ *stubMetric }
+
+func (h stubHistogram) With(...string) metrics.Histogram { return h }
+func (h stubHistogram) Observe(float64)                  { h.Add(1) }
+
+type stubContainerRepository struct {
+	Repository
+	containers []*Container
+}
+
+func (r stubContainerRepository) ContainerByName(name string) (*Container, error) {
+	for _, c := range r.containers {
+		if c.Name == name {
+			return c, nil
+		}
+	}
+	return nil, ErrContainerNotFound
+}
+
+func TestProxyHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/redirect":
+			http.Redirect(w, r, "/login?next=%2Fadmin", http.StatusFound)
+		case "/redirect/absolute":
+			http.Redirect(w, r, "http://"+r.Host+"/login", http.StatusFound)
+		case "/redirect/elsewhere":
+			http.Redirect(w, r, "http://example.com/login", http.StatusFound)
+		case "/ws":
+			conn, brw, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+			brw.Flush()
+			line, _ := brw.ReadString('\n')
+			brw.WriteString("echo: " + line)
+			brw.Flush()
+		default:
+			w.Header().Set("X-Path", r.URL.Path)
+			w.Header().Set("X-Prefix", r.Header.Get("X-Forwarded-Prefix"))
+			w.Header().Set("X-Proxy-Authorization", r.Header.Get("Proxy-Authorization"))
+			w.Write([]byte("ok"))
+		}
+	}))
+	defer upstream.Close()
+	u, _ := url.Parse(upstream.URL)
+	host, port, _ := net.SplitHostPort(u.Host)
+
+	repository := stubContainerRepository{containers: []*Container{
+		{Name: "web", State: "running", PrivateIP: host, Labels: map[string]string{"ports": "9990, " + port}},
+		{Name: "stopped", State: "stopped", PrivateIP: host, Labels: map[string]string{"ports": port}},
+		{Name: "unlabelled", State: "running", PrivateIP: host},
+	}}
+	requests := newStubCounter()
+	latency := stubHistogram{&stubMetric{}}
+	h := NewProxyHandler(Environment{Name: "dev"}, repository, ProxyConfig{
+		Tokens:     []string{"other", "s3cr3t"},
+		PortsLabel: "ports",
+	}, requests, latency, stdopentracing.GlobalTracer(), log.NewNopLogger())
+	// NOTE: Bypass the metadata service mocks
+	h.(*proxyHandler).transport = httpmock.InitialTransport
+
+	r := mux.NewRouter()
+	r.PathPrefix("/rms/v1/{name}/proxy/{port}").Handler(h)
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	client := &http.Client{
+		Transport: httpmock.InitialTransport,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	get := func(path, token string) *http.Response {
+		req, _ := http.NewRequest("GET", server.URL+path, nil)
+		if token != "" {
+			req.Header.Set("Proxy-Authorization", "Bearer "+token)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp
+	}
+	base := "/rms/v1/web/proxy/" + port
+
+	resp := get(base+"/admin/status", "s3cr3t")
+	assert.Equal(http.StatusOK, resp.StatusCode, "Proxy success")
+	assert.Equal("/admin/status", resp.Header.Get("X-Path"), "Proxy success strips prefix")
+	assert.Equal(base, resp.Header.Get("X-Prefix"), "Proxy success forwards prefix")
+	assert.Equal("", resp.Header.Get("X-Proxy-Authorization"), "Proxy success strips token")
+	assert.Equal("/", get(base, "s3cr3t").Header.Get("X-Path"), "Proxy root")
+
+	assert.Equal(base+"/login?next=%2Fadmin", get(base+"/redirect", "s3cr3t").Header.Get("Location"), "Proxy rewrites Location")
+	assert.Equal(base+"/login", get(base+"/redirect/absolute", "s3cr3t").Header.Get("Location"), "Proxy rewrites absolute Location")
+	assert.Equal("http://example.com/login", get(base+"/redirect/elsewhere", "s3cr3t").Header.Get("Location"), "Proxy leaves other Locations")
+
+	resp = get(base+"/admin", "")
+	assert.Equal(http.StatusProxyAuthRequired, resp.StatusCode, "Proxy without token")
+	assert.NotEqual("", resp.Header.Get("Proxy-Authenticate"), "Proxy without token")
+	assert.Equal(http.StatusProxyAuthRequired, get(base+"/admin", "wrong").StatusCode, "Proxy wrong token")
+	assert.Equal(http.StatusForbidden, get("/rms/v1/web/proxy/22/", "s3cr3t").StatusCode, "Proxy port not allowed")
+	assert.Equal(http.StatusForbidden, get("/rms/v1/unlabelled/proxy/"+port+"/", "s3cr3t").StatusCode, "Proxy no ports label")
+	assert.Equal(http.StatusBadRequest, get("/rms/v1/web/proxy/http/", "s3cr3t").StatusCode, "Proxy invalid port")
+	assert.Equal(http.StatusNotFound, get("/rms/v1/db/proxy/"+port+"/", "s3cr3t").StatusCode, "Proxy container not found")
+	assert.Equal(http.StatusServiceUnavailable, get("/rms/v1/stopped/proxy/"+port+"/", "s3cr3t").StatusCode, "Proxy container not running")
+	assert.Equal(http.StatusBadGateway, get("/rms/v1/web/proxy/9990/", "s3cr3t").StatusCode, "Proxy upstream down")
+
+	// WebSocket upgrades are proxied over the hijacked connection
+	conn, err := net.Dial("tcp", strings.TrimPrefix(server.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "GET %s/ws HTTP/1.1\r\nHost: rms\r\nConnection: Upgrade\r\nUpgrade: websocket\r\nProxy-Authorization: Bearer s3cr3t\r\n\r\n", base)
+	br := bufio.NewReader(conn)
+	upgrade, err := http.ReadResponse(br, nil)
+	if assert.Equal(nil, err, "Proxy WebSocket upgrade") {
+		assert.Equal(http.StatusSwitchingProtocols, upgrade.StatusCode, "Proxy WebSocket upgrade")
+		fmt.Fprint(conn, "hello\n")
+		line, _ := br.ReadString('\n')
+		assert.Equal("echo: hello\n", line, "Proxy WebSocket echo")
+	}
+
+	conn.Close()
+
+	assert.Equal(float64(2), requests.count("environment,dev,code,200"), "Proxy counts by code")
+	assert.Equal(float64(3), requests.count("environment,dev,code,302"), "Proxy counts by code")
+	assert.Equal(float64(2), requests.count("environment,dev,code,407"), "Proxy counts by code")
+
+	// The tokens may be replaced while running
+	h.(ProxyTokensSetter).SetTokens([]string{"rotated"})
+	assert.Equal(http.StatusProxyAuthRequired, get(base+"/admin/status", "s3cr3t").StatusCode, "Proxy replaced token")
+	assert.Equal(http.StatusOK, get(base+"/admin/status", "rotated").StatusCode, "Proxy new token")
+}
+
+func (r stubContainerRepository) Containers() ([]*Container, error) {
+	return r.containers, nil
+}
+
+type stubLabelledGauge struct{ stubCounter }
+
+func (g stubLabelledGauge) With(lvs ...string) metrics.Gauge {
+	return stubLabelledGauge{g.stubCounter.With(lvs...).(stubCounter)}
+}
+
+func (g stubLabelledGauge) Set(value float64) {
+	g.mtx.Lock()
+	g.counts[g.labels] = value
+	g.mtx.Unlock()
+}
+
+func TestContainerProbe(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, tc := range []struct {
+		labels map[string]string
+		typ    string
+		target string
+		ok     bool
+	}{
+		{map[string]string{ProbePortLabel: "8080"}, ProbeTCP, "10.0.0.1:8080", true},
+		{map[string]string{ProbePortLabel: "8080", ProbePathLabel: "/health"}, ProbeHTTP, "http://10.0.0.1:8080/health", true},
+		{map[string]string{ProbePortLabel: "8080", ProbePathLabel: "health"}, ProbeHTTP, "http://10.0.0.1:8080/health", true},
+		{map[string]string{ProbePortLabel: "8080", ProbeTypeLabel: ProbeHTTP}, ProbeHTTP, "http://10.0.0.1:8080/", true},
+		{map[string]string{ProbePortLabel: "8080", ProbePathLabel: "/health", ProbeTypeLabel: ProbeTCP}, ProbeTCP, "10.0.0.1:8080", true},
+		{map[string]string{ProbePortLabel: "8080", ProbeTypeLabel: "udp"}, "", "", false},
+		{map[string]string{ProbePortLabel: "http"}, "", "", false},
+		{map[string]string{ProbePathLabel: "/health"}, "", "", false},
+		{nil, "", "", false},
+	} {
+		p, ok := containerProbe(&Container{Name: "web", PrivateIP: "10.0.0.1", Labels: tc.labels})
+		assert.Equal(tc.ok, ok, "containerProbe() %v", tc.labels)
+		assert.Equal(tc.typ, p.typ, "containerProbe() type %v", tc.labels)
+		assert.Equal(tc.target, p.target, "containerProbe() target %v", tc.labels)
+	}
+}
+
+func TestProber(t *testing.T) {
+	assert := assert.New(t)
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer upstream.Close()
+	u, _ := url.Parse(upstream.URL)
+	host, port, _ := net.SplitHostPort(u.Host)
+
+	// A port nothing listens on
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	_, closed, _ := net.SplitHostPort(l.Addr().String())
+	l.Close()
+
+	repository := stubContainerRepository{containers: []*Container{
+		{Name: "web_1", State: "running", PrivateIP: host, StackName: "web", ServiceName: "app",
+			Labels: map[string]string{ProbePortLabel: port, ProbePathLabel: "/health"}},
+		{Name: "web_2", State: "running", PrivateIP: host, StackName: "web", ServiceName: "app",
+			Labels: map[string]string{ProbePortLabel: port, ProbePathLabel: "/broken"}},
+		{Name: "db_1", State: "running", PrivateIP: host, StackName: "db", ServiceName: "postgres",
+			Labels: map[string]string{ProbePortLabel: port}},
+		{Name: "db_2", State: "running", PrivateIP: "127.0.0.1", StackName: "db", ServiceName: "postgres",
+			Labels: map[string]string{ProbePortLabel: closed}},
+		{Name: "stopped", State: "stopped", PrivateIP: host, Labels: map[string]string{ProbePortLabel: port}},
+		{Name: "unprobed", State: "running", PrivateIP: host},
+	}}
+	up, down := stubLabelledGauge{newStubCounter()}, stubLabelledGauge{newStubCounter()}
+	p := &prober{
+		env:        Environment{Name: "dev"},
+		repository: repository,
+		cfg:        ProbeConfig{Interval: time.Minute, Timeout: time.Second, Workers: 2},
+		// NOTE: Bypass the metadata service mocks
+		client:   &http.Client{Transport: httpmock.InitialTransport, Timeout: time.Second},
+		results:  make(map[string]*ProbeResult),
+		services: make(map[[2]string]bool),
+		up:       up,
+		down:     down,
+		logger:   log.NewNopLogger(),
+	}
+
+	res, err := p.ContainerHealth("web_1")
+	assert.Equal(nil, err, "ContainerHealth() before probing")
+	assert.Equal(&ProbeResult{Status: ProbeUnknown, Type: ProbeHTTP, Target: upstream.URL + "/health"}, res, "ContainerHealth() before probing")
+
+	p.probeAll(context.Background())
+
+	res, _ = p.ContainerHealth("web_1")
+	assert.Equal(ProbeUp, res.Status, "ContainerHealth() HTTP up")
+	assert.Equal(http.StatusOK, res.StatusCode, "ContainerHealth() HTTP up")
+	assert.NotNil(res.Checked, "ContainerHealth() HTTP up")
+	res, _ = p.ContainerHealth("web_2")
+	assert.Equal(ProbeDown, res.Status, "ContainerHealth() HTTP down")
+	assert.Equal(http.StatusServiceUnavailable, res.StatusCode, "ContainerHealth() HTTP down")
+	assert.NotEqual("", res.Error, "ContainerHealth() HTTP down")
+	res, _ = p.ContainerHealth("db_1")
+	assert.Equal(ProbeUp, res.Status, "ContainerHealth() TCP up")
+	res, _ = p.ContainerHealth("db_2")
+	assert.Equal(ProbeDown, res.Status, "ContainerHealth() TCP down")
+	res, _ = p.ContainerHealth("stopped")
+	assert.Equal(ProbeUnknown, res.Status, "ContainerHealth() not running")
+
+	_, err = p.ContainerHealth("unprobed")
+	assert.Equal(ErrContainerNotProbed, err, "ContainerHealth() no probe")
+	_, err = p.ContainerHealth("missing")
+	assert.Equal(ErrContainerNotFound, err, "ContainerHealth() not found")
+
+	assert.Equal(float64(1), up.count("environment,dev,stack,web,service,app"), "up gauge")
+	assert.Equal(float64(1), down.count("environment,dev,stack,web,service,app"), "down gauge")
+	assert.Equal(float64(1), up.count("environment,dev,stack,db,service,postgres"), "up gauge")
+	assert.Equal(float64(1), down.count("environment,dev,stack,db,service,postgres"), "down gauge")
+
+	// Services that have gone are zeroed
+	p.repository = stubContainerRepository{containers: repository.containers[:2]}
+	p.probeAll(context.Background())
+	assert.Equal(float64(0), up.count("environment,dev,stack,db,service,postgres"), "up gauge zeroed")
+	assert.Equal(float64(0), down.count("environment,dev,stack,db,service,postgres"), "down gauge zeroed")
+	assert.Equal(float64(1), up.count("environment,dev,stack,web,service,app"), "up gauge")
+
+	// Served over HTTP
+	r := mux.NewRouter()
+	r.Methods("GET").Path("/containers/{name}/health").Handler(MakeContainerHealthHTTPHandler(
+		context.Background(), NewContainerHealthEndpoint(p, stdopentracing.GlobalTracer()),
+		stdopentracing.GlobalTracer(), log.NewNopLogger()))
+	for _, tc := range []struct {
+		name   string
+		status int
+	}{
+		{"web_1", http.StatusOK},
+		{"unprobed", http.StatusNotFound},
+		{"missing", http.StatusNotFound},
+	} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", "/containers/"+tc.name+"/health", nil))
+		assert.Equal(tc.status, w.Code, "ContainerHealth HTTP %s", tc.name)
+		if tc.status == http.StatusOK {
+			var body containerHealthResponse
+			json.Unmarshal(w.Body.Bytes(), &body)
+			assert.Equal("web_1", body.Name, "ContainerHealth HTTP body")
+			assert.Equal(ProbeUp, body.Probe.Status, "ContainerHealth HTTP body")
+		}
+	}
+}
+
+func TestDialProbe(t *testing.T) {
+	assert := assert.New(t)
+
+	// The proxy tunnels only to the one address, and only when authenticated
+	proxy, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer proxy.Close()
+	go func() {
+		for {
+			conn, err := proxy.Accept()
+			if err != nil {
+				return
+			}
+			req, err := http.ReadRequest(bufio.NewReader(conn))
+			switch {
+			case err != nil:
+			case req.Header.Get("Proxy-Authorization") != "Basic dXNlcjpzM2NyM3Q=":
+				io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+			case req.Method != "CONNECT" || req.Host != "10.42.0.1:5432":
+				io.WriteString(conn, "HTTP/1.1 403 Forbidden\r\n\r\n")
+			default:
+				io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+			}
+			conn.Close()
+		}
+	}()
+	proxyURL, _ := url.Parse("http://user:s3cr3t@" + proxy.Addr().String())
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	conn, err := dialProbe(ctx, proxyURL, "10.42.0.1:5432")
+	if assert.Equal(nil, err, "dialProbe() tunnelled") {
+		conn.Close()
+	}
+	_, err = dialProbe(ctx, proxyURL, "10.42.0.2:5432")
+	assert.EqualError(err, "proxy refused tunnel: 403 Forbidden", "dialProbe() refused")
+	proxyURL.User = nil
+	_, err = dialProbe(ctx, proxyURL, "10.42.0.1:5432")
+	assert.EqualError(err, "proxy refused tunnel: 407 Proxy Authentication Required", "dialProbe() unauthenticated")
+}
+
+var updateGolden = flag.Bool("update", false, "Update the golden files in testdata")
+
+// golden compares the content with the named golden file in testdata,
+// rewriting it instead when run with -update.
+func golden(t *testing.T, name string, content []byte) {
+	path := filepath.Join("testdata", name)
+	if *updateGolden {
+		if err := ioutil.WriteFile(path, content, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, string(expected), string(content), "golden %s", name)
+}
+
+func TestComposeExportGolden(t *testing.T) {
+	b, err := ioutil.ReadFile("testdata/rancher_containers.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cs []*Container
+	if err := json.Unmarshal(b, &cs); err != nil {
+		t.Fatal(err)
+	}
+
+	e, err := NewComposeExport("web", cs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	golden(t, "web.docker-compose.yml", e.DockerCompose)
+	golden(t, "web.rancher-compose.yml", e.RancherCompose)
+}
+
+func TestComposeExport(t *testing.T) {
+	assert := assert.New(t)
+
+	primary := map[string]string{rancherLaunchConfigLabel: rancherPrimaryLaunchConfig, "io.rancher.container.name": "x", "tier": "front"}
+	cs := []*Container{
+		{Name: "app_web_1", ServiceName: "web", StackName: "app", Labels: primary, Ports: []string{"0.0.0.0:8080:80/tcp"}},
+		{Name: "app_web_2", ServiceName: "web", StackName: "app", Labels: map[string]string{rancherLaunchConfigLabel: rancherPrimaryLaunchConfig, "tier": "front", "canary": "true"}, Ports: []string{"0.0.0.0:8080:80/tcp", "10.0.0.1:9990:9990/tcp"}},
+		{Name: "app_web_logs_1", ServiceName: "web", StackName: "app", Labels: map[string]string{rancherLaunchConfigLabel: "logs"}},
+		{Name: "other_db_1", ServiceName: "db", StackName: "other"},
+		{Name: "standalone"},
+	}
+
+	e, err := NewComposeExport("app", cs)
+	assert.Equal(nil, err, "NewComposeExport()")
+	assert.Equal(`version: "2"
+services:
+  logs: {}
+  web:
+    labels:
+      io.rancher.sidekicks: logs
+      tier: front
+    ports:
+    - 10.0.0.1:9990:9990/tcp
+    - 8080:80/tcp
+`, string(e.DockerCompose), "NewComposeExport() docker-compose.yml")
+	assert.Equal(`version: "2"
+services:
+  logs:
+    scale: 1
+  web:
+    scale: 2
+`, string(e.RancherCompose), "NewComposeExport() rancher-compose.yml")
+
+	_, err = NewComposeExport("missing", cs)
+	assert.Equal(ErrStackNotFound, err, "NewComposeExport() not found")
+
+	r := mux.NewRouter()
+	r.Methods("GET").Path("/stacks/{name}/export").Handler(MakeStackExportHTTPHandler(
+		context.Background(), NewStackExportEndpoint(stubServerService{containers: cs}, stdopentracing.GlobalTracer()),
+		stdopentracing.GlobalTracer(), log.NewNopLogger()))
+	for _, tc := range []struct {
+		path   string
+		status int
+	}{
+		{"/stacks/app/export?format=compose", http.StatusOK},
+		{"/stacks/app/export", http.StatusOK},
+		{"/stacks/app/export?format=helm", http.StatusBadRequest},
+		{"/stacks/missing/export", http.StatusNotFound},
+	} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", tc.path, nil))
+		assert.Equal(tc.status, w.Code, "StackExport HTTP %s", tc.path)
+		if tc.status == http.StatusOK {
+			var body stackExportResponse
+			json.Unmarshal(w.Body.Bytes(), &body)
+			assert.Equal(string(e.DockerCompose), body.Files["docker-compose.yml"], "StackExport HTTP body")
+			assert.Equal(string(e.RancherCompose), body.Files["rancher-compose.yml"], "StackExport HTTP body")
+		}
+	}
+}
+
+// cattleStandIn stands in for the Rancher API, transitioning containers
+// and services after a number of polls.
+type cattleStandIn struct {
+	mtx        sync.Mutex
+	containers []*APIContainer
+	stacks     []*APIStack
+	services   []*APIService
+	// the state each container or service transitions to, or error
+	transitions map[string]string
+	polls       map[string]int
+	// the input of the most recent update or action upon each service
+	inputs map[string]map[string]interface{}
+}
+
+func (s *cattleStandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	apiError := func(status int, code string) {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(APIError{Status: status, Code: code})
+	}
+	if key, secret, ok := r.BasicAuth(); !ok || key != "access" || secret != "s3cr3t" {
+		apiError(http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	switch {
+	case r.URL.Path == "/v2-beta/projects/1a5/stacks":
+		var data []*APIStack
+		for _, st := range s.stacks {
+			if st.Name == r.URL.Query().Get("name") {
+				data = append(data, st)
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"type": "collection", "data": data})
+		return
+	case strings.HasPrefix(r.URL.Path, "/v2-beta/projects/1a5/services"):
+		s.serveService(w, r, apiError)
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/v2-beta/projects/1a5/containers")
+	if path == "" {
+		var data []*APIContainer
+		for _, c := range s.containers {
+			if (r.URL.Query().Get("uuid") == "" || c.UUID == r.URL.Query().Get("uuid")) &&
+				(r.URL.Query().Get("externalId") == "" || c.ExternalID == r.URL.Query().Get("externalId")) {
+				data = append(data, c)
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"type": "collection", "data": data})
+		return
+	}
+
+	var c *APIContainer
+	for _, ac := range s.containers {
+		if "/"+ac.ID == path {
+			c = ac
+		}
+	}
+	if c == nil {
+		apiError(http.StatusNotFound, "NotFound")
+		return
+	}
+
+	switch r.Method {
+	case "POST":
+		action := r.URL.Query().Get("action")
+		if _, ok := c.Actions[action]; !ok {
+			apiError(http.StatusUnprocessableEntity, "InvalidAction")
+			return
+		}
+		c.State, c.Transitioning, c.Actions = action+"ing", "yes", nil
+		s.polls[c.ID] = 2
+	case "GET":
+		if c.Transitioning == "yes" && s.polls[c.ID] > 0 {
+			if s.polls[c.ID]--; s.polls[c.ID] == 0 {
+				switch t := s.transitions[c.ID]; t {
+				case "error":
+					c.Transitioning, c.TransitioningMessage = "error", "boom"
+				case "":
+					// Never transitions
+				default:
+					c.State, c.Transitioning = t, "no"
+				}
+			}
+		}
+	}
+	json.NewEncoder(w).Encode(c)
+}
+
+func (s *cattleStandIn) serveService(w http.ResponseWriter, r *http.Request, apiError func(int, string)) {
+	path := strings.TrimPrefix(r.URL.Path, "/v2-beta/projects/1a5/services")
+	if path == "" {
+		var data []*APIService
+		for _, svc := range s.services {
+			if svc.Name == r.URL.Query().Get("name") && svc.StackID == r.URL.Query().Get("stackId") {
+				data = append(data, svc)
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"type": "collection", "data": data})
+		return
+	}
+
+	var svc *APIService
+	for _, as := range s.services {
+		if "/"+as.ID == path {
+			svc = as
+		}
+	}
+	if svc == nil {
+		apiError(http.StatusNotFound, "NotFound")
+		return
+	}
+
+	switch r.Method {
+	case "PUT", "POST":
+		state := "updating-active"
+		if r.Method == "POST" {
+			action := r.URL.Query().Get("action")
+			if _, ok := svc.Actions[action]; !ok {
+				apiError(http.StatusUnprocessableEntity, "InvalidAction")
+				return
+			}
+			state = map[string]string{
+				"upgrade":       "upgrading",
+				"finishupgrade": "finishing-upgrade",
+				"rollback":      "rolling-back",
+			}[action]
+		}
+		var input map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&input)
+		s.inputs[svc.ID] = input
+		if scale, ok := input["scale"].(float64); ok {
+			svc.Scale = int(scale)
+		}
+		svc.State, svc.Transitioning, svc.Actions = state, "yes", nil
+		s.polls[svc.ID] = 2
+	case "GET":
+		if svc.Transitioning == "yes" && s.polls[svc.ID] > 0 {
+			if s.polls[svc.ID]--; s.polls[svc.ID] == 0 {
+				switch t := s.transitions[svc.ID]; t {
+				case "error":
+					svc.Transitioning, svc.TransitioningMessage = "error", "boom"
+				case "":
+					// Never transitions
+				default:
+					svc.State, svc.Transitioning = t, "no"
+				}
+			}
+		}
+	}
+	json.NewEncoder(w).Encode(svc)
+}
+
+func TestActionService(t *testing.T) {
+	assert := assert.New(t)
+	httpmock.Activate()
+	defer httpmock.Deactivate()
+
+	standIn := &cattleStandIn{
+		containers: []*APIContainer{
+			{ID: "1i1", UUID: defaultContainers[0].UUID, State: "running", Transitioning: "no",
+				Actions: map[string]string{"restart": "", "stop": ""}},
+			{ID: "1i2", UUID: "stale", ExternalID: defaultContainers[1].ExternalID, State: "running", Transitioning: "no",
+				Actions: map[string]string{"restart": "", "stop": ""}},
+			{ID: "1i3", UUID: defaultContainers[2].UUID, State: "running", Transitioning: "no",
+				Actions: map[string]string{"restart": "", "stop": ""}},
+			{ID: "1i4", UUID: defaultContainers[3].UUID, State: "stopped", Transitioning: "no",
+				Actions: map[string]string{"start": ""}},
+		},
+		transitions: map[string]string{"1i1": "running", "1i2": "stopped", "1i3": "error"},
+		polls:       make(map[string]int),
+	}
+	apiURL, _ := url.Parse("http://cattle/v2-beta/projects/1a5")
+	responder := func(req *http.Request) (*http.Response, error) {
+		w := httptest.NewRecorder()
+		standIn.ServeHTTP(w, req)
+		return w.Result(), nil
+	}
+	httpmock.RegisterResponder("GET", apiURL.String()+"/containers", responder)
+	for _, c := range standIn.containers {
+		httpmock.RegisterResponder("GET", apiURL.String()+"/containers/"+c.ID, responder)
+		httpmock.RegisterResponder("POST", apiURL.String()+"/containers/"+c.ID, responder)
+	}
+
+	env := Environment{Name: "cattle", APIURL: apiURL, APIAccessKey: "access", APISecretKey: "s3cr3t"}
+	cs := NewClientService(context.Background(), NewClientEndpoints(context.Background(), env, nil, stdopentracing.GlobalTracer(), log.NewNopLogger()))
+	repository := stubContainerRepository{containers: defaultContainers}
+	as := NewActionService(context.Background(), repository, cs, ActionConfig{PollInterval: time.Millisecond, Timeout: time.Second})
+
+	res, err := as.ContainerAction(context.Background(), defaultContainers[0].Name, ContainerRestart)
+	assert.Equal(nil, err, "ContainerAction() restart by uuid")
+	assert.Equal(&ContainerActionResult{Name: defaultContainers[0].Name, ID: "1i1", Action: "restart", State: "running"}, res, "ContainerAction() restart by uuid")
+
+	res, err = as.ContainerAction(context.Background(), defaultContainers[1].Name, ContainerStop)
+	assert.Equal(nil, err, "ContainerAction() stop by external_id")
+	assert.Equal(&ContainerActionResult{Name: defaultContainers[1].Name, ID: "1i2", Action: "stop", State: "stopped"}, res, "ContainerAction() stop by external_id")
+
+	_, err = as.ContainerAction(context.Background(), defaultContainers[2].Name, ContainerRestart)
+	assert.Equal(&ContainerTransitionError{State: "restarting", Message: "boom"}, err, "ContainerAction() transition error")
+
+	_, err = as.ContainerAction(context.Background(), defaultContainers[3].Name, ContainerStop)
+	assert.Equal(ErrContainerActionUnavailable, err, "ContainerAction() unavailable")
+	_, err = as.ContainerAction(context.Background(), defaultContainers[4].Name, ContainerStop)
+	assert.Equal(ErrAPIContainerNotFound, err, "ContainerAction() not in API")
+	_, err = as.ContainerAction(context.Background(), "missing", ContainerStop)
+	assert.Equal(ErrContainerNotFound, err, "ContainerAction() not in repository")
+	_, err = as.ContainerAction(context.Background(), defaultContainers[0].Name, "kill")
+	assert.Equal(ErrContainerActionUnknown, err, "ContainerAction() unknown")
+
+	// Never transitions
+	as = NewActionService(context.Background(), repository, cs, ActionConfig{PollInterval: time.Millisecond, Timeout: 50 * time.Millisecond})
+	_, err = as.ContainerAction(context.Background(), defaultContainers[3].Name, ContainerStart)
+	assert.Equal(ErrContainerActionTimeout, err, "ContainerAction() timeout")
+
+	// Unauthorized
+	env.APISecretKey = "wrong"
+	env.Name = "cattle-unauthorized"
+	ces := NewClientEndpoints(context.Background(), env, nil, stdopentracing.GlobalTracer(), log.NewNopLogger())
+	cs = NewClientService(context.Background(), ces)
+	as = NewActionService(context.Background(), repository, cs, ActionConfig{PollInterval: time.Millisecond, Timeout: time.Second})
+	_, err = as.ContainerAction(context.Background(), defaultContainers[0].Name, ContainerRestart)
+	assert.Equal(&APIError{Status: http.StatusUnauthorized, Code: "Unauthorized"}, err, "ContainerAction() unauthorized")
+
+	// Rotated keys authenticate from the next request
+	standIn.containers[0].Actions = map[string]string{"restart": ""}
+	standIn.containers[0].Transitioning = "no"
+	ces.APIKeys.SetKeys(APIKeyPair{AccessKey: "access", SecretKey: "s3cr3t"})
+	_, err = as.ContainerAction(context.Background(), defaultContainers[0].Name, ContainerRestart)
+	assert.Equal(nil, err, "ContainerAction() rotated keys")
+
+	// Not configured
+	as = NewActionService(context.Background(), repository, rcs, ActionConfig{PollInterval: time.Millisecond, Timeout: time.Second})
+	_, err = as.ContainerAction(context.Background(), defaultContainers[0].Name, ContainerRestart)
+	assert.Equal(ErrAPINotConfigured, err, "ContainerAction() not configured")
+
+	// Served over HTTP
+	standIn.containers[0].Actions = map[string]string{"restart": ""}
+	standIn.containers[0].Transitioning = "no"
+	as = NewActionService(context.Background(), repository, NewClientService(context.Background(), NewClientEndpoints(context.Background(),
+		Environment{Name: "cattle", APIURL: apiURL, APIAccessKey: "access", APISecretKey: "s3cr3t"}, nil, stdopentracing.GlobalTracer(), log.NewNopLogger())),
+		ActionConfig{PollInterval: time.Millisecond, Timeout: time.Second})
+	r := mux.NewRouter()
+	r.Methods("POST").Path("/containers/{name}/actions/{action}").Handler(MakeContainerActionHTTPHandler(
+		context.Background(), Authorized(NewActionAuthorizer([]string{"t1", "t2"}))(NewContainerActionEndpoint(as, stdopentracing.GlobalTracer())),
+		stdopentracing.GlobalTracer(), log.NewNopLogger()))
+	for _, tc := range []struct {
+		name, action, auth string
+		status             int
+	}{
+		{defaultContainers[0].Name, "restart", "Bearer t2", http.StatusOK},
+		{defaultContainers[0].Name, "kill", "Bearer t1", http.StatusBadRequest},
+		{defaultContainers[3].Name, "stop", "Bearer t1", http.StatusConflict},
+		{defaultContainers[2].Name, "start", "Bearer t1", http.StatusConflict},
+		{defaultContainers[4].Name, "stop", "Bearer t1", http.StatusNotFound},
+		{defaultContainers[0].Name, "restart", "", http.StatusUnauthorized},
+		{defaultContainers[0].Name, "restart", "Bearer t3", http.StatusUnauthorized},
+		{defaultContainers[0].Name, "restart", "Basic dDE6", http.StatusUnauthorized},
+	} {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/containers/"+tc.name+"/actions/"+tc.action, nil)
+		if tc.auth != "" {
+			req.Header.Set("Authorization", tc.auth)
+		}
+		r.ServeHTTP(w, req)
+		assert.Equal(tc.status, w.Code, "ContainerAction HTTP %s %s %q", tc.action, tc.name, tc.auth)
+		if tc.status == http.StatusUnauthorized {
+			assert.Equal(actionAuthenticate, w.Header().Get("WWW-Authenticate"), "ContainerAction HTTP unauthorized")
+		}
+	}
+}
+
+// stubWatchedRepository feeds the events sent to it to its watcher.
+type stubWatchedRepository struct {
+	stubContainerRepository
+	events chan ContainerEvent
+}
+
+func (r stubWatchedRepository) WatchContainers(context.Context) <-chan ContainerEvent {
+	return r.events
+}
+
+// stubOrderedRepository notes whether it was watched before being read.
+type stubOrderedRepository struct {
+	stubWatchedRepository
+	calls *[]string
+}
+
+func (r stubOrderedRepository) WatchContainers(ctx context.Context) <-chan ContainerEvent {
+	*r.calls = append(*r.calls, "WatchContainers")
+	return r.stubWatchedRepository.WatchContainers(ctx)
+}
+
+func (r stubOrderedRepository) Containers() ([]*Container, error) {
+	*r.calls = append(*r.calls, "Containers")
+	return r.stubWatchedRepository.Containers()
+}
+
+func TestServiceActions(t *testing.T) {
+	assert := assert.New(t)
+	httpmock.Activate()
+	defer httpmock.Deactivate()
+
+	global := map[string]interface{}{"labels": map[string]interface{}{rancherGlobalLabel: "true"}}
+	standIn := &cattleStandIn{
+		stacks: []*APIStack{{ID: "1st1", Name: "web", State: "active"}},
+		services: []*APIService{
+			{ID: "1s1", Name: "gossman", StackID: "1st1", State: "active", Transitioning: "no", Scale: 1,
+				Actions: map[string]string{"upgrade": ""}},
+			{ID: "1s2", Name: "web-self-service", StackID: "1st1", State: "active", Transitioning: "no", Scale: 2,
+				Actions:      map[string]string{"upgrade": ""},
+				LaunchConfig: map[string]interface{}{"imageUuid": "docker:gossman:1.0"}},
+			{ID: "1s3", Name: "web-deployment", StackID: "1st1", State: "upgraded", Transitioning: "no", Scale: 2,
+				Actions: map[string]string{"finishupgrade": "", "rollback": ""}},
+			{ID: "1s4", Name: "service-web", StackID: "1st1", State: "active", Transitioning: "no",
+				Actions: map[string]string{"upgrade": ""}, LaunchConfig: global},
+		},
+		transitions: map[string]string{"1s1": "active", "1s2": "upgraded", "1s3": "error"},
+		polls:       make(map[string]int),
+		inputs:      make(map[string]map[string]interface{}),
+	}
+	apiURL, _ := url.Parse("http://cattle/v2-beta/projects/1a5")
+	responder := func(req *http.Request) (*http.Response, error) {
+		w := httptest.NewRecorder()
+		standIn.ServeHTTP(w, req)
+		return w.Result(), nil
+	}
+	httpmock.RegisterResponder("GET", apiURL.String()+"/stacks", responder)
+	httpmock.RegisterResponder("GET", apiURL.String()+"/services", responder)
+	for _, svc := range standIn.services {
+		httpmock.RegisterResponder("GET", apiURL.String()+"/services/"+svc.ID, responder)
+		httpmock.RegisterResponder("PUT", apiURL.String()+"/services/"+svc.ID, responder)
+		httpmock.RegisterResponder("POST", apiURL.String()+"/services/"+svc.ID, responder)
+	}
+
+	env := Environment{Name: "cattle-services", APIURL: apiURL, APIAccessKey: "access", APISecretKey: "s3cr3t"}
+	cs := NewClientService(context.Background(), NewClientEndpoints(context.Background(), env, nil, stdopentracing.GlobalTracer(), log.NewNopLogger()))
+	cfg := ActionConfig{PollInterval: time.Millisecond, Timeout: time.Second, ServiceTimeout: time.Second}
+	watched := func(events ...ContainerEvent) stubWatchedRepository {
+		r := stubWatchedRepository{stubContainerRepository{containers: defaultContainers}, make(chan ContainerEvent, len(events))}
+		for _, e := range events {
+			r.events <- e
+		}
+		return r
+	}
+	container := func(c *Container, name, state string) *Container {
+		cc := copyContainer(c)
+		cc.Name, cc.State = name, state
+		return cc
+	}
+	// await returns the progress once the action is no longer tracked
+	await := func(as ActionService, p *ServiceProgress) *ServiceProgress {
+		deadline := time.Now().Add(5 * time.Second)
+		for p.Finished == nil && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+			latest, err := as.ServiceAction(context.Background(), p.Stack, p.Service, p.ActionID)
+			if !assert.Equal(nil, err, "ServiceAction()") {
+				break
+			}
+			p = latest
+		}
+		return p
+	}
+
+	// Scale up, once the new container is running
+	var calls []string
+	as := NewActionService(context.Background(), stubOrderedRepository{watched(
+		ContainerEvent{Type: ContainerAdded, Container: defaultContainers[0]},
+		ContainerEvent{Type: ContainerAdded, Container: container(defaultContainers[0], "web_gossman_3", "starting")},
+		ContainerEvent{Type: ContainerUpdated, Container: container(defaultContainers[0], "web_gossman_3", "running")},
+	), &calls}, cs, cfg)
+	p, err := as.ScaleService(context.Background(), "web", "gossman", 2)
+	assert.Equal(nil, err, "ScaleService()")
+	assert.NotEmpty(p.ActionID, "ScaleService() action ID")
+	assert.Equal([]string{"WatchContainers", "Containers"}, calls, "ScaleService() watches before reading")
+	p = await(as, p)
+	assert.Equal(true, p.Complete, "ScaleService() complete")
+	assert.NotNil(p.Finished, "ScaleService() finished")
+	assert.Equal("active", p.State, "ScaleService() state")
+	assert.Equal([]ServiceContainer{
+		{Name: "web_gossman_2", State: "running"},
+		{Name: "web_gossman_3", State: "running", New: true},
+	}, p.Containers, "ScaleService() containers")
+	assert.Equal([3]int{2, 2, 1}, [3]int{p.Desired, p.Running, p.NewRunning}, "ScaleService() counts")
+	assert.Equal(map[string]interface{}{"scale": float64(2)}, standIn.inputs["1s1"], "ScaleService() input")
+
+	// Upgrade, once as many new containers as the scale are running
+	as = NewActionService(context.Background(), watched(
+		ContainerEvent{Type: ContainerUpdated, Container: container(defaultContainers[2], defaultContainers[2].Name, "stopped")},
+		ContainerEvent{Type: ContainerAdded, Container: container(defaultContainers[2], "web_web-self-service_4", "running")},
+		ContainerEvent{Type: ContainerUpdated, Container: container(defaultContainers[3], defaultContainers[3].Name, "stopped")},
+		ContainerEvent{Type: ContainerAdded, Container: container(defaultContainers[3], "web_web-self-service_5", "running")},
+	), cs, cfg)
+	p, err = as.UpgradeService(context.Background(), "web", "web-self-service", UpgradeStrategy{Image: "gossman:1.1"})
+	assert.Equal(nil, err, "UpgradeService()")
+	p = await(as, p)
+	assert.Equal(true, p.Complete, "UpgradeService() complete")
+	assert.Equal("upgraded", p.State, "UpgradeService() state")
+	assert.Equal([3]int{2, 2, 2}, [3]int{p.Desired, p.Running, p.NewRunning}, "UpgradeService() counts")
+	assert.Equal(map[string]interface{}{
+		"batchSize":      float64(1),
+		"intervalMillis": float64(2000),
+		"startFirst":     false,
+		"launchConfig":   map[string]interface{}{"imageUuid": "docker:gossman:1.1"},
+	}, standIn.inputs["1s2"]["inServiceStrategy"], "UpgradeService() input")
+
+	// Incomplete at the timeout, as the containers never run
+	as = NewActionService(context.Background(), watched(), cs, ActionConfig{PollInterval: time.Millisecond, ServiceTimeout: 50 * time.Millisecond})
+	standIn.services[0].Actions = map[string]string{"upgrade": ""}
+	p, err = as.UpgradeService(context.Background(), "web", "gossman", UpgradeStrategy{})
+	assert.Equal(nil, err, "UpgradeService() timeout")
+	p = await(as, p)
+	assert.Equal(false, p.Complete, "UpgradeService() timeout")
+	assert.Equal(ErrServiceActionTimeout.Error(), p.Error, "UpgradeService() timeout")
+	assert.Equal(0, p.NewRunning, "UpgradeService() timeout")
+
+	as = NewActionService(context.Background(), watched(), cs, cfg)
+	p, err = as.UpgradeService(context.Background(), "web", "web-deployment", UpgradeStrategy{Action: ServiceRollback})
+	assert.Equal(nil, err, "UpgradeService() transition error")
+	p = await(as, p)
+	assert.Equal(false, p.Complete, "UpgradeService() transition error")
+	assert.Equal((&ServiceTransitionError{State: "rolling-back", Message: "boom"}).Error(), p.Error, "UpgradeService() transition error")
+	_, err = as.ServiceAction(context.Background(), "web", "gossman", p.ActionID)
+	assert.Equal(ErrServiceActionNotFound, err, "ServiceAction() another service")
+	_, err = as.UpgradeService(context.Background(), "web", "service-web", UpgradeStrategy{Action: ServiceFinishUpgrade})
+	assert.Equal(ErrServiceActionUnavailable, err, "UpgradeService() unavailable")
+	_, err = as.UpgradeService(context.Background(), "web", "service-web", UpgradeStrategy{Action: "kill"})
+	assert.Equal(ErrServiceActionUnknown, err, "UpgradeService() unknown")
+	_, err = as.ScaleService(context.Background(), "web", "service-web", 3)
+	assert.Equal(ErrServiceScaleGlobal, err, "ScaleService() global")
+	_, err = as.ScaleService(context.Background(), "web", "gossman", -1)
+	assert.Equal(ErrServiceScaleInvalid, err, "ScaleService() negative")
+	_, err = as.ScaleService(context.Background(), "web", "missing", 1)
+	assert.Equal(ErrAPIServiceNotFound, err, "ScaleService() missing service")
+	_, err = as.ScaleService(context.Background(), "missing", "gossman", 1)
+	assert.Equal(ErrAPIServiceNotFound, err, "ScaleService() missing stack")
+
+	// Not configured
+	as = NewActionService(context.Background(), watched(), rcs, cfg)
+	_, err = as.ScaleService(context.Background(), "web", "gossman", 1)
+	assert.Equal(ErrAPINotConfigured, err, "ScaleService() not configured")
+
+	// Served over HTTP, without waiting for the action
+	ctx, cancel := context.WithCancel(context.Background())
+	as = NewActionService(ctx, watched(), cs, ActionConfig{PollInterval: time.Millisecond, ServiceTimeout: time.Minute})
+	authorized := Authorized(NewActionAuthorizer([]string{"t1"}))
+	r := mux.NewRouter()
+	r.Methods("PUT").Path("/stacks/{stack}/services/{service}/scale").Handler(MakeServiceScaleHTTPHandler(
+		context.Background(), authorized(NewServiceScaleEndpoint(as, stdopentracing.GlobalTracer())),
+		stdopentracing.GlobalTracer(), log.NewNopLogger()))
+	r.Methods("POST").Path("/stacks/{stack}/services/{service}/upgrade").Handler(MakeServiceUpgradeHTTPHandler(
+		context.Background(), authorized(NewServiceUpgradeEndpoint(as, stdopentracing.GlobalTracer())),
+		stdopentracing.GlobalTracer(), log.NewNopLogger()))
+	r.Methods("GET").Path("/stacks/{stack}/services/{service}/actions/{id}").Handler(MakeServiceActionHTTPHandler(
+		context.Background(), authorized(NewServiceActionEndpoint(as, stdopentracing.GlobalTracer())),
+		stdopentracing.GlobalTracer(), log.NewNopLogger()))
+	serve := func(method, path, body, auth string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		r.ServeHTTP(w, req)
+		return w
+	}
+	for _, tc := range []struct {
+		method, path, body, auth string
+		status                   int
+	}{
+		{"PUT", "/stacks/web/services/gossman/scale", `{}`, "Bearer t1", http.StatusBadRequest},
+		{"PUT", "/stacks/web/services/service-web/scale", `{"Scale": 2}`, "Bearer t1", http.StatusConflict},
+		{"PUT", "/stacks/web/services/missing/scale", `{"Scale": 2}`, "Bearer t1", http.StatusNotFound},
+		{"POST", "/stacks/web/services/gossman/upgrade", `{"Action": "kill"}`, "Bearer t1", http.StatusBadRequest},
+		{"POST", "/stacks/web/services/service-web/upgrade", `{"Action": "rollback"}`, "Bearer t1", http.StatusConflict},
+		{"GET", "/stacks/web/services/gossman/actions/unknown", "", "Bearer t1", http.StatusNotFound},
+		{"PUT", "/stacks/web/services/gossman/scale", `{"Scale": 5}`, "", http.StatusUnauthorized},
+		{"POST", "/stacks/web/services/gossman/upgrade", `{}`, "Bearer t2", http.StatusUnauthorized},
+	} {
+		w := serve(tc.method, tc.path, tc.body, tc.auth)
+		assert.Equal(tc.status, w.Code, "Service action HTTP %s %s %q", tc.method, tc.path, tc.auth)
+	}
+
+	start := time.Now()
+	w := serve("PUT", "/stacks/web/services/gossman/scale", `{"Scale": 5}`, "Bearer t1")
+	assert.Equal(http.StatusAccepted, w.Code, "Service action HTTP accepted")
+	assert.True(time.Since(start) < time.Second, "Service action HTTP does not wait")
+	var accepted serviceProgressResponse
+	assert.Equal(nil, json.NewDecoder(w.Body).Decode(&accepted), "Service action HTTP progress")
+	if assert.NotNil(accepted.Progress, "Service action HTTP progress") {
+		assert.Equal("actions/"+accepted.Progress.ActionID, w.Header().Get("Location"), "Service action HTTP location")
+		w = serve("GET", "/stacks/web/services/gossman/actions/"+accepted.Progress.ActionID, "", "Bearer t1")
+		assert.Equal(http.StatusOK, w.Code, "Service action HTTP progress")
+		w = serve("GET", "/stacks/web/services/gossman/actions/"+accepted.Progress.ActionID, "", "")
+		assert.Equal(http.StatusUnauthorized, w.Code, "Service action HTTP progress unauthorized")
+
+		// Tracking stops with the service
+		cancel()
+		p = await(as, accepted.Progress)
+		assert.Equal(context.Canceled.Error(), p.Error, "Service action HTTP cancelled")
+	}
+	cancel()
+}
+
+func TestParsePolicies(t *testing.T) {
+	assert := assert.New(t)
+
+	ps, err := ParsePolicies("", DefaultPolicy)
+	assert.Equal(nil, err, "ParsePolicies() empty spec")
+	assert.Equal(DefaultPolicy, ps.policy(metadataContainersCommand), "ParsePolicies() empty spec")
+
+	// The default policy applies beneath the others, wherever it is given
+	ps, err = ParsePolicies("endpoint=rancher-api-service-update-endpoint,timeout=30s,breaker=gobreaker,max_concurrent=4;endpoint=default,timeout=5s,retries=2,backoff=10ms,max_backoff=1s", DefaultPolicy)
+	assert.Equal(nil, err, "ParsePolicies() success")
+	assert.Equal(Policy{Timeout: 5 * time.Second, Retries: 2, Backoff: 10 * time.Millisecond, MaxBackoff: time.Second, Breaker: BreakerHystrix},
+		ps.policy(metadataContainersCommand), "ParsePolicies() default")
+	assert.Equal(Policy{Timeout: 30 * time.Second, Retries: 2, Backoff: 10 * time.Millisecond, MaxBackoff: time.Second, Breaker: BreakerGobreaker, MaxConcurrent: 4},
+		ps.policy(apiServiceUpdateCommand), "ParsePolicies() endpoint")
+
+	for _, spec := range []string{
+		"timeout=1s",
+		"endpoint=containers",
+		"endpoint=default;endpoint=default",
+		"endpoint=default,timeout=soon",
+		"endpoint=default,colour=blue",
+		"endpoint=default,breaker=fuse",
+		"endpoint=default,retries=-1",
+		"endpoint=default,backoff=1s,max_backoff=10ms",
+		"endpoint=default,retries=2",
+		"endpoint",
+	} {
+		_, err := ParsePolicies(spec, DefaultPolicy)
+		assert.NotNil(err, "ParsePolicies() failure: "+spec)
+	}
+}
+
+func TestResilient(t *testing.T) {
+	assert := assert.New(t)
+	hystrix.Flush()
+
+	var calls int32
+	failing := func(context.Context, interface{}) (interface{}, error) {
+		atomic.AddInt32(&calls, 1)
+		return nil, errors.New("unavailable")
+	}
+	p := Policy{Timeout: time.Second, Retries: 2, Backoff: time.Millisecond, MaxBackoff: 2 * time.Millisecond, Breaker: BreakerGobreaker}
+
+	// Failed calls are retried, unless they act upon containers or services
+	_, err := resilient(newCircuit(Environment{Name: "retry"}, apiContainersCommand, p))(failing)(context.Background(), nil)
+	assert.EqualError(err, "unavailable", "resilient() retries")
+	assert.Equal(int32(3), atomic.LoadInt32(&calls), "resilient() retries")
+
+	atomic.StoreInt32(&calls, 0)
+	_, err = resilient(newCircuit(Environment{Name: "retry"}, apiContainerActionCommand, p))(failing)(context.Background(), nil)
+	assert.EqualError(err, "unavailable", "resilient() mutating")
+	assert.Equal(int32(1), atomic.LoadInt32(&calls), "resilient() mutating")
+
+	// Backing off is abandoned once the context is done
+	atomic.StoreInt32(&calls, 0)
+	slow := Policy{Timeout: time.Second, Retries: 2, Backoff: time.Hour, MaxBackoff: time.Hour, Breaker: BreakerGobreaker}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	started := time.Now()
+	_, err = resilient(newCircuit(Environment{Name: "backoff"}, apiContainersCommand, slow))(failing)(ctx, nil)
+	assert.Equal(context.DeadlineExceeded, err, "resilient() backoff cancelled")
+	assert.True(time.Since(started) < time.Minute, "resilient() backoff cancelled")
+	assert.Equal(int32(1), atomic.LoadInt32(&calls), "resilient() backoff cancelled")
+
+	// Attempts are timed out
+	p.Retries = 0
+	p.Timeout = 10 * time.Millisecond
+	_, err = resilient(newCircuit(Environment{Name: "timeout"}, apiContainersCommand, p))(func(ctx context.Context, _ interface{}) (interface{}, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})(context.Background(), nil)
+	assert.Equal(context.DeadlineExceeded, err, "resilient() timeout")
+
+	// Calls beyond the bulkhead fail fast
+	p.Timeout = time.Second
+	p.MaxConcurrent = 1
+	entered, release := make(chan struct{}), make(chan struct{})
+	e := resilient(newCircuit(Environment{Name: "bulkhead"}, apiContainersCommand, p))(func(context.Context, interface{}) (interface{}, error) {
+		close(entered)
+		<-release
+		return nil, nil
+	})
+	go e(context.Background(), nil)
+	<-entered
+	_, err = e(context.Background(), nil)
+	assert.Equal(ErrBulkheadFull, err, "resilient() bulkhead full")
+	close(release)
+
+	// The circuit opens after consecutive failures
+	p.MaxConcurrent = 0
+	c := newCircuit(Environment{Name: "breaker"}, apiContainersCommand, p)
+	e = resilient(c)(failing)
+	for i := 0; i < 6; i++ {
+		e(context.Background(), nil)
+	}
+	state, err := Circuits{c}.state(Environment{Name: "breaker"}.command(apiContainersCommand))
+	assert.Equal(nil, err, "Circuits.state() open")
+	assert.Equal(CircuitOpen, state, "Circuits.state() open")
+	assert.Equal(p, c.Policy(), "Circuit.Policy()")
+
+	w := httptest.NewRecorder()
+	MakeCircuitsDebugHandler(Circuits{c}).ServeHTTP(w, httptest.NewRequest("GET", "/debug/circuits", nil))
+	assert.Regexp(`(?m)^breaker\s+`+apiContainersCommand+`\s+gobreaker\s+open\s+0\s+0\s+1s\s+0\s+1ms-2ms$`, w.Body.String(), "MakeCircuitsDebugHandler() row")
+
+	// Client endpoints retry calls failing upstream
+	httpmock.Activate()
+	defer httpmock.Deactivate()
+	metadataURL, _ := url.Parse("http://rancher-metadata.retry/latest")
+	var requests int32
+	httpmock.RegisterResponder("GET", metadataURL.String()+"/containers", func(*http.Request) (*http.Response, error) {
+		if atomic.AddInt32(&requests, 1) < 3 {
+			return httpmock.NewStringResponse(500, ""), nil
+		}
+		return httpmock.NewStringResponse(200, "[]"), nil
+	})
+	ps, _ := ParsePolicies("endpoint=default,timeout=1s,retries=2,backoff=1ms,max_backoff=2ms", DefaultPolicy)
+	ces := NewClientEndpoints(context.Background(), Environment{Name: "retry", MetadataURL: metadataURL}, ps, stdopentracing.GlobalTracer(), log.NewNopLogger())
+	cs := NewClientService(context.Background(), ces)
+	_, err = cs.MetadataContainers(context.Background())
+	assert.Equal(nil, err, "MetadataContainers() retried")
+	assert.Equal(int32(3), atomic.LoadInt32(&requests), "MetadataContainers() retried")
+
+	// Policies apply from the next call, keeping their breaker
+	atomic.StoreInt32(&requests, 0)
+	ps, _ = ParsePolicies("endpoint=default,timeout=1s,breaker=gobreaker", DefaultPolicy)
+	ces.Circuits.SetPolicies(ps)
+	_, err = cs.MetadataContainers(context.Background())
+	assert.NotEqual(nil, err, "MetadataContainers() no longer retried")
+	assert.Equal(int32(1), atomic.LoadInt32(&requests), "MetadataContainers() no longer retried")
+	for _, c := range ces.Circuits {
+		if c.Endpoint == metadataContainersCommand {
+			assert.Equal(Policy{Timeout: time.Second, Backoff: DefaultPolicy.Backoff, MaxBackoff: DefaultPolicy.MaxBackoff, Breaker: BreakerHystrix}, c.Policy(), "SetPolicies() policy")
+		}
+	}
+}
+
+func TestHystrixStreamHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	defer func(d time.Duration) { hystrixStreamInterval = d }(hystrixStreamInterval)
+	hystrixStreamInterval = 10 * time.Millisecond
+
+	h := NewHystrixStreamHandler()
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	// Commands are on the stream before their first call
+	hystrixBreaker("hystrix-stream-command")
+	resp, err := (&http.Client{Transport: &http.Transport{}}).Get(srv.URL)
+	if !assert.NoError(err, "HystrixStreamHandler") {
+		return
+	}
+	defer resp.Body.Close()
+	assert.Equal("text/event-stream", resp.Header.Get("Content-Type"), "HystrixStreamHandler content type")
+
+	found := make(chan bool)
+	go func() {
+		s := bufio.NewScanner(resp.Body)
+		for s.Scan() {
+			if strings.HasPrefix(s.Text(), "data:") && strings.Contains(s.Text(), `"name":"hystrix-stream-command"`) {
+				found <- true
+				break
+			}
+		}
+		// Stopping ends the stream
+		ioutil.ReadAll(resp.Body)
+		close(found)
+	}()
+	select {
+	case ok := <-found:
+		assert.True(ok, "HystrixStreamHandler command")
+	case <-time.After(5 * time.Second):
+		assert.Fail("HystrixStreamHandler command not streamed")
+	}
+
+	h.Stop()
+	select {
+	case <-found:
+	case <-time.After(5 * time.Second):
+		assert.Fail("HystrixStreamHandler stream not ended")
+	}
+}
+
+func TestHystrixMetricCollector(t *testing.T) {
+	assert := assert.New(t)
+
+	events, durations := newStubCounter(), stubHistogram{&stubMetric{}}
+	c := NewHystrixMetricCollector(events, durations)("rancher-metadata-service-containers-endpoint")
+	c.IncrementAttempts()
+	c.IncrementShortCircuits()
+	c.IncrementShortCircuits()
+	c.UpdateRunDuration(time.Millisecond)
+	c.Reset()
+
+	assert.Equal(1.0, events.count("command,rancher-metadata-service-containers-endpoint,event,attempts"), "HystrixMetricCollector attempts")
+	assert.Equal(2.0, events.count("command,rancher-metadata-service-containers-endpoint,event,short_circuits"), "HystrixMetricCollector short circuits")
+	assert.Equal(1.0, durations.Value(), "HystrixMetricCollector run duration")
+}
+
+func TestRateLimiter(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Unix(0, 0)
+	requests := newStubCounter()
+	l := NewRateLimiter(RateLimitRead, RateLimit{Rate: 2}, requests)
+	l.now = func() time.Time { return now }
+
+	// The burst defaults to a second's worth of the rate
+	for i := 0; i < 2; i++ {
+		release, err := l.acquire("ip:10.0.0.1")
+		if assert.NoError(err, "acquire() burst") {
+			release()
+		}
+	}
+	_, err := l.acquire("ip:10.0.0.1")
+	if assert.IsType(&RateLimitError{}, err, "acquire() exhausted") {
+		assert.Equal(500*time.Millisecond, err.(*RateLimitError).RetryAfter, "acquire() retry after")
+	}
+	release, err := l.acquire("ip:10.0.0.2")
+	if assert.NoError(err, "acquire() other client") {
+		release()
+	}
+
+	now = now.Add(500 * time.Millisecond)
+	release, err = l.acquire("ip:10.0.0.1")
+	if assert.NoError(err, "acquire() refilled") {
+		release()
+	}
+
+	assert.Equal(float64(3), requests.count("budget,read,client,ip:10.0.0.1,result,allowed"), "acquire() counts allowed")
+	assert.Equal(float64(1), requests.count("budget,read,client,ip:10.0.0.1,result,limited"), "acquire() counts limited")
+
+	// Idle clients with a full bucket are forgotten
+	now = now.Add(rateLimitSweepInterval)
+	l.acquire("ip:10.0.0.3")
+	assert.Len(l.clients, 1, "acquire() sweeps idle clients")
+
+	// Concurrency is limited until released
+	l = NewRateLimiter(RateLimitMutating, RateLimit{MaxConcurrent: 1}, requests)
+	release, err = l.acquire("ip:10.0.0.1")
+	assert.NoError(err, "acquire() in flight")
+	_, err = l.acquire("ip:10.0.0.1")
+	if assert.IsType(&RateLimitError{}, err, "acquire() too many in flight") {
+		assert.Equal(time.Second, err.(*RateLimitError).RetryAfter, "acquire() retry after")
+	}
+	release()
+	_, err = l.acquire("ip:10.0.0.1")
+	assert.NoError(err, "acquire() released")
+
+	// Zero limits, unidentified clients and nil limiters are not limited
+	for _, l := range []*RateLimiter{NewRateLimiter(RateLimitRead, RateLimit{}, requests), nil} {
+		for i := 0; i < 10; i++ {
+			_, err := l.acquire("ip:10.0.0.1")
+			assert.NoError(err, "acquire() unlimited")
+		}
+	}
+	l = NewRateLimiter(RateLimitRead, RateLimit{Rate: 1}, requests)
+	for i := 0; i < 10; i++ {
+		_, err := l.acquire("")
+		assert.NoError(err, "acquire() unidentified")
+	}
+
+	// Limits apply from the next request, clients keeping their buckets
+	l = NewRateLimiter(RateLimitRead, RateLimit{}, requests)
+	l.now = func() time.Time { return now }
+	_, err = l.acquire("ip:10.0.0.1")
+	assert.NoError(err, "acquire() before SetLimit()")
+	l.SetLimit(RateLimit{Rate: 1})
+	_, err = l.acquire("ip:10.0.0.1")
+	assert.NoError(err, "acquire() after SetLimit()")
+	_, err = l.acquire("ip:10.0.0.1")
+	assert.IsType(&RateLimitError{}, err, "acquire() limited after SetLimit()")
+	l.SetLimit(RateLimit{})
+	_, err = l.acquire("ip:10.0.0.1")
+	assert.NoError(err, "acquire() unlimited after SetLimit()")
+}
+
+func TestRateLimited(t *testing.T) {
+	assert := assert.New(t)
+
+	requests := newStubCounter()
+	l := NewRateLimiter(RateLimitRead, RateLimit{Rate: 0.5, Burst: 1}, requests)
+	e := RateLimited(l)(func(context.Context, interface{}) (interface{}, error) {
+		return nil, ErrContainerNotProbed
+	})
+	r := mux.NewRouter()
+	r.Handle("/containers/{name}/health", MakeContainerHealthHTTPHandler(context.Background(), e, stdopentracing.GlobalTracer(), log.NewNopLogger()))
+
+	get := func(remoteAddr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/containers/web/health", nil)
+		req.RemoteAddr = remoteAddr
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec
+	}
+
+	assert.Equal(http.StatusNotFound, get("10.0.0.1:50000").Code, "RateLimited() allowed")
+	rec := get("10.0.0.1:50001")
+	assert.Equal(http.StatusTooManyRequests, rec.Code, "RateLimited() limited")
+	assert.Equal("2", rec.Header().Get("Retry-After"), "RateLimited() Retry-After")
+	assert.Contains(rec.Body.String(), "too many requests", "RateLimited() error body")
+
+	// Forwarded addresses have no port
+	assert.Equal(http.StatusNotFound, get("10.0.0.2").Code, "RateLimited() other client")
+	assert.Equal(float64(1), requests.count("budget,read,client,ip:10.0.0.2,result,allowed"), "RateLimited() counts by client")
+
+	// Clients are identified by a verified certificate before their address
+	req := httptest.NewRequest("GET", "/", nil)
+	req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: "ci"}}}}}
+	assert.Equal("cn:ci", ClientIdentity(req), "ClientIdentity() certificate")
+
+	// Actions are limited before they are authorized, by an allowed token
+	// rather than the address it is shared with
+	actions := newStubCounter()
+	a := NewActionAuthorizer([]string{"s3cr3t"})
+	action := IdentifiedByToken(a)(RateLimited(NewRateLimiter(RateLimitMutating, RateLimit{Rate: 0.5, Burst: 1}, actions))(Authorized(a)(
+		func(context.Context, interface{}) (interface{}, error) { return nil, nil })))
+	act := func(token string) error {
+		ctx := context.WithValue(context.Background(), clientIdentityKey{}, "ip:10.0.0.3")
+		_, err := action(context.WithValue(ctx, bearerTokenKey{}, token), nil)
+		return err
+	}
+	assert.Equal(ErrActionUnauthorized, act("guess"), "RateLimited() wrong token")
+	assert.IsType(&RateLimitError{}, act("another guess"), "RateLimited() guessing tokens")
+	assert.NoError(act("s3cr3t"), "IdentifiedByToken() allowed token")
+	assert.Equal(float64(1), actions.count("budget,mutating,client,"+tokenIdentity("s3cr3t")+",result,allowed"), "IdentifiedByToken() counts by token")
+
+	// The proxy limits each token by the budget of the method
+	proxy := &proxyHandler{cfg: ProxyConfig{
+		ReadLimiter:     NewRateLimiter(RateLimitRead, RateLimit{Rate: 1}, requests),
+		MutatingLimiter: NewRateLimiter(RateLimitMutating, RateLimit{Rate: 1}, requests),
+	}}
+	for _, method := range []string{"GET", "POST"} {
+		req := httptest.NewRequest(method, "/", nil)
+		req.Header.Set("Proxy-Authorization", "Bearer s3cr3t")
+		_, err := proxy.limit(req)
+		assert.NoError(err, "limit() "+method)
+		_, err = proxy.limit(req)
+		assert.IsType(&RateLimitError{}, err, "limit() "+method+" exhausted")
+	}
+	assert.Equal(float64(1), requests.count("budget,mutating,client,"+tokenIdentity("s3cr3t")+",result,limited"), "limit() counts by token")
+}
+
+func TestGovernor(t *testing.T) {
+	assert := assert.New(t)
+
+	queued, waited := stubLabelledGauge{newStubCounter()}, stubHistogram{&stubMetric{}}
+	g := NewGovernor(GovernorConfig{MaxConcurrent: 2, MaxPerHost: 1}, queued, waited)
+	web := func(host string) *Container {
+		return &Container{StackName: "web", ServiceName: "gossman", Host: Host{UUID: host}}
+	}
+	// acquire acquires in the background, reporting the job once its turn
+	// comes, and waits until the call is queued or granted
+	granted := make(chan string, 8)
+	var releases sync.Map
+	acquire := func(job string, c *Container) {
+		before := g.calls()
+		go func() {
+			release, err := g.Acquire(context.Background(), job, "dev", c)
+			if err == nil {
+				r, _ := releases.LoadOrStore(job, make(chan func(), 8))
+				r.(chan func()) <- release
+				granted <- job
+			}
+		}()
+		for g.calls() == before {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	release := func(job string) {
+		r, _ := releases.Load(job)
+		(<-r.(chan func()))()
+	}
+	next := func() string {
+		select {
+		case job := <-granted:
+			return job
+		case <-time.After(time.Second):
+			return "none"
+		}
+	}
+
+	// Calls beyond a host's cap wait, without holding back other hosts
+	acquire("a", web("host1"))
+	assert.Equal("a", next(), "Acquire() within caps")
+	acquire("a", web("host1"))
+	acquire("b", web("host2"))
+	assert.Equal("b", next(), "Acquire() other host")
+	assert.Equal(float64(1), queued.count("job,a"), "Acquire() queue depth")
+
+	// Turns are taken by job, however many calls each job has queued
+	acquire("a", web("host3"))
+	acquire("a", web("host4"))
+	acquire("c", web("host5"))
+	release("b")
+	assert.Equal("a", next(), "Acquire() turn")
+	release("a")
+	assert.Equal("c", next(), "Acquire() fair turn")
+	release("a")
+	assert.Equal("a", next(), "Acquire() turn")
+	release("a")
+	assert.Equal("a", next(), "Acquire() turn")
+	assert.Equal(float64(0), queued.count("job,a"), "Acquire() queue drained")
+	release("a")
+	release("c")
+
+	// Waits are bounded by the context and the maximum wait
+	g = NewGovernor(GovernorConfig{MaxConcurrent: 1, MaxWait: 50 * time.Millisecond}, queued, waited)
+	held, err := g.Acquire(context.Background(), "a", "dev", web("host1"))
+	assert.NoError(err, "Acquire()")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = g.Acquire(ctx, "b", "dev", web("host2"))
+	assert.Equal(context.DeadlineExceeded, err, "Acquire() deadline")
+	_, err = g.Acquire(context.Background(), "b", "dev", web("host2"))
+	assert.Equal(ErrGovernorTimeout, err, "Acquire() maximum wait")
+	assert.Equal(1, g.calls(), "Acquire() abandoned calls dequeued")
+	held()
+	_, err = g.Acquire(context.Background(), "b", "dev", web("host2"))
+	assert.NoError(err, "Acquire() released")
+	assert.True(waited.Value() > 0, "Acquire() observes waits")
+
+	// Hosts are told apart by their UUID, whatever their name
+	g = NewGovernor(GovernorConfig{MaxPerHost: 1}, queued, waited)
+	_, err = g.Acquire(context.Background(), "a", "dev", &Container{Host: Host{UUID: "1h1", Name: "host1"}})
+	assert.NoError(err, "Acquire() host UUID")
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = g.Acquire(ctx, "b", "dev", &Container{Host: Host{UUID: "1h1", Name: "renamed"}})
+	assert.Equal(context.DeadlineExceeded, err, "Acquire() same host UUID")
+	_, err = g.Acquire(context.Background(), "b", "dev", &Container{Host: Host{UUID: "1h2", Name: "host1"}})
+	assert.NoError(err, "Acquire() other host UUID")
+
+	// A nil governor never waits
+	var none *Governor
+	_, err = none.Acquire(context.Background(), "a", "dev", web("host1"))
+	assert.NoError(err, "Acquire() nil")
+}
+
+// calls returns the number of calls in flight or waiting for their turn.
+func (g *Governor) calls() int {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	n := g.inFlight
+	for _, j := range g.jobs {
+		n += len(j.calls)
+	}
+	return n
+}
+
+func TestRequestID(t *testing.T) {
+	assert := assert.New(t)
+
+	var got string
+	e := func(ctx context.Context, _ interface{}) (interface{}, error) {
+		got = RequestIDFromContext(ctx)
+		return nil, ErrContainerNotProbed
+	}
+	r := mux.NewRouter()
+	r.Handle("/containers/{name}/health", MakeContainerHealthHTTPHandler(context.Background(), e, stdopentracing.GlobalTracer(), log.NewNopLogger()))
+	h := NewRequestIDHandler(r)
+
+	get := func(id string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/containers/web/health", nil)
+		if id != "" {
+			req.Header.Set(RequestIDHeader, id)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// Generated when absent, and echoed in both the header and error body
+	rec := get("")
+	id := rec.Header().Get(RequestIDHeader)
+	assert.Len(id, 32, "NewRequestIDHandler() generated")
+	assert.Equal(id, got, "NewRequestIDHandler() endpoint context")
+	var body httpErrorBody
+	assert.NoError(json.NewDecoder(rec.Body).Decode(&body))
+	assert.Equal(id, body.RequestID, "encodeHTTPError() request ID")
+
+	// Propagated when valid
+	rec = get("abc-123")
+	assert.Equal("abc-123", rec.Header().Get(RequestIDHeader), "NewRequestIDHandler() propagated")
+	assert.Equal("abc-123", got, "NewRequestIDHandler() propagated context")
+
+	// Replaced when not
+	for _, bad := range []string{"has space", strings.Repeat("a", maxRequestIDLength+1)} {
+		rec = get(bad)
+		assert.NotEqual(bad, rec.Header().Get(RequestIDHeader), "NewRequestIDHandler() invalid")
+		assert.Len(rec.Header().Get(RequestIDHeader), 32, "NewRequestIDHandler() invalid replaced")
+	}
+
+	// Forwarded on outbound requests, or generated outside of any
+	req := httptest.NewRequest("GET", "/", nil)
+	ForwardRequestID(ContextWithRequestID(context.Background(), "abc-123"), req)
+	assert.Equal("abc-123", req.Header.Get(RequestIDHeader), "ForwardRequestID() forwarded")
+	ctx := ForwardRequestID(context.Background(), req)
+	assert.Len(req.Header.Get(RequestIDHeader), 32, "ForwardRequestID() generated")
+	assert.Equal(req.Header.Get(RequestIDHeader), RequestIDFromContext(ctx), "ForwardRequestID() context")
+
+	// Logged alongside the trace and span IDs
+	tracer, err := zipkin.NewTracer(zipkin.NewRecorder(zipkin.NopCollector{}, false, "", ""))
+	assert.NoError(err)
+	span := tracer.StartSpan("test")
+	ctx = stdopentracing.ContextWithSpan(ContextWithRequestID(context.Background(), "abc-123"), span)
+	var buf bytes.Buffer
+	withCorrelation(log.NewLogfmtLogger(&buf), ctx).Log("msg", "hello")
+	assert.Contains(buf.String(), "request_id=abc-123", "withCorrelation() request ID")
+	assert.Contains(buf.String(), "trace_id=", "withCorrelation() trace ID")
+	assert.Contains(buf.String(), "span_id=", "withCorrelation() span ID")
+
+	buf.Reset()
+	withCorrelation(log.NewLogfmtLogger(&buf), context.Background()).Log("msg", "hello")
+	assert.Equal("msg=hello\n", buf.String(), "withCorrelation() uncorrelated")
+}
+
+func TestClientTracing(t *testing.T) {
+	assert := assert.New(t)
+
+	httpmock.Activate()
+	defer httpmock.Deactivate()
+	metadataURL, _ := url.Parse("http://rancher-metadata.traced/latest")
+	var (
+		mtx     sync.Mutex
+		headers = make(map[string]http.Header)
+	)
+	for _, subpath := range []string{"/containers", "/hosts"} {
+		subpath := subpath
+		httpmock.RegisterResponder("GET", metadataURL.String()+subpath, func(r *http.Request) (*http.Response, error) {
+			mtx.Lock()
+			headers[subpath] = r.Header
+			mtx.Unlock()
+			return httpmock.NewStringResponse(200, "[]"), nil
+		})
+	}
+
+	tracer := mocktracer.New()
+	env := Environment{Name: "traced", MetadataURL: metadataURL}
+	cs := NewClientService(context.Background(), NewClientEndpoints(context.Background(), env, nil, tracer, log.NewNopLogger()))
+
+	// Synchronous calls are children of the calling span
+	parent := tracer.StartSpan("Container")
+	_, err := cs.MetadataContainers(stdopentracing.ContextWithSpan(context.Background(), parent))
+	assert.NoError(err)
+	parent.Finish()
+
+	spans := tracer.FinishedSpans()
+	if assert.Len(spans, 2, "MetadataContainers() spans") {
+		client, pctx := spans[0], parent.Context().(mocktracer.MockSpanContext)
+		assert.Equal(env.command(metadataContainersCommand), client.OperationName, "MetadataContainers() span name")
+		assert.Equal(pctx.SpanID, client.ParentID, "MetadataContainers() child of caller")
+		assert.Equal(pctx.TraceID, client.SpanContext.TraceID, "MetadataContainers() same trace")
+		assert.Equal("client", fmt.Sprint(client.Tag("span.kind")), "MetadataContainers() client span")
+
+		// Injected into the outbound request
+		h := headers["/containers"]
+		assert.Equal(fmt.Sprint(pctx.TraceID), h.Get("Mockpfx-Ids-Traceid"), "MetadataContainers() trace injected")
+		assert.Equal(fmt.Sprint(client.SpanContext.SpanID), h.Get("Mockpfx-Ids-Spanid"), "MetadataContainers() span injected")
+	}
+
+	// Background refreshes are traced from a root span of their own
+	tracer.Reset()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	NewMetadataCachingRepository(ctx, cs, time.Hour, 0, nil, tracer)
+
+	spans = tracer.FinishedSpans()
+	var refresh *mocktracer.MockSpan
+	for _, s := range spans {
+		if s.OperationName == metadataRefreshOperation {
+			refresh = s
+		}
+	}
+	if assert.NotNil(refresh, "cachePopulate() span") && assert.Len(spans, 3, "cachePopulate() spans") {
+		assert.Equal(0, refresh.ParentID, "cachePopulate() root span")
+		assert.NotEmpty(refresh.Tag("request.id"), "cachePopulate() request ID")
+		for _, s := range spans {
+			if s == refresh {
+				continue
+			}
+			assert.Equal(refresh.SpanContext.SpanID, s.ParentID, "cachePopulate() child of refresh: "+s.OperationName)
+			assert.Equal(refresh.Tag("request.id"), s.Tag("request.id"), "cachePopulate() shared request ID: "+s.OperationName)
+		}
+		mtx.Lock()
+		assert.Equal(fmt.Sprint(refresh.SpanContext.TraceID), headers["/hosts"].Get("Mockpfx-Ids-Traceid"), "cachePopulate() trace injected")
+		mtx.Unlock()
+	}
+}
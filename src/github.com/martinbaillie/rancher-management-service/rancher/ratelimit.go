@@ -0,0 +1,266 @@
+// Copyright 2017 Martin Baillie <martin.t.baillie@gmail.com>.
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file or at:
+// https://opensource.org/licenses/BSD-3-Clause
+
+package rancher
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/metrics"
+)
+
+// Rate limit budgets
+const (
+	RateLimitRead     = "read"
+	RateLimitMutating = "mutating"
+)
+
+// rateLimitSweepInterval is how often idle clients are forgotten.
+const rateLimitSweepInterval = time.Minute
+
+// RateLimitError is returned when a client has exhausted its budget.
+type RateLimitError struct {
+	// how long the client should wait before trying again
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return "too many requests"
+}
+
+// retryAfter is the Retry-After header value for the error, in whole seconds.
+func (e *RateLimitError) retryAfter() string {
+	s := int(math.Ceil(e.RetryAfter.Seconds()))
+	if s < 1 {
+		s = 1
+	}
+	return strconv.Itoa(s)
+}
+
+// RateLimit describes the budget each client is allowed.
+type RateLimit struct {
+	// the requests per second each client may make, refilling its bucket
+	// (0 does not limit the rate)
+	Rate float64
+	// the requests each client may make at once before being limited to the
+	// rate (0 defaults to a second's worth of the rate)
+	Burst int
+	// the requests each client may have in flight (0 does not limit them)
+	MaxConcurrent int
+}
+
+func (l RateLimit) burst() float64 {
+	if l.Burst > 0 {
+		return float64(l.Burst)
+	}
+	return math.Max(1, math.Ceil(l.Rate))
+}
+
+// RateLimiter applies a RateLimit to each client, identified from the
+// request context, with a token bucket and in-flight count per client.
+type RateLimiter struct {
+	budget   string
+	limit    RateLimit
+	requests metrics.Counter
+	now      func() time.Time
+
+	mtx     sync.Mutex
+	clients map[string]*rateBucket
+	swept   time.Time
+}
+
+type rateBucket struct {
+	tokens   float64
+	refilled time.Time
+	inFlight int
+}
+
+// NewRateLimiter returns a limiter applying the limit to each client,
+// counting the requests by budget, client and result (allowed or limited).
+// A zero limit allows every request.
+func NewRateLimiter(budget string, limit RateLimit, requests metrics.Counter) *RateLimiter {
+	return &RateLimiter{
+		budget:   budget,
+		limit:    limit,
+		requests: requests,
+		now:      time.Now,
+		clients:  make(map[string]*rateBucket),
+	}
+}
+
+// SetLimit applies the limit to each client from its next request. Clients
+// keep their buckets, which refill at the new rate up to the new burst.
+func (l *RateLimiter) SetLimit(limit RateLimit) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	now := l.now()
+	for _, b := range l.clients {
+		l.refill(b, now)
+	}
+	l.limit = limit
+	for _, b := range l.clients {
+		b.tokens = math.Min(b.tokens, limit.burst())
+	}
+}
+
+// acquire takes a request from the client's budget, returning a func to
+// release it once complete. It is safe to call on a nil limiter.
+func (l *RateLimiter) acquire(client string) (func(), error) {
+	if l == nil || client == "" {
+		return func() {}, nil
+	}
+
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	if l.limit.Rate <= 0 && l.limit.MaxConcurrent <= 0 {
+		return func() {}, nil
+	}
+
+	now := l.now()
+	l.sweep(now)
+
+	b, ok := l.clients[client]
+	if !ok {
+		b = &rateBucket{tokens: l.limit.burst(), refilled: now}
+		l.clients[client] = b
+	}
+	l.refill(b, now)
+
+	var err *RateLimitError
+	switch {
+	case l.limit.MaxConcurrent > 0 && b.inFlight >= l.limit.MaxConcurrent:
+		err = &RateLimitError{RetryAfter: time.Second}
+	case l.limit.Rate > 0 && b.tokens < 1:
+		err = &RateLimitError{RetryAfter: time.Duration((1 - b.tokens) / l.limit.Rate * float64(time.Second))}
+	}
+	if err != nil {
+		l.requests.With("budget", l.budget, "client", client, "result", "limited").Add(1)
+		return nil, err
+	}
+	l.requests.With("budget", l.budget, "client", client, "result", "allowed").Add(1)
+
+	if l.limit.Rate > 0 {
+		b.tokens--
+	}
+	b.inFlight++
+	return func() {
+		l.mtx.Lock()
+		b.inFlight--
+		l.mtx.Unlock()
+	}, nil
+}
+
+func (l *RateLimiter) refill(b *rateBucket, now time.Time) {
+	if l.limit.Rate <= 0 {
+		return
+	}
+	b.tokens = math.Min(l.limit.burst(), b.tokens+now.Sub(b.refilled).Seconds()*l.limit.Rate)
+	b.refilled = now
+}
+
+// sweep forgets the clients with nothing in flight and a full bucket, as
+// they are indistinguishable from new clients. It must be called locked.
+func (l *RateLimiter) sweep(now time.Time) {
+	if now.Sub(l.swept) < rateLimitSweepInterval {
+		return
+	}
+	l.swept = now
+	for client, b := range l.clients {
+		l.refill(b, now)
+		if b.inFlight == 0 && (l.limit.Rate <= 0 || b.tokens >= l.limit.burst()) {
+			delete(l.clients, client)
+		}
+	}
+}
+
+// RateLimited returns an endpoint middleware limiting each client, as
+// identified in the context by PopulateClientIdentity, with the limiter.
+// Requests without a client identity, e.g. from the gRPC, Thrift and AMQP
+// transports, are not limited.
+func RateLimited(l *RateLimiter) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			release, err := l.acquire(clientIdentityFromContext(ctx))
+			if err != nil {
+				return nil, err
+			}
+			defer release()
+			return next(ctx, request)
+		}
+	}
+}
+
+type clientIdentityKey struct{}
+
+// ClientIdentity identifies the client making the request, by the common
+// name of its verified TLS certificate or else its IP address. Clients
+// carrying an allowed bearer token are identified by it instead, see
+// IdentifiedByToken.
+//
+// NOTE: The remote address is expected to have already been rewritten from
+// the X-Forwarded-For or X-Real-IP headers by handlers.ProxyHeaders
+func ClientIdentity(r *http.Request) string {
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 && len(r.TLS.VerifiedChains[0]) > 0 {
+		if cn := r.TLS.VerifiedChains[0][0].Subject.CommonName; cn != "" {
+			return "cn:" + cn
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		// ProxyHeaders leaves the forwarded address without a port
+		host = r.RemoteAddr
+	}
+	if host == "" {
+		return ""
+	}
+	return "ip:" + host
+}
+
+// tokenIdentity identifies the client by a fingerprint of its verified
+// bearer token, so as never to expose the token in metrics.
+func tokenIdentity(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return "token:" + hex.EncodeToString(sum[:])[:12]
+}
+
+// IdentifiedByToken returns an endpoint middleware identifying the client to
+// the RateLimited middleware it decorates by its bearer token, as noted in
+// the context by PopulateBearerToken, so that clients sharing an address,
+// e.g. behind a proxy, have budgets of their own. Only tokens the authorizer
+// allows identify a client, lest it escape its limit by changing its token.
+func IdentifiedByToken(a *ActionAuthorizer) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			if token := bearerTokenFromContext(ctx); token != "" && a.allows(token) {
+				ctx = context.WithValue(ctx, clientIdentityKey{}, tokenIdentity(token))
+			}
+			return next(ctx, request)
+		}
+	}
+}
+
+// PopulateClientIdentity is a RequestFunc noting the ClientIdentity of the
+// request in the context, for the RateLimited middleware.
+func PopulateClientIdentity(ctx context.Context, r *http.Request) context.Context {
+	return context.WithValue(ctx, clientIdentityKey{}, ClientIdentity(r))
+}
+
+func clientIdentityFromContext(ctx context.Context) string {
+	client, _ := ctx.Value(clientIdentityKey{}).(string)
+	return client
+}
@@ -0,0 +1,158 @@
+// Copyright 2017 Martin Baillie <martin.t.baillie@gmail.com>.
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file or at:
+// https://opensource.org/licenses/BSD-3-Clause
+
+package rancher
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+
+	"github.com/go-kit/kit/log"
+	stdopentracing "github.com/opentracing/opentracing-go"
+	"google.golang.org/grpc/metadata"
+)
+
+// RequestIDHeader carries the ID correlating a request across logs, traces
+// and responses, both in and out of the service.
+const RequestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength bounds the request IDs accepted from callers.
+const maxRequestIDLength = 128
+
+type requestIDKey struct{}
+
+// NewRequestID returns a random request ID.
+func NewRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// ContextWithRequestID returns a copy of the context carrying the request ID.
+func ContextWithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestIDFromContext returns the request ID the context carries, if any.
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// validRequestID reports whether a caller's request ID may be propagated,
+// being short and printable so as to be safe in logs and headers.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, r := range id {
+		if r < '!' || r > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// NewRequestIDHandler returns a middleware propagating the caller's
+// X-Request-ID, or generating one, into the request context and echoing it
+// in the response.
+func NewRequestIDHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if !validRequestID(id) {
+			id = NewRequestID()
+		}
+		r.Header.Set(RequestIDHeader, id)
+		w.Header().Set(RequestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(ContextWithRequestID(r.Context(), id)))
+	})
+}
+
+// PopulateRequestID is a RequestFunc carrying the request ID over from the
+// request context, as set by NewRequestIDHandler, into the endpoint context
+// and tagging the request's span with it.
+//
+// NOTE: It must follow opentracing.FromHTTPRequest, for the span.
+func PopulateRequestID(ctx context.Context, r *http.Request) context.Context {
+	id := RequestIDFromContext(r.Context())
+	if id == "" {
+		id = r.Header.Get(RequestIDHeader)
+	}
+	if !validRequestID(id) {
+		id = NewRequestID()
+	}
+	if span := stdopentracing.SpanFromContext(ctx); span != nil {
+		span.SetTag("request.id", id)
+	}
+	return ContextWithRequestID(ctx, id)
+}
+
+// PopulateGRPCRequestID is the gRPC transport's PopulateRequestID, taking
+// the caller's request ID from the x-request-id metadata.
+func PopulateGRPCRequestID(ctx context.Context, md metadata.MD) context.Context {
+	var id string
+	if v := md[strings.ToLower(RequestIDHeader)]; len(v) > 0 {
+		id = v[0]
+	}
+	if !validRequestID(id) {
+		id = NewRequestID()
+	}
+	if span := stdopentracing.SpanFromContext(ctx); span != nil {
+		span.SetTag("request.id", id)
+	}
+	return ContextWithRequestID(ctx, id)
+}
+
+// ForwardRequestID is a RequestFunc forwarding the context's request ID on
+// outbound requests, generating one for requests made outside of any, e.g.
+// cache refreshes, and tagging the outbound span with it.
+func ForwardRequestID(ctx context.Context, r *http.Request) context.Context {
+	id := RequestIDFromContext(ctx)
+	if id == "" {
+		id = NewRequestID()
+		ctx = ContextWithRequestID(ctx, id)
+	}
+	if span := stdopentracing.SpanFromContext(ctx); span != nil {
+		span.SetTag("request.id", id)
+	}
+	r.Header.Set(RequestIDHeader, id)
+	return ctx
+}
+
+// withCorrelation returns the logger with the context's request ID and the
+// trace and span IDs of its span, so that log lines may be tied to both.
+func withCorrelation(logger log.Logger, ctx context.Context) log.Logger {
+	var kvs []interface{}
+	if id := RequestIDFromContext(ctx); id != "" {
+		kvs = append(kvs, "request_id", id)
+	}
+	if span := stdopentracing.SpanFromContext(ctx); span != nil {
+		// NOTE: OpenTracing keeps the IDs opaque, so they are read back from
+		// the B3 headers the span would be propagated with
+		carrier := stdopentracing.TextMapCarrier{}
+		span.Tracer().Inject(span.Context(), stdopentracing.TextMap, carrier)
+		var traceID, spanID string
+		for k, v := range carrier {
+			switch strings.ToLower(k) {
+			case "x-b3-traceid":
+				traceID = v
+			case "x-b3-spanid":
+				spanID = v
+			}
+		}
+		if traceID != "" {
+			kvs = append(kvs, "trace_id", traceID, "span_id", spanID)
+		}
+	}
+	if len(kvs) == 0 {
+		return logger
+	}
+	return log.NewContext(logger).With(kvs...)
+}
@@ -0,0 +1,487 @@
+// Copyright 2017 Martin Baillie <martin.t.baillie@gmail.com>.
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file or at:
+// https://opensource.org/licenses/BSD-3-Clause
+
+package rancher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+
+	"github.com/afex/hystrix-go/hystrix"
+	"github.com/sony/gobreaker"
+
+	"github.com/go-kit/kit/circuitbreaker"
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/sd"
+	"github.com/go-kit/kit/sd/lb"
+)
+
+// ErrBulkheadFull is returned by a client endpoint that already has as many
+// calls in flight as its policy allows.
+var ErrBulkheadFull = errors.New("too many concurrent calls to client endpoint")
+
+// Circuit breakers guarding client endpoints
+const (
+	BreakerHystrix   = "hystrix"
+	BreakerGobreaker = "gobreaker"
+)
+
+// Circuit states
+const (
+	CircuitClosed   = "closed"
+	CircuitHalfOpen = "half-open"
+	CircuitOpen     = "open"
+)
+
+// DefaultPolicyEndpoint names the policy of the client endpoints without one
+// of their own.
+const DefaultPolicyEndpoint = "default"
+
+// DefaultPolicy guards client endpoints with Hystrix's defaults alone, as
+// they were before policies could be given.
+var DefaultPolicy = Policy{
+	Breaker:    BreakerHystrix,
+	Backoff:    100 * time.Millisecond,
+	MaxBackoff: 5 * time.Second,
+}
+
+// Policy describes how calls through a client endpoint are made resilient.
+type Policy struct {
+	// the duration after which each attempt at a call is abandoned, or zero
+	// for none (Hystrix's own timeout still applies)
+	Timeout time.Duration
+	// the number of times a failed call is retried
+	//
+	// NOTE: Calls acting upon containers and services are never retried
+	Retries int
+	// the delay before the first retry, doubling for each retry thereafter up
+	// to MaxBackoff. Each delay is jittered by up to half.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// the circuit breaker, one of hystrix or gobreaker
+	Breaker string
+	// the number of calls that may be in flight at once, or zero for no limit
+	// beyond the circuit breaker's own
+	MaxConcurrent int
+}
+
+// backoff returns the jittered delay before the nth retry.
+func (p Policy) backoff(n int) time.Duration {
+	d := p.Backoff << uint(n-1)
+	if d > p.MaxBackoff || d < p.Backoff {
+		d = p.MaxBackoff
+	}
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// retryBudget returns the duration after which retrying a call gives up.
+func (p Policy) retryBudget() time.Duration {
+	return time.Duration(p.Retries+1)*p.Timeout + time.Duration(p.Retries)*p.MaxBackoff
+}
+
+// Policies are the Policy of each client endpoint, by command name, with the
+// default policy applying to those without their own.
+type Policies map[string]Policy
+
+// policy returns the Policy of the client endpoint.
+func (ps Policies) policy(command string) Policy {
+	if p, ok := ps[command]; ok {
+		return p
+	}
+	if p, ok := ps[DefaultPolicyEndpoint]; ok {
+		return p
+	}
+	return DefaultPolicy
+}
+
+// clientCommands are the client endpoints that may be given a policy.
+var clientCommands = map[string]bool{
+	metadataContainersCommand: true,
+	metadataHostsCommand:      true,
+	apiContainersCommand:      true,
+	apiContainerCommand:       true,
+	apiContainerActionCommand: true,
+	apiStacksCommand:          true,
+	apiServicesCommand:        true,
+	apiServiceCommand:         true,
+	apiServiceUpdateCommand:   true,
+	apiServiceActionCommand:   true,
+}
+
+// mutatingCommands are the client endpoints whose calls are never retried.
+var mutatingCommands = map[string]bool{
+	apiContainerActionCommand: true,
+	apiServiceUpdateCommand:   true,
+	apiServiceActionCommand:   true,
+}
+
+// ParsePolicies parses a semicolon separated list of client endpoint
+// policies, each a comma separated list of key=value settings, e.g.:
+//
+//	endpoint=default,timeout=5s,retries=2,backoff=100ms,max_backoff=2s;endpoint=rancher-api-service-update-endpoint,timeout=30s,breaker=gobreaker,max_concurrent=4
+//
+// The endpoint is required, either the command name of a client endpoint or
+// default. Settings that are not given are taken from the default policy, if
+// given, otherwise from the provided defaults. Retries require a timeout.
+func ParsePolicies(spec string, defaults Policy) (Policies, error) {
+	var specs [][]string
+	for _, policySpec := range strings.Split(spec, ";") {
+		if strings.TrimSpace(policySpec) == "" {
+			continue
+		}
+		specs = append(specs, strings.Split(policySpec, ","))
+	}
+
+	// The default policy is parsed first, so that the others may build on it
+	endpointOf := func(settings []string) string {
+		for _, setting := range settings {
+			if kv := strings.SplitN(setting, "=", 2); len(kv) == 2 && strings.TrimSpace(kv[0]) == "endpoint" {
+				return strings.TrimSpace(kv[1])
+			}
+		}
+		return ""
+	}
+	sort.SliceStable(specs, func(i, j int) bool {
+		return endpointOf(specs[i]) == DefaultPolicyEndpoint && endpointOf(specs[j]) != DefaultPolicyEndpoint
+	})
+
+	ps := make(Policies)
+	for _, settings := range specs {
+		policySpec := strings.Join(settings, ",")
+		p, endpoint := defaults, ""
+		if dp, ok := ps[DefaultPolicyEndpoint]; ok {
+			p = dp
+		}
+		for _, setting := range settings {
+			kv := strings.SplitN(setting, "=", 2)
+			if len(kv) != 2 {
+				return nil, fmt.Errorf("policy setting %q is not of the form key=value", setting)
+			}
+
+			var err error
+			switch k, v := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1]); k {
+			case "endpoint":
+				endpoint = v
+			case "timeout":
+				p.Timeout, err = time.ParseDuration(v)
+			case "retries":
+				p.Retries, err = strconv.Atoi(v)
+			case "backoff":
+				p.Backoff, err = time.ParseDuration(v)
+			case "max_backoff":
+				p.MaxBackoff, err = time.ParseDuration(v)
+			case "breaker":
+				p.Breaker = v
+			case "max_concurrent":
+				p.MaxConcurrent, err = strconv.Atoi(v)
+			default:
+				err = fmt.Errorf("unknown setting %q", k)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("policy %q: %v", policySpec, err)
+			}
+		}
+
+		var err error
+		switch {
+		case endpoint == "":
+			err = fmt.Errorf("endpoint is required")
+		case endpoint != DefaultPolicyEndpoint && !clientCommands[endpoint]:
+			err = fmt.Errorf("unknown endpoint %q", endpoint)
+		case duplicate(ps, endpoint):
+			err = fmt.Errorf("duplicate endpoint %q", endpoint)
+		case p.Breaker != BreakerHystrix && p.Breaker != BreakerGobreaker:
+			err = fmt.Errorf("unknown breaker %q, expected hystrix or gobreaker", p.Breaker)
+		case p.Timeout < 0, p.Backoff < 0, p.Retries < 0, p.MaxConcurrent < 0:
+			err = fmt.Errorf("settings must not be negative")
+		case p.MaxBackoff < p.Backoff:
+			err = fmt.Errorf("max_backoff %s is less than backoff %s", p.MaxBackoff, p.Backoff)
+		case p.Retries > 0 && p.Timeout == 0:
+			err = fmt.Errorf("retries require a timeout")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("policy %q: %v", policySpec, err)
+		}
+		ps[endpoint] = p
+	}
+	return ps, nil
+}
+
+// RequireRestart returns the client endpoints, sorted, whose next policy
+// cannot apply while running: those changing their circuit breaker, and
+// those guarded by Hystrix changing their concurrency, as Hystrix sizes its
+// pool of concurrent calls only once.
+func (ps Policies) RequireRestart(next Policies) []string {
+	var commands []string
+	for command := range clientCommands {
+		p, np := ps.policy(command), next.policy(command)
+		if p.Breaker != np.Breaker || (p.Breaker == BreakerHystrix && p.MaxConcurrent != np.MaxConcurrent) {
+			commands = append(commands, command)
+		}
+	}
+	sort.Strings(commands)
+	return commands
+}
+
+// duplicate reports whether the endpoint already has a policy.
+func duplicate(ps Policies, endpoint string) bool {
+	_, ok := ps[endpoint]
+	return ok
+}
+
+// Circuit is the circuit breaker guarding a client endpoint, along with the
+// rest of the Policy it is guarded by.
+type Circuit struct {
+	// the environment of the client endpoint
+	Environment string
+	// the command name of the client endpoint
+	Endpoint string
+
+	command  string
+	breaker  *gobreaker.CircuitBreaker
+	inFlight int32
+
+	mtx    sync.RWMutex
+	policy Policy
+}
+
+// Policy returns the policy guarding the client endpoint.
+func (c *Circuit) Policy() Policy {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	return c.policy
+}
+
+// setPolicy guards the client endpoint with the policy from its next call,
+// keeping the circuit breaker it was built with. Hystrix reads its timeout
+// per call, but sizes its pool of concurrent calls only once.
+func (c *Circuit) setPolicy(p Policy) {
+	c.mtx.Lock()
+	p.Breaker = c.policy.Breaker
+	c.policy = p
+	c.mtx.Unlock()
+
+	if c.breaker == nil {
+		configureHystrix(c.command, p)
+	}
+}
+
+// State returns the state of the circuit, one of closed, half-open or open.
+//
+// NOTE: Hystrix circuits are never reported half-open, as Hystrix lets single
+// test calls through an open circuit instead.
+func (c *Circuit) State() string {
+	if c.breaker != nil {
+		switch c.breaker.State() {
+		case gobreaker.StateHalfOpen:
+			return CircuitHalfOpen
+		case gobreaker.StateOpen:
+			return CircuitOpen
+		}
+		return CircuitClosed
+	}
+	if cb, _, err := hystrix.GetCircuit(c.command); err == nil && cb.IsOpen() {
+		return CircuitOpen
+	}
+	return CircuitClosed
+}
+
+// InFlight returns the number of calls in flight through the bulkhead.
+func (c *Circuit) InFlight() int {
+	return int(atomic.LoadInt32(&c.inFlight))
+}
+
+// Circuits holds the Circuit of every client endpoint of an environment, see
+// NewClientEndpoints.
+type Circuits []*Circuit
+
+// SetPolicies guards every client endpoint with its policy, see Policies,
+// from its next call. The circuit breaker of each endpoint is kept.
+func (cs Circuits) SetPolicies(ps Policies) {
+	for _, c := range cs {
+		c.setPolicy(ps.policy(c.Endpoint))
+	}
+}
+
+// state returns the state of the named circuit, falling back on Hystrix for
+// circuits that are not guarding one of the client endpoints.
+func (cs Circuits) state(command string) (string, error) {
+	for _, c := range cs {
+		if c.command == command {
+			return c.State(), nil
+		}
+	}
+
+	cb, _, err := hystrix.GetCircuit(command)
+	if err != nil {
+		return "", err
+	}
+	if cb.IsOpen() {
+		return CircuitOpen, nil
+	}
+	return CircuitClosed, nil
+}
+
+// newCircuit returns the Circuit guarding the environment's client endpoint
+// with the policy, see resilient.
+func newCircuit(env Environment, command string, p Policy) *Circuit {
+	c := &Circuit{
+		Environment: env.Name,
+		Endpoint:    command,
+		policy:      p,
+		command:     env.command(command),
+	}
+	switch p.Breaker {
+	case BreakerGobreaker:
+		c.breaker = gobreaker.NewCircuitBreaker(gobreaker.Settings{Name: c.command})
+	default:
+		configureHystrix(c.command, p)
+	}
+	return c
+}
+
+// resilient returns a middleware guarding a client endpoint with the
+// circuit's policy, or whichever policy SetPolicies later gives it. Each
+// attempt at a call is timed out, passes through the circuit breaker and
+// takes a place in the bulkhead. Failed calls are retried with backoff,
+// unless the circuit is open or the bulkhead full.
+func resilient(c *Circuit) endpoint.Middleware {
+	breaker := hystrixBreaker(c.command)
+	if c.breaker != nil {
+		breaker = circuitbreaker.Gobreaker(c.breaker)
+	}
+
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		e := bulkhead(c)(breaker(timeout(c)(next)))
+		if mutatingCommands[c.Endpoint] {
+			return e
+		}
+
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			p := c.Policy()
+			if p.Retries == 0 {
+				return e(ctx, request)
+			}
+
+			retry := lb.RetryWithCallback(p.retryBudget(), lb.NewRoundRobin(sd.FixedSubscriber{withBackoff(p, e)}),
+				func(n int, err error) (bool, error) {
+					if n > p.Retries || err == ErrBulkheadFull || err == hystrix.ErrMaxConcurrency || c.State() == CircuitOpen {
+						return false, nil
+					}
+					return true, nil
+				})
+			response, err := retry(ctx, request)
+			// Callers see the final error alone, as they would without retries
+			if re, ok := err.(lb.RetryError); ok {
+				err = re.Final
+			}
+			return response, err
+		}
+	}
+}
+
+// withBackoff returns an endpoint making attempts at a single call, waiting out
+// the policy's backoff before each retry. The wait is abandoned should the
+// context be done first, e.g. by the caller or the retry budget.
+//
+// NOTE: The retry mechanism makes its attempts one after another, so they
+// may share the count without a lock
+func withBackoff(p Policy, next endpoint.Endpoint) endpoint.Endpoint {
+	var attempts int
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		if attempts > 0 {
+			t := time.NewTimer(p.backoff(attempts))
+			select {
+			case <-t.C:
+			case <-ctx.Done():
+				t.Stop()
+				return nil, ctx.Err()
+			}
+		}
+		attempts++
+		return next(ctx, request)
+	}
+}
+
+// configureHystrix configures the Hystrix command with the policy's timeout
+// and concurrency, leaving Hystrix's defaults for those not given.
+func configureHystrix(command string, p Policy) {
+	hystrix.ConfigureCommand(command, hystrix.CommandConfig{
+		Timeout:               int(p.Timeout / time.Millisecond),
+		MaxConcurrentRequests: p.MaxConcurrent,
+	})
+}
+
+// timeout returns a middleware abandoning calls after the circuit's policy's
+// timeout, if any.
+func timeout(c *Circuit) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			if d := c.Policy().Timeout; d > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, d)
+				defer cancel()
+			}
+			return next(ctx, request)
+		}
+	}
+}
+
+// bulkhead returns a middleware counting the circuit's calls in flight, and
+// failing calls fast with ErrBulkheadFull once there are as many as its
+// policy allows.
+func bulkhead(c *Circuit) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			n := atomic.AddInt32(&c.inFlight, 1)
+			defer atomic.AddInt32(&c.inFlight, -1)
+			if max := c.Policy().MaxConcurrent; max > 0 && int(n) > max {
+				return nil, ErrBulkheadFull
+			}
+			return next(ctx, request)
+		}
+	}
+}
+
+// MakeCircuitsDebugHandler returns a handler listing the given Circuits,
+// along with their policies, as a plain text table sorted by environment and
+// endpoint.
+func MakeCircuitsDebugHandler(cs Circuits) http.Handler {
+	cs = append(Circuits(nil), cs...)
+	sort.Slice(cs, func(i, j int) bool {
+		if cs[i].Environment != cs[j].Environment {
+			return cs[i].Environment < cs[j].Environment
+		}
+		return cs[i].Endpoint < cs[j].Endpoint
+	})
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "ENVIRONMENT\tENDPOINT\tBREAKER\tSTATE\tIN FLIGHT\tMAX CONCURRENT\tTIMEOUT\tRETRIES\tBACKOFF")
+		for _, c := range cs {
+			p := c.Policy()
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%d\t%s\t%d\t%s-%s\n",
+				c.Environment, c.Endpoint, p.Breaker, c.State(), c.InFlight(), p.MaxConcurrent,
+				p.Timeout, p.Retries, p.Backoff, p.MaxBackoff)
+		}
+		tw.Flush()
+	})
+}
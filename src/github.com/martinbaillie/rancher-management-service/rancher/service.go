@@ -7,7 +7,10 @@
 
 package rancher
 
-import "context"
+import (
+	"context"
+	"net/url"
+)
 
 // The Rancher package's servicing functionality is split into Server services
 // and Client services, where:
@@ -21,6 +24,8 @@ import "context"
 type ServerService interface {
 	Container(ctx context.Context, name string) (*Container, error)
 	Containers(ctx context.Context) ([]*Container, error)
+	CacheStatus(ctx context.Context) CacheStatus
+	WatchContainers(ctx context.Context) <-chan ContainerEvent
 }
 
 type serverService struct {
@@ -54,11 +59,32 @@ func (s serverService) Containers(_ context.Context) ([]*Container, error) {
 	return cs, nil
 }
 
+// CacheStatus implements ServerService.
+// It calls into the configured Repository implementation of CacheStatus.
+func (s serverService) CacheStatus(_ context.Context) CacheStatus {
+	return s.repository.CacheStatus()
+}
+
+// WatchContainers implements ServerService.
+// It calls into the configured Repository implementation of WatchContainers.
+func (s serverService) WatchContainers(ctx context.Context) <-chan ContainerEvent {
+	return s.repository.WatchContainers(ctx)
+}
+
 // ClientService encapsulates services used internally by the Rancher package
 // to integrate to external 3rd party services e.g. the Rancher metadata service.
 type ClientService interface {
-	MetadataContainers() ([]*Container, error)
-	MetadataHosts() ([]*Host, error)
+	MetadataContainers(ctx context.Context) ([]*Container, error)
+	MetadataHosts(ctx context.Context) ([]*Host, error)
+
+	APIContainer(ctx context.Context, c *Container) (*APIContainer, error)
+	APIContainerByID(ctx context.Context, id string) (*APIContainer, error)
+	APIContainerAction(ctx context.Context, id, action string) (*APIContainer, error)
+
+	APIService(ctx context.Context, stack, service string) (*APIService, error)
+	APIServiceByID(ctx context.Context, id string) (*APIService, error)
+	APIServiceScale(ctx context.Context, id string, scale int) (*APIService, error)
+	APIServiceAction(ctx context.Context, id, action string, input interface{}) (*APIService, error)
 }
 
 type clientService struct {
@@ -77,8 +103,8 @@ func NewClientService(ctx context.Context, ces ClientEndpoints) ClientService {
 // MetadataContainers implements ClientService.
 // It calls the configured MetadataContainersEndpoint, i.e.:
 // <metadata scheme>://<metadata URL>/<metadata version>/containers
-func (cs clientService) MetadataContainers() ([]*Container, error) {
-	res, err := cs.MetadataContainersEndpoint(cs.Context, metadataGenericRequest{Subpath: "/containers"})
+func (cs clientService) MetadataContainers(ctx context.Context) ([]*Container, error) {
+	res, err := cs.MetadataContainersEndpoint(ctx, metadataGenericRequest{Subpath: "/containers"})
 	if err != nil {
 		return nil, err
 	}
@@ -88,10 +114,152 @@ func (cs clientService) MetadataContainers() ([]*Container, error) {
 // MetadataHosts implements ClientService.
 // It calls the configured MetadataHostsEndpoint, i.e.:
 // <metadata scheme>://<metadata URL>/<metadata version>/hosts
-func (cs clientService) MetadataHosts() ([]*Host, error) {
-	res, err := cs.MetadataHostsEndpoint(cs.Context, metadataGenericRequest{Subpath: "/hosts"})
+func (cs clientService) MetadataHosts(ctx context.Context) ([]*Host, error) {
+	res, err := cs.MetadataHostsEndpoint(ctx, metadataGenericRequest{Subpath: "/hosts"})
 	if err != nil {
 		return nil, err
 	}
 	return res.(metadataHostsResponse).Hosts, nil
 }
+
+// APIContainer implements ClientService.
+// It resolves the container's Rancher API resource by its uuid, falling back
+// to its Docker ID, using the configured APIContainersEndpoint, i.e.:
+// <API URL>/containers?uuid=<uuid>
+func (cs clientService) APIContainer(ctx context.Context, c *Container) (*APIContainer, error) {
+	if cs.APIContainersEndpoint == nil {
+		return nil, ErrAPINotConfigured
+	}
+	for _, filter := range []url.Values{
+		{"uuid": {c.UUID}},
+		{"externalId": {c.ExternalID}},
+	} {
+		for k, v := range filter {
+			if v[0] == "" {
+				delete(filter, k)
+			}
+		}
+		if len(filter) == 0 {
+			continue
+		}
+		res, err := cs.APIContainersEndpoint(ctx, apiListRequest{Filter: filter})
+		if err != nil {
+			return nil, err
+		}
+		if res := res.(apiContainersResponse); res.Err != nil {
+			return nil, res.Err
+		} else if len(res.Containers) > 0 {
+			return res.Containers[0], nil
+		}
+	}
+	return nil, ErrAPIContainerNotFound
+}
+
+// APIContainerByID implements ClientService.
+// It calls the configured APIContainerEndpoint, i.e.:
+// <API URL>/containers/<id>
+func (cs clientService) APIContainerByID(ctx context.Context, id string) (*APIContainer, error) {
+	if cs.APIContainerEndpoint == nil {
+		return nil, ErrAPINotConfigured
+	}
+	res, err := cs.APIContainerEndpoint(ctx, apiGetRequest{ID: id})
+	if err != nil {
+		return nil, err
+	}
+	return res.(apiContainerResponse).Container, res.(apiContainerResponse).Err
+}
+
+// APIContainerAction implements ClientService.
+// It calls the configured APIContainerActionEndpoint, i.e.:
+// POST <API URL>/containers/<id>?action=<action>
+func (cs clientService) APIContainerAction(ctx context.Context, id, action string) (*APIContainer, error) {
+	if cs.APIContainerActionEndpoint == nil {
+		return nil, ErrAPINotConfigured
+	}
+	res, err := cs.APIContainerActionEndpoint(ctx, apiActionRequest{ID: id, Action: action})
+	if err != nil {
+		return nil, err
+	}
+	return res.(apiContainerResponse).Container, res.(apiContainerResponse).Err
+}
+
+// APIService implements ClientService.
+// It resolves the stack's Rancher API resource by name, and then the
+// service's, using the configured APIStacksEndpoint and APIServicesEndpoint,
+// i.e.:
+// <API URL>/stacks?name=<stack>
+// <API URL>/services?name=<service>&stackId=<stack ID>
+func (cs clientService) APIService(ctx context.Context, stack, service string) (*APIService, error) {
+	if cs.APIStacksEndpoint == nil || cs.APIServicesEndpoint == nil {
+		return nil, ErrAPINotConfigured
+	}
+	res, err := cs.APIStacksEndpoint(ctx, apiListRequest{Filter: url.Values{"name": {stack}}})
+	if err != nil {
+		return nil, err
+	}
+	stacks := res.(apiStacksResponse)
+	if stacks.Err != nil {
+		return nil, stacks.Err
+	}
+	if len(stacks.Stacks) == 0 {
+		return nil, ErrAPIServiceNotFound
+	}
+
+	res, err = cs.APIServicesEndpoint(ctx, apiListRequest{Filter: url.Values{
+		"name":    {service},
+		"stackId": {stacks.Stacks[0].ID},
+	}})
+	if err != nil {
+		return nil, err
+	}
+	services := res.(apiServicesResponse)
+	if services.Err != nil {
+		return nil, services.Err
+	}
+	if len(services.Services) == 0 {
+		return nil, ErrAPIServiceNotFound
+	}
+	return services.Services[0], nil
+}
+
+// APIServiceByID implements ClientService.
+// It calls the configured APIServiceEndpoint, i.e.:
+// <API URL>/services/<id>
+func (cs clientService) APIServiceByID(ctx context.Context, id string) (*APIService, error) {
+	if cs.APIServiceEndpoint == nil {
+		return nil, ErrAPINotConfigured
+	}
+	res, err := cs.APIServiceEndpoint(ctx, apiGetRequest{ID: id})
+	if err != nil {
+		return nil, err
+	}
+	return res.(apiServiceResponse).Service, res.(apiServiceResponse).Err
+}
+
+// APIServiceScale implements ClientService.
+// It calls the configured APIServiceUpdateEndpoint, i.e.:
+// PUT <API URL>/services/<id>
+func (cs clientService) APIServiceScale(ctx context.Context, id string, scale int) (*APIService, error) {
+	if cs.APIServiceUpdateEndpoint == nil {
+		return nil, ErrAPINotConfigured
+	}
+	res, err := cs.APIServiceUpdateEndpoint(ctx, apiUpdateRequest{ID: id, Input: apiServiceScale{Scale: scale}})
+	if err != nil {
+		return nil, err
+	}
+	return res.(apiServiceResponse).Service, res.(apiServiceResponse).Err
+}
+
+// APIServiceAction implements ClientService.
+// It calls the configured APIServiceActionEndpoint, i.e.:
+// POST <API URL>/services/<id>?action=<action>
+func (cs clientService) APIServiceAction(ctx context.Context, id, action string, input interface{}) (*APIService, error) {
+	if cs.APIServiceActionEndpoint == nil {
+		return nil, ErrAPINotConfigured
+	}
+	res, err := cs.APIServiceActionEndpoint(ctx, apiActionRequest{ID: id, Action: action, Input: input})
+	if err != nil {
+		return nil, err
+	}
+	return res.(apiServiceResponse).Service, res.(apiServiceResponse).Err
+}
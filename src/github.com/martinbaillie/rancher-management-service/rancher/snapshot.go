@@ -0,0 +1,217 @@
+// Copyright 2017 Martin Baillie <martin.t.baillie@gmail.com>.
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file or at:
+// https://opensource.org/licenses/BSD-3-Clause
+
+package rancher
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Snapshot errors
+var (
+	ErrSnapshotVersion  = errors.New("unsupported snapshot version")
+	ErrSnapshotChecksum = errors.New("snapshot checksum mismatch")
+)
+
+// SnapshotStore persists snapshots of a Repository's cache, allowing it to be
+// warmed from the last good snapshot across restarts.
+type SnapshotStore interface {
+	// Load returns the most recently saved snapshot, or nil if none exists.
+	Load() (*Snapshot, error)
+	// Save replaces the most recently saved snapshot.
+	Save(*Snapshot) error
+}
+
+// Snapshot is a point in time copy of a Repository's cache.
+type Snapshot struct {
+	Refreshed  time.Time
+	Containers []*Container
+	Hosts      []*Host
+}
+
+// The on-disk snapshot format.
+//
+// NOTE: bump snapshotVersion whenever snapshotPayload changes, including when
+// fields are added, as a snapshot without them would restore containers with
+// the fields empty rather than be refused and replaced from the metadata
+// service. Version 2 added each container's UUID, Docker ID, service, stack,
+// labels and ports.
+const (
+	snapshotVersion  = 2
+	snapshotFileName = "metadata-snapshot.json"
+)
+
+type snapshotFile struct {
+	Version  int             `json:"version"`
+	Checksum string          `json:"checksum"`
+	Payload  json.RawMessage `json:"payload"`
+}
+
+type snapshotPayload struct {
+	Refreshed  time.Time           `json:"refreshed"`
+	Containers []snapshotContainer `json:"containers"`
+	Hosts      []snapshotHost      `json:"hosts"`
+}
+
+// Snapshot records are kept separate from the Container and Host models as
+// the latter (un)marshal to and from Rancher's metadata and API formats.
+type snapshotContainer struct {
+	Name         string            `json:"name"`
+	UUID         string            `json:"uuid,omitempty"`
+	ExternalID   string            `json:"external_id,omitempty"`
+	State        string            `json:"state"`
+	PrivateIP    string            `json:"private_ip"`
+	ServiceIndex int64             `json:"service_index"`
+	ServiceName  string            `json:"service_name,omitempty"`
+	StackName    string            `json:"stack_name,omitempty"`
+	Labels       map[string]string `json:"labels,omitempty"`
+	Ports        []string          `json:"ports,omitempty"`
+	HostUUID     string            `json:"host_uuid"`
+}
+
+type snapshotHost struct {
+	UUID string `json:"uuid"`
+	Name string `json:"name"`
+}
+
+// NewFileSnapshotStore creates a new SnapshotStore persisting snapshots to a
+// versioned, checksummed file in the given directory.
+func NewFileSnapshotStore(dir string) SnapshotStore {
+	return &fileSnapshotStore{
+		path: filepath.Join(dir, snapshotFileName),
+	}
+}
+
+type fileSnapshotStore struct {
+	path string
+}
+
+// Load implements SnapshotStore.
+func (fss *fileSnapshotStore) Load() (*Snapshot, error) {
+	b, err := ioutil.ReadFile(fss.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var f snapshotFile
+	if err := json.Unmarshal(b, &f); err != nil {
+		return nil, err
+	}
+	if f.Version != snapshotVersion {
+		return nil, ErrSnapshotVersion
+	}
+	if sum := sha256.Sum256(f.Payload); hex.EncodeToString(sum[:]) != f.Checksum {
+		return nil, ErrSnapshotChecksum
+	}
+
+	var p snapshotPayload
+	if err := json.Unmarshal(f.Payload, &p); err != nil {
+		return nil, err
+	}
+
+	s := &Snapshot{
+		Refreshed:  p.Refreshed,
+		Containers: make([]*Container, len(p.Containers)),
+		Hosts:      make([]*Host, len(p.Hosts)),
+	}
+	for i, h := range p.Hosts {
+		s.Hosts[i] = &Host{UUID: h.UUID, Name: h.Name}
+	}
+	for i, c := range p.Containers {
+		s.Containers[i] = &Container{
+			Name:         c.Name,
+			UUID:         c.UUID,
+			ExternalID:   c.ExternalID,
+			State:        c.State,
+			PrivateIP:    c.PrivateIP,
+			ServiceIndex: c.ServiceIndex,
+			ServiceName:  c.ServiceName,
+			StackName:    c.StackName,
+			Labels:       c.Labels,
+			Ports:        c.Ports,
+			Host:         Host{UUID: c.HostUUID},
+		}
+	}
+	return s, nil
+}
+
+// Save implements SnapshotStore.
+// The snapshot is written to a temporary file which then atomically replaces
+// the previous snapshot.
+func (fss *fileSnapshotStore) Save(s *Snapshot) (err error) {
+	p := snapshotPayload{
+		Refreshed:  s.Refreshed,
+		Containers: make([]snapshotContainer, len(s.Containers)),
+		Hosts:      make([]snapshotHost, len(s.Hosts)),
+	}
+	for i, h := range s.Hosts {
+		p.Hosts[i] = snapshotHost{UUID: h.UUID, Name: h.Name}
+	}
+	for i, c := range s.Containers {
+		p.Containers[i] = snapshotContainer{
+			Name:         c.Name,
+			UUID:         c.UUID,
+			ExternalID:   c.ExternalID,
+			State:        c.State,
+			PrivateIP:    c.PrivateIP,
+			ServiceIndex: c.ServiceIndex,
+			ServiceName:  c.ServiceName,
+			StackName:    c.StackName,
+			Labels:       c.Labels,
+			Ports:        c.Ports,
+			HostUUID:     c.Host.UUID,
+		}
+	}
+
+	f := snapshotFile{Version: snapshotVersion}
+	if f.Payload, err = json.Marshal(p); err != nil {
+		return err
+	}
+	sum := sha256.Sum256(f.Payload)
+	f.Checksum = hex.EncodeToString(sum[:])
+
+	b, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(fss.path)
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(dir, "."+snapshotFileName)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	if _, err = tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), fss.path)
+}
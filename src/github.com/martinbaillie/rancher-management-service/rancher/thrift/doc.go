@@ -0,0 +1,15 @@
+// Copyright 2017 Martin Baillie <martin.t.baillie@gmail.com>.
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file or at:
+// https://opensource.org/licenses/BSD-3-Clause
+
+// Package thrift holds the Go bindings for the Rancher package's Thrift IDL
+// (rancher.thrift) used by the Thrift transport.
+//
+// NOTE: These bindings are maintained by hand against the vendored Apache
+// Thrift library rather than generated, so any change to rancher.thrift must
+// be mirrored in rancher.go. Field IDs, types and method names are what make
+// them wire compatible with bindings generated for other languages.
+package thrift
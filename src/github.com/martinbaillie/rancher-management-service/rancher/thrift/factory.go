@@ -0,0 +1,41 @@
+// Copyright 2017 Martin Baillie <martin.t.baillie@gmail.com>.
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file or at:
+// https://opensource.org/licenses/BSD-3-Clause
+
+package thrift
+
+import (
+	"fmt"
+
+	apache "github.com/apache/thrift/lib/go/thrift"
+)
+
+// NewProtocolFactory returns the named Thrift protocol factory, one of
+// "binary", "compact" or "json".
+func NewProtocolFactory(name string) (apache.TProtocolFactory, error) {
+	switch name {
+	case "binary":
+		return apache.NewTBinaryProtocolFactoryDefault(), nil
+	case "compact":
+		return apache.NewTCompactProtocolFactory(), nil
+	case "json":
+		return apache.NewTJSONProtocolFactory(), nil
+	}
+	return nil, fmt.Errorf("invalid thrift protocol %q", name)
+}
+
+// NewTransportFactory returns the named Thrift transport factory, one of
+// "buffered" or "framed".
+func NewTransportFactory(name string) (apache.TTransportFactory, error) {
+	switch name {
+	case "buffered":
+		return apache.NewTBufferedTransportFactory(8192), nil
+	case "framed":
+		return apache.NewTFramedTransportFactory(
+			apache.NewTBufferedTransportFactory(8192)), nil
+	}
+	return nil, fmt.Errorf("invalid thrift transport %q", name)
+}
@@ -0,0 +1,582 @@
+// Copyright 2017 Martin Baillie <martin.t.baillie@gmail.com>.
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file or at:
+// https://opensource.org/licenses/BSD-3-Clause
+
+package thrift
+
+import (
+	"fmt"
+
+	apache "github.com/apache/thrift/lib/go/thrift"
+)
+
+// Host is a Rancher host.
+type Host struct {
+	Uuid string
+	Name string
+}
+
+// Read implements apache.TStruct.
+func (p *Host) Read(iprot apache.TProtocol) error {
+	return readStruct(iprot, func(id int16, t apache.TType) (ok bool, err error) {
+		switch {
+		case id == 1 && t == apache.STRING:
+			p.Uuid, err = iprot.ReadString()
+		case id == 2 && t == apache.STRING:
+			p.Name, err = iprot.ReadString()
+		default:
+			return false, nil
+		}
+		return true, err
+	})
+}
+
+// Write implements apache.TStruct.
+func (p *Host) Write(oprot apache.TProtocol) error {
+	return writeStruct(oprot, "Host", func() error {
+		if err := writeString(oprot, "uuid", 1, p.Uuid); err != nil {
+			return err
+		}
+		return writeString(oprot, "name", 2, p.Name)
+	})
+}
+
+func (p *Host) String() string {
+	if p == nil {
+		return "<nil>"
+	}
+	return fmt.Sprintf("Host(%+v)", *p)
+}
+
+// Container is a Rancher container.
+type Container struct {
+	Name         string
+	State        string
+	PrivateIp    string
+	ServiceIndex int64
+	Host         *Host
+	Environment  string
+}
+
+// Read implements apache.TStruct.
+func (p *Container) Read(iprot apache.TProtocol) error {
+	return readStruct(iprot, func(id int16, t apache.TType) (ok bool, err error) {
+		switch {
+		case id == 1 && t == apache.STRING:
+			p.Name, err = iprot.ReadString()
+		case id == 2 && t == apache.STRING:
+			p.State, err = iprot.ReadString()
+		case id == 3 && t == apache.STRING:
+			p.PrivateIp, err = iprot.ReadString()
+		case id == 4 && t == apache.I64:
+			p.ServiceIndex, err = iprot.ReadI64()
+		case id == 5 && t == apache.STRUCT:
+			p.Host = &Host{}
+			err = p.Host.Read(iprot)
+		case id == 6 && t == apache.STRING:
+			p.Environment, err = iprot.ReadString()
+		default:
+			return false, nil
+		}
+		return true, err
+	})
+}
+
+// Write implements apache.TStruct.
+func (p *Container) Write(oprot apache.TProtocol) error {
+	return writeStruct(oprot, "Container", func() error {
+		if err := writeString(oprot, "name", 1, p.Name); err != nil {
+			return err
+		}
+		if err := writeString(oprot, "state", 2, p.State); err != nil {
+			return err
+		}
+		if err := writeString(oprot, "privateIp", 3, p.PrivateIp); err != nil {
+			return err
+		}
+		if err := writeField(oprot, "serviceIndex", apache.I64, 4, func() error {
+			return oprot.WriteI64(p.ServiceIndex)
+		}); err != nil {
+			return err
+		}
+		if p.Host != nil {
+			if err := writeField(oprot, "host", apache.STRUCT, 5, func() error {
+				return p.Host.Write(oprot)
+			}); err != nil {
+				return err
+			}
+		}
+		return writeString(oprot, "environment", 6, p.Environment)
+	})
+}
+
+func (p *Container) String() string {
+	if p == nil {
+		return "<nil>"
+	}
+	return fmt.Sprintf("Container(%+v)", *p)
+}
+
+// NotFound is thrown when the requested object was not found in the
+// repository.
+type NotFound struct {
+	Message string
+}
+
+// Read implements apache.TStruct.
+func (p *NotFound) Read(iprot apache.TProtocol) error {
+	return readException(iprot, &p.Message)
+}
+
+// Write implements apache.TStruct.
+func (p *NotFound) Write(oprot apache.TProtocol) error {
+	return writeException(oprot, "NotFound", p.Message)
+}
+
+func (p *NotFound) Error() string {
+	return p.Message
+}
+
+// FailedDependency is thrown when the requested object could not be retrieved
+// due to a failed dependency.
+type FailedDependency struct {
+	Message string
+}
+
+// Read implements apache.TStruct.
+func (p *FailedDependency) Read(iprot apache.TProtocol) error {
+	return readException(iprot, &p.Message)
+}
+
+// Write implements apache.TStruct.
+func (p *FailedDependency) Write(oprot apache.TProtocol) error {
+	return writeException(oprot, "FailedDependency", p.Message)
+}
+
+func (p *FailedDependency) Error() string {
+	return p.Message
+}
+
+// readStruct reads a struct from the protocol, handing each field to read.
+// Fields not recognised by read are skipped.
+func readStruct(iprot apache.TProtocol, read func(id int16, t apache.TType) (bool, error)) error {
+	if _, err := iprot.ReadStructBegin(); err != nil {
+		return err
+	}
+	for {
+		_, t, id, err := iprot.ReadFieldBegin()
+		if err != nil {
+			return err
+		}
+		if t == apache.STOP {
+			break
+		}
+		ok, err := read(id, t)
+		if err != nil {
+			return apache.PrependError(fmt.Sprintf("field %d read error: ", id), err)
+		}
+		if !ok {
+			if err := iprot.Skip(t); err != nil {
+				return err
+			}
+		}
+		if err := iprot.ReadFieldEnd(); err != nil {
+			return err
+		}
+	}
+	return iprot.ReadStructEnd()
+}
+
+// writeStruct writes a struct to the protocol, its fields written by write.
+func writeStruct(oprot apache.TProtocol, name string, write func() error) error {
+	if err := oprot.WriteStructBegin(name); err != nil {
+		return err
+	}
+	if err := write(); err != nil {
+		return apache.PrependError(name+" write error: ", err)
+	}
+	if err := oprot.WriteFieldStop(); err != nil {
+		return err
+	}
+	return oprot.WriteStructEnd()
+}
+
+// writeField writes a single field to the protocol, its value written by
+// write.
+func writeField(oprot apache.TProtocol, name string, t apache.TType, id int16, write func() error) error {
+	if err := oprot.WriteFieldBegin(name, t, id); err != nil {
+		return err
+	}
+	if err := write(); err != nil {
+		return err
+	}
+	return oprot.WriteFieldEnd()
+}
+
+func writeString(oprot apache.TProtocol, name string, id int16, v string) error {
+	return writeField(oprot, name, apache.STRING, id, func() error {
+		return oprot.WriteString(v)
+	})
+}
+
+// readException and writeException (un)marshal the exceptions, all of which
+// carry a single message field.
+func readException(iprot apache.TProtocol, message *string) error {
+	return readStruct(iprot, func(id int16, t apache.TType) (ok bool, err error) {
+		if id != 1 || t != apache.STRING {
+			return false, nil
+		}
+		*message, err = iprot.ReadString()
+		return true, err
+	})
+}
+
+func writeException(oprot apache.TProtocol, name, message string) error {
+	return writeStruct(oprot, name, func() error {
+		return writeString(oprot, "message", 1, message)
+	})
+}
+
+// RancherService is the Thrift service described in rancher.thrift.
+type RancherService interface {
+	// Containers returns all containers in the repository.
+	//
+	// Throws FailedDependency.
+	Containers() ([]*Container, error)
+	// Container returns the named container.
+	//
+	// Throws NotFound and FailedDependency.
+	Container(name string) (*Container, error)
+}
+
+// The Thrift method arguments and results. Results carry the return value in
+// field 0 and any declared exceptions from field 1 onwards.
+
+type containersArgs struct{}
+
+func (p *containersArgs) Read(iprot apache.TProtocol) error {
+	return readStruct(iprot, func(int16, apache.TType) (bool, error) {
+		return false, nil
+	})
+}
+
+func (p *containersArgs) Write(oprot apache.TProtocol) error {
+	return writeStruct(oprot, "containers_args", func() error { return nil })
+}
+
+type containersResult struct {
+	Success          []*Container
+	FailedDependency *FailedDependency
+}
+
+func (p *containersResult) Read(iprot apache.TProtocol) error {
+	return readStruct(iprot, func(id int16, t apache.TType) (bool, error) {
+		switch {
+		case id == 0 && t == apache.LIST:
+			_, size, err := iprot.ReadListBegin()
+			if err != nil {
+				return true, err
+			}
+			p.Success = make([]*Container, 0, size)
+			for i := 0; i < size; i++ {
+				c := &Container{}
+				if err := c.Read(iprot); err != nil {
+					return true, err
+				}
+				p.Success = append(p.Success, c)
+			}
+			return true, iprot.ReadListEnd()
+		case id == 1 && t == apache.STRUCT:
+			p.FailedDependency = &FailedDependency{}
+			return true, p.FailedDependency.Read(iprot)
+		}
+		return false, nil
+	})
+}
+
+func (p *containersResult) Write(oprot apache.TProtocol) error {
+	return writeStruct(oprot, "containers_result", func() error {
+		if p.FailedDependency != nil {
+			return writeField(oprot, "failedDependency", apache.STRUCT, 1, func() error {
+				return p.FailedDependency.Write(oprot)
+			})
+		}
+		return writeField(oprot, "success", apache.LIST, 0, func() error {
+			if err := oprot.WriteListBegin(apache.STRUCT, len(p.Success)); err != nil {
+				return err
+			}
+			for _, c := range p.Success {
+				if err := c.Write(oprot); err != nil {
+					return err
+				}
+			}
+			return oprot.WriteListEnd()
+		})
+	})
+}
+
+type containerArgs struct {
+	Name string
+}
+
+func (p *containerArgs) Read(iprot apache.TProtocol) error {
+	return readStruct(iprot, func(id int16, t apache.TType) (ok bool, err error) {
+		if id != 1 || t != apache.STRING {
+			return false, nil
+		}
+		p.Name, err = iprot.ReadString()
+		return true, err
+	})
+}
+
+func (p *containerArgs) Write(oprot apache.TProtocol) error {
+	return writeStruct(oprot, "container_args", func() error {
+		return writeString(oprot, "name", 1, p.Name)
+	})
+}
+
+type containerResult struct {
+	Success          *Container
+	NotFound         *NotFound
+	FailedDependency *FailedDependency
+}
+
+func (p *containerResult) Read(iprot apache.TProtocol) error {
+	return readStruct(iprot, func(id int16, t apache.TType) (bool, error) {
+		switch {
+		case id == 0 && t == apache.STRUCT:
+			p.Success = &Container{}
+			return true, p.Success.Read(iprot)
+		case id == 1 && t == apache.STRUCT:
+			p.NotFound = &NotFound{}
+			return true, p.NotFound.Read(iprot)
+		case id == 2 && t == apache.STRUCT:
+			p.FailedDependency = &FailedDependency{}
+			return true, p.FailedDependency.Read(iprot)
+		}
+		return false, nil
+	})
+}
+
+func (p *containerResult) Write(oprot apache.TProtocol) error {
+	return writeStruct(oprot, "container_result", func() error {
+		switch {
+		case p.NotFound != nil:
+			return writeField(oprot, "notFound", apache.STRUCT, 1, func() error {
+				return p.NotFound.Write(oprot)
+			})
+		case p.FailedDependency != nil:
+			return writeField(oprot, "failedDependency", apache.STRUCT, 2, func() error {
+				return p.FailedDependency.Write(oprot)
+			})
+		case p.Success != nil:
+			return writeField(oprot, "success", apache.STRUCT, 0, func() error {
+				return p.Success.Write(oprot)
+			})
+		}
+		return nil
+	})
+}
+
+// RancherServiceProcessor is an apache.TProcessor dispatching Thrift calls to
+// a RancherService handler.
+type RancherServiceProcessor struct {
+	handler RancherService
+}
+
+// NewRancherServiceProcessor returns a processor for the given handler.
+func NewRancherServiceProcessor(handler RancherService) *RancherServiceProcessor {
+	return &RancherServiceProcessor{handler: handler}
+}
+
+// Process implements apache.TProcessor.
+func (p *RancherServiceProcessor) Process(iprot, oprot apache.TProtocol) (bool, apache.TException) {
+	name, _, seqID, err := iprot.ReadMessageBegin()
+	if err != nil {
+		return false, err
+	}
+
+	var args, result apache.TStruct
+	var call func() error
+	switch name {
+	case "containers":
+		res := &containersResult{}
+		args, result = &containersArgs{}, res
+		call = func() error {
+			cs, err := p.handler.Containers()
+			switch e := err.(type) {
+			case nil:
+				res.Success = cs
+			case *FailedDependency:
+				res.FailedDependency = e
+			default:
+				return err
+			}
+			return nil
+		}
+	case "container":
+		a, res := &containerArgs{}, &containerResult{}
+		args, result = a, res
+		call = func() error {
+			c, err := p.handler.Container(a.Name)
+			switch e := err.(type) {
+			case nil:
+				res.Success = c
+			case *NotFound:
+				res.NotFound = e
+			case *FailedDependency:
+				res.FailedDependency = e
+			default:
+				return err
+			}
+			return nil
+		}
+	default:
+		iprot.Skip(apache.STRUCT)
+		iprot.ReadMessageEnd()
+		x := apache.NewTApplicationException(
+			apache.UNKNOWN_METHOD, "Unknown function "+name)
+		writeApplicationException(oprot, name, seqID, x)
+		return false, x
+	}
+
+	if err := args.Read(iprot); err != nil {
+		iprot.ReadMessageEnd()
+		x := apache.NewTApplicationException(apache.PROTOCOL_ERROR, err.Error())
+		writeApplicationException(oprot, name, seqID, x)
+		return false, x
+	}
+	iprot.ReadMessageEnd()
+
+	if err := call(); err != nil {
+		// Undeclared errors are reported to the caller without dropping the
+		// connection.
+		x := apache.NewTApplicationException(apache.INTERNAL_ERROR,
+			fmt.Sprintf("Internal error processing %s: %s", name, err))
+		if err := writeApplicationException(oprot, name, seqID, x); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+
+	if err := writeMessage(oprot, name, apache.REPLY, seqID, result); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func writeApplicationException(oprot apache.TProtocol, name string, seqID int32, x apache.TApplicationException) error {
+	if err := oprot.WriteMessageBegin(name, apache.EXCEPTION, seqID); err != nil {
+		return err
+	}
+	if err := x.Write(oprot); err != nil {
+		return err
+	}
+	if err := oprot.WriteMessageEnd(); err != nil {
+		return err
+	}
+	return oprot.Flush()
+}
+
+func writeMessage(oprot apache.TProtocol, name string, t apache.TMessageType, seqID int32, s apache.TStruct) error {
+	if err := oprot.WriteMessageBegin(name, t, seqID); err != nil {
+		return err
+	}
+	if err := s.Write(oprot); err != nil {
+		return err
+	}
+	if err := oprot.WriteMessageEnd(); err != nil {
+		return err
+	}
+	return oprot.Flush()
+}
+
+// RancherServiceClient is a RancherService calling a remote Thrift server.
+// It is not safe for concurrent use.
+type RancherServiceClient struct {
+	transport apache.TTransport
+	iprot     apache.TProtocol
+	oprot     apache.TProtocol
+	seqID     int32
+}
+
+// NewRancherServiceClientFactory returns a client over the given (opened)
+// transport, using the given protocol in both directions.
+func NewRancherServiceClientFactory(t apache.TTransport, f apache.TProtocolFactory) *RancherServiceClient {
+	return &RancherServiceClient{
+		transport: t,
+		iprot:     f.GetProtocol(t),
+		oprot:     f.GetProtocol(t),
+	}
+}
+
+// Containers implements RancherService.
+func (c *RancherServiceClient) Containers() ([]*Container, error) {
+	var res containersResult
+	if err := c.call("containers", &containersArgs{}, &res); err != nil {
+		return nil, err
+	}
+	if res.FailedDependency != nil {
+		return nil, res.FailedDependency
+	}
+	return res.Success, nil
+}
+
+// Container implements RancherService.
+func (c *RancherServiceClient) Container(name string) (*Container, error) {
+	var res containerResult
+	if err := c.call("container", &containerArgs{Name: name}, &res); err != nil {
+		return nil, err
+	}
+	switch {
+	case res.NotFound != nil:
+		return nil, res.NotFound
+	case res.FailedDependency != nil:
+		return nil, res.FailedDependency
+	case res.Success == nil:
+		return nil, apache.NewTApplicationException(apache.MISSING_RESULT,
+			"container failed: unknown result")
+	}
+	return res.Success, nil
+}
+
+func (c *RancherServiceClient) call(method string, args, result apache.TStruct) error {
+	c.seqID++
+	if err := writeMessage(c.oprot, method, apache.CALL, c.seqID, args); err != nil {
+		return err
+	}
+
+	name, t, seqID, err := c.iprot.ReadMessageBegin()
+	if err != nil {
+		return err
+	}
+	switch {
+	case name != method:
+		return apache.NewTApplicationException(apache.WRONG_METHOD_NAME,
+			method+" failed: wrong method name")
+	case seqID != c.seqID:
+		return apache.NewTApplicationException(apache.BAD_SEQUENCE_ID,
+			method+" failed: out of sequence response")
+	case t == apache.EXCEPTION:
+		x, err := apache.NewTApplicationException(
+			apache.UNKNOWN_APPLICATION_EXCEPTION, "").Read(c.iprot)
+		if err != nil {
+			return err
+		}
+		if err := c.iprot.ReadMessageEnd(); err != nil {
+			return err
+		}
+		return x
+	case t != apache.REPLY:
+		return apache.NewTApplicationException(apache.INVALID_MESSAGE_TYPE_EXCEPTION,
+			method+" failed: invalid message type")
+	}
+
+	if err := result.Read(c.iprot); err != nil {
+		return err
+	}
+	return c.iprot.ReadMessageEnd()
+}
@@ -0,0 +1,45 @@
+// Copyright 2017 Martin Baillie <martin.t.baillie@gmail.com>.
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file or at:
+// https://opensource.org/licenses/BSD-3-Clause
+
+namespace go thrift
+namespace java com.github.martinbaillie.rms.rancher
+
+// A Rancher host.
+struct Host {
+  1: string uuid
+  2: string name
+}
+
+// A Rancher container.
+struct Container {
+  1: string name
+  2: string state
+  3: string privateIp
+  4: i64 serviceIndex
+  5: Host host
+  6: string environment
+}
+
+// The requested object was not found in the repository.
+exception NotFound {
+  1: string message
+}
+
+// The requested object could not be retrieved due to a failed dependency,
+// e.g. the upstream Rancher metadata service was unavailable.
+exception FailedDependency {
+  1: string message
+}
+
+// The Rancher service definition.
+service RancherService {
+  // Get summaries of all Rancher containers in the environment.
+  list<Container> containers() throws (1: FailedDependency failedDependency)
+
+  // Get a summary for a single Rancher container in the environment.
+  Container container(1: string name) throws (1: NotFound notFound, 2: FailedDependency failedDependency)
+}
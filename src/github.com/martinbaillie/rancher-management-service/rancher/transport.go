@@ -14,12 +14,16 @@ import (
 	"encoding/json"
 	"errors"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"context"
 
 	"github.com/gorilla/mux"
 	stdopentracing "github.com/opentracing/opentracing-go"
 
+	"github.com/go-kit/kit/endpoint"
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/tracing/opentracing"
 
@@ -32,6 +36,42 @@ type HTTPHandlers struct {
 	Containers http.Handler
 }
 
+// The request was invalid.
+// swagger:model badRequestResponse
+type badRequestResponse struct {
+	httpErrorBody
+}
+
+// The request did not carry the required authorization.
+// swagger:model unauthorizedResponse
+type unauthorizedResponse struct {
+	httpErrorBody
+}
+
+// The requested action conflicts with the state of the object.
+// swagger:model conflictResponse
+type conflictResponse struct {
+	httpErrorBody
+}
+
+// The requested functionality is not configured.
+// swagger:model notImplementedResponse
+type notImplementedResponse struct {
+	httpErrorBody
+}
+
+// An upstream Rancher service failed the request.
+// swagger:model badGatewayResponse
+type badGatewayResponse struct {
+	httpErrorBody
+}
+
+// An upstream Rancher service did not complete the request in time.
+// swagger:model gatewayTimeoutResponse
+type gatewayTimeoutResponse struct {
+	httpErrorBody
+}
+
 // The requested object was not found in the repository.
 // swagger:model notFoundResponse
 type notFoundResponse struct {
@@ -44,6 +84,13 @@ type failedDependencyResponse struct {
 	httpErrorBody
 }
 
+// The client has made too many requests, and should retry after the number
+// of seconds in the Retry-After header.
+// swagger:model tooManyRequestsResponse
+type tooManyRequestsResponse struct {
+	httpErrorBody
+}
+
 // An internal error has caused the requested service to become unavailable.
 // swagger:model serviceUnavailableResponse
 type serviceUnavailableResponse struct {
@@ -54,8 +101,11 @@ type serviceUnavailableResponse struct {
 type httpErrorBody struct {
 	// required: true
 	// min: 1
-	Error  string `json:"Error"`
-	Status int    `json:"-"`
+	Error string `json:"Error"`
+	// the ID correlating the request across logs and traces, as in the
+	// X-Request-ID header
+	RequestID string `json:"RequestID,omitempty"`
+	Status    int    `json:"-"`
 }
 
 // MakeHTTPHandlers creates a new instance of HTTPHandlers.
@@ -64,6 +114,7 @@ func MakeHTTPHandlers(ctx context.Context, es ServerEndpoints, tracer stdopentra
 	options := []kithttp.ServerOption{
 		kithttp.ServerErrorLogger(logger),
 		kithttp.ServerErrorEncoder(encodeHTTPError),
+		kithttp.ServerBefore(PopulateClientIdentity),
 	}
 
 	return HTTPHandlers{
@@ -79,6 +130,7 @@ func MakeHTTPHandlers(ctx context.Context, es ServerEndpoints, tracer stdopentra
 		// Responses:
 		//	200: containersResponse
 		//	424: body:failedDependencyResponse The upstream Rancher metadata service was unavilable.
+		//  429: body:tooManyRequestsResponse The client has exceeded its rate limit.
 		//  500: body:serviceUnavailableResponse An internal error has occurred.
 		Containers: kithttp.NewServer(
 			ctx,
@@ -86,7 +138,7 @@ func MakeHTTPHandlers(ctx context.Context, es ServerEndpoints, tracer stdopentra
 			DecodeHTTPContainersRequest,
 			EncodeHTTPGenericResponse,
 			append(options, kithttp.ServerBefore(
-				opentracing.FromHTTPRequest(tracer, "Containers", logger)))...,
+				opentracing.FromHTTPRequest(tracer, "Containers", logger), PopulateRequestID))...,
 		),
 
 		// Container swagger:route GET /containers/{name} containers container
@@ -102,6 +154,7 @@ func MakeHTTPHandlers(ctx context.Context, es ServerEndpoints, tracer stdopentra
 		//	200: containerResponse
 		//  404: body:notFoundResponse The container was not found in the repository.
 		//	424: body:failedDependencyResponse The upstream Rancher metadata service was unavilable.
+		//  429: body:tooManyRequestsResponse The client has exceeded its rate limit.
 		//  500: body:serviceUnavailableResponse An internal error has occurred.
 		Container: kithttp.NewServer(
 			ctx,
@@ -109,11 +162,348 @@ func MakeHTTPHandlers(ctx context.Context, es ServerEndpoints, tracer stdopentra
 			DecodeHTTPContainerRequest,
 			EncodeHTTPGenericResponse,
 			append(options, kithttp.ServerBefore(
-				opentracing.FromHTTPRequest(tracer, "Container", logger)))...,
+				opentracing.FromHTTPRequest(tracer, "Container", logger), PopulateRequestID))...,
 		),
 	}
 }
 
+// MakePrometheusHTTPHandler creates a handler serving Prometheus scrape
+// targets from the given endpoint, see NewPrometheusTargetsEndpoint.
+// The handler is decorated with opentracing annotations.
+func MakePrometheusHTTPHandler(ctx context.Context, e endpoint.Endpoint, tracer stdopentracing.Tracer, logger log.Logger) http.Handler {
+	// PrometheusTargets swagger:route GET /prometheus/targets prometheus prometheusTargets
+	//
+	// Get the containers to scrape in the Prometheus http_sd format
+	//
+	// Produces:
+	// - application/json
+	//
+	// Schemes: http, https
+	//
+	// Responses:
+	//	200: prometheusTargetsResponse
+	//	424: body:failedDependencyResponse The upstream Rancher metadata service was unavilable.
+	//  429: body:tooManyRequestsResponse The client has exceeded its rate limit.
+	//  500: body:serviceUnavailableResponse An internal error has occurred.
+	return kithttp.NewServer(
+		ctx,
+		e,
+		DecodeHTTPPrometheusTargetsRequest,
+		EncodeHTTPGenericResponse,
+		kithttp.ServerErrorLogger(logger),
+		kithttp.ServerErrorEncoder(encodeHTTPError),
+		kithttp.ServerBefore(opentracing.FromHTTPRequest(tracer, "PrometheusTargets", logger)),
+		kithttp.ServerBefore(PopulateRequestID),
+		kithttp.ServerBefore(PopulateClientIdentity),
+	)
+}
+
+// MakeContainerHealthHTTPHandler creates a handler serving a container's most
+// recent probe from the given endpoint, see NewContainerHealthEndpoint.
+// The handler is decorated with opentracing annotations.
+func MakeContainerHealthHTTPHandler(ctx context.Context, e endpoint.Endpoint, tracer stdopentracing.Tracer, logger log.Logger) http.Handler {
+	// ContainerHealth swagger:route GET /containers/{name}/health containers containerHealth
+	//
+	// Get the most recent probe of a single Rancher container in the environment
+	//
+	// Produces:
+	// - application/json
+	//
+	// Schemes: http, https
+	//
+	// Responses:
+	//	200: containerHealthResponse
+	//  404: body:notFoundResponse The container was not found in the repository, or has no probe.
+	//	424: body:failedDependencyResponse The upstream Rancher metadata service was unavilable.
+	//  429: body:tooManyRequestsResponse The client has exceeded its rate limit.
+	//  500: body:serviceUnavailableResponse An internal error has occurred.
+	return kithttp.NewServer(
+		ctx,
+		e,
+		DecodeHTTPContainerRequest,
+		EncodeHTTPGenericResponse,
+		kithttp.ServerErrorLogger(logger),
+		kithttp.ServerErrorEncoder(encodeHTTPError),
+		kithttp.ServerBefore(opentracing.FromHTTPRequest(tracer, "ContainerHealth", logger)),
+		kithttp.ServerBefore(PopulateRequestID),
+		kithttp.ServerBefore(PopulateClientIdentity),
+	)
+}
+
+// MakeStackExportHTTPHandler creates a handler serving stacks reconstructed
+// by the given endpoint, see NewStackExportEndpoint.
+// The handler is decorated with opentracing annotations.
+func MakeStackExportHTTPHandler(ctx context.Context, e endpoint.Endpoint, tracer stdopentracing.Tracer, logger log.Logger) http.Handler {
+	// StackExport swagger:route GET /stacks/{name}/export stacks stackExport
+	//
+	// Reconstruct a Rancher stack in the environment from its observed containers
+	//
+	// Produces:
+	// - application/json
+	//
+	// Schemes: http, https
+	//
+	// Responses:
+	//	200: stackExportResponse
+	//  400: body:badRequestResponse The export format is not supported.
+	//  404: body:notFoundResponse The stack was not found in the repository.
+	//	424: body:failedDependencyResponse The upstream Rancher metadata service was unavilable.
+	//  429: body:tooManyRequestsResponse The client has exceeded its rate limit.
+	//  500: body:serviceUnavailableResponse An internal error has occurred.
+	return kithttp.NewServer(
+		ctx,
+		e,
+		DecodeHTTPStackExportRequest,
+		EncodeHTTPGenericResponse,
+		kithttp.ServerErrorLogger(logger),
+		kithttp.ServerErrorEncoder(encodeHTTPError),
+		kithttp.ServerBefore(opentracing.FromHTTPRequest(tracer, "StackExport", logger)),
+		kithttp.ServerBefore(PopulateRequestID),
+		kithttp.ServerBefore(PopulateClientIdentity),
+	)
+}
+
+// DecodeHTTPStackExportRequest decodes the request into a stackExportRequest,
+// defaulting to the compose format
+func DecodeHTTPStackExportRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	var req stackExportRequest
+
+	req.Name = mux.Vars(r)["name"]
+	if req.Name == "" {
+		return nil, errors.New("failed to extract stack name from URL")
+	}
+	req.Format = r.URL.Query().Get("format")
+	if req.Format == "" {
+		req.Format = ExportCompose
+	}
+
+	return req, nil
+}
+
+// MakeContainerActionHTTPHandler creates a handler acting upon containers
+// with the given endpoint, see NewContainerActionEndpoint.
+// The handler is decorated with opentracing annotations.
+func MakeContainerActionHTTPHandler(ctx context.Context, e endpoint.Endpoint, tracer stdopentracing.Tracer, logger log.Logger) http.Handler {
+	// ContainerAction swagger:route POST /containers/{name}/actions/{action} containers containerAction
+	//
+	// Restart, stop or start a single Rancher container in the environment, waiting for it to transition
+	//
+	// Produces:
+	// - application/json
+	//
+	// Schemes: http, https
+	//
+	// Responses:
+	//	200: containerActionResponse
+	//  400: body:badRequestResponse The action is unknown.
+	//  401: body:unauthorizedResponse The request did not carry one of the action tokens.
+	//  404: body:notFoundResponse The container was not found in the repository or the Rancher API.
+	//  409: body:conflictResponse The action is unavailable in the container's current state.
+	//	424: body:failedDependencyResponse The upstream Rancher metadata service was unavilable.
+	//  429: body:tooManyRequestsResponse The client has exceeded its rate limit.
+	//  500: body:serviceUnavailableResponse An internal error has occurred.
+	//  501: body:notImplementedResponse The environment has no Rancher API configured.
+	//  502: body:badGatewayResponse The Rancher API failed the action.
+	//  504: body:gatewayTimeoutResponse The container did not finish transitioning in time.
+	return kithttp.NewServer(
+		ctx,
+		e,
+		DecodeHTTPContainerActionRequest,
+		EncodeHTTPGenericResponse,
+		kithttp.ServerErrorLogger(logger),
+		kithttp.ServerErrorEncoder(encodeHTTPError),
+		kithttp.ServerBefore(opentracing.FromHTTPRequest(tracer, "ContainerAction", logger)),
+		kithttp.ServerBefore(PopulateRequestID),
+		kithttp.ServerBefore(PopulateClientIdentity),
+		kithttp.ServerBefore(PopulateBearerToken),
+	)
+}
+
+// DecodeHTTPContainerActionRequest decodes the request into a
+// containerActionRequest
+func DecodeHTTPContainerActionRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	var req containerActionRequest
+
+	vars := mux.Vars(r)
+	req.Name, req.Action = vars["name"], vars["action"]
+	if req.Name == "" || req.Action == "" {
+		return nil, errors.New("failed to extract container name and action from URL")
+	}
+
+	return req, nil
+}
+
+// MakeServiceScaleHTTPHandler creates a handler scaling services with the
+// given endpoint, see NewServiceScaleEndpoint.
+// The handler is decorated with opentracing annotations.
+func MakeServiceScaleHTTPHandler(ctx context.Context, e endpoint.Endpoint, tracer stdopentracing.Tracer, logger log.Logger) http.Handler {
+	// ServiceScale swagger:route PUT /stacks/{stack}/services/{service}/scale services serviceScale
+	//
+	// Scale a Rancher service in the environment, tracking its containers until they are running
+	//
+	// Consumes:
+	// - application/json
+	//
+	// Produces:
+	// - application/json
+	//
+	// Schemes: http, https
+	//
+	// Responses:
+	//	202: serviceProgressResponse The service is scaling, with its progress at the Location.
+	//  400: body:badRequestResponse The scale is missing or negative.
+	//  401: body:unauthorizedResponse The request did not carry one of the action tokens.
+	//  404: body:notFoundResponse The service was not found in the Rancher API.
+	//  409: body:conflictResponse The service is scheduled globally.
+	//	424: body:failedDependencyResponse The upstream Rancher metadata service was unavilable.
+	//  429: body:tooManyRequestsResponse The client has exceeded its rate limit.
+	//  500: body:serviceUnavailableResponse An internal error has occurred.
+	//  501: body:notImplementedResponse The environment has no Rancher API configured.
+	//  502: body:badGatewayResponse The Rancher API failed the action.
+	return kithttp.NewServer(
+		ctx,
+		e,
+		DecodeHTTPServiceScaleRequest,
+		EncodeHTTPGenericResponse,
+		kithttp.ServerErrorLogger(logger),
+		kithttp.ServerErrorEncoder(encodeHTTPError),
+		kithttp.ServerBefore(opentracing.FromHTTPRequest(tracer, "ServiceScale", logger)),
+		kithttp.ServerBefore(PopulateRequestID),
+		kithttp.ServerBefore(PopulateClientIdentity),
+		kithttp.ServerBefore(PopulateBearerToken),
+	)
+}
+
+// DecodeHTTPServiceScaleRequest JSON decodes the request into a
+// serviceScaleRequest
+func DecodeHTTPServiceScaleRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	var req serviceScaleRequest
+
+	vars := mux.Vars(r)
+	req.Stack, req.Service = vars["stack"], vars["service"]
+	if req.Stack == "" || req.Service == "" {
+		return nil, errors.New("failed to extract stack and service name from URL")
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err.Error() != "EOF" {
+		return nil, err
+	}
+
+	return req, nil
+}
+
+// MakeServiceUpgradeHTTPHandler creates a handler upgrading services with
+// the given endpoint, see NewServiceUpgradeEndpoint.
+// The handler is decorated with opentracing annotations.
+func MakeServiceUpgradeHTTPHandler(ctx context.Context, e endpoint.Endpoint, tracer stdopentracing.Tracer, logger log.Logger) http.Handler {
+	// ServiceUpgrade swagger:route POST /stacks/{stack}/services/{service}/upgrade services serviceUpgrade
+	//
+	// Upgrade, finish upgrading or roll back a Rancher service in the environment, tracking its containers until they are running
+	//
+	// Consumes:
+	// - application/json
+	//
+	// Produces:
+	// - application/json
+	//
+	// Schemes: http, https
+	//
+	// Responses:
+	//	202: serviceProgressResponse The service is transitioning, with its progress at the Location.
+	//  400: body:badRequestResponse The action is unknown.
+	//  401: body:unauthorizedResponse The request did not carry one of the action tokens.
+	//  404: body:notFoundResponse The service was not found in the Rancher API.
+	//  409: body:conflictResponse The action is unavailable in the service's current state.
+	//	424: body:failedDependencyResponse The upstream Rancher metadata service was unavilable.
+	//  429: body:tooManyRequestsResponse The client has exceeded its rate limit.
+	//  500: body:serviceUnavailableResponse An internal error has occurred.
+	//  501: body:notImplementedResponse The environment has no Rancher API configured.
+	//  502: body:badGatewayResponse The Rancher API failed the action.
+	return kithttp.NewServer(
+		ctx,
+		e,
+		DecodeHTTPServiceUpgradeRequest,
+		EncodeHTTPGenericResponse,
+		kithttp.ServerErrorLogger(logger),
+		kithttp.ServerErrorEncoder(encodeHTTPError),
+		kithttp.ServerBefore(opentracing.FromHTTPRequest(tracer, "ServiceUpgrade", logger)),
+		kithttp.ServerBefore(PopulateRequestID),
+		kithttp.ServerBefore(PopulateClientIdentity),
+		kithttp.ServerBefore(PopulateBearerToken),
+	)
+}
+
+// DecodeHTTPServiceUpgradeRequest JSON decodes the request into a
+// serviceUpgradeRequest
+func DecodeHTTPServiceUpgradeRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	var req serviceUpgradeRequest
+
+	vars := mux.Vars(r)
+	req.Stack, req.Service = vars["stack"], vars["service"]
+	if req.Stack == "" || req.Service == "" {
+		return nil, errors.New("failed to extract stack and service name from URL")
+	}
+	// Special case while the upgrade strategy is optional
+	if err := json.NewDecoder(r.Body).Decode(&req.Strategy); err != nil && err.Error() != "EOF" {
+		return nil, err
+	}
+
+	return req, nil
+}
+
+// MakeServiceActionHTTPHandler creates a handler serving the progress of
+// actions upon services with the given endpoint, see
+// NewServiceActionEndpoint.
+// The handler is decorated with opentracing annotations.
+func MakeServiceActionHTTPHandler(ctx context.Context, e endpoint.Endpoint, tracer stdopentracing.Tracer, logger log.Logger) http.Handler {
+	// ServiceAction swagger:route GET /stacks/{stack}/services/{service}/actions/{id} services serviceAction
+	//
+	// Get the progress of a scale or upgrade of a Rancher service in the environment
+	//
+	// Produces:
+	// - application/json
+	//
+	// Schemes: http, https
+	//
+	// Responses:
+	//	200: serviceProgressResponse
+	//  401: body:unauthorizedResponse The request did not carry one of the action tokens.
+	//  404: body:notFoundResponse The action is unknown, or no longer tracked.
+	//  429: body:tooManyRequestsResponse The client has exceeded its rate limit.
+	//  500: body:serviceUnavailableResponse An internal error has occurred.
+	return kithttp.NewServer(
+		ctx,
+		e,
+		DecodeHTTPServiceActionRequest,
+		EncodeHTTPGenericResponse,
+		kithttp.ServerErrorLogger(logger),
+		kithttp.ServerErrorEncoder(encodeHTTPError),
+		kithttp.ServerBefore(opentracing.FromHTTPRequest(tracer, "ServiceAction", logger)),
+		kithttp.ServerBefore(PopulateRequestID),
+		kithttp.ServerBefore(PopulateClientIdentity),
+		kithttp.ServerBefore(PopulateBearerToken),
+	)
+}
+
+// DecodeHTTPServiceActionRequest decodes the request into a
+// serviceActionRequest
+func DecodeHTTPServiceActionRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	var req serviceActionRequest
+
+	vars := mux.Vars(r)
+	req.Stack, req.Service, req.ID = vars["stack"], vars["service"], vars["id"]
+	if req.Stack == "" || req.Service == "" || req.ID == "" {
+		return nil, errors.New("failed to extract stack, service name and action ID from URL")
+	}
+
+	return req, nil
+}
+
+// DecodeHTTPPrometheusTargetsRequest decodes the request into a
+// prometheusTargetsRequest
+func DecodeHTTPPrometheusTargetsRequest(_ context.Context, _ *http.Request) (interface{}, error) {
+	return prometheusTargetsRequest{}, nil
+}
+
 // DecodeHTTPContainersRequest JSON decodes the request into a containersRequest
 func DecodeHTTPContainersRequest(_ context.Context, r *http.Request) (interface{}, error) {
 	var req containersRequest
@@ -140,16 +530,25 @@ func DecodeHTTPContainerRequest(_ context.Context, r *http.Request) (interface{}
 // EncodeHTTPGenericResponse is an EncodeResponseFunc that encodes the response
 // as JSON to the response writer, handling any error conditions
 func EncodeHTTPGenericResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
+	if c, ok := response.(cacheStatuser); ok {
+		encodeHTTPCacheHeaders(c.cacheStatus(), w)
+	}
 	if e, ok := response.(errorer); ok && e.error() != nil {
 		// Business logic error has occurred
 		encodeHTTPError(ctx, e.error(), w)
 		return nil
 	}
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if l, ok := response.(locationer); ok && l.location() != "" {
+		w.Header().Set("Location", l.location())
+	}
+	if s, ok := response.(statuser); ok {
+		w.WriteHeader(s.status())
+	}
 	return json.NewEncoder(w).Encode(response)
 }
 
-func encodeHTTPError(_ context.Context, err error, w http.ResponseWriter) {
+func encodeHTTPError(ctx context.Context, err error, w http.ResponseWriter) {
 	if err == nil {
 		panic("encodeError with nil error")
 	}
@@ -158,19 +557,65 @@ func encodeHTTPError(_ context.Context, err error, w http.ResponseWriter) {
 	// Handle the Rancher package's business errors
 	var resp httpErrorBody
 	resp.Error = err.Error()
+	resp.RequestID = RequestIDFromContext(ctx)
 	switch err {
-	case ErrContainerNotFound, ErrHostNotFound:
+	case ErrContainerNotFound, ErrHostNotFound, ErrContainerNotProbed,
+		ErrStackNotFound, ErrServiceActionNotFound:
+		resp.Status = http.StatusNotFound
+	case ErrExportFormatUnsupported, ErrContainerActionUnknown,
+		ErrServiceActionUnknown, ErrServiceScaleInvalid:
+		resp.Status = http.StatusBadRequest
+	case ErrAPIContainerNotFound, ErrAPIServiceNotFound:
 		resp.Status = http.StatusNotFound
-	case ErrContainerRepoEmpty, ErrHostRepoEmpty:
+	case ErrContainerActionUnavailable, ErrServiceActionUnavailable,
+		ErrServiceScaleGlobal, ErrContainerAmbiguous:
+		resp.Status = http.StatusConflict
+	case ErrAPINotConfigured:
+		resp.Status = http.StatusNotImplemented
+	case ErrActionUnauthorized:
+		w.Header().Set("WWW-Authenticate", actionAuthenticate)
+		resp.Status = http.StatusUnauthorized
+	case ErrContainerActionTimeout:
+		resp.Status = http.StatusGatewayTimeout
+	case ErrContainerRepoEmpty, ErrHostRepoEmpty,
+		ErrContainerRepoStale, ErrHostRepoStale:
 		resp.Status = http.StatusFailedDependency
 	default:
-		resp.Status = http.StatusInternalServerError
+		switch e := err.(type) {
+		case *ContainerTransitionError, *ServiceTransitionError, *APIError:
+			resp.Status = http.StatusBadGateway
+		case *RateLimitError:
+			w.Header().Set("Retry-After", e.retryAfter())
+			resp.Status = http.StatusTooManyRequests
+		default:
+			resp.Status = http.StatusInternalServerError
+		}
 	}
 
 	w.WriteHeader(resp.Status)
 	json.NewEncoder(w).Encode(resp)
 }
 
+// encodeHTTPCacheHeaders lets the consumer know how fresh the response is and,
+// should it have been restored from a snapshot or the most recent metadata
+// refresh have failed, that it may be stale. Environments that could not be
+// served are named, as the response is partial.
+func encodeHTTPCacheHeaders(cs CacheStatus, w http.ResponseWriter) {
+	if cs.Refreshed.IsZero() {
+		return
+	}
+	w.Header().Set("X-Cache-Age", strconv.Itoa(int(time.Since(cs.Refreshed).Seconds())))
+	if cs.Restored {
+		w.Header().Add("Warning", `110 - "Response is Stale"`)
+	}
+	if cs.Failures > 0 {
+		w.Header().Add("Warning", `111 - "Revalidation Failed"`)
+	}
+	if len(cs.Unavailable) > 0 {
+		w.Header().Add("Warning", `199 - "Environments Unavailable: `+strings.Join(cs.Unavailable, ",")+`"`)
+	}
+}
+
 func decodeMetadataContainersResponse(_ context.Context, resp *http.Response) (interface{}, error) {
 	var response metadataContainersResponse
 
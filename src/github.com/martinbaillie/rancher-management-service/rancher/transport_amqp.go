@@ -0,0 +1,336 @@
+// Copyright 2017 Martin Baillie <martin.t.baillie@gmail.com>.
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file or at:
+// https://opensource.org/licenses/BSD-3-Clause
+
+package rancher
+
+// This file provides server-side bindings for the AMQP transport.
+// It utilizes the transport/amqp.Subscriber.
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/streadway/amqp"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/log"
+	level "github.com/go-kit/kit/log/experimental_level"
+
+	kitamqp "github.com/go-kit/kit/transport/amqp"
+)
+
+// AMQP transport errors
+var (
+	ErrAMQPUnknownCommand = errors.New("unknown command")
+	ErrAMQPMissingName    = errors.New("container name is required")
+	ErrAMQPMissingService = errors.New("stack and service names are required")
+)
+
+// AMQP commands, carried in the type property of each message.
+const (
+	AMQPContainersCommand = "containers"
+	AMQPContainerCommand  = "container"
+	AMQPRestartCommand    = ContainerRestart
+	AMQPStopCommand       = ContainerStop
+	AMQPStartCommand      = ContainerStart
+	AMQPScaleCommand      = ServiceScale
+	AMQPUpgradeCommand    = ServiceUpgrade
+)
+
+// amqpAuthorizationHeader carries a command's bearer token, as the
+// Authorization header does over HTTP.
+const amqpAuthorizationHeader = "Authorization"
+
+// MakeAMQPHandler makes the Rancher package's ServerEndpoints, and any of the
+// ActionEndpoints, available as commands consumed from AMQP. The command is
+// taken from each message's type property, its arguments from the JSON body,
+// and its bearer token from the Authorization header.
+//
+// Replies are published to the message's reply_to with its correlation ID.
+// Commands that fail are replied to with the error and rejected, sending them
+// to the queue's dead-letter exchange should it have one.
+func MakeAMQPHandler(es ServerEndpoints, aes ActionEndpoints, ch kitamqp.Channel, logger log.Logger) func(*amqp.Delivery) {
+	options := []kitamqp.SubscriberOption{
+		kitamqp.SubscriberBefore(kitamqp.SetContentType("application/json")),
+		kitamqp.SubscriberAfter(ackAfterEndpoint),
+		kitamqp.SubscriberErrorEncoder(encodeAMQPError),
+		kitamqp.SubscriberErrorLogger(logger),
+	}
+
+	commands := map[string]func(*amqp.Delivery){
+		AMQPContainersCommand: kitamqp.NewSubscriber(
+			amqpEndpoint(es.ContainersEndpoint),
+			DecodeAMQPContainersRequest,
+			kitamqp.EncodeJSONResponse,
+			options...,
+		).ServeDelivery(ch),
+		AMQPContainerCommand: kitamqp.NewSubscriber(
+			amqpEndpoint(es.ContainerEndpoint),
+			DecodeAMQPContainerRequest,
+			kitamqp.EncodeJSONResponse,
+			options...,
+		).ServeDelivery(ch),
+	}
+	if aes.ContainerActionEndpoint != nil {
+		serve := kitamqp.NewSubscriber(
+			amqpBearerEndpoint(amqpEndpoint(aes.ContainerActionEndpoint)),
+			decodeAMQPBearer(DecodeAMQPContainerActionRequest),
+			kitamqp.EncodeJSONResponse,
+			options...,
+		).ServeDelivery(ch)
+		commands[AMQPRestartCommand] = serve
+		commands[AMQPStopCommand] = serve
+		commands[AMQPStartCommand] = serve
+	}
+	if aes.ServiceScaleEndpoint != nil {
+		commands[AMQPScaleCommand] = kitamqp.NewSubscriber(
+			amqpBearerEndpoint(amqpEndpoint(aes.ServiceScaleEndpoint)),
+			decodeAMQPBearer(DecodeAMQPServiceScaleRequest),
+			kitamqp.EncodeJSONResponse,
+			options...,
+		).ServeDelivery(ch)
+	}
+	if aes.ServiceUpgradeEndpoint != nil {
+		commands[AMQPUpgradeCommand] = kitamqp.NewSubscriber(
+			amqpBearerEndpoint(amqpEndpoint(aes.ServiceUpgradeEndpoint)),
+			decodeAMQPBearer(DecodeAMQPServiceUpgradeRequest),
+			kitamqp.EncodeJSONResponse,
+			options...,
+		).ServeDelivery(ch)
+	}
+
+	return func(deliv *amqp.Delivery) {
+		serve, ok := commands[deliv.Type]
+		if !ok {
+			level.Error(logger).Log("err", ErrAMQPUnknownCommand, "command", deliv.Type)
+			encodeAMQPError(context.Background(), ErrAMQPUnknownCommand, deliv, ch, &amqp.Publishing{})
+			return
+		}
+		serve(deliv)
+	}
+}
+
+// ConsumeAMQPCommands serves the commands consumed from the given queue with
+// the handler, see MakeAMQPHandler, until the context is cancelled or the
+// channel closes.
+func ConsumeAMQPCommands(ctx context.Context, ch kitamqp.Channel, queue, consumer string, handler func(*amqp.Delivery)) error {
+	deliveries, err := ch.Consume(queue, consumer, false, false, false, false, nil)
+	if err != nil {
+		return err
+	}
+	for {
+		select {
+		case deliv, ok := <-deliveries:
+			if !ok {
+				return amqp.ErrClosed
+			}
+			handler(&deliv)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// AMQPDialer connects to the broker, readying the queue commands are consumed
+// from. It returns the channel to consume on, notice of the connection closing
+// and a function closing it.
+type AMQPDialer func() (ch kitamqp.Channel, closed <-chan *amqp.Error, closeConn func() error, err error)
+
+// ServeAMQPCommands consumes commands as ConsumeAMQPCommands does, on a channel
+// from the dialer served by the handler made for it. Should the connection to
+// the broker drop, it is redialed with the policy's backoff and consumption
+// resumes, until the context is cancelled and the connection closed.
+//
+// Only unrecoverable errors are returned, i.e. failing to make the first
+// connection or to consume on a fresh one. A cancelled context returns nil.
+func ServeAMQPCommands(ctx context.Context, dial AMQPDialer, p Policy, queue, consumer string, makeHandler func(kitamqp.Channel) func(*amqp.Delivery), logger log.Logger) error {
+	var attempts int
+	for {
+		ch, closed, closeConn, err := dial()
+		if err != nil {
+			if attempts == 0 {
+				return err
+			}
+			level.Error(logger).Log("err", err, "queue", queue, "attempt", attempts)
+		} else {
+			if attempts > 0 {
+				level.Info(logger).Log("msg", "reconnected", "queue", queue)
+			}
+			err = ConsumeAMQPCommands(ctx, ch, queue, consumer, makeHandler(ch))
+			closeConn()
+			if ctx.Err() != nil {
+				return nil
+			}
+			if err != amqp.ErrClosed {
+				return err
+			}
+			select {
+			case reason := <-closed:
+				level.Error(logger).Log("err", reason, "queue", queue, "msg", "reconnecting")
+			default:
+				level.Error(logger).Log("err", err, "queue", queue, "msg", "reconnecting")
+			}
+			attempts = 0
+		}
+		attempts++
+
+		t := time.NewTimer(p.backoff(attempts))
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return nil
+		}
+	}
+}
+
+// DecodeAMQPContainersRequest decodes the AMQP message into a
+// containersRequest
+func DecodeAMQPContainersRequest(_ context.Context, _ *amqp.Delivery) (interface{}, error) {
+	return containersRequest{}, nil
+}
+
+// DecodeAMQPContainerRequest decodes the AMQP message into a
+// containerRequest
+func DecodeAMQPContainerRequest(_ context.Context, deliv *amqp.Delivery) (interface{}, error) {
+	var req containerRequest
+	if err := json.Unmarshal(deliv.Body, &req); err != nil {
+		return nil, err
+	}
+	if req.Name == "" {
+		return nil, ErrAMQPMissingName
+	}
+	return req, nil
+}
+
+// DecodeAMQPContainerActionRequest decodes the AMQP message into a
+// containerActionRequest, the action being the command.
+func DecodeAMQPContainerActionRequest(_ context.Context, deliv *amqp.Delivery) (interface{}, error) {
+	req := containerActionRequest{Action: deliv.Type}
+	if err := json.Unmarshal(deliv.Body, &req); err != nil {
+		return nil, err
+	}
+	if req.Name == "" {
+		return nil, ErrAMQPMissingName
+	}
+	return req, nil
+}
+
+// DecodeAMQPServiceScaleRequest decodes the AMQP message into a
+// serviceScaleRequest
+func DecodeAMQPServiceScaleRequest(_ context.Context, deliv *amqp.Delivery) (interface{}, error) {
+	var body struct {
+		Stack, Service string
+		Scale          *int
+	}
+	if err := json.Unmarshal(deliv.Body, &body); err != nil {
+		return nil, err
+	}
+	if body.Stack == "" || body.Service == "" {
+		return nil, ErrAMQPMissingService
+	}
+	return serviceScaleRequest{Stack: body.Stack, Service: body.Service, Scale: body.Scale}, nil
+}
+
+// DecodeAMQPServiceUpgradeRequest decodes the AMQP message into a
+// serviceUpgradeRequest, the upgrade strategy given alongside the names.
+func DecodeAMQPServiceUpgradeRequest(_ context.Context, deliv *amqp.Delivery) (interface{}, error) {
+	var body struct {
+		Stack, Service string
+		UpgradeStrategy
+	}
+	if err := json.Unmarshal(deliv.Body, &body); err != nil {
+		return nil, err
+	}
+	if body.Stack == "" || body.Service == "" {
+		return nil, ErrAMQPMissingService
+	}
+	return serviceUpgradeRequest{Stack: body.Stack, Service: body.Service, Strategy: body.UpgradeStrategy}, nil
+}
+
+// amqpBearerRequest carries a command's bearer token alongside its request,
+// as the subscriber's RequestFuncs do not see the message.
+type amqpBearerRequest struct {
+	token   string
+	request interface{}
+}
+
+// decodeAMQPBearer wraps the decoder, noting the bearer token of the
+// message's Authorization header with the request.
+func decodeAMQPBearer(dec kitamqp.DecodeRequestFunc) kitamqp.DecodeRequestFunc {
+	return func(ctx context.Context, deliv *amqp.Delivery) (interface{}, error) {
+		request, err := dec(ctx, deliv)
+		if err != nil {
+			return nil, err
+		}
+		auth, _ := deliv.Headers[amqpAuthorizationHeader].(string)
+		if !strings.HasPrefix(auth, proxyAuthorizationBearer) {
+			auth = ""
+		}
+		return amqpBearerRequest{token: strings.TrimPrefix(auth, proxyAuthorizationBearer), request: request}, nil
+	}
+}
+
+// amqpBearerEndpoint notes the command's bearer token in the context, for the
+// Authorized middleware, passing on its request.
+func amqpBearerEndpoint(e endpoint.Endpoint) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(amqpBearerRequest)
+		if req.token != "" {
+			ctx = context.WithValue(ctx, bearerTokenKey{}, req.token)
+		}
+		return e(ctx, req.request)
+	}
+}
+
+// amqpEndpoint surfaces business errors from the endpoint's response as
+// endpoint errors, so that the command is treated as failed.
+func amqpEndpoint(e endpoint.Endpoint) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		response, err := e(ctx, request)
+		if err != nil {
+			return nil, err
+		}
+		if r, ok := response.(errorer); ok && r.error() != nil {
+			return nil, r.error()
+		}
+		return response, nil
+	}
+}
+
+type amqpAckedKey struct{}
+
+// ackAfterEndpoint acknowledges the command once the endpoint has succeeded,
+// noting as much for encodeAMQPError.
+func ackAfterEndpoint(ctx context.Context, deliv *amqp.Delivery, _ kitamqp.Channel, _ *amqp.Publishing) context.Context {
+	deliv.Ack(false)
+	return context.WithValue(ctx, amqpAckedKey{}, true)
+}
+
+// amqpErrorBody is the reply to a failed command.
+type amqpErrorBody struct {
+	Error string
+}
+
+// encodeAMQPError replies to a failed command with the error and, unless
+// already acknowledged, rejects it without requeueing so that it is
+// dead-lettered.
+func encodeAMQPError(ctx context.Context, err error, deliv *amqp.Delivery, ch kitamqp.Channel, pub *amqp.Publishing) {
+	if deliv.ReplyTo != "" {
+		pub.CorrelationId = deliv.CorrelationId
+		pub.ContentType = "application/json"
+		pub.Type = "error"
+		pub.Body, _ = json.Marshal(amqpErrorBody{Error: err.Error()})
+		ch.Publish("", deliv.ReplyTo, false, false, *pub)
+	}
+	if acked, _ := ctx.Value(amqpAckedKey{}).(bool); !acked {
+		deliv.Nack(false, false)
+	}
+}
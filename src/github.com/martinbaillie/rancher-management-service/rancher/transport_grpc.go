@@ -0,0 +1,190 @@
+// Copyright 2017 Martin Baillie <martin.t.baillie@gmail.com>.
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file or at:
+// https://opensource.org/licenses/BSD-3-Clause
+
+package rancher
+
+// This file provides server-side bindings for the gRPC transport.
+// It utilizes the transport/grpc.Server.
+
+import (
+	"context"
+
+	oldcontext "golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	stdopentracing "github.com/opentracing/opentracing-go"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/tracing/opentracing"
+
+	kitgrpc "github.com/go-kit/kit/transport/grpc"
+
+	"github.com/martinbaillie/rancher-management-service/rancher/pb"
+)
+
+// MakeGRPCServer makes the Rancher package's ServerEndpoints available as a
+// gRPC RancherServer.
+// Each handler is decorated with opentracing annotations.
+//
+// NOTE: Streaming RPCs fall outside of Go kit's request/response endpoints,
+// so containers are watched directly through the given ServerService.
+func MakeGRPCServer(es ServerEndpoints, s ServerService, tracer stdopentracing.Tracer, logger log.Logger) pb.RancherServer {
+	options := []kitgrpc.ServerOption{
+		kitgrpc.ServerErrorLogger(logger),
+	}
+
+	return &grpcServer{
+		containers: kitgrpc.NewServer(
+			es.ContainersEndpoint,
+			DecodeGRPCContainersRequest,
+			EncodeGRPCContainersResponse,
+			append(options, kitgrpc.ServerBefore(
+				opentracing.FromGRPCRequest(tracer, "Containers", logger), PopulateGRPCRequestID))...,
+		),
+		container: kitgrpc.NewServer(
+			es.ContainerEndpoint,
+			DecodeGRPCContainerRequest,
+			EncodeGRPCContainerResponse,
+			append(options, kitgrpc.ServerBefore(
+				opentracing.FromGRPCRequest(tracer, "Container", logger), PopulateGRPCRequestID))...,
+		),
+		watcher: s,
+		watchBefore: opentracing.FromGRPCRequest(
+			tracer, "WatchContainers", logger),
+	}
+}
+
+type grpcServer struct {
+	containers  kitgrpc.Handler
+	container   kitgrpc.Handler
+	watcher     ServerService
+	watchBefore kitgrpc.ServerRequestFunc
+}
+
+// Containers implements pb.RancherServer.
+func (s *grpcServer) Containers(ctx oldcontext.Context, req *pb.ContainersRequest) (*pb.ContainersReply, error) {
+	_, rep, err := s.containers.ServeGRPC(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	return rep.(*pb.ContainersReply), nil
+}
+
+// Container implements pb.RancherServer.
+func (s *grpcServer) Container(ctx oldcontext.Context, req *pb.ContainerRequest) (*pb.ContainerReply, error) {
+	_, rep, err := s.container.ServeGRPC(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	return rep.(*pb.ContainerReply), nil
+}
+
+// WatchContainers implements pb.RancherServer.
+// Changes are streamed until the consumer goes away or, should it fall too far
+// behind, the watch is closed and an Unavailable error returned.
+func (s *grpcServer) WatchContainers(_ *pb.WatchContainersRequest, stream pb.Rancher_WatchContainersServer) error {
+	var ctx context.Context = stream.Context()
+	md, ok := metadata.FromContext(ctx)
+	if !ok {
+		md = metadata.MD{}
+	}
+	ctx = s.watchBefore(ctx, md)
+	if span := stdopentracing.SpanFromContext(ctx); span != nil {
+		defer span.Finish()
+	}
+
+	for e := range s.watcher.WatchContainers(ctx) {
+		if err := stream.Send(encodeGRPCContainerEvent(e)); err != nil {
+			return err
+		}
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return status.Error(codes.Unavailable, "container watch fell behind")
+}
+
+// DecodeGRPCContainersRequest decodes the gRPC request into a containersRequest
+func DecodeGRPCContainersRequest(_ context.Context, grpcReq interface{}) (interface{}, error) {
+	return containersRequest{}, nil
+}
+
+// DecodeGRPCContainerRequest decodes the gRPC request into a containerRequest
+func DecodeGRPCContainerRequest(_ context.Context, grpcReq interface{}) (interface{}, error) {
+	req := grpcReq.(*pb.ContainerRequest)
+	if req.Name == "" {
+		return nil, status.Error(codes.InvalidArgument, "container name is required")
+	}
+	return containerRequest{Name: req.Name}, nil
+}
+
+// EncodeGRPCContainersResponse encodes the containersResponse into a gRPC
+// reply, handling any error conditions
+func EncodeGRPCContainersResponse(_ context.Context, response interface{}) (interface{}, error) {
+	resp := response.(containersResponse)
+	if resp.Err != nil {
+		return nil, encodeGRPCError(resp.Err)
+	}
+
+	rep := &pb.ContainersReply{Containers: make([]*pb.Container, len(resp.Containers))}
+	for i, c := range resp.Containers {
+		rep.Containers[i] = encodeGRPCContainer(c)
+	}
+	return rep, nil
+}
+
+// EncodeGRPCContainerResponse encodes the containerResponse into a gRPC
+// reply, handling any error conditions
+func EncodeGRPCContainerResponse(_ context.Context, response interface{}) (interface{}, error) {
+	resp := response.(containerResponse)
+	if resp.Err != nil {
+		return nil, encodeGRPCError(resp.Err)
+	}
+	return &pb.ContainerReply{Container: encodeGRPCContainer(resp.Container)}, nil
+}
+
+// encodeGRPCError maps the Rancher package's business errors to gRPC statuses.
+func encodeGRPCError(err error) error {
+	switch err {
+	case ErrContainerNotFound, ErrHostNotFound:
+		return status.Error(codes.NotFound, err.Error())
+	case ErrContainerRepoEmpty, ErrHostRepoEmpty,
+		ErrContainerRepoStale, ErrHostRepoStale:
+		return status.Error(codes.FailedPrecondition, err.Error())
+	default:
+		return status.Error(codes.Internal, err.Error())
+	}
+}
+
+func encodeGRPCContainer(c *Container) *pb.Container {
+	return &pb.Container{
+		Name:         c.Name,
+		State:        c.State,
+		PrivateIp:    c.PrivateIP,
+		ServiceIndex: c.ServiceIndex,
+		Host: &pb.Host{
+			Uuid: c.Host.UUID,
+			Name: c.Host.Name,
+		},
+		Environment: c.Environment,
+	}
+}
+
+func encodeGRPCContainerEvent(e ContainerEvent) *pb.ContainerEvent {
+	var t pb.ContainerEvent_Type
+	switch e.Type {
+	case ContainerAdded:
+		t = pb.ContainerEvent_ADDED
+	case ContainerUpdated:
+		t = pb.ContainerEvent_UPDATED
+	case ContainerRemoved:
+		t = pb.ContainerEvent_REMOVED
+	}
+	return &pb.ContainerEvent{Type: t, Container: encodeGRPCContainer(e.Container)}
+}
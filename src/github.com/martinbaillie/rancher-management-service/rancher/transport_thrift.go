@@ -0,0 +1,112 @@
+// Copyright 2017 Martin Baillie <martin.t.baillie@gmail.com>.
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file or at:
+// https://opensource.org/licenses/BSD-3-Clause
+
+package rancher
+
+// This file provides server-side bindings for the Thrift transport.
+//
+// NOTE: Go kit has no Thrift transport, so in the style of its examples the
+// handler simply invokes the ServerEndpoints directly.
+
+import (
+	"context"
+
+	stdopentracing "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+
+	"github.com/martinbaillie/rancher-management-service/rancher/thrift"
+)
+
+// MakeThriftHandler makes the Rancher package's ServerEndpoints available as a
+// Thrift RancherService. Each call is made with a context derived from the
+// given one.
+func MakeThriftHandler(ctx context.Context, es ServerEndpoints, tracer stdopentracing.Tracer) thrift.RancherService {
+	return &thriftServer{ctx: ctx, endpoints: es, tracer: tracer}
+}
+
+type thriftServer struct {
+	ctx       context.Context
+	endpoints ServerEndpoints
+	tracer    stdopentracing.Tracer
+}
+
+// callContext returns the context for a single call, traced by a span of its
+// own and carrying a new request ID, as Thrift carries neither from callers.
+// The caller finishes the span.
+func (s *thriftServer) callContext(operation string) (context.Context, stdopentracing.Span) {
+	span := s.tracer.StartSpan(operation)
+	ext.SpanKindRPCServer.Set(span)
+	ctx := stdopentracing.ContextWithSpan(ContextWithRequestID(s.ctx, NewRequestID()), span)
+	span.SetTag("request.id", RequestIDFromContext(ctx))
+	return ctx, span
+}
+
+// Containers implements thrift.RancherService.
+func (s *thriftServer) Containers() ([]*thrift.Container, error) {
+	ctx, span := s.callContext("Containers")
+	defer span.Finish()
+
+	response, err := s.endpoints.ContainersEndpoint(ctx, containersRequest{})
+	if err != nil {
+		return nil, err
+	}
+	resp := response.(containersResponse)
+	if resp.Err != nil {
+		return nil, encodeThriftError(resp.Err)
+	}
+
+	cs := make([]*thrift.Container, len(resp.Containers))
+	for i, c := range resp.Containers {
+		cs[i] = encodeThriftContainer(c)
+	}
+	return cs, nil
+}
+
+// Container implements thrift.RancherService.
+func (s *thriftServer) Container(name string) (*thrift.Container, error) {
+	ctx, span := s.callContext("Container")
+	defer span.Finish()
+
+	response, err := s.endpoints.ContainerEndpoint(ctx, containerRequest{Name: name})
+	if err != nil {
+		return nil, err
+	}
+	resp := response.(containerResponse)
+	if resp.Err != nil {
+		return nil, encodeThriftError(resp.Err)
+	}
+	return encodeThriftContainer(resp.Container), nil
+}
+
+// encodeThriftError maps the Rancher package's business errors to the
+// exceptions declared in rancher.thrift. Anything else is left to surface as a
+// Thrift internal error.
+func encodeThriftError(err error) error {
+	switch err {
+	case ErrContainerNotFound, ErrHostNotFound:
+		return &thrift.NotFound{Message: err.Error()}
+	case ErrContainerRepoEmpty, ErrHostRepoEmpty,
+		ErrContainerRepoStale, ErrHostRepoStale:
+		return &thrift.FailedDependency{Message: err.Error()}
+	default:
+		return err
+	}
+}
+
+func encodeThriftContainer(c *Container) *thrift.Container {
+	return &thrift.Container{
+		Name:         c.Name,
+		State:        c.State,
+		PrivateIp:    c.PrivateIP,
+		ServiceIndex: int64(c.ServiceIndex),
+		Host: &thrift.Host{
+			Uuid: c.Host.UUID,
+			Name: c.Host.Name,
+		},
+		Environment: c.Environment,
+	}
+}
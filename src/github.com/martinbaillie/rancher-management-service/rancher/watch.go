@@ -0,0 +1,229 @@
+// Copyright 2017 Martin Baillie <martin.t.baillie@gmail.com>.
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file or at:
+// https://opensource.org/licenses/BSD-3-Clause
+
+package rancher
+
+import (
+	"context"
+	"reflect"
+)
+
+// ContainerEventType describes how a container changed between successive
+// populations of a Repository's cache.
+type ContainerEventType string
+
+// Container event types
+const (
+	ContainerAdded   ContainerEventType = "added"
+	ContainerUpdated ContainerEventType = "updated"
+	ContainerRemoved ContainerEventType = "removed"
+)
+
+// ContainerEvent is a change to a single container.
+type ContainerEvent struct {
+	Type      ContainerEventType
+	Container *Container
+}
+
+// watchBuffer is the number of events a watcher may fall behind by before it
+// is considered too slow and its channel is closed.
+const watchBuffer = 64
+
+// DiffContainers returns the events that turn the old containers into the
+// new. Containers are matched by name.
+func DiffContainers(old, new []*Container) []ContainerEvent {
+	om := make(map[string]*Container, len(old))
+	for _, c := range old {
+		om[c.Name] = c
+	}
+
+	var es []ContainerEvent
+	nm := make(map[string]bool, len(new))
+	for _, c := range new {
+		nm[c.Name] = true
+		if o, ok := om[c.Name]; !ok {
+			es = append(es, ContainerEvent{Type: ContainerAdded, Container: copyContainer(c)})
+		} else if !reflect.DeepEqual(o, c) {
+			es = append(es, ContainerEvent{Type: ContainerUpdated, Container: copyContainer(c)})
+		}
+	}
+	for _, c := range old {
+		if !nm[c.Name] {
+			es = append(es, ContainerEvent{Type: ContainerRemoved, Container: copyContainer(c)})
+		}
+	}
+	return es
+}
+
+// copyContainer returns a copy of the container safe to hand to watchers
+// while the cache continues to be populated.
+func copyContainer(c *Container) *Container {
+	cc := *c
+	if c.Labels != nil {
+		cc.Labels = make(map[string]string, len(c.Labels))
+		for k, v := range c.Labels {
+			cc.Labels[k] = v
+		}
+	}
+	if c.Ports != nil {
+		cc.Ports = append([]string(nil), c.Ports...)
+	}
+	return &cc
+}
+
+// WatchContainers returns a channel of changes to the repository's containers,
+// starting with every currently cached container as added. The channel is
+// closed once the context is cancelled, or should the watcher fall too far
+// behind.
+func (mcr *metadataCachingRepository) WatchContainers(ctx context.Context) <-chan ContainerEvent {
+	mcr.watchMtx.Lock()
+	defer mcr.watchMtx.Unlock()
+
+	ch := make(chan ContainerEvent, len(mcr.watched)+watchBuffer)
+	for _, c := range mcr.watched {
+		ch <- ContainerEvent{Type: ContainerAdded, Container: copyContainer(c)}
+	}
+	unwatched := make(chan struct{})
+	mcr.watchers[ch] = unwatched
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			mcr.unwatch(ch)
+		case <-unwatched:
+		}
+	}()
+	return ch
+}
+
+// publishContainers fans out the changes since the containers were last
+// published to every watcher.
+func (mcr *metadataCachingRepository) publishContainers(cs []*Container) {
+	mcr.watchMtx.Lock()
+	defer mcr.watchMtx.Unlock()
+
+	// Keep our own copies as the cache is free to name their hosts later
+	watched := make([]*Container, len(cs))
+	for i, c := range cs {
+		watched[i] = copyContainer(c)
+	}
+	es := DiffContainers(mcr.watched, watched)
+	mcr.watched = watched
+
+	for ch, unwatched := range mcr.watchers {
+	events:
+		for _, e := range es {
+			select {
+			case ch <- e:
+			default:
+				// Too slow, the watcher will need to watch again
+				delete(mcr.watchers, ch)
+				close(ch)
+				close(unwatched)
+				break events
+			}
+		}
+	}
+}
+
+// unwatch closes the watcher's channel, unless already closed.
+func (mcr *metadataCachingRepository) unwatch(ch chan ContainerEvent) {
+	mcr.watchMtx.Lock()
+	defer mcr.watchMtx.Unlock()
+
+	if unwatched, ok := mcr.watchers[ch]; ok {
+		delete(mcr.watchers, ch)
+		close(ch)
+		close(unwatched)
+	}
+}
+
+// copySnapshot returns a copy of the snapshot safe to hand to watchers while
+// the cache continues to be populated.
+func copySnapshot(s *Snapshot) *Snapshot {
+	cs := &Snapshot{
+		Refreshed:  s.Refreshed,
+		Containers: make([]*Container, len(s.Containers)),
+		Hosts:      make([]*Host, len(s.Hosts)),
+	}
+	for i, c := range s.Containers {
+		cs.Containers[i] = copyContainer(c)
+	}
+	for i, h := range s.Hosts {
+		hc := *h
+		cs.Hosts[i] = &hc
+	}
+	return cs
+}
+
+// WatchSnapshots returns a channel of the repository's last good snapshots,
+// starting with the current one should the cache have been populated or
+// restored. The channel is closed once the context is cancelled, or should
+// the watcher fall too far behind.
+func (mcr *metadataCachingRepository) WatchSnapshots(ctx context.Context) <-chan *Snapshot {
+	mcr.watchMtx.Lock()
+	defer mcr.watchMtx.Unlock()
+
+	ch := make(chan *Snapshot, watchBuffer)
+	if mcr.watchedSnapshot != nil {
+		ch <- copySnapshot(mcr.watchedSnapshot)
+	}
+	unwatched := make(chan struct{})
+	mcr.snapshotWatchers[ch] = unwatched
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			mcr.unwatchSnapshots(ch)
+		case <-unwatched:
+		}
+	}()
+	return ch
+}
+
+// RestoredSnapshot returns the snapshot the cache was warmed from when the
+// repository was created, or nil should there have been none to restore.
+func (mcr *metadataCachingRepository) RestoredSnapshot() *Snapshot {
+	mcr.watchMtx.Lock()
+	defer mcr.watchMtx.Unlock()
+
+	if mcr.restoredSnapshot == nil {
+		return nil
+	}
+	return copySnapshot(mcr.restoredSnapshot)
+}
+
+// publishSnapshot fans out a new last good snapshot to every watcher.
+func (mcr *metadataCachingRepository) publishSnapshot(s *Snapshot) {
+	mcr.watchMtx.Lock()
+	defer mcr.watchMtx.Unlock()
+
+	mcr.watchedSnapshot = copySnapshot(s)
+	for ch, unwatched := range mcr.snapshotWatchers {
+		select {
+		case ch <- copySnapshot(s):
+		default:
+			// Too slow, the watcher will need to watch again
+			delete(mcr.snapshotWatchers, ch)
+			close(ch)
+			close(unwatched)
+		}
+	}
+}
+
+// unwatchSnapshots closes the snapshot watcher's channel, unless already
+// closed.
+func (mcr *metadataCachingRepository) unwatchSnapshots(ch chan *Snapshot) {
+	mcr.watchMtx.Lock()
+	defer mcr.watchMtx.Unlock()
+
+	if unwatched, ok := mcr.snapshotWatchers[ch]; ok {
+		delete(mcr.snapshotWatchers, ch)
+		close(ch)
+		close(unwatched)
+	}
+}